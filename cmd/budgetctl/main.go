@@ -0,0 +1,251 @@
+// Command budgetctl runs maintenance tasks against the budgeting database.
+// It reads the same environment as the web server.
+//
+// Usage:
+//
+//	budgetctl [-dsn DSN] <command> [flags]
+//
+// Commands:
+//
+//	check  [-user ID]   report the counters that drifted from the expenses
+//	repair [-user ID]   recompute the drifted counters and store them
+//	migrate up                    apply every pending migration
+//	migrate down [-steps N]       revert the latest N migrations, 1 by default
+//	migrate status                list the migrations and whether they were applied
+//	migrate baseline -version N   mark migrations up to N as applied without running them
+//
+// check exits with status 1 if it found any discrepancy.
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/joho/godotenv"
+	_ "github.com/mattn/go-sqlite3"
+	"kweeuhree.personal-budgeting-backend/internal/config"
+	"kweeuhree.personal-budgeting-backend/internal/integrity"
+	"kweeuhree.personal-budgeting-backend/internal/migrations"
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
+
+// actorId is recorded in the audit log as the author of repairs
+const actorId = "budgetctl"
+
+func main() {
+	env := os.Getenv("ENV")
+	if env != config.Production {
+		err := godotenv.Load()
+		if err != nil {
+			log.Printf("Error loading .env file: %v", err)
+		}
+		env = config.Development
+	}
+
+	infoLog := log.New(io.Discard, "", 0)
+	errorLog := log.New(os.Stderr, "ERROR\t", log.Ldate|log.Ltime)
+
+	flag.Usage = usage
+	// Load parses the global flags, the command and its flags are left over
+	cfg, err := config.Load(env, errorLog)
+	if err != nil {
+		errorLog.Fatalf("Error loading configuration: %v", err)
+	}
+
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	dialect, err := models.DialectFor(cfg.Driver)
+	if err != nil {
+		errorLog.Fatalf("Error loading configuration: %v", err)
+	}
+
+	db, err := openDB(dialect, cfg.DSN)
+	if err != nil {
+		errorLog.Fatalf("Database connection failed: %v", err)
+	}
+
+	checker := &integrity.Checker{DB: db, Dialect: dialect, InfoLog: infoLog, ErrorLog: errorLog}
+
+	var code int
+	switch args[0] {
+	case "check":
+		code = runIntegrity(checker, args[1:], false)
+	case "repair":
+		code = runIntegrity(checker, args[1:], true)
+	case "migrate":
+		code = runMigrate(db, dialect, args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "budgetctl: unknown command %q\n", args[0])
+		usage()
+		code = 2
+	}
+
+	db.Close()
+	os.Exit(code)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: budgetctl [-dsn DSN] <command> [flags]
+
+Commands:
+  check  [-user ID]   report the counters that drifted from the expenses
+  repair [-user ID]   recompute the drifted counters and store them
+  migrate up                    apply every pending migration
+  migrate down [-steps N]       revert the latest N migrations, 1 by default
+  migrate status                list the migrations and whether they were applied
+  migrate baseline -version N   mark migrations up to N as applied without running them
+`)
+}
+
+// runIntegrity checks, or repairs, the counters of one user or of every
+// user and prints the discrepancies. It returns the exit status.
+func runIntegrity(checker *integrity.Checker, args []string, repair bool) int {
+	name := "check"
+	if repair {
+		name = "repair"
+	}
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	userId := flags.String("user", "", "only this user id")
+	flags.Parse(args)
+
+	userIds := []string{*userId}
+	if *userId == "" {
+		var err error
+		userIds, err = checker.UserIds()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "budgetctl: %v\n", err)
+			return 1
+		}
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tENTITY\tID\tFIELD\tSTORED\tEXPECTED")
+
+	drifted := 0
+	for _, id := range userIds {
+		var report *integrity.Report
+		var err error
+		if repair {
+			report, err = checker.Repair(id, integrity.Actor{UserId: actorId})
+		} else {
+			report, err = checker.Check(id)
+		}
+		if err != nil {
+			tw.Flush()
+			fmt.Fprintf(os.Stderr, "budgetctl: user %s: %v\n", id, err)
+			return 1
+		}
+
+		if !report.OK() {
+			drifted++
+		}
+		for _, d := range report.Discrepancies {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\n", report.UserId, d.EntityType, d.EntityId, d.Field, d.Stored, d.Expected)
+		}
+	}
+	tw.Flush()
+
+	if repair {
+		fmt.Printf("\nchecked %d users, repaired %d\n", len(userIds), drifted)
+		return 0
+	}
+	fmt.Printf("\nchecked %d users, %d with discrepancies\n", len(userIds), drifted)
+	if drifted > 0 {
+		return 1
+	}
+	return 0
+}
+
+// runMigrate applies, reverts or lists the schema migrations. It returns
+// the exit status.
+func runMigrate(db *sql.DB, dialect models.Dialect, args []string) int {
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+
+	migrator, err := migrations.New(db, dialect, log.New(os.Stdout, "", 0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "budgetctl: %v\n", err)
+		return 1
+	}
+
+	switch args[0] {
+	case "up":
+		var applied []migrations.Migration
+		applied, err = migrator.Up()
+		if err == nil {
+			fmt.Printf("applied %d migrations\n", len(applied))
+		}
+	case "down":
+		flags := flag.NewFlagSet("down", flag.ExitOnError)
+		steps := flags.Int("steps", 1, "number of migrations to revert")
+		flags.Parse(args[1:])
+
+		var reverted []migrations.Migration
+		reverted, err = migrator.Down(*steps)
+		if err == nil {
+			fmt.Printf("reverted %d migrations\n", len(reverted))
+		}
+	case "status":
+		var statuses []migrations.Status
+		statuses, err = migrator.Status()
+		if err == nil {
+			tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+			for _, s := range statuses {
+				applied := "pending"
+				if s.Applied {
+					applied = s.AppliedAt.Format(time.RFC3339)
+				}
+				fmt.Fprintf(tw, "%04d\t%s\t%s\n", s.Version, s.Name, applied)
+			}
+			tw.Flush()
+		}
+	case "baseline":
+		flags := flag.NewFlagSet("baseline", flag.ExitOnError)
+		version := flags.Int64("version", 0, "last migration the schema already has")
+		flags.Parse(args[1:])
+
+		err = migrator.Baseline(*version)
+		if err == nil {
+			fmt.Printf("marked migrations up to %04d as applied\n", *version)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "budgetctl: unknown migrate command %q\n", args[0])
+		usage()
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "budgetctl: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// The openDB() function wraps sql.Open() and returns a sql.DB connection pool
+// for a given dsn of the database of the dialect
+func openDB(dialect models.Dialect, dsn string) (*sql.DB, error) {
+	db, err := sql.Open(dialect.Driver(), dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Ping(); err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
@@ -0,0 +1,42 @@
+// Command mockoidc serves the OpenID Connect provider of internal/mockoidc,
+// for trying out single sign-on locally. It logs in whoever fills in its
+// login form, with the email, name and subject they type, and keeps
+// everything in memory.
+//
+// Usage:
+//
+//	mockoidc [-addr ADDR] [-issuer URL] [-client-id ID] [-client-secret SECRET]
+//
+// Point the web server at it with:
+//
+//	OIDC_PROVIDERS=mock
+//	OIDC_MOCK_ISSUER=http://localhost:9000
+//	OIDC_MOCK_CLIENT_ID=budgeting
+//	OIDC_MOCK_CLIENT_SECRET=secret
+//
+// It is not meant to be exposed to anyone but its developer.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"kweeuhree.personal-budgeting-backend/internal/mockoidc"
+)
+
+func main() {
+	addr := flag.String("addr", ":9000", "HTTP network address")
+	issuer := flag.String("issuer", "http://localhost:9000", "issuer URL, the address the provider is reached at")
+	clientId := flag.String("client-id", "budgeting", "client id of the web server")
+	clientSecret := flag.String("client-secret", "secret", "client secret of the web server")
+	flag.Parse()
+
+	p, err := mockoidc.New(*issuer, *clientId, *clientSecret)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Mock OpenID Connect provider %s listening on %s", p.Issuer(), *addr)
+	log.Fatal(http.ListenAndServe(*addr, p))
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"kweeuhree.personal-budgeting-backend/internal/mailer"
+	"kweeuhree.personal-budgeting-backend/internal/models"
+	"kweeuhree.personal-budgeting-backend/internal/validator"
+)
+
+// UpdateDisplayNameInput struct for renaming the logged in user
+type UpdateDisplayNameInput struct {
+	DisplayName         string `json:"displayName" validate:"required,maxchars=255"`
+	validator.Validator `json:"-"`
+}
+
+// ChangeEmailInput struct for moving the account to another email address
+type ChangeEmailInput struct {
+	Email               string `json:"email" validate:"required,email,maxchars=255"`
+	CurrentPassword     string `json:"currentPassword" validate:"required"`
+	validator.Validator `json:"-"`
+}
+
+// ChangePasswordInput struct for choosing a new password while logged in
+type ChangePasswordInput struct {
+	CurrentPassword     string `json:"currentPassword" validate:"required"`
+	NewPassword         string `json:"newPassword" validate:"required,minchars=8,maxchars=72"`
+	validator.Validator `json:"-"`
+}
+
+// DeleteAccountInput struct for deleting the account, Export asks for the
+// data of the account in the response
+type DeleteAccountInput struct {
+	CurrentPassword     string `json:"currentPassword" validate:"required"`
+	Export              bool   `json:"export"`
+	validator.Validator `json:"-"`
+}
+
+// Every record of an account, as returned by the export
+type AccountExport struct {
+	ExportedAt time.Time                 `json:"exportedAt"`
+	User       AccountExportUser         `json:"user"`
+	Budget     *BudgetResponse           `json:"budget"`
+	Categories []ExpenseCategoryResponse `json:"categories"`
+	Expenses   []ExpenseResponse         `json:"expenses"`
+	Webhooks   []WebhookResponse         `json:"webhooks"`
+}
+
+type AccountExportUser struct {
+	UserId          string     `json:"userId"`
+	Email           string     `json:"email"`
+	DisplayName     string     `json:"displayName"`
+	CreatedAt       time.Time  `json:"createdAt"`
+	EmailVerifiedAt *time.Time `json:"emailVerifiedAt"`
+}
+
+type DeleteAccountResponse struct {
+	Export *AccountExport `json:"export,omitempty"`
+	Flash  string         `json:"flash"`
+}
+
+// rename the logged in user
+func (app *application) updateDisplayName(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	var form UpdateDisplayNameInput
+	if err := decodeJSON(w, r, &form); err != nil {
+		return
+	}
+
+	form.Validate()
+	if !form.Valid() {
+		app.failedValidation(w, r, form.Validator)
+		return
+	}
+
+	var user *models.User
+	err := app.withTx(r, func(tx *application) error {
+		var err error
+		user, err = tx.user.Get(userId)
+		if err != nil {
+			return err
+		}
+		before := snapshotUser(user)
+
+		err = tx.user.UpdateDisplayName(userId, form.DisplayName)
+		if err != nil {
+			return err
+		}
+		user.DisplayName = form.DisplayName
+		return tx.audit(userId, models.AuditActionUpdate, models.AuditEntityUser, userId, before, snapshotUser(user))
+	})
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.setFlash(r.Context(), "Your display name was changed.")
+
+	err = encodeJSON(w, http.StatusOK, app.newAccountResponse(r, user))
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// move the account of the logged in user to another email address. The new
+// address has to be verified, and the old one is told about the change.
+func (app *application) changeEmail(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	var form ChangeEmailInput
+	if err := decodeJSON(w, r, &form); err != nil {
+		return
+	}
+
+	form.Validate()
+	if !form.Valid() {
+		app.failedValidation(w, r, form.Validator)
+		return
+	}
+
+	user, ok := app.confirmPassword(w, r, userId, form.CurrentPassword, &form.Validator)
+	if !ok {
+		return
+	}
+	if form.Email == user.Email {
+		form.AddFieldError("email", "This is already your email")
+		app.failedValidation(w, r, form.Validator)
+		return
+	}
+
+	oldEmail := user.Email
+	var token string
+	err := app.withTx(r, func(tx *application) error {
+		before := snapshotUser(user)
+
+		err := tx.user.UpdateEmail(userId, form.Email)
+		if err != nil {
+			return err
+		}
+		user.Email = form.Email
+		user.EmailVerifiedAt = nil
+
+		// The links sent to the old address must not verify the new one
+		err = tx.emailVerifications.DeleteAll(userId)
+		if err != nil {
+			return err
+		}
+		token, err = tx.issueEmailVerification(userId)
+		if err != nil {
+			return err
+		}
+		return tx.audit(userId, models.AuditActionUpdate, models.AuditEntityUser, userId, before, snapshotUser(user))
+	})
+	if err != nil {
+		if errors.Is(err, models.ErrDuplicateEmail) {
+			form.AddFieldError("email", "Email already in use")
+			p := newProblem(http.StatusConflict, ErrCodeEmailInUse, "Email already in use")
+			p.FieldErrors = form.FieldErrors
+			writeProblem(w, r, p)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	app.sendEmailVerificationInBackground(user, token)
+	app.background(func() {
+		err := app.mailer.Send(mailer.Message{
+			To:      oldEmail,
+			Subject: "Your email address was changed",
+			Body: fmt.Sprintf("Hi %s,\n\n"+
+				"The email address of your Personal Budgeting account was changed to %s. "+
+				"If it wasn't you, reset your password right away.\n",
+				displayNameOrEmail(user.DisplayName, oldEmail), form.Email),
+		})
+		if err != nil {
+			app.errorLog.Printf("account: unable to notify %s of the email change: %v", userId, err)
+		}
+	})
+
+	app.setFlash(r.Context(), "Your email was changed. Please check your email to verify the new address.")
+
+	err = encodeJSON(w, http.StatusOK, app.newAccountResponse(r, user))
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// choose a new password while logged in. Every other session of the user
+// ends, and the current one gets a new token.
+func (app *application) changePassword(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	var form ChangePasswordInput
+	if err := decodeJSON(w, r, &form); err != nil {
+		return
+	}
+
+	form.Validate()
+	if !form.Valid() {
+		app.failedValidation(w, r, form.Validator)
+		return
+	}
+
+	_, ok := app.confirmPassword(w, r, userId, form.CurrentPassword, &form.Validator)
+	if !ok {
+		return
+	}
+
+	err := app.withTx(r, func(tx *application) error {
+		err := tx.user.UpdatePassword(userId, form.NewPassword)
+		if err != nil {
+			return err
+		}
+		return tx.audit(userId, models.AuditActionPasswordChange, models.AuditEntityUser, userId, nil, nil)
+	})
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// The stored copy of the current session is destroyed as well, it is
+	// saved again under the new token when the request ends
+	_, err = app.destroyUserSessions(userId)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	err = app.sessionManager.RenewToken(r.Context())
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	// The current session stays logged in, under its new token
+	err = app.recordSession(r, userId)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.setFlash(r.Context(), "Your password was changed. You were logged out on your other devices.")
+
+	err = encodeJSON(w, http.StatusOK, UserResponse{Flash: app.getFlash(r.Context())})
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// return every record of the account of the logged in user
+func (app *application) exportAccount(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	export, err := app.exportUserData(userId)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="personal-budgeting-export.json"`)
+	err = encodeJSON(w, http.StatusOK, export)
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// delete the account of the logged in user with its budget, expenses,
+// categories, webhooks and audit trail in one transaction, and end every
+// session of the user. With export set, the response carries the data of
+// the account as it was just before the deletion.
+func (app *application) deleteAccount(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	var form DeleteAccountInput
+	if err := decodeJSON(w, r, &form); err != nil {
+		return
+	}
+
+	form.Validate()
+	if !form.Valid() {
+		app.failedValidation(w, r, form.Validator)
+		return
+	}
+
+	_, ok := app.confirmPassword(w, r, userId, form.CurrentPassword, &form.Validator)
+	if !ok {
+		return
+	}
+
+	var export *AccountExport
+	err := app.withTx(r, func(tx *application) error {
+		if form.Export {
+			var err error
+			export, err = tx.exportUserData(userId)
+			if err != nil {
+				return err
+			}
+		}
+		return tx.user.Delete(userId)
+	})
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.infoLog.Printf("account: deleted user %s", userId)
+
+	_, err = app.destroyUserSessions(userId)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	err = app.sessionManager.RenewToken(r.Context())
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.sessionManager.Remove(r.Context(), "authenticatedUserID")
+	app.sessionManager.Remove(r.Context(), sessionLastSeenKey)
+	app.setFlash(r.Context(), "Your account and all of its data were deleted.")
+
+	err = encodeJSON(w, http.StatusOK, DeleteAccountResponse{Export: export, Flash: app.getFlash(r.Context())})
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// confirmPassword checks the current password of the user before a
+// sensitive change. It is throttled like a login, so that a stolen session
+// cannot be used to guess the password. If the password is wrong, or the
+// check fails, the problem is written to the response and ok is false.
+func (app *application) confirmPassword(w http.ResponseWriter, r *http.Request, userId, password string, v *validator.Validator) (*models.User, bool) {
+	user, err := app.user.Get(userId)
+	if err != nil {
+		app.serverError(w, r, err)
+		return nil, false
+	}
+
+	throttles := app.loginThrottles(r, user.Email)
+	if !app.reserveLogin(w, r, throttles) {
+		return nil, false
+	}
+
+	id, err := app.user.Authenticate(user.Email, password)
+	if err != nil && !errors.Is(err, models.ErrInvalidCredentials) {
+		app.releaseReserved(throttles)
+		app.serverError(w, r, err)
+		return nil, false
+	}
+	if err != nil || id != userId {
+		if err := app.failLogin(throttles); err != nil {
+			app.serverError(w, r, err)
+			return nil, false
+		}
+		v.AddFieldError("currentPassword", "Password is incorrect")
+		p := newProblem(http.StatusForbidden, ErrCodeInvalidCredentials, "The current password is incorrect")
+		p.FieldErrors = v.FieldErrors
+		writeProblem(w, r, p)
+		return nil, false
+	}
+
+	err = app.releaseLogin(throttles)
+	if err != nil {
+		app.serverError(w, r, err)
+		return nil, false
+	}
+	return user, true
+}
+
+// exportUserData collects every record of the user
+func (app *application) exportUserData(userId string) (*AccountExport, error) {
+	user, err := app.user.Get(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	export := &AccountExport{
+		ExportedAt: time.Now().UTC().Truncate(time.Second),
+		User: AccountExportUser{
+			UserId:          user.UserId,
+			Email:           user.Email,
+			DisplayName:     user.DisplayName,
+			CreatedAt:       user.CreatedAt,
+			EmailVerifiedAt: user.EmailVerifiedAt,
+		},
+		Categories: []ExpenseCategoryResponse{},
+		Expenses:   []ExpenseResponse{},
+		Webhooks:   []WebhookResponse{},
+	}
+
+	budget, err := app.budget.GetBudgetByUserId(userId)
+	switch {
+	case err == nil:
+		budgetResponse := newBudgetResponse(budget)
+		export.Budget = &budgetResponse
+	case !errors.Is(err, models.ErrNoRecord):
+		return nil, err
+	}
+
+	cats, err := app.expenseCategory.All(userId)
+	if err != nil {
+		return nil, err
+	}
+	for _, cat := range cats {
+		export.Categories = append(export.Categories, newExpenseCategoryResponse(cat))
+	}
+
+	exps, err := app.expenses.All(userId)
+	if err != nil {
+		return nil, err
+	}
+	for _, exp := range exps {
+		export.Expenses = append(export.Expenses, newExpenseResponse(exp))
+	}
+
+	hooks, err := app.webhooks.All(userId)
+	if err != nil {
+		return nil, err
+	}
+	for _, wh := range hooks {
+		export.Webhooks = append(export.Webhooks, newWebhookResponse(wh))
+	}
+
+	return export, nil
+}
+
+// newAccountResponse returns the account of the user with the flash message
+// of the request
+func (app *application) newAccountResponse(r *http.Request, user *models.User) UserResponse {
+	emailVerified := user.EmailVerifiedAt != nil
+	return UserResponse{
+		UserId:        user.UserId,
+		Email:         user.Email,
+		DisplayName:   user.DisplayName,
+		EmailVerified: &emailVerified,
+		Flash:         app.getFlash(r.Context()),
+	}
+}
+
+// displayNameOrEmail returns how emails greet the user
+func displayNameOrEmail(displayName, email string) string {
+	if displayName == "" {
+		return email
+	}
+	return displayName
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// userRows returns the number of rows of the user in every table of the
+// SQLite test application with a userId column
+func userRows(t *testing.T, app *application, userId string) map[string]int {
+	t.Helper()
+
+	rows, err := app.integrity.DB.Query(`SELECT m.name FROM sqlite_master m, pragma_table_info(m.name) c
+			WHERE m.type = 'table' AND c.name = 'userId'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, table)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	counts := map[string]int{}
+	for _, table := range tables {
+		var n int
+		err := app.integrity.DB.QueryRow(`SELECT COUNT(*) FROM `+table+` WHERE userId = ?`, userId).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[table] = n
+	}
+	return counts
+}
+
+// setUpAccount signs a user up with a row in every table that holds the data
+// of a user, two-factor authentication included, and returns their id
+func setUpAccount(t *testing.T, app *application, ts *testServer, email string) string {
+	t.Helper()
+
+	userId, expense := setUpExpenses(t, ts, email)
+
+	status := ts.doJSON(t, http.MethodPost, "/api/webhooks", map[string]any{
+		"url":    "https://127.0.0.1/hooks/budget",
+		"events": []string{"expense.created"},
+	}, nil)
+	expectStatus(t, "create webhook", status, http.StatusCreated)
+
+	// The expense is delivered to the webhook, and its key is kept
+	ts.header.Set(idempotencyKeyHeader, "create-expense")
+	status = ts.doJSON(t, http.MethodPost, "/api/v2/expenses", expense, nil)
+	ts.header.Del(idempotencyKeyHeader)
+	expectStatus(t, "create expense", status, http.StatusCreated)
+
+	status = ts.doJSON(t, http.MethodPost, "/api/users/tokens", map[string]any{
+		"name":   "Script",
+		"scopes": []string{"budget:read"},
+	}, nil)
+	expectStatus(t, "create token", status, http.StatusCreated)
+
+	status = ts.doJSON(t, http.MethodPost, "/api/users/password/forgot", map[string]string{"email": email}, nil)
+	expectStatus(t, "forgot password", status, http.StatusAccepted)
+
+	var enrollment struct {
+		Secret string `json:"secret"`
+	}
+	status = ts.doJSON(t, http.MethodPost, "/api/users/2fa/enroll", map[string]string{
+		"currentPassword": testPassword,
+	}, &enrollment)
+	expectStatus(t, "enroll in two-factor", status, http.StatusOK)
+	status = ts.doJSON(t, http.MethodPost, "/api/users/2fa/confirm", map[string]string{
+		"code": totpCode(t, enrollment.Secret, time.Now()),
+	}, nil)
+	expectStatus(t, "confirm two-factor", status, http.StatusOK)
+
+	err := app.userIdentities.Insert("mock", "subject-"+userId, userId, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return userId
+}
+
+// Deleting an account deletes every row of the user, and nothing of the
+// other users
+func TestDeleteAccount(t *testing.T) {
+	app := newSQLiteTestApplication(t)
+	app.webhookAllowPrivate = true
+	useFileMailer(t, app)
+	ts := newTestServer(t, app.routes())
+	const email = "delete@example.com"
+	userId := setUpAccount(t, app, ts, email)
+
+	other := ts.newClient(t)
+	otherId := setUpAccount(t, app, other, "stay@example.com")
+	otherRows := userRows(t, app, otherId)
+
+	// Without every table filled the test would not show that it is emptied
+	for table, n := range userRows(t, app, userId) {
+		if n == 0 {
+			t.Fatalf("no rows of the user in %s before the deletion", table)
+		}
+	}
+
+	var problem Problem
+	status := ts.doJSON(t, http.MethodDelete, "/api/users/account", map[string]string{
+		"currentPassword": "wrong-password",
+	}, &problem)
+	expectStatus(t, "delete with a wrong password", status, http.StatusForbidden)
+	if problem.Code != ErrCodeInvalidCredentials {
+		t.Errorf("got code %q; want %q", problem.Code, ErrCodeInvalidCredentials)
+	}
+
+	var deleted DeleteAccountResponse
+	status = ts.doJSON(t, http.MethodDelete, "/api/users/account", map[string]any{
+		"currentPassword": testPassword,
+		"export":          true,
+	}, &deleted)
+	expectStatus(t, "delete account", status, http.StatusOK)
+	if deleted.Export == nil || deleted.Export.User.UserId != userId || len(deleted.Export.Expenses) != 1 {
+		t.Errorf("got export %+v; want the data of %s with its expense", deleted.Export, userId)
+	}
+
+	for table, n := range userRows(t, app, userId) {
+		if n != 0 {
+			t.Errorf("got %d rows of the user in %s after the deletion; want none", n, table)
+		}
+	}
+	for table, n := range userRows(t, app, otherId) {
+		if n != otherRows[table] {
+			t.Errorf("got %d rows of the other user in %s; want %d", n, table, otherRows[table])
+		}
+	}
+
+	status = ts.doJSON(t, http.MethodGet, "/api/users/sessions", nil, nil)
+	expectStatus(t, "session after the deletion", status, http.StatusUnauthorized)
+	status = other.doJSON(t, http.MethodGet, "/api/users/sessions", nil, nil)
+	expectStatus(t, "session of the other user", status, http.StatusOK)
+
+	ts.refreshCSRF(t)
+	status = ts.doJSON(t, http.MethodPost, "/api/users/login", map[string]string{"email": email, "password": testPassword}, nil)
+	expectStatus(t, "log in after the deletion", status, http.StatusUnauthorized)
+}
+
+// The export has every record of the user and none of the other users
+func TestExportAccount(t *testing.T) {
+	app := newTestApplication(t)
+	app.webhookAllowPrivate = true
+	ts := newTestServer(t, app.routes())
+	const email = "export@example.com"
+	userId, expense := setUpExpenses(t, ts, email)
+	status := ts.doJSON(t, http.MethodPost, "/api/v2/expenses", expense, nil)
+	expectStatus(t, "create expense", status, http.StatusCreated)
+	status = ts.doJSON(t, http.MethodPost, "/api/webhooks", map[string]any{
+		"url":    "https://127.0.0.1/hooks/budget",
+		"events": []string{"expense.created"},
+	}, nil)
+	expectStatus(t, "create webhook", status, http.StatusCreated)
+
+	other := ts.newClient(t)
+	_, otherExpense := setUpExpenses(t, other, "other-export@example.com")
+	status = other.doJSON(t, http.MethodPost, "/api/v2/expenses", otherExpense, nil)
+	expectStatus(t, "create expense of the other user", status, http.StatusCreated)
+
+	res, _ := ts.do(t, http.MethodGet, "/api/users/account/export", nil)
+	expectStatus(t, "export", res.StatusCode, http.StatusOK)
+	if got := res.Header.Get("Content-Disposition"); !strings.HasPrefix(got, "attachment;") {
+		t.Errorf("got Content-Disposition %q; want an attachment", got)
+	}
+
+	var export AccountExport
+	status = ts.doJSON(t, http.MethodGet, "/api/users/account/export", nil, &export)
+	expectStatus(t, "export", status, http.StatusOK)
+
+	if export.User.UserId != userId || export.User.Email != email || export.User.EmailVerifiedAt != nil {
+		t.Errorf("got user %+v; want %s with %s, unverified", export.User, userId, email)
+	}
+	if export.Budget == nil || export.Budget.CheckingBalance != 100000-1000 || export.Budget.TotalSpent != 1000 {
+		t.Errorf("got budget %+v; want 99000 checking and 1000 spent", export.Budget)
+	}
+	if len(export.Categories) != 1 || export.Categories[0].Name != "Rent" || export.Categories[0].TotalSum != 1000 {
+		t.Errorf("got categories %+v; want Rent with 1000", export.Categories)
+	}
+	if len(export.Expenses) != 1 || export.Expenses[0].AmountInCents != 1000 ||
+		export.Expenses[0].CategoryId == nil || *export.Expenses[0].CategoryId != export.Categories[0].ExpenseCategoryId {
+		t.Errorf("got expenses %+v; want one of 1000 in Rent", export.Expenses)
+	}
+	if len(export.Webhooks) != 1 || export.Webhooks[0].Secret != "" {
+		t.Errorf("got webhooks %+v; want one, without its secret", export.Webhooks)
+	}
+}
+
+// A changed email has to be verified again, with a link sent to the new
+// address only
+func TestChangeEmail(t *testing.T) {
+	app := newTestApplication(t)
+	dir := useFileMailer(t, app)
+	ts := newTestServer(t, app.routes())
+	const oldEmail, newEmail = "old@example.com", "new@example.com"
+	userId := ts.signUpAndLogIn(t, oldEmail)
+	oldToken := mailToken(t, waitForMails(t, dir, oldEmail, verifySubject, 1)[0])
+
+	status := ts.doJSON(t, http.MethodPost, "/api/users/email/verify", map[string]string{"token": oldToken}, nil)
+	expectStatus(t, "verify the old email", status, http.StatusOK)
+
+	other := ts.newClient(t)
+	other.signUpAndLogIn(t, "taken@example.com")
+
+	var problem Problem
+	status = ts.doJSON(t, http.MethodPut, "/api/users/account/email", map[string]string{
+		"email":           "taken@example.com",
+		"currentPassword": testPassword,
+	}, &problem)
+	expectStatus(t, "change to a taken email", status, http.StatusConflict)
+	if problem.Code != ErrCodeEmailInUse {
+		t.Errorf("got code %q; want %q", problem.Code, ErrCodeEmailInUse)
+	}
+
+	// A link sent to the old address before the change, and not used yet
+	staleToken, err := app.issueEmailVerification(userId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var account UserResponse
+	status = ts.doJSON(t, http.MethodPut, "/api/users/account/email", map[string]string{
+		"email":           newEmail,
+		"currentPassword": testPassword,
+	}, &account)
+	expectStatus(t, "change email", status, http.StatusOK)
+	if account.Email != newEmail || account.EmailVerified == nil || *account.EmailVerified {
+		t.Errorf("got account %+v; want %s, unverified", account, newEmail)
+	}
+
+	waitForMails(t, dir, oldEmail, "Your email address was changed", 1)
+	newToken := mailToken(t, waitForMails(t, dir, newEmail, verifySubject, 1)[0])
+
+	status = ts.doJSON(t, http.MethodPost, "/api/users/email/verify", map[string]string{"token": staleToken}, &problem)
+	expectStatus(t, "verify with a link from before the change", status, http.StatusBadRequest)
+	if problem.Code != ErrCodeInvalidVerifyToken {
+		t.Errorf("got code %q; want %q", problem.Code, ErrCodeInvalidVerifyToken)
+	}
+
+	status = ts.doJSON(t, http.MethodPost, "/api/users/email/verify", map[string]string{"token": newToken}, nil)
+	expectStatus(t, "verify the new email", status, http.StatusOK)
+
+	ts.refreshCSRF(t)
+	status = ts.doJSON(t, http.MethodPost, "/api/users/login", map[string]string{"email": oldEmail, "password": testPassword}, nil)
+	expectStatus(t, "log in with the old email", status, http.StatusUnauthorized)
+	ts.logIn(t, newEmail)
+}
+
+// Changing the password ends the other sessions of the user, and the
+// current one carries on under a new token
+func TestChangePassword(t *testing.T) {
+	app := newTestApplication(t)
+	laptop := newTestServer(t, app.routes())
+	const email = "change-password@example.com"
+	laptop.signUpAndLogIn(t, email)
+	phone := laptop.newClient(t)
+	phone.logIn(t, email)
+
+	before := sessionCookie(t, laptop)
+
+	var problem Problem
+	status := laptop.doJSON(t, http.MethodPut, "/api/users/account/password", map[string]string{
+		"currentPassword": "wrong-password",
+		"newPassword":     "n3w-pa$$word",
+	}, &problem)
+	expectStatus(t, "change with a wrong password", status, http.StatusForbidden)
+	if problem.Code != ErrCodeInvalidCredentials {
+		t.Errorf("got code %q; want %q", problem.Code, ErrCodeInvalidCredentials)
+	}
+
+	status = laptop.doJSON(t, http.MethodPut, "/api/users/account/password", map[string]string{
+		"currentPassword": testPassword,
+		"newPassword":     "n3w-pa$$word",
+	}, nil)
+	expectStatus(t, "change password", status, http.StatusOK)
+
+	after := sessionCookie(t, laptop)
+	if after.Value == before.Value {
+		t.Error("the session token was not renewed")
+	}
+
+	var sessions []struct {
+		Current bool `json:"current"`
+	}
+	status = laptop.doJSON(t, http.MethodGet, "/api/users/sessions", nil, &sessions)
+	expectStatus(t, "current session", status, http.StatusOK)
+	if len(sessions) != 1 || !sessions[0].Current {
+		t.Errorf("got sessions %+v; want only the current one", sessions)
+	}
+
+	status = phone.doJSON(t, http.MethodGet, "/api/users/sessions", nil, nil)
+	expectStatus(t, "other session", status, http.StatusUnauthorized)
+
+	// Whoever copied the old token is logged out too
+	stale := laptop.newClient(t)
+	u, err := url.Parse(laptop.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.client.Jar.SetCookies(u, []*http.Cookie{before})
+	status = stale.doJSON(t, http.MethodGet, "/api/users/sessions", nil, nil)
+	expectStatus(t, "old token", status, http.StatusUnauthorized)
+}
+
+// sessionCookie returns the session cookie the client holds
+func sessionCookie(t *testing.T, ts *testServer) *http.Cookie {
+	t.Helper()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range ts.client.Jar.Cookies(u) {
+		if c.Name == "session" {
+			return c
+		}
+	}
+	t.Fatal("no session cookie")
+	return nil
+}
@@ -0,0 +1,663 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"kweeuhree.personal-budgeting-backend/internal/integrity"
+	"kweeuhree.personal-budgeting-backend/internal/models"
+	"kweeuhree.personal-budgeting-backend/internal/validator"
+)
+
+// Input struct for repairing counters, every user is repaired when UserId
+// is empty
+type IntegrityRepairInput struct {
+	UserId              string `json:"userId" validate:"uuid"`
+	validator.Validator `json:"-"`
+}
+
+// Response struct for returning a counter that drifted from the expenses
+type DiscrepancyResponse struct {
+	EntityType string `json:"entityType"`
+	EntityId   string `json:"entityId"`
+	Field      string `json:"field"`
+	Stored     int64  `json:"stored"`
+	Expected   int64  `json:"expected"`
+}
+
+// Response struct for returning the integrity report of a user
+type IntegrityReportResponse struct {
+	UserId        string                `json:"userId"`
+	Discrepancies []DiscrepancyResponse `json:"discrepancies"`
+	Repaired      bool                  `json:"repaired"`
+}
+
+// Response struct for returning the reports of a check or repair. Reports
+// only lists the users with discrepancies, unless a single user was asked for.
+type IntegrityResponse struct {
+	Checked int                       `json:"checked"`
+	Reports []IntegrityReportResponse `json:"reports"`
+}
+
+func newIntegrityReportResponse(report *integrity.Report) IntegrityReportResponse {
+	response := IntegrityReportResponse{
+		UserId:        report.UserId,
+		Discrepancies: []DiscrepancyResponse{},
+		Repaired:      report.Repaired,
+	}
+	for _, d := range report.Discrepancies {
+		response.Discrepancies = append(response.Discrepancies, DiscrepancyResponse(d))
+	}
+	return response
+}
+
+// check the counters of one user, given by the userId query parameter, or
+// of every user
+func (app *application) adminIntegrityCheck(w http.ResponseWriter, r *http.Request) {
+	adminId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	input := IntegrityRepairInput{UserId: r.URL.Query().Get("userId")}
+	input.Validate()
+	if !input.Valid() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+
+	response, ok := app.integrityReports(w, r, input.UserId, func(userId string) (*integrity.Report, error) {
+		return app.integrity.Check(userId)
+	})
+	if !ok {
+		return
+	}
+
+	snapshot := adminIntegrityCheckSnapshot{UserId: input.UserId, Checked: response.Checked}
+	for _, report := range response.Reports {
+		if len(report.Discrepancies) > 0 {
+			snapshot.Inconsistent++
+		}
+	}
+	err := app.withTx(r, func(tx *application) error {
+		return tx.audit(adminId, models.AuditActionAdminIntegrityCheck, models.AuditEntityUser, adminId, nil, snapshot)
+	})
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	encodeJSON(w, http.StatusOK, response)
+}
+
+// recompute and store the counters of one user, or of every user
+func (app *application) adminIntegrityRepair(w http.ResponseWriter, r *http.Request) {
+	var input IntegrityRepairInput
+	err := decodeJSON(w, r, &input)
+	if err != nil {
+		return
+	}
+
+	input.Validate()
+	if !input.Valid() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+
+	auditActor := app.auditActorFrom(r)
+	actor := integrity.Actor(*auditActor)
+
+	response, ok := app.integrityReports(w, r, input.UserId, func(userId string) (*integrity.Report, error) {
+		return app.integrity.Repair(userId, actor)
+	})
+	if !ok {
+		return
+	}
+
+	encodeJSON(w, http.StatusOK, response)
+}
+
+// Run fn for the given user, or for every user, and return the reports. On
+// an error the response is written and ok is false.
+func (app *application) integrityReports(w http.ResponseWriter, r *http.Request, userId string, fn func(userId string) (*integrity.Report, error)) (*IntegrityResponse, bool) {
+	userIds := []string{userId}
+	if userId == "" {
+		var err error
+		userIds, err = app.integrity.UserIds()
+		if err != nil {
+			app.serverError(w, r, err)
+			return nil, false
+		}
+	}
+
+	response := IntegrityResponse{Reports: []IntegrityReportResponse{}}
+	for _, id := range userIds {
+		report, err := fn(id)
+		if err != nil {
+			if errors.Is(err, models.ErrVersionConflict) {
+				app.errorResponse(w, r, http.StatusConflict, ErrCodeEditConflict, fmt.Sprintf("The budget of user %s changed during the repair, please retry", id))
+			} else {
+				app.serverError(w, r, err)
+			}
+			return nil, false
+		}
+		response.Checked++
+		if !report.OK() || userId != "" {
+			response.Reports = append(response.Reports, newIntegrityReportResponse(report))
+		}
+	}
+	return &response, true
+}
+
+// adminPageSize is the number of users returned when no limit is given
+const adminPageSize = 50
+
+// adminStatsDays is the period of the new users and expenses of the stats,
+// when no days are given
+const adminStatsDays = 30
+
+// Query parameters of the user search
+type AdminUserQuery struct {
+	Query               string `json:"q" validate:"maxchars=255"`
+	Role                string `json:"role" validate:"oneof=user|admin"`
+	Status              string `json:"status" validate:"oneof=active|disabled"`
+	Offset              int64  `json:"offset" validate:"min=0"`
+	Limit               int64  `json:"limit" validate:"min=0,max=200"`
+	validator.Validator `json:"-"`
+}
+
+// Query parameters of the stats
+type AdminStatsQuery struct {
+	Days                int64 `json:"days" validate:"min=1,max=365"`
+	validator.Validator `json:"-"`
+}
+
+// Input struct for giving a user a role
+type SetRoleInput struct {
+	Role                string `json:"role" validate:"required,oneof=user|admin"`
+	validator.Validator `json:"-"`
+}
+
+// Response struct for returning a user to the admins
+type AdminUserResponse struct {
+	UserId          string     `json:"userId"`
+	Email           string     `json:"email"`
+	DisplayName     string     `json:"displayName"`
+	Role            string     `json:"role"`
+	CreatedAt       time.Time  `json:"createdAt"`
+	EmailVerifiedAt *time.Time `json:"emailVerifiedAt"`
+	DisabledAt      *time.Time `json:"disabledAt"`
+}
+
+// Response struct for returning a page of the user search. NextOffset is
+// passed back as the offset parameter to read the next page, it is left out
+// on the last page.
+type AdminUsersResponse struct {
+	Users      []AdminUserResponse `json:"users"`
+	NextOffset int64               `json:"nextOffset,omitempty"`
+}
+
+// Response struct for returning a user with a summary of their budget
+type AdminUserDetailResponse struct {
+	User             AdminUserResponse         `json:"user"`
+	Budget           *BudgetResponse           `json:"budget"`
+	Categories       []ExpenseCategoryResponse `json:"categories"`
+	Expenses         AdminExpenseSummary       `json:"expenses"`
+	TwoFactorEnabled bool                      `json:"twoFactorEnabled"`
+	Sessions         int                       `json:"sessions"`
+}
+
+// Summary of the expenses of a user
+type AdminExpenseSummary struct {
+	Count         int        `json:"count"`
+	AmountInCents int64      `json:"amountInCents"`
+	LastCreatedAt *time.Time `json:"lastCreatedAt"`
+}
+
+// Response struct for returning the outcome of an admin action on a user
+type AdminUserActionResponse struct {
+	User AdminUserResponse `json:"user"`
+	// Sessions is the number of sessions of the user that were ended
+	Sessions int    `json:"sessions"`
+	Flash    string `json:"flash"`
+}
+
+// Response struct for returning the figures of the whole system
+type AdminStatsResponse struct {
+	Since    time.Time         `json:"since"`
+	Users    AdminUserStats    `json:"users"`
+	Budgets  int64             `json:"budgets"`
+	Expenses AdminExpenseStats `json:"expenses"`
+}
+
+type AdminUserStats struct {
+	Total      int64 `json:"total"`
+	Admins     int64 `json:"admins"`
+	Disabled   int64 `json:"disabled"`
+	Unverified int64 `json:"unverified"`
+	New        int64 `json:"new"`
+}
+
+type AdminExpenseStats struct {
+	Count            int64 `json:"count"`
+	AmountInCents    int64 `json:"amountInCents"`
+	New              int64 `json:"new"`
+	NewAmountInCents int64 `json:"newAmountInCents"`
+}
+
+// Snapshots of the admin actions, as recorded in the audit log
+type accountStatusSnapshot struct {
+	Role     string `json:"role"`
+	Disabled bool   `json:"disabled"`
+}
+
+type adminSearchSnapshot struct {
+	Query   string `json:"q"`
+	Role    string `json:"role"`
+	Status  string `json:"status"`
+	Offset  int64  `json:"offset"`
+	Results int    `json:"results"`
+}
+
+// The user checked is empty when every user was checked
+type adminIntegrityCheckSnapshot struct {
+	UserId       string `json:"userId,omitempty"`
+	Checked      int    `json:"checked"`
+	Inconsistent int    `json:"inconsistent"`
+}
+
+type adminStatsSnapshot struct {
+	Since time.Time `json:"since"`
+}
+
+type forceLogoutSnapshot struct {
+	Sessions int `json:"sessions"`
+}
+
+func newAdminUserResponse(u *models.User) AdminUserResponse {
+	return AdminUserResponse{
+		UserId:          u.UserId,
+		Email:           u.Email,
+		DisplayName:     u.DisplayName,
+		Role:            u.Role,
+		CreatedAt:       u.CreatedAt,
+		EmailVerifiedAt: u.EmailVerifiedAt,
+		DisabledAt:      u.DisabledAt,
+	}
+}
+
+func snapshotAccountStatus(u *models.User) accountStatusSnapshot {
+	return accountStatusSnapshot{Role: u.Role, Disabled: u.Disabled()}
+}
+
+// search the users by part of their email or display name, role and status
+func (app *application) adminUsersView(w http.ResponseWriter, r *http.Request) {
+	adminId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	query := r.URL.Query()
+	input := AdminUserQuery{
+		Query:  query.Get("q"),
+		Role:   query.Get("role"),
+		Status: query.Get("status"),
+	}
+	for key, dst := range map[string]*int64{"offset": &input.Offset, "limit": &input.Limit} {
+		if value := query.Get(key); value != "" {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				input.AddFieldError(key, "This field must be a number")
+				continue
+			}
+			*dst = n
+		}
+	}
+
+	input.Validate()
+	if !input.Valid() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+
+	filter := models.UserFilter{
+		Query:  input.Query,
+		Role:   input.Role,
+		Status: input.Status,
+		Offset: int(input.Offset),
+		Limit:  int(input.Limit),
+	}
+	if filter.Limit == 0 {
+		filter.Limit = adminPageSize
+	}
+
+	users, err := app.user.Search(filter)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.withTx(r, func(tx *application) error {
+		return tx.audit(adminId, models.AuditActionAdminSearch, models.AuditEntityUser, adminId, nil, adminSearchSnapshot{
+			Query:   input.Query,
+			Role:    input.Role,
+			Status:  input.Status,
+			Offset:  input.Offset,
+			Results: len(users),
+		})
+	})
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	response := AdminUsersResponse{Users: []AdminUserResponse{}}
+	for _, u := range users {
+		response.Users = append(response.Users, newAdminUserResponse(u))
+	}
+	if len(users) == filter.Limit {
+		response.NextOffset = int64(filter.Offset + len(users))
+	}
+
+	encodeJSON(w, http.StatusOK, response)
+}
+
+// read a user with a summary of their budget, categories and expenses
+func (app *application) adminUserView(w http.ResponseWriter, r *http.Request) {
+	adminId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	user, ok := app.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	response := AdminUserDetailResponse{
+		User:       newAdminUserResponse(user),
+		Categories: []ExpenseCategoryResponse{},
+	}
+
+	budget, err := app.budget.GetBudgetByUserId(user.UserId)
+	switch {
+	case err == nil:
+		budgetResponse := newBudgetResponse(budget)
+		response.Budget = &budgetResponse
+	case !errors.Is(err, models.ErrNoRecord):
+		app.serverError(w, r, err)
+		return
+	}
+
+	cats, err := app.expenseCategory.All(user.UserId)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	for _, cat := range cats {
+		response.Categories = append(response.Categories, newExpenseCategoryResponse(cat))
+	}
+
+	exps, err := app.expenses.All(user.UserId)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	for _, exp := range exps {
+		response.Expenses.Count++
+		response.Expenses.AmountInCents += exp.AmountInCents
+		if last := response.Expenses.LastCreatedAt; last == nil || exp.CreatedAt.After(*last) {
+			createdAt := exp.CreatedAt
+			response.Expenses.LastCreatedAt = &createdAt
+		}
+	}
+
+	tf, err := app.twoFactor.Get(user.UserId)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	response.TwoFactorEnabled = tf.Enabled()
+
+	sessions, err := app.userSessions.All(user.UserId)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	response.Sessions = len(sessions)
+
+	err = app.withTx(r, func(tx *application) error {
+		return tx.audit(adminId, models.AuditActionAdminView, models.AuditEntityUser, user.UserId, nil, nil)
+	})
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	encodeJSON(w, http.StatusOK, response)
+}
+
+// keep a user from logging in, and log them out everywhere
+func (app *application) adminUserDisable(w http.ResponseWriter, r *http.Request) {
+	app.adminSetDisabled(w, r, true)
+}
+
+// let a disabled user log in again
+func (app *application) adminUserEnable(w http.ResponseWriter, r *http.Request) {
+	app.adminSetDisabled(w, r, false)
+}
+
+func (app *application) adminSetDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	adminId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	user, ok := app.adminTargetUser(w, r)
+	if !ok || !app.notOwnAccount(w, r, user.UserId) {
+		return
+	}
+
+	action := models.AuditActionEnable
+	if disabled {
+		action = models.AuditActionDisable
+	}
+
+	var updated *models.User
+	err := app.withTx(r, func(tx *application) error {
+		err := tx.user.SetDisabled(user.UserId, disabled)
+		if err != nil {
+			return err
+		}
+		updated, err = tx.user.Get(user.UserId)
+		if err != nil {
+			return err
+		}
+		return tx.audit(adminId, action, models.AuditEntityUser, user.UserId, snapshotAccountStatus(user), snapshotAccountStatus(updated))
+	})
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// The sessions would be refused anyway, ending them frees the store
+	sessions := 0
+	if disabled {
+		sessions, err = app.destroyUserSessions(user.UserId)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		app.setFlash(r.Context(), "The user was disabled and logged out.")
+	} else {
+		app.setFlash(r.Context(), "The user was enabled.")
+	}
+
+	app.writeAdminUserAction(w, r, updated, sessions)
+}
+
+// log a user out of every session
+func (app *application) adminUserLogout(w http.ResponseWriter, r *http.Request) {
+	adminId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	user, ok := app.adminTargetUser(w, r)
+	if !ok || !app.notOwnAccount(w, r, user.UserId) {
+		return
+	}
+
+	sessions, err := app.destroyUserSessions(user.UserId)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.withTx(r, func(tx *application) error {
+		return tx.audit(adminId, models.AuditActionForceLogout, models.AuditEntityUser, user.UserId, nil, forceLogoutSnapshot{
+			Sessions: sessions,
+		})
+	})
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.setFlash(r.Context(), "The user was logged out everywhere.")
+	app.writeAdminUserAction(w, r, user, sessions)
+}
+
+// give a user a role
+func (app *application) adminUserSetRole(w http.ResponseWriter, r *http.Request) {
+	var input SetRoleInput
+	err := decodeJSON(w, r, &input)
+	if err != nil {
+		return
+	}
+
+	input.Validate()
+	if !input.Valid() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+
+	adminId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+	user, ok := app.adminTargetUser(w, r)
+	if !ok || !app.notOwnAccount(w, r, user.UserId) {
+		return
+	}
+
+	var updated *models.User
+	err = app.withTx(r, func(tx *application) error {
+		err := tx.user.SetRole(user.UserId, input.Role)
+		if err != nil {
+			return err
+		}
+		updated, err = tx.user.Get(user.UserId)
+		if err != nil {
+			return err
+		}
+		return tx.audit(adminId, models.AuditActionRoleChange, models.AuditEntityUser, user.UserId, snapshotAccountStatus(user), snapshotAccountStatus(updated))
+	})
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.setFlash(r.Context(), fmt.Sprintf("The user is now a %s.", input.Role))
+	app.writeAdminUserAction(w, r, updated, 0)
+}
+
+// count the users, budgets and expenses, and what of them is new
+func (app *application) adminStats(w http.ResponseWriter, r *http.Request) {
+	adminId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	input := AdminStatsQuery{Days: adminStatsDays}
+	if value := r.URL.Query().Get("days"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			input.AddFieldError("days", "This field must be a number")
+		} else {
+			input.Days = n
+		}
+	}
+
+	input.Validate()
+	if !input.Valid() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+
+	since := time.Now().UTC().Truncate(time.Second).AddDate(0, 0, -int(input.Days))
+	stats, err := app.stats.Get(since)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.withTx(r, func(tx *application) error {
+		return tx.audit(adminId, models.AuditActionAdminStats, models.AuditEntityUser, adminId, nil, adminStatsSnapshot{Since: since})
+	})
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	encodeJSON(w, http.StatusOK, AdminStatsResponse{
+		Since: since,
+		Users: AdminUserStats{
+			Total:      stats.Users,
+			Admins:     stats.AdminUsers,
+			Disabled:   stats.DisabledUsers,
+			Unverified: stats.UnverifiedUsers,
+			New:        stats.NewUsers,
+		},
+		Budgets: stats.Budgets,
+		Expenses: AdminExpenseStats{
+			Count:            stats.Expenses,
+			AmountInCents:    stats.ExpenseAmount,
+			New:              stats.NewExpenses,
+			NewAmountInCents: stats.NewExpenseAmount,
+		},
+	})
+}
+
+// adminTargetUser returns the user of the userId parameter, and writes a not
+// found response if there is none
+func (app *application) adminTargetUser(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	userId := app.GetIdFromParams(r, "userId")
+	user, err := app.user.Get(userId)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w, r)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return nil, false
+	}
+	return user, true
+}
+
+// notOwnAccount keeps admins from disabling, logging out or demoting
+// themselves, which could leave no admin to undo it
+func (app *application) notOwnAccount(w http.ResponseWriter, r *http.Request, userId string) bool {
+	if userId == app.sessionManager.GetString(r.Context(), "authenticatedUserID") {
+		app.errorResponse(w, r, http.StatusConflict, ErrCodeCannotChangeSelf, "Admins cannot do this to their own account")
+		return false
+	}
+	return true
+}
+
+func (app *application) writeAdminUserAction(w http.ResponseWriter, r *http.Request, user *models.User, sessions int) {
+	err := encodeJSON(w, http.StatusOK, AdminUserActionResponse{
+		User:     newAdminUserResponse(user),
+		Sessions: sessions,
+		Flash:    app.getFlash(r.Context()),
+	})
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// userRole returns the role of the user. The users listed in ADMIN_USER_IDS
+// are admins whatever role they were given.
+func (app *application) userRole(userId string) (string, error) {
+	if slices.Contains(app.adminUserIds, userId) {
+		return models.RoleAdmin, nil
+	}
+	user, err := app.user.Get(userId)
+	if err != nil {
+		return "", err
+	}
+	return user.Role, nil
+}
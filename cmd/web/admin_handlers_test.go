@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
+
+// expectProblem checks the status and the code of an error response
+func expectProblem(t *testing.T, step string, res *http.Response, body []byte, wantStatus int, wantCode string) {
+	t.Helper()
+
+	expectStatus(t, step, res.StatusCode, wantStatus)
+	var problem Problem
+	if err := json.Unmarshal(body, &problem); err != nil {
+		t.Fatal(err)
+	}
+	if problem.Code != wantCode {
+		t.Errorf("%s: got code %q; want %q", step, problem.Code, wantCode)
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	userId := ts.signUpAndLogIn(t, "role@example.com")
+
+	visitor := ts.newClient(t)
+	res, _ := visitor.do(t, http.MethodGet, "/api/admin/stats", nil)
+	expectStatus(t, "logged out", res.StatusCode, http.StatusUnauthorized)
+
+	res, body := ts.do(t, http.MethodGet, "/api/admin/stats", nil)
+	expectProblem(t, "user", res, body, http.StatusForbidden, ErrCodeForbidden)
+
+	// The role takes effect on the next request
+	if err := app.user.SetRole(userId, models.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	res, _ = ts.do(t, http.MethodGet, "/api/admin/stats", nil)
+	expectStatus(t, "admin", res.StatusCode, http.StatusOK)
+	if err := app.user.SetRole(userId, models.RoleUser); err != nil {
+		t.Fatal(err)
+	}
+	res, body = ts.do(t, http.MethodGet, "/api/admin/stats", nil)
+	expectProblem(t, "no longer admin", res, body, http.StatusForbidden, ErrCodeForbidden)
+
+	// The users listed in ADMIN_USER_IDS are admins whatever their role
+	app.adminUserIds = []string{userId}
+	res, _ = ts.do(t, http.MethodGet, "/api/admin/stats", nil)
+	expectStatus(t, "listed in ADMIN_USER_IDS", res.StatusCode, http.StatusOK)
+
+	// and can make other users admins
+	other := ts.newClient(t)
+	otherId := other.signUpAndLogIn(t, "other-role@example.com")
+	status := ts.doJSON(t, http.MethodPut, "/api/admin/users/"+otherId+"/role", map[string]string{"role": models.RoleAdmin}, nil)
+	expectStatus(t, "make admin", status, http.StatusOK)
+	res, _ = other.do(t, http.MethodGet, "/api/admin/stats", nil)
+	expectStatus(t, "made admin", res.StatusCode, http.StatusOK)
+}
+
+// Admins cannot disable, log out or demote themselves
+func TestNotOwnAccount(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	adminId := ts.signUpAndLogIn(t, "own-account@example.com")
+	if err := app.user.SetRole(adminId, models.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   any
+	}{
+		{"disable", http.MethodPost, "/api/admin/users/" + adminId + "/disable", nil},
+		{"logout", http.MethodPost, "/api/admin/users/" + adminId + "/logout", nil},
+		{"role", http.MethodPut, "/api/admin/users/" + adminId + "/role", map[string]string{"role": models.RoleUser}},
+	}
+	for _, tt := range tests {
+		res, body := ts.do(t, tt.method, tt.path, tt.body)
+		expectProblem(t, tt.name, res, body, http.StatusConflict, ErrCodeCannotChangeSelf)
+	}
+
+	// The admin is still logged in, enabled and an admin
+	user, err := app.user.Get(adminId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Disabled() || user.Role != models.RoleAdmin {
+		t.Errorf("got disabled %t, role %q; want enabled admin", user.Disabled(), user.Role)
+	}
+	res, _ := ts.do(t, http.MethodGet, "/api/admin/stats", nil)
+	expectStatus(t, "still admin", res.StatusCode, http.StatusOK)
+}
+
+// The admin actions are recorded in the log of the admin, and are kept when
+// the user they were about deletes their account
+func TestAdminAudit(t *testing.T) {
+	app := newSQLiteTestApplication(t)
+	admin := newTestServer(t, app.routes())
+	adminId := admin.signUpAndLogIn(t, "audit-admin@example.com")
+	app.adminUserIds = []string{adminId}
+
+	user := admin.newClient(t)
+	const email = "audited@example.com"
+	userId := user.signUpAndLogIn(t, email)
+
+	steps := []struct {
+		method string
+		path   string
+		body   any
+	}{
+		{http.MethodGet, "/api/admin/users/" + userId, nil},
+		{http.MethodGet, "/api/admin/integrity?userId=" + userId, nil},
+		{http.MethodPut, "/api/admin/users/" + userId + "/role", map[string]string{"role": models.RoleUser}},
+		{http.MethodPost, "/api/admin/users/" + userId + "/logout", nil},
+		{http.MethodPost, "/api/admin/users/" + userId + "/disable", nil},
+		{http.MethodPost, "/api/admin/users/" + userId + "/enable", nil},
+	}
+	for _, step := range steps {
+		res, _ := admin.do(t, step.method, step.path, step.body)
+		expectStatus(t, step.path, res.StatusCode, http.StatusOK)
+	}
+
+	user.logIn(t, email)
+	status := user.doJSON(t, http.MethodDelete, "/api/users/account", map[string]string{"currentPassword": testPassword}, nil)
+	expectStatus(t, "delete account", status, http.StatusOK)
+
+	var log AuditLogResponse
+	status = admin.doJSON(t, http.MethodGet, "/api/audit?entityId="+userId, nil, &log)
+	expectStatus(t, "audit log of the admin", status, http.StatusOK)
+	got := map[string]bool{}
+	for _, entry := range log.Entries {
+		if entry.ActorId != adminId {
+			t.Errorf("got actor %q of %s; want the admin", entry.ActorId, entry.Action)
+		}
+		got[entry.Action] = true
+	}
+	for _, action := range []string{
+		models.AuditActionAdminView,
+		models.AuditActionRoleChange,
+		models.AuditActionForceLogout,
+		models.AuditActionDisable,
+		models.AuditActionEnable,
+	} {
+		if !got[action] {
+			t.Errorf("no %s entry about the deleted user in the log of the admin", action)
+		}
+	}
+
+	// The integrity check is recorded with the user it checked
+	status = admin.doJSON(t, http.MethodGet, "/api/audit?action="+models.AuditActionAdminIntegrityCheck, nil, &log)
+	expectStatus(t, "integrity checks", status, http.StatusOK)
+	if len(log.Entries) != 1 {
+		t.Fatalf("got %d integrity check entries; want 1", len(log.Entries))
+	}
+	var snapshot adminIntegrityCheckSnapshot
+	if err := json.Unmarshal(log.Entries[0].After, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.UserId != userId || snapshot.Checked != 1 {
+		t.Errorf("got snapshot %+v; want user %s checked", snapshot, userId)
+	}
+}
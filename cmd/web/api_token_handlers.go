@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"kweeuhree.personal-budgeting-backend/internal/models"
+	"kweeuhree.personal-budgeting-backend/internal/validator"
+)
+
+const (
+	// apiTokenPrefix starts every API token, so that a leaked token can be
+	// recognised, by secret scanners too
+	apiTokenPrefix = "pbt_"
+	// apiTokenShownChars is how much of a token is stored and shown to tell
+	// the tokens apart, prefix included
+	apiTokenShownChars = 12
+	// apiTokenDefaultDays is the lifetime of a token when none is given, it
+	// can be up to a year
+	apiTokenDefaultDays = 90
+	// apiTokenRetention is how long an expired token is still listed
+	apiTokenRetention = 30 * 24 * time.Hour
+)
+
+// apiTokenScopes are the scopes a token can be granted, the read and write
+// access to each resource
+var apiTokenScopes = []string{
+	"budget:read", "budget:write",
+	"expenses:read", "expenses:write",
+	"categories:read", "categories:write",
+}
+
+// apiTokenResources are the paths API tokens can use, and the resource of
+// the scope each needs. The rest of the API is only open to sessions.
+var apiTokenResources = []struct {
+	path     string
+	resource string
+}{
+	{"/api/budget", "budget"},
+	{"/api/v2/budgets", "budget"},
+	{"/api/expenses", "expenses"},
+	{"/api/v2/expenses", "expenses"},
+	{"/api/categories", "categories"},
+	{"/api/v2/categories", "categories"},
+}
+
+// Input struct for creating an API token. ExpiresInDays defaults to
+// apiTokenDefaultDays.
+type APITokenInput struct {
+	Name                string   `json:"name" validate:"required,maxchars=100"`
+	Scopes              []string `json:"scopes"`
+	ExpiresInDays       int64    `json:"expiresInDays" validate:"min=0,max=365"`
+	validator.Validator `json:"-"`
+}
+
+// Response struct for returning API token data, the token itself is only
+// returned when it is created
+type APITokenResponse struct {
+	TokenId    string     `json:"tokenId"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	Token      string     `json:"token,omitempty"`
+}
+
+func newAPITokenResponse(t *models.APIToken) APITokenResponse {
+	return APITokenResponse{
+		TokenId:    t.TokenId,
+		Name:       t.Name,
+		Prefix:     t.Prefix,
+		Scopes:     append([]string{}, t.Scopes...),
+		ExpiresAt:  t.ExpiresAt,
+		LastUsedAt: t.LastUsedAt,
+		CreatedAt:  t.CreatedAt,
+	}
+}
+
+// read all API tokens of the user
+func (app *application) apiTokensView(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	tokens, err := app.apiTokens.All(userId)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	response := []APITokenResponse{}
+	for _, t := range tokens {
+		response = append(response, newAPITokenResponse(t))
+	}
+
+	encodeJSON(w, http.StatusOK, response)
+}
+
+// create an API token, the response carries the token once
+func (app *application) apiTokenCreate(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	var input APITokenInput
+	err := decodeJSON(w, r, &input)
+	if err != nil {
+		return
+	}
+
+	input.Validate()
+	if !input.Valid() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+
+	secret, err := newToken()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	token := apiTokenPrefix + secret
+
+	days := input.ExpiresInDays
+	if days == 0 {
+		days = apiTokenDefaultDays
+	}
+
+	t := &models.APIToken{
+		TokenId:   uuid.New().String(),
+		UserId:    userId,
+		Name:      input.Name,
+		Prefix:    token[:apiTokenShownChars],
+		Scopes:    input.Scopes,
+		ExpiresAt: time.Now().UTC().Truncate(time.Second).Add(time.Duration(days) * 24 * time.Hour),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	err = app.apiTokens.Insert(t.TokenId, userId, t.Name, t.Prefix, hashToken(token), t.Scopes, t.ExpiresAt)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	response := newAPITokenResponse(t)
+	response.Token = token
+
+	encodeJSON(w, http.StatusCreated, response)
+}
+
+// revoke an API token
+func (app *application) apiTokenDelete(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	tokenId := app.GetIdFromParams(r, "tokenId")
+	if tokenId == "" {
+		app.notFound(w, r)
+		return
+	}
+
+	err := app.apiTokens.Delete(tokenId, userId)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w, r)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authenticateAPIToken authenticates a request with the API token it
+// carries instead of a session. The user id is put in the session of the
+// request, which loadSession never saves, so that the handlers find it where
+// they find the user of a session.
+func (app *application) authenticateAPIToken(w http.ResponseWriter, r *http.Request, token string, next http.Handler) {
+	t, err := app.apiTokens.GetByHash(hashToken(token))
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			app.errorResponse(w, r, http.StatusUnauthorized, ErrCodeInvalidToken, "The API token is invalid or has expired")
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	// The tokens of a disabled user are kept, they work again once an
+	// admin enables the user
+	active, err := app.user.IsActive(t.UserId)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if !active {
+		app.errorResponse(w, r, http.StatusForbidden, ErrCodeAccountDisabled, "The account of the API token has been disabled")
+		return
+	}
+
+	scope, ok := apiTokenScope(r)
+	if !ok {
+		app.errorResponse(w, r, http.StatusForbidden, ErrCodeInsufficientScope, "API tokens cannot access this resource")
+		return
+	}
+	if !t.HasScope(scope) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, scope))
+		app.errorResponse(w, r, http.StatusForbidden, ErrCodeInsufficientScope, fmt.Sprintf("The API token needs the %s scope", scope))
+		return
+	}
+
+	err = app.apiTokens.Touch(t.TokenId)
+	if err != nil {
+		app.errorLog.Printf("api token: unable to record the use of %s: %v", t.TokenId, err)
+	}
+
+	app.sessionManager.Put(r.Context(), "authenticatedUserID", t.UserId)
+	ctx := context.WithValue(r.Context(), isAuthenticatedContextKey, true)
+	ctx = context.WithValue(ctx, apiTokenContextKey, t)
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// apiTokenScope returns the scope an API token needs for the request, and
+// false if tokens cannot make it
+func apiTokenScope(r *http.Request) (string, bool) {
+	for _, res := range apiTokenResources {
+		if r.URL.Path == res.path || strings.HasPrefix(r.URL.Path, res.path+"/") {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead:
+				return res.resource + ":read", true
+			default:
+				return res.resource + ":write", true
+			}
+		}
+	}
+	return "", false
+}
+
+// bearerToken returns the token of an Authorization: Bearer header, and
+// whether the request has one
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// expireAPITokens deletes the tokens that expired more than
+// apiTokenRetention ago, every interval
+func (app *application) expireAPITokens(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n, err := app.apiTokens.DeleteExpired(time.Now().Add(-apiTokenRetention))
+		if err != nil {
+			app.errorLog.Printf("api token: unable to delete expired tokens: %v", err)
+			continue
+		}
+		if n > 0 {
+			app.infoLog.Printf("api token: deleted %d expired tokens", n)
+		}
+	}
+}
+
+// Check the scopes of a token are known ones
+func validAPITokenScopes(scopes []string) bool {
+	for _, scope := range scopes {
+		if !slices.Contains(apiTokenScopes, scope) {
+			return false
+		}
+	}
+	return true
+}
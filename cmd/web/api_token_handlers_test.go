@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestAPITokenScope(t *testing.T) {
+	tests := []struct {
+		method    string
+		path      string
+		wantScope string
+		wantOk    bool
+	}{
+		{http.MethodGet, "/api/budget/view", "budget:read", true},
+		{http.MethodHead, "/api/v2/budgets", "budget:read", true},
+		{http.MethodPost, "/api/budget/create", "budget:write", true},
+		{http.MethodPatch, "/api/v2/budgets/budget-1", "budget:write", true},
+		{http.MethodGet, "/api/v2/expenses", "expenses:read", true},
+		{http.MethodDelete, "/api/expenses/delete/expense-1", "expenses:write", true},
+		{http.MethodGet, "/api/v2/categories/category-1", "categories:read", true},
+		{http.MethodPut, "/api/categories/update/category-1", "categories:write", true},
+		// Only whole path segments match
+		{http.MethodGet, "/api/budgets", "", false},
+		{http.MethodGet, "/api/expensesummary", "", false},
+		// The rest of the API is only open to sessions
+		{http.MethodGet, "/api/users/tokens", "", false},
+		{http.MethodPost, "/api/users/logout", "", false},
+		{http.MethodGet, "/api/webhooks", "", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		scope, ok := apiTokenScope(r)
+		if scope != tt.wantScope || ok != tt.wantOk {
+			t.Errorf("%s %s: got %q, %t; want %q, %t", tt.method, tt.path, scope, ok, tt.wantScope, tt.wantOk)
+		}
+	}
+}
+
+// TestAPITokenAuthentication sends the requests of a script, with a bearer
+// token and neither a session cookie nor a CSRF token
+func TestAPITokenAuthentication(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	ts.signUpAndLogIn(t, "tokens@example.com")
+
+	status := ts.doJSON(t, http.MethodPost, "/api/budget/create", map[string]int64{"checkingBalance": 1000}, nil)
+	expectStatus(t, "create budget", status, http.StatusCreated)
+
+	newAPIToken := func(scopes ...string) string {
+		t.Helper()
+
+		var token APITokenResponse
+		status := ts.doJSON(t, http.MethodPost, "/api/users/tokens", map[string]any{
+			"name":   strings.Join(scopes, " "),
+			"scopes": scopes,
+		}, &token)
+		expectStatus(t, "create token", status, http.StatusCreated)
+		return token.Token
+	}
+	readBudget := newAPIToken("budget:read")
+	writeExpenses := newAPIToken("expenses:read", "expenses:write")
+
+	tests := []struct {
+		name       string
+		token      string
+		method     string
+		path       string
+		wantStatus int
+		wantCode   string
+	}{
+		{"read with the read scope", readBudget, http.MethodGet, "/api/v2/budgets", http.StatusOK, ""},
+		{"write with the read scope", readBudget, http.MethodPost, "/api/v2/budgets", http.StatusForbidden, ErrCodeInsufficientScope},
+		{"other resource", readBudget, http.MethodGet, "/api/v2/expenses", http.StatusForbidden, ErrCodeInsufficientScope},
+		{"session only route", readBudget, http.MethodGet, "/api/users/tokens", http.StatusForbidden, ErrCodeInsufficientScope},
+		{"read expenses", writeExpenses, http.MethodGet, "/api/v2/expenses", http.StatusOK, ""},
+		// The write gets past the CSRF check and the scope check, to the
+		// handler, which does not find the expense
+		{"write without a CSRF token", writeExpenses, http.MethodDelete, "/api/v2/expenses/no-such-expense", http.StatusNotFound, ErrCodeNotFound},
+		{"unknown token", "pbt_unknown", http.MethodGet, "/api/v2/budgets", http.StatusUnauthorized, ErrCodeInvalidToken},
+		{"unknown token on a write", "pbt_unknown", http.MethodPost, "/api/v2/budgets", http.StatusUnauthorized, ErrCodeInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script := ts.newClient(t)
+			script.header.Set("Authorization", "Bearer "+tt.token)
+
+			// Only the errors are decoded, as problems
+			var problem Problem
+			var dst any
+			if tt.wantCode != "" {
+				dst = &problem
+			}
+			status := script.doJSON(t, tt.method, tt.path, nil, dst)
+			expectStatus(t, tt.name, status, tt.wantStatus)
+			if problem.Code != tt.wantCode {
+				t.Errorf("got code %q; want %q", problem.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+// Requests without a bearer token need the CSRF token of their session
+func TestNoSurf(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	ts.signUpAndLogIn(t, "csrf@example.com")
+
+	tests := []struct {
+		name          string
+		csrfToken     string
+		authorization string
+		wantStatus    int
+	}{
+		{"session with the CSRF token", "session", "", http.StatusCreated},
+		{"session without the CSRF token", "", "", http.StatusBadRequest},
+		{"session with another CSRF token", "forged", "", http.StatusBadRequest},
+		// Only the Bearer scheme skips the check
+		{"basic authorization", "", "Basic dXNlcjpwYXNz", http.StatusBadRequest},
+		// The token is checked instead, and the session cookie ignored
+		{"bearer token", "", "Bearer pbt_unknown", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			csrfToken := ts.csrfToken
+			defer func() {
+				ts.csrfToken = csrfToken
+				ts.header.Del("Authorization")
+			}()
+
+			switch tt.csrfToken {
+			case "":
+				ts.csrfToken = ""
+			case "forged":
+				ts.csrfToken = strings.Repeat("A", len(csrfToken))
+			}
+			if tt.authorization != "" {
+				ts.header.Set("Authorization", tt.authorization)
+			}
+
+			var problem Problem
+			status := ts.doJSON(t, http.MethodPost, "/api/categories/create", map[string]string{"name": tt.name}, &problem)
+			expectStatus(t, tt.name, status, tt.wantStatus)
+			if tt.wantStatus == http.StatusBadRequest && problem.Code != ErrCodeCSRF {
+				t.Errorf("got code %q; want %q", problem.Code, ErrCodeCSRF)
+			}
+		})
+	}
+}
+
+// Browsers may send the Authorization header to the API from the frontend
+func TestCORSAllowsAuthorization(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	for _, method := range []string{http.MethodOptions, http.MethodGet} {
+		res, _ := ts.do(t, method, "/api/csrf-token", nil)
+		allowed := strings.Split(res.Header.Get("Access-Control-Allow-Headers"), ", ")
+		if !slices.Contains(allowed, "Authorization") {
+			t.Errorf("%s: Access-Control-Allow-Headers is %q; want it to include Authorization", method, res.Header.Get("Access-Control-Allow-Headers"))
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"kweeuhree.personal-budgeting-backend/internal/models"
+	"kweeuhree.personal-budgeting-backend/internal/validator"
+)
+
+// auditPageSize is the number of entries returned when no limit is given
+const auditPageSize = 50
+
+// auditActor describes who made the changes recorded in the audit log.
+// SessionId is a hash of the session token, so that entries can be grouped
+// by session without storing a credential.
+type auditActor struct {
+	UserId    string
+	SessionId string
+	IP        string
+	RequestId string
+}
+
+// Snapshots of the audited entities. They are kept apart from the response
+// structs so that the format of stored entries does not follow API changes.
+type budgetSnapshot struct {
+	BudgetId        string `json:"budgetId"`
+	CheckingBalance int64  `json:"checkingBalance"`
+	SavingsBalance  int64  `json:"savingsBalance"`
+	BudgetTotal     int64  `json:"budgetTotal"`
+	BudgetRemaining int64  `json:"budgetRemaining"`
+	TotalSpent      int64  `json:"totalSpent"`
+	Version         int    `json:"version"`
+}
+
+type expenseSnapshot struct {
+	ExpenseId     string `json:"expenseId"`
+	CategoryId    string `json:"categoryId"`
+	Description   string `json:"description"`
+	ExpenseType   string `json:"expenseType"`
+	AmountInCents int64  `json:"amountInCents"`
+	Version       int    `json:"version"`
+}
+
+type categorySnapshot struct {
+	ExpenseCategoryId string `json:"expenseCategoryId"`
+	Name              string `json:"name"`
+	Description       string `json:"description"`
+	TotalSum          int64  `json:"totalSum"`
+	Version           int    `json:"version"`
+}
+
+type userSnapshot struct {
+	UserId      string `json:"userId"`
+	Email       string `json:"email"`
+	DisplayName string `json:"displayName"`
+}
+
+func snapshotUser(u *models.User) userSnapshot {
+	return userSnapshot{
+		UserId:      u.UserId,
+		Email:       u.Email,
+		DisplayName: u.DisplayName,
+	}
+}
+
+func snapshotBudget(b *models.Budget) budgetSnapshot {
+	return budgetSnapshot{
+		BudgetId:        b.BudgetId,
+		CheckingBalance: b.CheckingBalance,
+		SavingsBalance:  b.SavingsBalance,
+		BudgetTotal:     b.BudgetTotal,
+		BudgetRemaining: b.BudgetRemaining,
+		TotalSpent:      b.TotalSpent,
+		Version:         b.Version,
+	}
+}
+
+func snapshotExpense(exp *models.Expense) expenseSnapshot {
+	return expenseSnapshot{
+		ExpenseId:     exp.ExpenseId,
+		CategoryId:    exp.CategoryId,
+		Description:   exp.Description,
+		ExpenseType:   exp.ExpenseType,
+		AmountInCents: exp.AmountInCents,
+		Version:       exp.Version,
+	}
+}
+
+func snapshotCategory(cat *models.ExpenseCategory) categorySnapshot {
+	return categorySnapshot{
+		ExpenseCategoryId: cat.ExpenseCategoryId,
+		Name:              cat.Name,
+		Description:       cat.Description,
+		TotalSum:          cat.TotalSum,
+		Version:           cat.Version,
+	}
+}
+
+// Response struct for returning an audit log entry
+type AuditEntryResponse struct {
+	AuditId    int64           `json:"auditId"`
+	ActorId    string          `json:"actorId"`
+	SessionId  string          `json:"sessionId"`
+	IP         string          `json:"ip"`
+	RequestId  string          `json:"requestId"`
+	Action     string          `json:"action"`
+	EntityType string          `json:"entityType"`
+	EntityId   string          `json:"entityId"`
+	Before     json.RawMessage `json:"before"`
+	After      json.RawMessage `json:"after"`
+	CreatedAt  time.Time       `json:"createdAt"`
+}
+
+// Response struct for returning a page of the audit log. NextBefore is
+// passed back as the before parameter to read the next page, it is left out
+// on the last page.
+type AuditLogResponse struct {
+	Entries    []AuditEntryResponse `json:"entries"`
+	NextBefore int64                `json:"nextBefore,omitempty"`
+}
+
+// Query parameters of the audit log
+type AuditLogQuery struct {
+	Action              string `json:"action" validate:"oneof=create|update|delete|login|logout|password_reset|password_change|verify_email|link_identity|enable_2fa|disable_2fa|repair|admin_view|admin_search|admin_stats|admin_integrity_check|disable|enable|force_logout|role_change"`
+	EntityType          string `json:"entityType" validate:"oneof=user|budget|expense|category"`
+	EntityId            string `json:"entityId" validate:"uuid"`
+	From                string `json:"from" validate:"date=2006-01-02T15:04:05Z07:00"`
+	To                  string `json:"to" validate:"date=2006-01-02T15:04:05Z07:00"`
+	Before              int64  `json:"before" validate:"min=0"`
+	Limit               int64  `json:"limit" validate:"min=0,max=500"`
+	validator.Validator `json:"-"`
+}
+
+func newAuditEntryResponse(e *models.AuditEntry) AuditEntryResponse {
+	response := AuditEntryResponse{
+		AuditId:    e.AuditId,
+		ActorId:    e.ActorId,
+		SessionId:  e.SessionId,
+		IP:         e.IP,
+		RequestId:  e.RequestId,
+		Action:     e.Action,
+		EntityType: e.EntityType,
+		EntityId:   e.EntityId,
+		Before:     json.RawMessage("null"),
+		After:      json.RawMessage("null"),
+		CreatedAt:  e.CreatedAt,
+	}
+	if len(e.Before) > 0 {
+		response.Before = e.Before
+	}
+	if len(e.After) > 0 {
+		response.After = e.After
+	}
+	return response
+}
+
+// Describe the user, session and address a request came from
+func (app *application) auditActorFrom(r *http.Request) *auditActor {
+	actor := &auditActor{
+		UserId:    app.sessionManager.GetString(r.Context(), "authenticatedUserID"),
+		IP:        app.clientIP(r),
+		RequestId: requestIdFromContext(r.Context()),
+	}
+
+	if token := app.sessionManager.Token(r.Context()); token != "" {
+		sum := sha256.Sum256([]byte(token))
+		actor.SessionId = hex.EncodeToString(sum[:8])
+	}
+	// Changes made with an API token are told apart by the prefix of the token
+	if t, ok := r.Context().Value(apiTokenContextKey).(*models.APIToken); ok {
+		actor.SessionId = t.Prefix
+	}
+
+	return actor
+}
+
+// Record a change to the data of the user in the audit log. Inside withTx
+// the entry is written in the transaction of the change. before and after
+// are snapshots of the entity, nil when it did not exist.
+func (app *application) audit(userId, action, entityType, entityId string, before, after any) error {
+	entry := &models.AuditEntry{
+		UserId:     userId,
+		Action:     action,
+		EntityType: entityType,
+		EntityId:   entityId,
+	}
+
+	// Changes made outside of a request are recorded without an actor
+	if app.actor != nil {
+		entry.ActorId = app.actor.UserId
+		entry.SessionId = app.actor.SessionId
+		entry.IP = app.actor.IP
+		entry.RequestId = app.actor.RequestId
+	}
+	if entry.ActorId == "" {
+		entry.ActorId = userId
+	}
+
+	var err error
+	if before != nil {
+		entry.Before, err = json.Marshal(before)
+		if err != nil {
+			return err
+		}
+	}
+	if after != nil {
+		entry.After, err = json.Marshal(after)
+		if err != nil {
+			return err
+		}
+	}
+
+	return app.auditLog.Insert(entry)
+}
+
+// read the audit trail of the user, newest first
+func (app *application) auditLogView(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	query := r.URL.Query()
+	input := AuditLogQuery{
+		Action:     query.Get("action"),
+		EntityType: query.Get("entityType"),
+		EntityId:   query.Get("entityId"),
+		From:       query.Get("from"),
+		To:         query.Get("to"),
+	}
+	for key, dst := range map[string]*int64{"before": &input.Before, "limit": &input.Limit} {
+		if value := query.Get(key); value != "" {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				input.AddFieldError(key, "This field must be a number")
+				continue
+			}
+			*dst = n
+		}
+	}
+
+	input.Validate()
+	if !input.Valid() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+
+	filter := models.AuditFilter{
+		Action:     input.Action,
+		EntityType: input.EntityType,
+		EntityId:   input.EntityId,
+		BeforeId:   input.Before,
+		Limit:      int(input.Limit),
+	}
+	if filter.Limit == 0 {
+		filter.Limit = auditPageSize
+	}
+	// Both dates were checked by Validate
+	if input.From != "" {
+		filter.From, _ = time.Parse(time.RFC3339, input.From)
+	}
+	if input.To != "" {
+		filter.To, _ = time.Parse(time.RFC3339, input.To)
+	}
+
+	entries, err := app.auditLog.List(userId, filter)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	response := AuditLogResponse{Entries: []AuditEntryResponse{}}
+	for _, e := range entries {
+		response.Entries = append(response.Entries, newAuditEntryResponse(e))
+	}
+	if len(entries) == filter.Limit {
+		response.NextBefore = entries[len(entries)-1].AuditId
+	}
+
+	encodeJSON(w, http.StatusOK, response)
+}
+
+// Delete the audit entries older than the retention period
+func (app *application) expireAuditEntries(interval, retention time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n, err := app.auditLog.DeleteOlderThan(time.Now().Add(-retention))
+		if err != nil {
+			app.errorLog.Printf("audit: unable to delete expired entries: %v", err)
+			continue
+		}
+		if n > 0 {
+			app.infoLog.Printf("audit: deleted %d entries older than %s", n, retention)
+		}
+	}
+}
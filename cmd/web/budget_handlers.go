@@ -7,23 +7,24 @@ import (
 	"net/http"
 
 	"github.com/google/uuid" // router
+	"kweeuhree.personal-budgeting-backend/internal/events"
 	"kweeuhree.personal-budgeting-backend/internal/models"
 	"kweeuhree.personal-budgeting-backend/internal/validator"
 )
 
 // Input struct for creating budgets
 type BudgetInput struct {
-	CheckingBalance int64 `json:"checkingBalance"`
-	SavingsBalance  int64 `json:"savingsBalance"`
-	validator.Validator
+	CheckingBalance     int64 `json:"checkingBalance" validate:"min=0,max=100000000000000"`
+	SavingsBalance      int64 `json:"savingsBalance" validate:"min=0,max=100000000000000"`
+	validator.Validator `json:"-"`
 }
 
 // Input struct for updating budgets
 type BudgetUpdate struct {
-	UpdateSumInCents int64  `json:"updateSumInCents"`
-	BalanceType      string `json:"balanceType"`
-	UpdateType       string `json:"updateType"`
-	validator.Validator
+	UpdateSumInCents    int64  `json:"updateSumInCents" validate:"positive,max=100000000000000"`
+	BalanceType         string `json:"balanceType" validate:"required,oneof=checkingBalance|savingsBalance"`
+	UpdateType          string `json:"updateType" validate:"required,oneof=add|subtract"`
+	validator.Validator `json:"-"`
 }
 
 // // Response struct for returning budget data
@@ -34,6 +35,7 @@ type BudgetResponse struct {
 	BudgetTotal     int64  `json:"budgetTotal"`
 	BudgetRemaining int64  `json:"budgetRemaining"`
 	TotalSpent      int64  `json:"totalSpent"`
+	Version         int    `json:"version"`
 	UpdatedAt       string `json:"updatedAt"`
 	Flash           string `json:"flash"`
 }
@@ -56,11 +58,12 @@ const (
 
 // read
 func (app *application) budgetView(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
 	budgetId := app.GetIdFromParams(r, "budgetId")
 
 	// return a 404 Not Found in case of invalid id or error
 	if budgetId == "" {
-		app.notFound(w)
+		app.notFound(w, r)
 		return
 	}
 
@@ -68,23 +71,22 @@ func (app *application) budgetView(w http.ResponseWriter, r *http.Request) {
 
 	if err != nil {
 		if errors.Is(err, models.ErrNoRecord) {
-			app.notFound(w)
+			app.notFound(w, r)
 		} else {
-			app.serverError(w, err)
+			app.serverError(w, r, err)
 		}
 		return
 	}
 
-	response := &BudgetResponse{
-		BudgetId:        budgetId,
-		CheckingBalance: budget.CheckingBalance,
-		SavingsBalance:  budget.SavingsBalance,
-		BudgetTotal:     budget.BudgetTotal,
-		BudgetRemaining: budget.BudgetRemaining,
-		TotalSpent:      budget.TotalSpent,
-		UpdatedAt:       budget.UpdatedAt.GoString(),
+	// Other users' budgets are reported as not found
+	if budget.UserId != userId {
+		app.notFound(w, r)
+		return
 	}
 
+	response := newBudgetResponse(budget)
+
+	w.Header().Set("ETag", etag(budget.Version))
 	encodeJSON(w, http.StatusOK, response)
 }
 
@@ -107,7 +109,7 @@ func (app *application) budgetCreate(w http.ResponseWriter, r *http.Request) {
 	// validate input
 	input.Validate()
 	if !input.Valid() {
-		encodeJSON(w, http.StatusBadRequest, input.FieldErrors)
+		app.failedValidation(w, r, input.Validator)
 		return
 	}
 
@@ -116,14 +118,31 @@ func (app *application) budgetCreate(w http.ResponseWriter, r *http.Request) {
 
 	userId := app.sessionManager.Get(r.Context(), "authenticatedUserID").(string)
 	if userId == "" {
-		app.serverError(w, fmt.Errorf("userId not found in session"))
+		app.serverError(w, r, fmt.Errorf("userId not found in session"))
 		return
 	}
 	log.Printf("Authenticated user id: %s", userId)
 	// Insert the new budget using the ID and body
-	id, err := app.budget.Insert(newId, userId, input.CheckingBalance, input.SavingsBalance, budgetTotal)
+	var id string
+	err = app.withTx(r, func(tx *application) error {
+		id, err = tx.budget.Insert(newId, userId, input.CheckingBalance, input.SavingsBalance, budgetTotal)
+		if err != nil {
+			return err
+		}
+
+		budget, err := tx.budget.Get(id)
+		if err != nil {
+			return err
+		}
+		err = tx.audit(userId, models.AuditActionCreate, models.AuditEntityBudget, id, nil, snapshotBudget(budget))
+		if err != nil {
+			return err
+		}
+
+		return tx.publishEvent(userId, events.BudgetCreated, EventPayload{})
+	})
 	if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 		return
 	}
 
@@ -134,34 +153,61 @@ func (app *application) budgetCreate(w http.ResponseWriter, r *http.Request) {
 		CheckingBalance: input.CheckingBalance,
 		SavingsBalance:  input.SavingsBalance,
 		BudgetTotal:     budgetTotal,
+		BudgetRemaining: budgetTotal,
+		Version:         1,
 		Flash:           app.getFlash(r.Context()),
 	}
 
+	w.Header().Set("ETag", etag(response.Version))
 	err = encodeJSON(w, http.StatusCreated, response)
 	if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 		return
 	}
 }
 
-// update
+// update, responds with 201 Created like it always has
 func (app *application) budgetUpdate(w http.ResponseWriter, r *http.Request) {
+	app.updateBudget(w, r, http.StatusCreated)
+}
+
+// Apply a budget update and write the budget with the given status
+func (app *application) updateBudget(w http.ResponseWriter, r *http.Request, status int) {
 	userId := app.sessionManager.Get(r.Context(), "authenticatedUserID").(string)
 	if userId == "" {
-		app.serverError(w, fmt.Errorf("userId not found in session"))
+		app.serverError(w, r, fmt.Errorf("userId not found in session"))
 		return
 	}
 
 	budgetId := app.GetIdFromParams(r, "budgetId")
 	if budgetId == "" {
-		app.notFound(w)
+		app.notFound(w, r)
 		log.Printf("Exiting due to invalid id")
 		return
 	}
 
+	currentBudget, err := app.budget.Get(budgetId)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w, r)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+	if currentBudget.UserId != userId {
+		app.notFound(w, r)
+		return
+	}
+
+	// Refuse the update if the client edited an older version of the budget
+	if !app.checkIfMatch(w, r, currentBudget.Version) {
+		return
+	}
+
 	// Decode the JSON body into the input struct
 	var input BudgetUpdate
-	err := decodeJSON(w, r, &input)
+	err = decodeJSON(w, r, &input)
 	if err != nil {
 		log.Printf("Exiting after decoding attempt...")
 		log.Printf("Error message %s", err)
@@ -173,7 +219,7 @@ func (app *application) budgetUpdate(w http.ResponseWriter, r *http.Request) {
 	// validate input
 	input.Validate()
 	if !input.Valid() {
-		encodeJSON(w, http.StatusBadRequest, input.FieldErrors)
+		app.failedValidation(w, r, input.Validator)
 		return
 	}
 
@@ -181,94 +227,105 @@ func (app *application) budgetUpdate(w http.ResponseWriter, r *http.Request) {
 	if input.UpdateType == UpdateTypeSubtract {
 		// validate the input against existing balance
 		err = app.CurrentBudgetIsValid(userId, input.BalanceType, input.UpdateSumInCents)
-
 		if err != nil {
-			app.serverError(w, fmt.Errorf("failed to update current budget: %v", err))
+			app.budgetError(w, r, err, "updateSumInCents", "balanceType")
 			return
 		}
 	}
 
-	updatedBudget, err := app.handleBudgetUpdate(userId, input.BalanceType, input.UpdateType, input.UpdateSumInCents)
+	updatedBudget, err := app.handleBudgetUpdate(r, currentBudget, input.BalanceType, input.UpdateType, input.UpdateSumInCents)
 	if err != nil {
-		app.serverError(w, fmt.Errorf("failed to update current budget: %v", err))
+		switch {
+		case errors.Is(err, models.ErrVersionConflict):
+			app.versionConflict(w, r)
+		case errors.Is(err, models.ErrNoRecord):
+			app.notFound(w, r)
+		case budgetProblem(err, "updateSumInCents", "balanceType") != nil:
+			app.budgetError(w, r, err, "updateSumInCents", "balanceType")
+		default:
+			app.serverError(w, r, fmt.Errorf("failed to update current budget: %w", err))
+		}
 		return
 	}
 
 	app.setFlash(r.Context(), "Budget has been updated.")
 
-	response := &BudgetResponse{
-		BudgetId:        budgetId,
-		CheckingBalance: updatedBudget.CheckingBalance,
-		SavingsBalance:  updatedBudget.SavingsBalance,
-		BudgetTotal:     updatedBudget.BudgetTotal,
-		BudgetRemaining: updatedBudget.BudgetRemaining,
-		TotalSpent:      updatedBudget.TotalSpent,
-		UpdatedAt:       updatedBudget.UpdatedAt.GoString(),
-		Flash:           app.getFlash(r.Context()),
-	}
+	response := newBudgetResponse(updatedBudget)
+	response.Flash = app.getFlash(r.Context())
 
-	err = encodeJSON(w, http.StatusCreated, response)
+	w.Header().Set("ETag", etag(updatedBudget.Version))
+	err = encodeJSON(w, status, response)
 	if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 		return
 	}
 }
 
+// Apply the update to the budget and store it. The budget is read again and
+// locked within the transaction, so that an update never works on a stale
+// copy; only a client whose If-Match no longer matches is refused.
 func (app *application) handleBudgetUpdate(
-	userId, balanceType, updateType string,
+	r *http.Request, currentBudget *models.Budget, balanceType, updateType string,
 	sumInCents int64,
 ) (*models.Budget, error) {
 
-	budgetId, checkingBalance, savingsBalance, budgetTotal, budgetRemaining, totalSpent, err := app.CalculateBudgetUpdates(userId, updateType, balanceType, sumInCents, false)
-	if err != nil {
-		return nil, err
-	}
-
-	// Update the budget in the database
-	app.UpdateBudgetInDB(budgetId, userId, checkingBalance, savingsBalance, budgetTotal, budgetRemaining, totalSpent)
+	var storedBudget *models.Budget
+	err := app.withTx(r, func(tx *application) error {
+		updatedBudget, err := tx.CalculateBudgetUpdates(currentBudget.UserId, updateType, balanceType, sumInCents, false)
+		if err != nil {
+			return err
+		}
+		if updatedBudget.BudgetId != currentBudget.BudgetId {
+			return models.ErrNoRecord
+		}
+		if !ifMatches(r, updatedBudget.Version) {
+			return models.ErrVersionConflict
+		}
 
-	// Create the updated budget model
-	updatedBudget := &models.Budget{
-		BudgetId:        budgetId,
-		CheckingBalance: checkingBalance,
-		SavingsBalance:  savingsBalance,
-		BudgetTotal:     budgetTotal,
-		BudgetRemaining: budgetRemaining,
-		TotalSpent:      totalSpent,
-	}
+		// Update the budget in the database
+		err = tx.UpdateBudgetInDB(updatedBudget)
+		if err != nil {
+			return err
+		}
 
-	return updatedBudget, nil
-}
+		// Read the budget back to return its new version and timestamp
+		storedBudget, err = tx.budget.Get(updatedBudget.BudgetId)
+		if err != nil {
+			return err
+		}
 
-// update the budget in the database
-func (app *application) UpdateBudgetInDB(budgetId, userId string, checkingBalance, savingsBalance, budgetTotal, budgetRemaining, totalSpent int64) {
-	err := app.budget.Put(budgetId, userId, checkingBalance, savingsBalance, budgetTotal, budgetRemaining, totalSpent)
+		response := newBudgetResponse(storedBudget)
+		return tx.publishEvent(storedBudget.UserId, events.BudgetUpdated, EventPayload{Budget: &response})
+	})
 	if err != nil {
-		log.Printf("Failed to update budget with ID %s for user %s: %s", budgetId, userId, err)
-		return
+		return nil, err
 	}
 
-	log.Printf("Budget updated successfully")
+	return storedBudget, nil
 }
 
 // delete
 func (app *application) budgetDelete(w http.ResponseWriter, r *http.Request) {
 	userId := app.sessionManager.Get(r.Context(), "authenticatedUserID").(string)
 	if userId == "" {
-		app.serverError(w, fmt.Errorf("userId not found in session"))
+		app.serverError(w, r, fmt.Errorf("userId not found in session"))
 		return
 	}
 
 	budgetId := app.GetIdFromParams(r, "budgetId")
 	if budgetId == "" {
-		app.notFound(w)
+		app.notFound(w, r)
 		return
 	}
 
 	// Deletes budget, expenses and voids totalSums of existing expense categories
-	err := app.DeleteAllBudgetDetails(budgetId, userId)
+	err := app.DeleteAllBudgetDetails(r, budgetId, userId)
 	if err != nil {
-		app.serverError(w, err)
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w, r)
+		} else {
+			app.serverError(w, r, err)
+		}
 		return
 	}
 
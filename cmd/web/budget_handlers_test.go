@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// A budget update without If-Match applies to the latest version of the
+// budget, even when an expense changed it since the client read it. With a
+// stale If-Match the update is refused.
+func TestBudgetUpdateVersions(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	ts.signUpAndLogIn(t, "versions@example.com")
+
+	var budget BudgetResponse
+	status := ts.doJSON(t, http.MethodPost, "/api/v2/budgets", map[string]int64{"checkingBalance": 10000}, &budget)
+	expectStatus(t, "create budget", status, http.StatusCreated)
+
+	var category ExpenseCategoryResponse
+	status = ts.doJSON(t, http.MethodPost, "/api/v2/categories", map[string]string{"name": "Rent"}, &category)
+	expectStatus(t, "create category", status, http.StatusCreated)
+
+	// The expense moves the budget past the version the client read
+	status = ts.doJSON(t, http.MethodPost, "/api/v2/expenses", map[string]any{
+		"amountInCents": 4000,
+		"categoryId":    category.ExpenseCategoryId,
+		"expenseType":   BalanceTypeChecking,
+	}, nil)
+	expectStatus(t, "create expense", status, http.StatusCreated)
+
+	update := map[string]any{
+		"updateSumInCents": 1000,
+		"balanceType":      BalanceTypeChecking,
+		"updateType":       UpdateTypeSubtract,
+	}
+
+	ts.header.Set("If-Match", etag(budget.Version))
+	var problem Problem
+	status = ts.doJSON(t, http.MethodPatch, "/api/v2/budgets/"+budget.BudgetId, update, &problem)
+	expectStatus(t, "update with a stale If-Match", status, http.StatusPreconditionFailed)
+	if problem.Code != ErrCodePreconditionFailed {
+		t.Errorf("got code %q; want %q", problem.Code, ErrCodePreconditionFailed)
+	}
+
+	ts.header.Del("If-Match")
+	var updated BudgetResponse
+	status = ts.doJSON(t, http.MethodPatch, "/api/v2/budgets/"+budget.BudgetId, update, &updated)
+	expectStatus(t, "update without If-Match", status, http.StatusOK)
+	if updated.CheckingBalance != 5000 {
+		t.Errorf("got checking balance %d; want 5000", updated.CheckingBalance)
+	}
+
+	// The balance is checked against the latest version too
+	update["updateSumInCents"] = 6000
+	status = ts.doJSON(t, http.MethodPatch, "/api/v2/budgets/"+budget.BudgetId, update, &problem)
+	expectStatus(t, "update over the balance", status, http.StatusConflict)
+	if problem.Code != ErrCodeInsufficientFunds {
+		t.Errorf("got code %q; want %q", problem.Code, ErrCodeInsufficientFunds)
+	}
+}
+
+// Deleting another user's budget answers 404 on both API versions and leaves
+// the owner's budget and expenses in place.
+func TestBudgetDeleteOtherUser(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	ts.signUpAndLogIn(t, "owner@example.com")
+
+	var budget BudgetResponse
+	status := ts.doJSON(t, http.MethodPost, "/api/v2/budgets", map[string]int64{"checkingBalance": 10000}, &budget)
+	expectStatus(t, "create budget", status, http.StatusCreated)
+
+	var category ExpenseCategoryResponse
+	status = ts.doJSON(t, http.MethodPost, "/api/v2/categories", map[string]string{"name": "Rent"}, &category)
+	expectStatus(t, "create category", status, http.StatusCreated)
+
+	var expense ExpenseResponse
+	status = ts.doJSON(t, http.MethodPost, "/api/v2/expenses", map[string]any{
+		"amountInCents": 4000,
+		"categoryId":    category.ExpenseCategoryId,
+		"expenseType":   BalanceTypeChecking,
+	}, &expense)
+	expectStatus(t, "create expense", status, http.StatusCreated)
+
+	other := ts.newClient(t)
+	other.signUpAndLogIn(t, "other@example.com")
+
+	status = other.doJSON(t, http.MethodDelete, "/api/v2/budgets/"+budget.BudgetId, nil, nil)
+	expectStatus(t, "v2 delete of another user's budget", status, http.StatusNotFound)
+	status = other.doJSON(t, http.MethodDelete, "/api/budget/delete/"+budget.BudgetId, nil, nil)
+	expectStatus(t, "v1 delete of another user's budget", status, http.StatusNotFound)
+
+	status = ts.doJSON(t, http.MethodGet, "/api/v2/budgets/"+budget.BudgetId, nil, nil)
+	expectStatus(t, "view budget", status, http.StatusOK)
+	status = ts.doJSON(t, http.MethodGet, "/api/v2/expenses/"+expense.ExpenseId, nil, nil)
+	expectStatus(t, "view expense", status, http.StatusOK)
+
+	status = ts.doJSON(t, http.MethodDelete, "/api/v2/budgets/"+budget.BudgetId, nil, nil)
+	expectStatus(t, "delete own budget", status, http.StatusNoContent)
+	status = ts.doJSON(t, http.MethodGet, "/api/v2/expenses/"+expense.ExpenseId, nil, nil)
+	expectStatus(t, "view deleted expense", status, http.StatusNotFound)
+}
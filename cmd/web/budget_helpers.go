@@ -3,96 +3,180 @@ package main
 import (
 	"errors"
 	"fmt"
-	"log"
+	"net/http"
+	"time"
+
+	"kweeuhree.personal-budgeting-backend/internal/events"
+	"kweeuhree.personal-budgeting-backend/internal/models"
+	"kweeuhree.personal-budgeting-backend/internal/validator"
 )
 
+// CurrentBudgetIsValid checks that sumInCents can be taken out of the given
+// balance. It returns one of the typed budget errors from the models package
+// so that handlers can report the exact problem to the user.
 func (app *application) CurrentBudgetIsValid(userId, balanceType string, sumInCents int64) error {
+	if sumInCents <= 0 {
+		return models.ErrInvalidAmount
+	}
+	if balanceType != BalanceTypeChecking && balanceType != BalanceTypeSavings {
+		return fmt.Errorf("%w: %s", models.ErrInvalidBalanceType, balanceType)
+	}
+
 	// Fetch the current budget for the user
 	currentBudget, err := app.budget.GetBudgetByUserId(userId)
-
 	if err != nil {
-		return fmt.Errorf("failed to fetch current budget: %v", err)
+		if errors.Is(err, models.ErrNoRecord) {
+			return models.ErrNoBudget
+		}
+		return fmt.Errorf("failed to fetch current budget: %w", err)
 	}
 
-	if currentBudget == nil {
-		return errors.New("current budget cannot be null")
-	}
-	if sumInCents <= 0 {
-		return errors.New("balance amount must be positive")
-	}
-	if balanceType != BalanceTypeChecking && balanceType != BalanceTypeSavings {
-		return fmt.Errorf("invalid balance type: %s", balanceType)
-	}
 	if (balanceType == BalanceTypeChecking && currentBudget.CheckingBalance < sumInCents) ||
 		(balanceType == BalanceTypeSavings && currentBudget.SavingsBalance < sumInCents) {
-		return fmt.Errorf("insufficient funds in %s account", balanceType)
+		return fmt.Errorf("%w in %s account", models.ErrInsufficientFunds, balanceType)
 	}
 	return nil
 }
 
+// Build the JSON representation of a stored budget
+func newBudgetResponse(budget *models.Budget) BudgetResponse {
+	return BudgetResponse{
+		BudgetId:        budget.BudgetId,
+		CheckingBalance: budget.CheckingBalance,
+		SavingsBalance:  budget.SavingsBalance,
+		BudgetTotal:     budget.BudgetTotal,
+		BudgetRemaining: budget.BudgetRemaining,
+		TotalSpent:      budget.TotalSpent,
+		Version:         budget.Version,
+		UpdatedAt:       budget.UpdatedAt.Format(time.RFC3339),
+	}
+}
+
+// The budgetError helper maps the typed budget errors returned by
+// CurrentBudgetIsValid, and concurrent changes of the budget, to 409/422
+// problem responses. The field names are those of the input struct, so that
+// the frontend can highlight the right input. Any other error is reported as
+// a 500.
+func (app *application) budgetError(w http.ResponseWriter, r *http.Request, err error, amountField, balanceTypeField string) {
+	p := budgetProblem(err, amountField, balanceTypeField)
+	if p == nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	writeProblem(w, r, p)
+}
+
+// budgetProblem returns the problem describing a typed budget error, or nil
+// if err is not one of them
+func budgetProblem(err error, amountField, balanceTypeField string) *Problem {
+	var p *Problem
+	switch {
+	case errors.Is(err, models.ErrInsufficientFunds):
+		p = newProblem(http.StatusConflict, ErrCodeInsufficientFunds, "Not enough money in the selected balance")
+		p.FieldErrors = map[string]string{amountField: "This amount exceeds the available balance"}
+	case errors.Is(err, models.ErrBalanceLimit):
+		p = newProblem(http.StatusUnprocessableEntity, ErrCodeBalanceLimit, "The balance cannot grow any further")
+		p.FieldErrors = map[string]string{amountField: fmt.Sprintf("This amount would take the balance above %d", models.MaxCents)}
+	case errors.Is(err, models.ErrNoBudget):
+		p = newProblem(http.StatusConflict, ErrCodeNoBudget, "Create a budget before adding or spending money")
+	case errors.Is(err, models.ErrInvalidAmount):
+		p = newProblem(http.StatusUnprocessableEntity, ErrCodeInvalidAmount, "Amount must be positive")
+		p.FieldErrors = map[string]string{amountField: "This field must be greater than zero"}
+	case errors.Is(err, models.ErrInvalidBalanceType):
+		p = newProblem(http.StatusUnprocessableEntity, ErrCodeInvalidBalanceType, "Unknown balance type")
+		p.FieldErrors = map[string]string{balanceTypeField: "This field must be either checkingBalance or savingsBalance"}
+	case errors.Is(err, models.ErrVersionConflict):
+		p = newProblem(http.StatusConflict, ErrCodeEditConflict, "Your budget changed while the request was handled, please retry")
+	}
+
+	return p
+}
+
 func (app *application) CalculateAndUpdateBudget(
 	userId, updateType, balanceType string, sumInCents int64, isExpense bool,
 ) error {
 
 	// add the expense amount back to the budget
-	budgetId, checkingBalance, savingsBalance, budgetTotal, budgetRemaining, totalSpent, err := app.CalculateBudgetUpdates(userId, updateType, balanceType, sumInCents, true)
+	updatedBudget, err := app.CalculateBudgetUpdates(userId, updateType, balanceType, sumInCents, isExpense)
 	if err != nil {
 		return err
 	}
 
 	// Update the budget in the database
-	app.UpdateBudgetInDB(budgetId, userId, checkingBalance, savingsBalance, budgetTotal, budgetRemaining, totalSpent)
-
-	return nil
+	return app.UpdateBudgetInDB(updatedBudget)
 }
 
+// CalculateBudgetUpdates fetches the current budget of the user and returns
+// it with the update applied. Called within withTx, the budget row stays
+// locked until the transaction ends, so that concurrent updates are applied
+// one after the other. The balance is checked again under the lock, since
+// it may have changed since the handler validated the input.
 func (app *application) CalculateBudgetUpdates(
 	userId, updateType, balanceType string, sumInCents int64, isExpense bool,
-) (string, int64, int64, int64, int64, int64, error) {
-	currentBudget, err := app.budget.GetBudgetByUserId(userId)
-	log.Printf("Current Budget: %+v", currentBudget)
+) (*models.Budget, error) {
+	currentBudget, err := app.budget.GetBudgetByUserIdForUpdate(userId)
 	if err != nil {
-		return "", 0, 0, 0, 0, 0, fmt.Errorf("failed to fetch current budget: %v", err)
+		if errors.Is(err, models.ErrNoRecord) {
+			return nil, models.ErrNoBudget
+		}
+		return nil, fmt.Errorf("failed to fetch current budget: %w", err)
 	}
 
-	updatedBudget := *currentBudget
+	if updateType == UpdateTypeSubtract && balanceOf(currentBudget, balanceType) < sumInCents {
+		return nil, fmt.Errorf("%w in %s account", models.ErrInsufficientFunds, balanceType)
+	}
+	if updateType == UpdateTypeAdd && !validator.InRange(sumInCents, 0, models.MaxCents-balanceOf(currentBudget, balanceType)) {
+		return nil, fmt.Errorf("%w in %s account", models.ErrBalanceLimit, balanceType)
+	}
 
+	updatedBudget := applyBudgetUpdate(*currentBudget, updateType, balanceType, sumInCents, isExpense)
+	return &updatedBudget, nil
+}
+
+// applyBudgetUpdate adds sumInCents to, or subtracts it from, the given
+// balance and recomputes the derived totals. When isExpense is set, the
+// amount is also counted in (or, when adding back, taken out of) totalSpent.
+func applyBudgetUpdate(budget models.Budget, updateType, balanceType string, sumInCents int64, isExpense bool) models.Budget {
 	// Adjust checking or savings balance based on balance type
 	if balanceType == BalanceTypeChecking {
-		newCheckingBalance := app.updateBalance(updatedBudget.CheckingBalance, sumInCents, updateType)
-		updatedBudget.CheckingBalance = newCheckingBalance
+		budget.CheckingBalance = updateBalance(budget.CheckingBalance, sumInCents, updateType)
 	} else if balanceType == BalanceTypeSavings {
-		newSavingsBalance := app.updateBalance(updatedBudget.SavingsBalance, sumInCents, updateType)
-		updatedBudget.SavingsBalance = newSavingsBalance
+		budget.SavingsBalance = updateBalance(budget.SavingsBalance, sumInCents, updateType)
 	}
 
-	newBudgetRemaining := updatedBudget.CheckingBalance + updatedBudget.SavingsBalance
-	newTotalSpent := updatedBudget.TotalSpent
-
-	var newBudgetTotal int64
+	budget.BudgetRemaining = budget.CheckingBalance + budget.SavingsBalance
 
 	switch updateType {
 	case UpdateTypeAdd:
-		newBudgetTotal = updatedBudget.BudgetTotal + sumInCents
+		budget.BudgetTotal += sumInCents
 		if isExpense {
-			newTotalSpent = updatedBudget.TotalSpent - sumInCents
+			budget.TotalSpent -= sumInCents
 		}
 
 	case UpdateTypeSubtract:
-		newBudgetTotal = updatedBudget.BudgetTotal - sumInCents
+		budget.BudgetTotal -= sumInCents
 		if isExpense {
-			newTotalSpent = updatedBudget.TotalSpent + sumInCents
+			budget.TotalSpent += sumInCents
 		}
 	}
 
-	if newTotalSpent < 0 {
-		newTotalSpent = 0
+	if budget.TotalSpent < 0 {
+		budget.TotalSpent = 0
 	}
 
-	return updatedBudget.BudgetId, updatedBudget.CheckingBalance, updatedBudget.SavingsBalance, newBudgetTotal, newBudgetRemaining, newTotalSpent, nil
+	return budget
 }
 
-func (app *application) updateBalance(currentBalance, sumInCents int64, updateType string) int64 {
+// Return the checking or savings balance of the budget
+func balanceOf(budget *models.Budget, balanceType string) int64 {
+	if balanceType == BalanceTypeSavings {
+		return budget.SavingsBalance
+	}
+	return budget.CheckingBalance
+}
+
+func updateBalance(currentBalance, sumInCents int64, updateType string) int64 {
 	var updatedBalance int64
 	switch updateType {
 	case UpdateTypeAdd:
@@ -103,24 +187,76 @@ func (app *application) updateBalance(currentBalance, sumInCents int64, updateTy
 	return updatedBalance
 }
 
-func (app *application) DeleteAllBudgetDetails(budgetId, userId string) error {
-	// Delete the budget using the ID
-	err := app.budget.Delete(budgetId, userId)
+// update the budget in the database, as long as nobody changed it since it was read
+func (app *application) UpdateBudgetInDB(budget *models.Budget) error {
+	before, err := app.budget.Get(budget.BudgetId)
 	if err != nil {
 		return err
 	}
 
-	// Delete all expenses associated with that user
-	err = app.expenses.DeleteAll(userId)
+	err = app.budget.PutIfVersion(budget.BudgetId, budget.UserId, budget.Version, budget.CheckingBalance, budget.SavingsBalance, budget.BudgetTotal, budget.BudgetRemaining, budget.TotalSpent)
 	if err != nil {
+		app.errorLog.Printf("Failed to update budget with ID %s for user %s: %s", budget.BudgetId, budget.UserId, err)
 		return err
 	}
 
-	// Void all expense categories totalSums
-	err = app.expenseCategory.VoidAllTotalSums(userId)
+	after := *budget
+	after.Version++
+	err = app.audit(budget.UserId, models.AuditActionUpdate, models.AuditEntityBudget, budget.BudgetId, snapshotBudget(before), snapshotBudget(&after))
 	if err != nil {
 		return err
 	}
 
+	app.infoLog.Printf("Budget updated successfully")
 	return nil
 }
+
+// DeleteAllBudgetDetails deletes the budget of the user, their expenses and
+// the totals of their categories. It returns models.ErrNoRecord, and deletes
+// nothing, if the budget does not exist or belongs to someone else.
+func (app *application) DeleteAllBudgetDetails(r *http.Request, budgetId, userId string) error {
+	return app.withTx(r, func(tx *application) error {
+		budget, err := tx.budget.Get(budgetId)
+		if err != nil {
+			return err
+		}
+		if budget.UserId != userId {
+			return models.ErrNoRecord
+		}
+
+		// Delete the budget using the ID
+		err = tx.budget.Delete(budgetId, userId)
+		if err != nil {
+			return err
+		}
+		err = tx.audit(userId, models.AuditActionDelete, models.AuditEntityBudget, budgetId, snapshotBudget(budget), nil)
+		if err != nil {
+			return err
+		}
+
+		exps, err := tx.expenses.All(userId)
+		if err != nil {
+			return err
+		}
+
+		// Delete all expenses associated with that user
+		err = tx.expenses.DeleteAll(userId)
+		if err != nil {
+			return err
+		}
+		for _, exp := range exps {
+			err = tx.audit(userId, models.AuditActionDelete, models.AuditEntityExpense, exp.ExpenseId, snapshotExpense(exp), nil)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Void all expense categories totalSums
+		err = tx.expenseCategory.VoidAllTotalSums(userId)
+		if err != nil {
+			return err
+		}
+
+		return tx.publishEvent(userId, events.BudgetDeleted, EventPayload{})
+	})
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
+
+func TestApplyBudgetUpdate(t *testing.T) {
+	budget := models.Budget{
+		CheckingBalance: 10000,
+		SavingsBalance:  5000,
+		BudgetTotal:     20000,
+		BudgetRemaining: 15000,
+		TotalSpent:      5000,
+	}
+
+	tests := []struct {
+		name        string
+		updateType  string
+		balanceType string
+		sum         int64
+		isExpense   bool
+		want        models.Budget
+	}{
+		{
+			name:        "add to checking",
+			updateType:  UpdateTypeAdd,
+			balanceType: BalanceTypeChecking,
+			sum:         2500,
+			want:        models.Budget{CheckingBalance: 12500, SavingsBalance: 5000, BudgetTotal: 22500, BudgetRemaining: 17500, TotalSpent: 5000},
+		},
+		{
+			name:        "subtract from savings",
+			updateType:  UpdateTypeSubtract,
+			balanceType: BalanceTypeSavings,
+			sum:         1000,
+			want:        models.Budget{CheckingBalance: 10000, SavingsBalance: 4000, BudgetTotal: 19000, BudgetRemaining: 14000, TotalSpent: 5000},
+		},
+		{
+			name:        "spend from checking",
+			updateType:  UpdateTypeSubtract,
+			balanceType: BalanceTypeChecking,
+			sum:         3000,
+			isExpense:   true,
+			want:        models.Budget{CheckingBalance: 7000, SavingsBalance: 5000, BudgetTotal: 17000, BudgetRemaining: 12000, TotalSpent: 8000},
+		},
+		{
+			name:        "give an expense back to savings",
+			updateType:  UpdateTypeAdd,
+			balanceType: BalanceTypeSavings,
+			sum:         2000,
+			isExpense:   true,
+			want:        models.Budget{CheckingBalance: 10000, SavingsBalance: 7000, BudgetTotal: 22000, BudgetRemaining: 17000, TotalSpent: 3000},
+		},
+		{
+			name:        "give back more than was spent",
+			updateType:  UpdateTypeAdd,
+			balanceType: BalanceTypeChecking,
+			sum:         6000,
+			isExpense:   true,
+			want:        models.Budget{CheckingBalance: 16000, SavingsBalance: 5000, BudgetTotal: 26000, BudgetRemaining: 21000, TotalSpent: 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := applyBudgetUpdate(budget, tt.updateType, tt.balanceType, tt.sum, tt.isExpense)
+			if got != tt.want {
+				t.Errorf("got %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCalculateBudgetUpdates(t *testing.T) {
+	app := newTestApplication(t)
+
+	const userId = "user-1"
+	err := app.user.Insert(userId, "calculate@example.com", "Test User", testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = app.budget.Insert("budget-1", userId, 10000, 5000, 15000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		userId       string
+		updateType   string
+		balanceType  string
+		sum          int64
+		isExpense    bool
+		wantChecking int64
+		wantSavings  int64
+		wantSpent    int64
+		wantErr      error
+	}{
+		{
+			name:         "spend from checking",
+			userId:       userId,
+			updateType:   UpdateTypeSubtract,
+			balanceType:  BalanceTypeChecking,
+			sum:          4000,
+			isExpense:    true,
+			wantChecking: 6000,
+			wantSavings:  5000,
+			wantSpent:    4000,
+		},
+		{
+			name:         "add to savings",
+			userId:       userId,
+			updateType:   UpdateTypeAdd,
+			balanceType:  BalanceTypeSavings,
+			sum:          500,
+			wantChecking: 10000,
+			wantSavings:  5500,
+		},
+		{
+			name:         "spend the whole balance",
+			userId:       userId,
+			updateType:   UpdateTypeSubtract,
+			balanceType:  BalanceTypeSavings,
+			sum:          5000,
+			isExpense:    true,
+			wantChecking: 10000,
+			wantSavings:  0,
+			wantSpent:    5000,
+		},
+		{
+			name:        "spend more than the balance",
+			userId:      userId,
+			updateType:  UpdateTypeSubtract,
+			balanceType: BalanceTypeSavings,
+			sum:         5001,
+			isExpense:   true,
+			wantErr:     models.ErrInsufficientFunds,
+		},
+		{
+			name:         "add up to the limit",
+			userId:       userId,
+			updateType:   UpdateTypeAdd,
+			balanceType:  BalanceTypeChecking,
+			sum:          models.MaxCents - 10000,
+			wantChecking: models.MaxCents,
+			wantSavings:  5000,
+		},
+		{
+			name:        "add past the limit",
+			userId:      userId,
+			updateType:  UpdateTypeAdd,
+			balanceType: BalanceTypeChecking,
+			sum:         models.MaxCents - 9999,
+			wantErr:     models.ErrBalanceLimit,
+		},
+		{
+			name:        "no budget",
+			userId:      "user-2",
+			updateType:  UpdateTypeAdd,
+			balanceType: BalanceTypeChecking,
+			sum:         100,
+			wantErr:     models.ErrNoBudget,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := app.CalculateBudgetUpdates(tt.userId, tt.updateType, tt.balanceType, tt.sum, tt.isExpense)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v; want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got.CheckingBalance != tt.wantChecking || got.SavingsBalance != tt.wantSavings || got.TotalSpent != tt.wantSpent {
+				t.Errorf("got checking %d, savings %d, spent %d; want %d, %d, %d",
+					got.CheckingBalance, got.SavingsBalance, got.TotalSpent, tt.wantChecking, tt.wantSavings, tt.wantSpent)
+			}
+			if got.BudgetRemaining != got.CheckingBalance+got.SavingsBalance {
+				t.Errorf("got remaining %d; want the sum of the balances", got.BudgetRemaining)
+			}
+			// The budget keeps the version it was read at, for UpdateBudgetInDB
+			if got.Version != 1 {
+				t.Errorf("got version %d; want 1", got.Version)
+			}
+		})
+	}
+}
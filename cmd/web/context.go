@@ -1,5 +1,24 @@
 package main
 
+import "context"
+
 type contextKey string
 
-const isAuthenticatedContextKey = contextKey("isAuthenticated")
+const (
+	isAuthenticatedContextKey = contextKey("isAuthenticated")
+	requestIdContextKey       = contextKey("requestId")
+	apiTokenContextKey        = contextKey("apiToken")
+	// idempotencyCommitContextKey holds the *bool the idempotency middleware
+	// uses to learn that the handler committed a transaction
+	idempotencyCommitContextKey = contextKey("idempotencyCommit")
+)
+
+// Return the request id stored in the context by the requestId middleware,
+// or an empty string if there isn't one
+func requestIdFromContext(ctx context.Context) string {
+	id, ok := ctx.Value(requestIdContextKey).(string)
+	if !ok {
+		return ""
+	}
+	return id
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/legacy"
+	"github.com/pquerna/otp/totp"
+	"kweeuhree.personal-budgeting-backend/docs"
+)
+
+// contractChecker validates the requests to the /api routes, and the
+// responses of the handlers, against docs/openapi.yaml and fails the test on
+// every mismatch. It also records the operations it saw, so that the test
+// can tell which parts of the spec it never reached.
+type contractChecker struct {
+	t       *testing.T
+	doc     *openapi3.T
+	router  routers.Router
+	options *openapi3filter.Options
+
+	mu      sync.Mutex
+	covered map[string]bool
+}
+
+func newContractChecker(t *testing.T) *contractChecker {
+	t.Helper()
+
+	loader := openapi3.NewLoader()
+	doc, err := loader.LoadFromData(docs.OpenAPI)
+	if err != nil {
+		t.Fatalf("loading the OpenAPI spec: %v", err)
+	}
+	if err = doc.Validate(loader.Context); err != nil {
+		t.Fatalf("invalid OpenAPI spec: %v", err)
+	}
+
+	// The test server listens on a random port, so routes are matched on
+	// the path alone
+	doc.Servers = nil
+
+	router, err := legacy.NewRouter(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &contractChecker{
+		t:      t,
+		doc:    doc,
+		router: router,
+		options: &openapi3filter.Options{
+			// Authentication is enforced by the middleware chain
+			AuthenticationFunc:    openapi3filter.NoopAuthenticationFunc,
+			IncludeResponseStatus: true,
+			MultiError:            true,
+		},
+		covered: map[string]bool{},
+	}
+}
+
+// wrap returns a handler that checks every API request and response that
+// goes through next
+func (cc *contractChecker) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		route, pathParams, err := cc.router.FindRoute(r)
+		if err != nil {
+			cc.t.Errorf("%s %s is not in the OpenAPI spec: %v", r.Method, r.URL.Path, err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Hand the validator and the handler a copy of the body each
+		reqBody, err := io.ReadAll(r.Body)
+		if err != nil {
+			cc.t.Fatal(err)
+		}
+
+		requestInput := &openapi3filter.RequestValidationInput{
+			Request:    r.Clone(context.Background()),
+			PathParams: pathParams,
+			Route:      route,
+			Options:    cc.options,
+		}
+		requestInput.Request.Body = io.NopCloser(bytes.NewReader(reqBody))
+		if err := openapi3filter.ValidateRequest(r.Context(), requestInput); err != nil {
+			cc.t.Errorf("request %s %s does not match the spec: %v", r.Method, r.URL.Path, err)
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(reqBody))
+		rec := httptest.NewRecorder()
+		next.ServeHTTP(rec, r)
+
+		responseInput := &openapi3filter.ResponseValidationInput{
+			RequestValidationInput: requestInput,
+			Status:                 rec.Code,
+			Header:                 rec.Header(),
+			Options:                cc.options,
+		}
+		responseInput.SetBodyBytes(rec.Body.Bytes())
+		if err := openapi3filter.ValidateResponse(r.Context(), responseInput); err != nil {
+			cc.t.Errorf("response %d to %s %s does not match the spec: %v", rec.Code, r.Method, r.URL.Path, err)
+		}
+
+		cc.mu.Lock()
+		cc.covered[route.Method+" "+route.Path] = true
+		cc.mu.Unlock()
+
+		for name, values := range rec.Header() {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes())
+	})
+}
+
+// uncovered returns the operations of the spec, on the paths include
+// selects, that no request reached
+func (cc *contractChecker) uncovered(include func(path string) bool) []string {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	var missing []string
+	for path, item := range cc.doc.Paths.Map() {
+		if !include(path) {
+			continue
+		}
+		for method := range item.Operations() {
+			if key := method + " " + path; !cc.covered[key] {
+				missing = append(missing, key)
+			}
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// TestV2Contract sends a request to every v2 route through app.routes(), and
+// fails on any request or response that does not match docs/openapi.yaml
+func TestV2Contract(t *testing.T) {
+	app := newTestApplication(t)
+	cc := newContractChecker(t)
+	ts := newTestServer(t, cc.wrap(app.routes()))
+
+	ts.refreshCSRF(t)
+
+	var csrf struct {
+		CSRFToken string `json:"csrf_token"`
+	}
+	expectStatus(t, "csrf token", ts.doJSON(t, http.MethodGet, "/api/v2/csrf-token", nil, &csrf), http.StatusOK)
+	ts.csrfToken = csrf.CSRFToken
+
+	const email = "contract@example.com"
+	status := ts.doJSON(t, http.MethodPost, "/api/v2/users", map[string]string{
+		"email":       email,
+		"displayName": "Contract Test",
+		"password":    testPassword,
+	}, nil)
+	expectStatus(t, "signup", status, http.StatusOK)
+
+	// A rejected login still answers with a problem that follows the spec
+	status = ts.doJSON(t, http.MethodPost, "/api/v2/sessions", map[string]string{
+		"email":    email,
+		"password": "not-the-password",
+	}, nil)
+	if status < 400 {
+		t.Fatalf("login with a wrong password: status %d", status)
+	}
+
+	status = ts.doJSON(t, http.MethodPost, "/api/v2/sessions", map[string]string{
+		"email":    email,
+		"password": testPassword,
+	}, nil)
+	expectStatus(t, "login", status, http.StatusOK)
+	ts.refreshCSRF(t)
+
+	// Budgets
+	var budget struct {
+		BudgetId string `json:"budgetId"`
+	}
+	status = ts.doJSON(t, http.MethodPost, "/api/v2/budgets", map[string]int64{
+		"checkingBalance": 100000,
+		"savingsBalance":  50000,
+	}, &budget)
+	expectStatus(t, "create budget", status, http.StatusCreated)
+
+	expectStatus(t, "list budgets", ts.doJSON(t, http.MethodGet, "/api/v2/budgets", nil, nil), http.StatusOK)
+	expectStatus(t, "view budget", ts.doJSON(t, http.MethodGet, "/api/v2/budgets/"+budget.BudgetId, nil, nil), http.StatusOK)
+	expectStatus(t, "view missing budget", ts.doJSON(t, http.MethodGet, "/api/v2/budgets/00000000-0000-0000-0000-000000000000", nil, nil), http.StatusNotFound)
+
+	status = ts.doJSON(t, http.MethodPatch, "/api/v2/budgets/"+budget.BudgetId, map[string]any{
+		"updateSumInCents": 2500,
+		"balanceType":      "checkingBalance",
+		"updateType":       "add",
+	}, nil)
+	expectStatus(t, "update budget", status, http.StatusOK)
+
+	// Categories
+	var category struct {
+		ExpenseCategoryId string `json:"expenseCategoryId"`
+	}
+	status = ts.doJSON(t, http.MethodPost, "/api/v2/categories", map[string]string{
+		"name":        "Groceries",
+		"description": "Food and household",
+	}, &category)
+	expectStatus(t, "create category", status, http.StatusCreated)
+
+	expectStatus(t, "list categories", ts.doJSON(t, http.MethodGet, "/api/v2/categories", nil, nil), http.StatusOK)
+	expectStatus(t, "view category", ts.doJSON(t, http.MethodGet, "/api/v2/categories/"+category.ExpenseCategoryId, nil, nil), http.StatusOK)
+
+	status = ts.doJSON(t, http.MethodPatch, "/api/v2/categories/"+category.ExpenseCategoryId, map[string]string{
+		"description": "Food",
+	}, nil)
+	expectStatus(t, "update category", status, http.StatusOK)
+
+	// Expenses
+	var expense struct {
+		ExpenseId string `json:"expenseId"`
+	}
+	status = ts.doJSON(t, http.MethodPost, "/api/v2/expenses", map[string]any{
+		"amountInCents": 1999,
+		"categoryId":    category.ExpenseCategoryId,
+		"expenseType":   "checkingBalance",
+		"description":   "Weekly shop",
+	}, &expense)
+	expectStatus(t, "create expense", status, http.StatusCreated)
+
+	expectStatus(t, "list expenses", ts.doJSON(t, http.MethodGet, "/api/v2/expenses", nil, nil), http.StatusOK)
+	expectStatus(t, "view expense", ts.doJSON(t, http.MethodGet, "/api/v2/expenses/"+expense.ExpenseId, nil, nil), http.StatusOK)
+	expectStatus(t, "list category expenses", ts.doJSON(t, http.MethodGet, "/api/v2/categories/"+category.ExpenseCategoryId+"/expenses", nil, nil), http.StatusOK)
+
+	status = ts.doJSON(t, http.MethodPatch, "/api/v2/expenses/"+expense.ExpenseId, map[string]any{
+		"amountInCents": 2499,
+	}, nil)
+	expectStatus(t, "update expense", status, http.StatusOK)
+
+	expectStatus(t, "delete expense", ts.doJSON(t, http.MethodDelete, "/api/v2/expenses/"+expense.ExpenseId, nil, nil), http.StatusNoContent)
+	expectStatus(t, "delete category", ts.doJSON(t, http.MethodDelete, "/api/v2/categories/"+category.ExpenseCategoryId, nil, nil), http.StatusNoContent)
+	expectStatus(t, "delete budget", ts.doJSON(t, http.MethodDelete, "/api/v2/budgets/"+budget.BudgetId, nil, nil), http.StatusNoContent)
+
+	expectStatus(t, "logout", ts.doJSON(t, http.MethodDelete, "/api/v2/sessions/current", nil, nil), http.StatusOK)
+
+	// Once logged out the protected routes answer with a problem too
+	expectStatus(t, "list budgets after logout", ts.doJSON(t, http.MethodGet, "/api/v2/budgets", nil, nil), http.StatusUnauthorized)
+
+	if missing := cc.uncovered(isV2Path); len(missing) > 0 {
+		t.Errorf("v2 operations not covered by the test: %s", strings.Join(missing, ", "))
+	}
+}
+
+func isV2Path(path string) bool {
+	return strings.HasPrefix(path, "/api/v2/")
+}
+
+// expectStatus fails the test when the status of a step is not the expected one
+func expectStatus(t *testing.T, step string, got, want int) {
+	t.Helper()
+
+	if got != want {
+		t.Fatalf("%s: got status %d; want %d", step, got, want)
+	}
+}
+
+// TestAPIContract sends a request to every route of the spec outside of v2
+// through app.routes(), on an SQLite database, and fails on any request or
+// response that does not match docs/openapi.yaml
+func TestAPIContract(t *testing.T) {
+	app := newSQLiteTestApplication(t)
+	app.webhookAllowPrivate = true
+	cc := newContractChecker(t)
+	ts := newTestServer(t, cc.wrap(app.routes()))
+	useMockProvider(t, app, ts)
+
+	// Users and sessions
+	const email = "contract@example.com"
+	userId := ts.signUpAndLogIn(t, email)
+	password := testPassword
+
+	expectStatus(t, "forgot password", ts.doJSON(t, http.MethodPost, "/api/users/password/forgot", map[string]string{
+		"email": email,
+	}, nil), http.StatusAccepted)
+	expectStatus(t, "reset password with an unknown token", ts.doJSON(t, http.MethodPost, "/api/users/password/reset", map[string]string{
+		"token":    "unknown",
+		"password": "another-password",
+	}, nil), http.StatusBadRequest)
+	expectStatus(t, "verify email with an unknown token", ts.doJSON(t, http.MethodPost, "/api/users/email/verify", map[string]string{
+		"token": "unknown",
+	}, nil), http.StatusBadRequest)
+	// A verification email was just sent by the signup
+	expectStatus(t, "resend verification", ts.doJSON(t, http.MethodPost, "/api/users/email/resend", nil, nil), http.StatusTooManyRequests)
+
+	expectStatus(t, "change display name", ts.doJSON(t, http.MethodPut, "/api/users/account/display-name", map[string]string{
+		"displayName": "Contract",
+	}, nil), http.StatusOK)
+	expectStatus(t, "change email", ts.doJSON(t, http.MethodPut, "/api/users/account/email", map[string]string{
+		"email":           "contract-2@example.com",
+		"currentPassword": password,
+	}, nil), http.StatusOK)
+	expectStatus(t, "change password", ts.doJSON(t, http.MethodPut, "/api/users/account/password", map[string]string{
+		"currentPassword": password,
+		"newPassword":     "a-new-password",
+	}, nil), http.StatusOK)
+	password = "a-new-password"
+	ts.refreshCSRF(t)
+	expectStatus(t, "export account", ts.doJSON(t, http.MethodGet, "/api/users/account/export", nil, nil), http.StatusOK)
+
+	var sessions []struct {
+		SessionId string `json:"sessionId"`
+		Current   bool   `json:"current"`
+	}
+	other := ts.newClient(t)
+	other.refreshCSRF(t)
+	expectStatus(t, "log in elsewhere", other.doJSON(t, http.MethodPost, "/api/users/login", map[string]string{
+		"email":    "contract-2@example.com",
+		"password": password,
+	}, nil), http.StatusOK)
+	expectStatus(t, "list sessions", ts.doJSON(t, http.MethodGet, "/api/users/sessions", nil, &sessions), http.StatusOK)
+	for _, s := range sessions {
+		if !s.Current {
+			expectStatus(t, "end a session", ts.doJSON(t, http.MethodDelete, "/api/users/sessions/"+s.SessionId, nil, nil), http.StatusOK)
+		}
+	}
+
+	// Two-factor authentication
+	expectStatus(t, "two-factor status", ts.doJSON(t, http.MethodGet, "/api/users/2fa", nil, nil), http.StatusOK)
+	var enrollment struct {
+		Secret string `json:"secret"`
+	}
+	expectStatus(t, "enroll in two-factor", ts.doJSON(t, http.MethodPost, "/api/users/2fa/enroll", map[string]string{
+		"currentPassword": password,
+	}, &enrollment), http.StatusOK)
+	expectStatus(t, "confirm two-factor", ts.doJSON(t, http.MethodPost, "/api/users/2fa/confirm", map[string]string{
+		"code": totpCode(t, enrollment.Secret, time.Now()),
+	}, nil), http.StatusOK)
+	expectStatus(t, "disable two-factor", ts.doJSON(t, http.MethodPost, "/api/users/2fa/disable", map[string]string{
+		"currentPassword": password,
+		"code":            totpCode(t, enrollment.Secret, time.Now().Add(totpPeriod*time.Second)),
+	}, nil), http.StatusOK)
+	expectStatus(t, "second factor without a pending login", ts.doJSON(t, http.MethodPost, "/api/users/login/2fa", map[string]string{
+		"code": "123456",
+	}, nil), http.StatusUnauthorized)
+
+	// Single sign-on
+	expectStatus(t, "list providers", ts.doJSON(t, http.MethodGet, "/api/users/sso", nil, nil), http.StatusOK)
+	res, _ := ts.do(t, http.MethodGet, "/api/users/sso/mock", nil)
+	expectStatus(t, "start single sign-on", res.StatusCode, http.StatusFound)
+	res, _ = ts.do(t, http.MethodGet, "/api/users/sso/mock/callback?state=unknown&code=unknown", nil)
+	expectStatus(t, "single sign-on callback with an unknown state", res.StatusCode, http.StatusFound)
+
+	// Budget, categories and expenses
+	var budget struct {
+		BudgetId string `json:"budgetId"`
+	}
+	expectStatus(t, "create budget", ts.doJSON(t, http.MethodPost, "/api/budget/create", map[string]int64{
+		"checkingBalance": 100000,
+		"savingsBalance":  50000,
+	}, &budget), http.StatusCreated)
+	expectStatus(t, "view budget", ts.doJSON(t, http.MethodGet, "/api/budget/"+budget.BudgetId+"/view", nil, nil), http.StatusOK)
+	expectStatus(t, "update budget", ts.doJSON(t, http.MethodPut, "/api/budget/update/"+budget.BudgetId, map[string]any{
+		"updateSumInCents": 2500,
+		"balanceType":      "savingsBalance",
+		"updateType":       "add",
+	}, nil), http.StatusCreated)
+
+	var category struct {
+		ExpenseCategoryId string `json:"expenseCategoryId"`
+	}
+	expectStatus(t, "create category", ts.doJSON(t, http.MethodPost, "/api/categories/create", map[string]string{
+		"name": "Groceries",
+	}, &category), http.StatusCreated)
+	expectStatus(t, "list categories", ts.doJSON(t, http.MethodGet, "/api/categories/view", nil, nil), http.StatusOK)
+
+	var expense struct {
+		ExpenseId string `json:"expenseId"`
+	}
+	expectStatus(t, "create expense", ts.doJSON(t, http.MethodPost, "/api/expenses/create", map[string]any{
+		"amountInCents": 1999,
+		"categoryId":    category.ExpenseCategoryId,
+		"expenseType":   "checkingBalance",
+		"description":   "Weekly shop",
+	}, &expense), http.StatusCreated)
+	expectStatus(t, "list expenses", ts.doJSON(t, http.MethodGet, "/api/expenses/view", nil, nil), http.StatusOK)
+	expectStatus(t, "view expense", ts.doJSON(t, http.MethodGet, "/api/expenses/view/"+expense.ExpenseId, nil, nil), http.StatusOK)
+	expectStatus(t, "list category expenses", ts.doJSON(t, http.MethodGet, "/api/categories/expenses/"+category.ExpenseCategoryId, nil, nil), http.StatusOK)
+	expectStatus(t, "update expense", ts.doJSON(t, http.MethodPut, "/api/expenses/update/"+expense.ExpenseId, map[string]any{
+		"amountInCents": 2499,
+		"categoryId":    category.ExpenseCategoryId,
+		"expenseType":   "checkingBalance",
+		"description":   "Weekly shop",
+	}, nil), http.StatusOK)
+	expectStatus(t, "batch", ts.doJSON(t, http.MethodPost, "/api/expenses/batch", map[string]any{
+		"operations": []map[string]any{
+			{"op": "create", "amountInCents": 500, "categoryId": category.ExpenseCategoryId, "expenseType": "savingsBalance"},
+		},
+	}, nil), http.StatusOK)
+
+	expectStatus(t, "stream with a malformed Last-Event-ID", func() int {
+		ts.header.Set("Last-Event-ID", "latest")
+		defer ts.header.Del("Last-Event-ID")
+		return ts.doJSON(t, http.MethodGet, "/api/events", nil, nil)
+	}(), http.StatusBadRequest)
+	expectStatus(t, "audit log", ts.doJSON(t, http.MethodGet, "/api/audit?entityType=expense", nil, nil), http.StatusOK)
+
+	// Webhooks and tokens
+	var webhook struct {
+		WebhookId string `json:"webhookId"`
+	}
+	expectStatus(t, "create webhook", ts.doJSON(t, http.MethodPost, "/api/webhooks", map[string]any{
+		"url":    "https://127.0.0.1/hooks/budget",
+		"events": []string{"expense.created"},
+	}, &webhook), http.StatusCreated)
+	expectStatus(t, "list webhooks", ts.doJSON(t, http.MethodGet, "/api/webhooks", nil, nil), http.StatusOK)
+	expectStatus(t, "list deliveries", ts.doJSON(t, http.MethodGet, "/api/webhooks/"+webhook.WebhookId+"/deliveries", nil, nil), http.StatusOK)
+	expectStatus(t, "delete webhook", ts.doJSON(t, http.MethodDelete, "/api/webhooks/"+webhook.WebhookId, nil, nil), http.StatusNoContent)
+
+	var token struct {
+		TokenId string `json:"tokenId"`
+	}
+	expectStatus(t, "create token", ts.doJSON(t, http.MethodPost, "/api/users/tokens", map[string]any{
+		"name":   "Contract",
+		"scopes": []string{"budget:read"},
+	}, &token), http.StatusCreated)
+	expectStatus(t, "list tokens", ts.doJSON(t, http.MethodGet, "/api/users/tokens", nil, nil), http.StatusOK)
+	expectStatus(t, "revoke token", ts.doJSON(t, http.MethodDelete, "/api/users/tokens/"+token.TokenId, nil, nil), http.StatusNoContent)
+
+	expectStatus(t, "delete expense", ts.doJSON(t, http.MethodDelete, "/api/expenses/delete/"+expense.ExpenseId, nil, nil), http.StatusOK)
+	expectStatus(t, "delete category", ts.doJSON(t, http.MethodDelete, "/api/categories/delete/"+category.ExpenseCategoryId, nil, nil), http.StatusOK)
+	expectStatus(t, "delete budget", ts.doJSON(t, http.MethodDelete, "/api/budget/delete/"+budget.BudgetId, nil, nil), http.StatusOK)
+
+	// Administration, by an administrator set in ADMIN_USER_IDS
+	admin := ts.newClient(t)
+	adminId := admin.signUpAndLogIn(t, "admin@example.com")
+	app.adminUserIds = []string{adminId}
+
+	expectStatus(t, "check integrity", admin.doJSON(t, http.MethodGet, "/api/admin/integrity?userId="+userId, nil, nil), http.StatusOK)
+	expectStatus(t, "repair integrity", admin.doJSON(t, http.MethodPost, "/api/admin/integrity/repair", map[string]string{
+		"userId": userId,
+	}, nil), http.StatusOK)
+	expectStatus(t, "stats", admin.doJSON(t, http.MethodGet, "/api/admin/stats", nil, nil), http.StatusOK)
+	expectStatus(t, "search users", admin.doJSON(t, http.MethodGet, "/api/admin/users?q=contract", nil, nil), http.StatusOK)
+	expectStatus(t, "view user", admin.doJSON(t, http.MethodGet, "/api/admin/users/"+userId, nil, nil), http.StatusOK)
+	expectStatus(t, "change role", admin.doJSON(t, http.MethodPut, "/api/admin/users/"+userId+"/role", map[string]string{
+		"role": "user",
+	}, nil), http.StatusOK)
+	expectStatus(t, "log out user", admin.doJSON(t, http.MethodPost, "/api/admin/users/"+userId+"/logout", nil, nil), http.StatusOK)
+	expectStatus(t, "disable user", admin.doJSON(t, http.MethodPost, "/api/admin/users/"+userId+"/disable", nil, nil), http.StatusOK)
+	expectStatus(t, "enable user", admin.doJSON(t, http.MethodPost, "/api/admin/users/"+userId+"/enable", nil, nil), http.StatusOK)
+
+	// The user was logged out by the admin
+	expectStatus(t, "export when logged out", ts.doJSON(t, http.MethodGet, "/api/users/account/export", nil, nil), http.StatusUnauthorized)
+	ts.refreshCSRF(t)
+	expectStatus(t, "log in again", ts.doJSON(t, http.MethodPost, "/api/users/login", map[string]string{
+		"email":    "contract-2@example.com",
+		"password": password,
+	}, nil), http.StatusOK)
+	ts.refreshCSRF(t)
+	expectStatus(t, "log out everywhere", ts.doJSON(t, http.MethodDelete, "/api/users/sessions", nil, nil), http.StatusOK)
+
+	other.refreshCSRF(t)
+	expectStatus(t, "log in to delete", other.doJSON(t, http.MethodPost, "/api/users/login", map[string]string{
+		"email":    "contract-2@example.com",
+		"password": password,
+	}, nil), http.StatusOK)
+	other.refreshCSRF(t)
+	expectStatus(t, "delete account", other.doJSON(t, http.MethodDelete, "/api/users/account", map[string]string{
+		"currentPassword": password,
+	}, nil), http.StatusOK)
+
+	admin.refreshCSRF(t)
+	expectStatus(t, "log out", admin.doJSON(t, http.MethodPost, "/api/users/logout", nil, nil), http.StatusOK)
+
+	if missing := cc.uncovered(func(path string) bool { return !isV2Path(path) }); len(missing) > 0 {
+		t.Errorf("operations not covered by the test: %s", strings.Join(missing, ", "))
+	}
+}
+
+// totpCode returns the code of the authenticator app for the secret at t
+func totpCode(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+
+	code, err := totp.GenerateCode(secret, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
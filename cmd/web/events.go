@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"kweeuhree.personal-budgeting-backend/internal/events"
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
+
+const (
+	// eventReplayBuffer is the number of events kept for clients resuming
+	// with Last-Event-ID
+	eventReplayBuffer = 1000
+	// eventHeartbeatInterval keeps idle streams open through proxies, the
+	// session of the stream is checked on every heartbeat
+	eventHeartbeatInterval = 15 * time.Second
+	// eventRetry tells the browser how long to wait before reconnecting
+	eventRetry = 3 * time.Second
+)
+
+// Data of a published event. Every event carries the budget totals after the
+// change, so that dashboards can update without another request.
+type EventPayload struct {
+	Expense    *ExpenseResponse         `json:"expense,omitempty"`
+	ExpenseId  string                   `json:"expenseId,omitempty"`
+	Category   *ExpenseCategoryResponse `json:"category,omitempty"`
+	CategoryId string                   `json:"categoryId,omitempty"`
+	Budget     *BudgetResponse          `json:"budget,omitempty"`
+}
+
+// Publish an event to the open streams and the webhooks of the user. The
+// budget totals are read after the change unless the payload already carries
+// them. Inside withTx the webhook deliveries are part of the transaction and
+// the streams only receive the event once it commits.
+func (app *application) publishEvent(userId, eventType string, payload EventPayload) error {
+	if payload.Budget == nil && eventType != events.BudgetDeleted {
+		budget, err := app.budget.GetBudgetByUserId(userId)
+		if err != nil && !errors.Is(err, models.ErrNoRecord) {
+			app.errorLog.Printf("events: unable to read budget totals for %s: %v", eventType, err)
+		}
+		if budget != nil {
+			response := newBudgetResponse(budget)
+			payload.Budget = &response
+		}
+	}
+
+	// Flash messages belong to the request that caused the change
+	if payload.Expense != nil {
+		payload.Expense.Flash = ""
+	}
+	if payload.Category != nil {
+		payload.Category.Flash = ""
+	}
+	if payload.Budget != nil {
+		payload.Budget.Flash = ""
+	}
+
+	eventId := uuid.New().String()
+	body, err := json.Marshal(WebhookBody{
+		Id:        eventId,
+		Type:      eventType,
+		CreatedAt: time.Now().UTC(),
+		Data:      payload,
+	})
+	if err != nil {
+		return err
+	}
+	err = app.webhooks.Enqueue(userId, eventId, eventType, body)
+	if err != nil {
+		return fmt.Errorf("unable to queue webhook deliveries for %s: %w", eventType, err)
+	}
+
+	if app.pendingEvents != nil {
+		*app.pendingEvents = append(*app.pendingEvents, events.Event{UserId: userId, Type: eventType, Data: payload})
+		return nil
+	}
+	app.events.Publish(userId, eventType, payload)
+	return nil
+}
+
+// stream the changes to the data of the user as server-sent events
+func (app *application) eventsStream(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	// Browsers send the id of the last event they received when reconnecting
+	var lastEventId uint64
+	if header := r.Header.Get("Last-Event-ID"); header != "" {
+		id, err := strconv.ParseUint(header, 10, 64)
+		if err != nil {
+			app.errorResponse(w, r, http.StatusBadRequest, ErrCodeBadRequest, "The Last-Event-ID header must be an event id")
+			return
+		}
+		lastEventId = id
+	}
+
+	// The stream outlives the server's write timeout
+	rc := http.NewResponseController(w)
+	err := rc.SetWriteDeadline(time.Time{})
+	if err != nil {
+		app.serverError(w, r, fmt.Errorf("events: streaming is not supported: %w", err))
+		return
+	}
+
+	sub, missed, ok := app.events.Subscribe(userId, lastEventId)
+	defer app.events.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(w, "retry: %d\n\n", eventRetry.Milliseconds())
+	if !ok {
+		fmt.Fprintf(w, "event: %s\ndata: {}\n\n", events.ResyncRequired)
+	}
+	for _, event := range missed {
+		err = writeEvent(w, event)
+		if err != nil {
+			return
+		}
+	}
+	rc.Flush()
+
+	heartbeat := time.NewTicker(app.eventHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case event, open := <-sub.Events:
+			// The hub dropped us for falling behind, the client reconnects
+			// and resumes with Last-Event-ID
+			if !open {
+				return
+			}
+			err = writeEvent(w, event)
+			if err != nil {
+				return
+			}
+
+		case <-heartbeat.C:
+			// Close the stream once the user logs out, is logged out by an
+			// admin or is disabled. The client then fails to reconnect.
+			var authorized bool
+			authorized, err = app.streamAuthorized(r, userId)
+			if err != nil {
+				app.errorLog.Printf("[%s] events: unable to check the session: %v", requestIdFromContext(r.Context()), err)
+				return
+			}
+			if !authorized {
+				return
+			}
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+			if err != nil {
+				return
+			}
+		}
+
+		err = rc.Flush()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// streamAuthorized reports whether the user is still active and still
+// logged in with the session the stream was opened with. API tokens cannot
+// open streams.
+func (app *application) streamAuthorized(r *http.Request, userId string) (bool, error) {
+	active, err := app.user.IsActive(userId)
+	if err != nil || !active {
+		return false, err
+	}
+
+	_, found, err := app.sessionManager.Store.Find(app.sessionManager.Token(r.Context()))
+	return found, err
+}
+
+// Write a single event in the text/event-stream format
+func writeEvent(w http.ResponseWriter, event events.Event) error {
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Type, data)
+	return err
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openStream opens the event stream of the logged in user and returns a
+// channel of its lines, which is closed when the server ends the stream
+func (ts *testServer) openStream(t *testing.T) <-chan string {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/api/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := ts.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	expectStatus(t, "open stream", res.StatusCode, http.StatusOK)
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	return lines
+}
+
+// waitForLine reads the stream until a line with the prefix arrives
+func waitForLine(t *testing.T, lines <-chan string, prefix string) {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case line, open := <-lines:
+			if !open {
+				t.Fatalf("stream ended before %q", prefix)
+			}
+			if strings.HasPrefix(line, prefix) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %q", prefix)
+		}
+	}
+}
+
+// waitForEnd reads the stream until the server ends it
+func waitForEnd(t *testing.T, lines <-chan string) {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, open := <-lines:
+			if !open {
+				return
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for the stream to end")
+		}
+	}
+}
+
+// The stream checks the session on every heartbeat and ends once the user
+// is no longer logged in with it
+func TestEventsStreamEndsWithSession(t *testing.T) {
+	tests := []struct {
+		name string
+		end  func(t *testing.T, app *application, ts *testServer, userId string)
+	}{
+		{
+			name: "logout",
+			end: func(t *testing.T, app *application, ts *testServer, userId string) {
+				status := ts.doJSON(t, http.MethodPost, "/api/users/logout", nil, nil)
+				expectStatus(t, "logout", status, http.StatusOK)
+			},
+		},
+		{
+			name: "logged out from another session",
+			end: func(t *testing.T, app *application, ts *testServer, userId string) {
+				other := ts.newClient(t)
+				other.logIn(t, "stream@example.com")
+				status := other.doJSON(t, http.MethodDelete, "/api/users/sessions", nil, nil)
+				expectStatus(t, "end other sessions", status, http.StatusOK)
+			},
+		},
+		{
+			name: "disabled",
+			end: func(t *testing.T, app *application, ts *testServer, userId string) {
+				err := app.user.SetDisabled(userId, true)
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.eventHeartbeat = 20 * time.Millisecond
+			ts := newTestServer(t, app.routes())
+			userId := ts.signUpAndLogIn(t, "stream@example.com")
+
+			lines := ts.openStream(t)
+			waitForLine(t, lines, "retry:")
+
+			status := ts.doJSON(t, http.MethodPost, "/api/v2/budgets", map[string]int64{"checkingBalance": 1000}, nil)
+			expectStatus(t, "create budget", status, http.StatusCreated)
+			waitForLine(t, lines, "event: budget.created")
+			waitForLine(t, lines, ": heartbeat")
+
+			tt.end(t, app, ts, userId)
+			waitForEnd(t, lines)
+		})
+	}
+}
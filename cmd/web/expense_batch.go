@@ -0,0 +1,526 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"kweeuhree.personal-budgeting-backend/internal/events"
+	"kweeuhree.personal-budgeting-backend/internal/models"
+	"kweeuhree.personal-budgeting-backend/internal/validator"
+)
+
+const (
+	// BatchModeAtomic applies every operation of a batch or none of them
+	BatchModeAtomic = "atomic"
+	// BatchModeBestEffort applies the operations that succeed and reports the others
+	BatchModeBestEffort = "bestEffort"
+)
+
+const (
+	BatchOpCreate       = "create"
+	BatchOpUpdate       = "update"
+	BatchOpDelete       = "delete"
+	BatchOpRecategorize = "recategorize"
+)
+
+const maxBatchOperations = 100
+
+// Input struct for batches of expense operations
+type ExpenseBatchInput struct {
+	Mode                string                  `json:"mode" validate:"oneof=atomic|bestEffort"`
+	Operations          []ExpenseBatchOperation `json:"operations"`
+	validator.Validator `json:"-"`
+}
+
+// A single operation of a batch. Create needs the fields of a new expense,
+// update changes the fields that are present, delete only needs the
+// expenseId, and recategorize moves the expense to categoryId.
+type ExpenseBatchOperation struct {
+	Op                  string  `json:"op" validate:"required,oneof=create|update|delete|recategorize"`
+	ExpenseId           string  `json:"expenseId" validate:"uuid"`
+	CategoryId          *string `json:"categoryId" validate:"required,uuid"`
+	Description         *string `json:"description" validate:"maxchars=255"`
+	AmountInCents       *int64  `json:"amountInCents" validate:"positive,max=100000000000000"`
+	ExpenseType         *string `json:"expenseType" validate:"required,oneof=checkingBalance|savingsBalance"`
+	validator.Validator `json:"-"`
+}
+
+// Outcome of a single operation, status is the HTTP status the operation
+// would have had as a request of its own
+type ExpenseBatchResult struct {
+	Index   int              `json:"index"`
+	Op      string           `json:"op"`
+	Status  int              `json:"status"`
+	Expense *ExpenseResponse `json:"expense,omitempty"`
+	Error   *Problem         `json:"error,omitempty"`
+}
+
+// Response struct for returning the outcome of a batch
+type ExpenseBatchResponse struct {
+	Mode    string               `json:"mode"`
+	Applied int                  `json:"applied"`
+	Failed  int                  `json:"failed"`
+	Results []ExpenseBatchResult `json:"results"`
+	Budget  *BudgetResponse      `json:"budget,omitempty"`
+}
+
+var errUnknownCategory = errors.New("unknown expense category")
+
+// apply several expense operations in one transaction
+func (app *application) expenseBatch(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	var input ExpenseBatchInput
+	err := decodeJSON(w, r, &input)
+	if err != nil {
+		return
+	}
+
+	input.Validate()
+	if !input.Valid() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+	if input.Mode == "" {
+		input.Mode = BatchModeAtomic
+	}
+
+	plan, err := app.newExpenseBatchPlan(userId)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	results := make([]ExpenseBatchResult, len(input.Operations))
+	failed := 0
+	for i := range input.Operations {
+		results[i] = plan.apply(i, &input.Operations[i])
+		if results[i].Error != nil {
+			failed++
+		}
+	}
+
+	if failed > 0 && input.Mode == BatchModeAtomic {
+		for i := range results {
+			if results[i].Error == nil {
+				results[i].Status = http.StatusFailedDependency
+				results[i].Expense = nil
+				results[i].Error = newProblem(http.StatusFailedDependency, ErrCodeBatchAborted, "Not applied because another operation of the batch failed")
+			}
+		}
+		p := newProblem(http.StatusUnprocessableEntity, ErrCodeBatchFailed, "No operation was applied because at least one of them failed")
+		p.Results = results
+		writeProblem(w, r, p)
+		return
+	}
+
+	response := ExpenseBatchResponse{
+		Mode:    input.Mode,
+		Applied: len(results) - failed,
+		Failed:  failed,
+		Results: results,
+	}
+
+	err = app.withTx(r, func(tx *application) error {
+		if response.Applied > 0 {
+			err := tx.expenses.ApplyBatch(plan.batch())
+			if err != nil {
+				return err
+			}
+
+			err = tx.auditBatch(plan)
+			if err != nil {
+				return err
+			}
+		}
+
+		if plan.budgetChanged {
+			budget, err := tx.budget.GetBudgetByUserId(userId)
+			if err != nil {
+				return err
+			}
+			budgetResponse := newBudgetResponse(budget)
+			response.Budget = &budgetResponse
+		}
+
+		return tx.publishBatchEvents(userId, &input, &response)
+	})
+	if err != nil {
+		if errors.Is(err, models.ErrVersionConflict) {
+			app.errorResponse(w, r, http.StatusConflict, ErrCodeEditConflict, "Your expenses changed while the batch was applied, please retry")
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	encodeJSON(w, http.StatusOK, response)
+}
+
+// Publish an event for every applied operation of the batch. They all carry
+// the budget totals after the whole batch.
+func (app *application) publishBatchEvents(userId string, input *ExpenseBatchInput, response *ExpenseBatchResponse) error {
+	budget := response.Budget
+	if budget == nil {
+		budget = &BudgetResponse{}
+		current, err := app.budget.GetBudgetByUserId(userId)
+		if err != nil && !errors.Is(err, models.ErrNoRecord) {
+			app.errorLog.Printf("events: unable to read budget totals for batch: %v", err)
+		}
+		if current != nil {
+			*budget = newBudgetResponse(current)
+		} else {
+			budget = nil
+		}
+	}
+
+	for _, result := range response.Results {
+		if result.Error != nil {
+			continue
+		}
+
+		var err error
+		payload := EventPayload{Budget: budget, Expense: result.Expense}
+		switch result.Op {
+		case BatchOpCreate:
+			err = app.publishEvent(userId, events.ExpenseCreated, payload)
+		case BatchOpUpdate, BatchOpRecategorize:
+			err = app.publishEvent(userId, events.ExpenseUpdated, payload)
+		case BatchOpDelete:
+			payload.ExpenseId = input.Operations[result.Index].ExpenseId
+			err = app.publishEvent(userId, events.ExpenseDeleted, payload)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Record every change of an applied batch in the audit log, an expense
+// changed by several operations gets a single entry
+func (app *application) auditBatch(plan *expenseBatchPlan) error {
+	userId := plan.userId
+
+	for _, expenseId := range plan.createdIds {
+		if !plan.created[expenseId] {
+			continue
+		}
+		after := *plan.expenses[expenseId]
+		after.Version = 1
+		err := app.audit(userId, models.AuditActionCreate, models.AuditEntityExpense, expenseId, nil, snapshotExpense(&after))
+		if err != nil {
+			return err
+		}
+	}
+
+	for expenseId := range plan.updated {
+		after := *plan.expenses[expenseId]
+		after.Version = plan.expenseVersions[expenseId] + 1
+		err := app.audit(userId, models.AuditActionUpdate, models.AuditEntityExpense, expenseId, snapshotExpense(plan.originalExpenses[expenseId]), snapshotExpense(&after))
+		if err != nil {
+			return err
+		}
+	}
+
+	for expenseId := range plan.deleted {
+		err := app.audit(userId, models.AuditActionDelete, models.AuditEntityExpense, expenseId, snapshotExpense(plan.originalExpenses[expenseId]), nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	if plan.budgetChanged {
+		after := *plan.budget
+		after.Version = plan.originalBudget.Version + 1
+		err := app.audit(userId, models.AuditActionUpdate, models.AuditEntityBudget, after.BudgetId, snapshotBudget(plan.originalBudget), snapshotBudget(&after))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// expenseBatchPlan applies the operations of a batch to an in-memory copy of
+// the budget, categories and expenses of the user. Budget and category total
+// changes are aggregated, so that each is written once however many
+// operations touched it.
+type expenseBatchPlan struct {
+	userId        string
+	budget        *models.Budget
+	budgetChanged bool
+	// the budget and expenses as they were read, for the audit log
+	originalBudget   *models.Budget
+	originalExpenses map[string]*models.Expense
+	// the categories of the user, and how much the totals of the ones the
+	// batch touched change
+	categories      map[string]bool
+	categoryDeltas  map[string]int64
+	expenses        map[string]*models.Expense
+	createdIds      []string
+	created         map[string]bool
+	updated         map[string]bool
+	deleted         map[string]*models.Expense
+	expenseVersions map[string]int
+}
+
+func (app *application) newExpenseBatchPlan(userId string) (*expenseBatchPlan, error) {
+	plan := &expenseBatchPlan{
+		userId:           userId,
+		categories:       map[string]bool{},
+		categoryDeltas:   map[string]int64{},
+		expenses:         map[string]*models.Expense{},
+		created:          map[string]bool{},
+		updated:          map[string]bool{},
+		deleted:          map[string]*models.Expense{},
+		expenseVersions:  map[string]int{},
+		originalExpenses: map[string]*models.Expense{},
+	}
+
+	budget, err := app.budget.GetBudgetByUserId(userId)
+	if err != nil && !errors.Is(err, models.ErrNoRecord) {
+		return nil, err
+	}
+	plan.budget = budget
+	plan.originalBudget = budget
+
+	cats, err := app.expenseCategory.All(userId)
+	if err != nil {
+		return nil, err
+	}
+	for _, cat := range cats {
+		plan.categories[cat.ExpenseCategoryId] = true
+	}
+
+	exps, err := app.expenses.All(userId)
+	if err != nil {
+		return nil, err
+	}
+	for _, exp := range exps {
+		plan.expenses[exp.ExpenseId] = exp
+		plan.expenseVersions[exp.ExpenseId] = exp.Version
+		plan.originalExpenses[exp.ExpenseId] = exp
+	}
+
+	return plan, nil
+}
+
+// apply validates and applies a single operation. A failed operation leaves
+// the plan untouched, so that best-effort batches can carry on.
+func (plan *expenseBatchPlan) apply(index int, op *ExpenseBatchOperation) ExpenseBatchResult {
+	result := ExpenseBatchResult{Index: index, Op: op.Op}
+
+	op.Validate()
+	if !op.Valid() {
+		result.Status = http.StatusBadRequest
+		result.Error = newProblem(http.StatusBadRequest, ErrCodeValidation, "One or more fields are invalid")
+		result.Error.FieldErrors = op.FieldErrors
+		return result
+	}
+
+	var exp *models.Expense
+	var err error
+	switch op.Op {
+	case BatchOpCreate:
+		exp, err = plan.create(op)
+		result.Status = http.StatusCreated
+	case BatchOpUpdate, BatchOpRecategorize:
+		exp, err = plan.update(op)
+		result.Status = http.StatusOK
+	case BatchOpDelete:
+		err = plan.delete(op.ExpenseId)
+		result.Status = http.StatusNoContent
+	}
+
+	if err != nil {
+		result.Error = batchItemProblem(err)
+		result.Status = result.Error.Status
+		return result
+	}
+
+	if exp != nil {
+		response := newExpenseResponse(exp)
+		// The expense is written once, whatever number of operations changed it
+		response.Version = plan.expenseVersions[exp.ExpenseId] + 1
+		result.Expense = &response
+	}
+	return result
+}
+
+func (plan *expenseBatchPlan) create(op *ExpenseBatchOperation) (*models.Expense, error) {
+	exp := &models.Expense{
+		ExpenseId:     uuid.New().String(),
+		UserId:        plan.userId,
+		CategoryId:    *op.CategoryId,
+		ExpenseType:   *op.ExpenseType,
+		AmountInCents: *op.AmountInCents,
+		CreatedAt:     time.Now().UTC(),
+	}
+	if op.Description != nil {
+		exp.Description = *op.Description
+	}
+
+	err := plan.move(&models.Expense{}, exp)
+	if err != nil {
+		return nil, err
+	}
+
+	plan.expenses[exp.ExpenseId] = exp
+	plan.createdIds = append(plan.createdIds, exp.ExpenseId)
+	plan.created[exp.ExpenseId] = true
+	return exp, nil
+}
+
+func (plan *expenseBatchPlan) update(op *ExpenseBatchOperation) (*models.Expense, error) {
+	current, ok := plan.expenses[op.ExpenseId]
+	if !ok {
+		return nil, models.ErrNoRecord
+	}
+
+	updated := *current
+	if op.CategoryId != nil {
+		updated.CategoryId = *op.CategoryId
+	}
+	// recategorize only moves the expense to another category
+	if op.Op == BatchOpUpdate {
+		if op.Description != nil {
+			updated.Description = *op.Description
+		}
+		if op.ExpenseType != nil {
+			updated.ExpenseType = *op.ExpenseType
+		}
+		if op.AmountInCents != nil {
+			updated.AmountInCents = *op.AmountInCents
+		}
+	}
+
+	err := plan.move(current, &updated)
+	if err != nil {
+		return nil, err
+	}
+
+	plan.expenses[updated.ExpenseId] = &updated
+	if !plan.created[updated.ExpenseId] {
+		plan.updated[updated.ExpenseId] = true
+	}
+	return &updated, nil
+}
+
+func (plan *expenseBatchPlan) delete(expenseId string) error {
+	current, ok := plan.expenses[expenseId]
+	if !ok {
+		return models.ErrNoRecord
+	}
+
+	err := plan.move(current, &models.Expense{})
+	if err != nil {
+		return err
+	}
+
+	delete(plan.expenses, expenseId)
+	if plan.created[expenseId] {
+		delete(plan.created, expenseId)
+		return nil
+	}
+	delete(plan.updated, expenseId)
+	plan.deleted[expenseId] = current
+	return nil
+}
+
+// move takes the money of the current expense out of the budget and the
+// category totals, and puts the money of the updated one in. A zero Expense
+// stands for no expense, so create and delete are moves too.
+func (plan *expenseBatchPlan) move(current, updated *models.Expense) error {
+	if updated.CategoryId != "" {
+		if !plan.categories[updated.CategoryId] {
+			return errUnknownCategory
+		}
+	}
+
+	moneyMoved := current.AmountInCents != updated.AmountInCents ||
+		current.ExpenseType != updated.ExpenseType
+
+	var budget models.Budget
+	if moneyMoved {
+		if plan.budget == nil {
+			return models.ErrNoBudget
+		}
+		budget = *plan.budget
+		if current.AmountInCents > 0 {
+			budget = applyBudgetUpdate(budget, UpdateTypeAdd, current.ExpenseType, current.AmountInCents, true)
+		}
+		if updated.AmountInCents > 0 {
+			if balanceOf(&budget, updated.ExpenseType) < updated.AmountInCents {
+				return models.ErrInsufficientFunds
+			}
+			budget = applyBudgetUpdate(budget, UpdateTypeSubtract, updated.ExpenseType, updated.AmountInCents, true)
+		}
+	}
+
+	// Every check passed, the operation can now change the plan
+	if moneyMoved {
+		plan.budget = &budget
+		plan.budgetChanged = true
+	}
+	if current.CategoryId != updated.CategoryId || current.AmountInCents != updated.AmountInCents {
+		if current.CategoryId != "" {
+			plan.categoryDeltas[current.CategoryId] -= current.AmountInCents
+		}
+		if updated.CategoryId != "" {
+			plan.categoryDeltas[updated.CategoryId] += updated.AmountInCents
+		}
+	}
+
+	return nil
+}
+
+// batch returns the combined changes of every applied operation
+func (plan *expenseBatchPlan) batch() *models.ExpenseBatch {
+	batch := &models.ExpenseBatch{
+		UserId:         plan.userId,
+		CategoryDeltas: map[string]int64{},
+	}
+
+	for _, id := range plan.createdIds {
+		if plan.created[id] {
+			batch.Created = append(batch.Created, plan.expenses[id])
+		}
+	}
+	for id := range plan.updated {
+		exp := *plan.expenses[id]
+		exp.Version = plan.expenseVersions[id]
+		batch.Updated = append(batch.Updated, &exp)
+	}
+	for _, exp := range plan.deleted {
+		batch.Deleted = append(batch.Deleted, exp)
+	}
+
+	if plan.budgetChanged {
+		batch.Budget = plan.budget
+	}
+	for id, delta := range plan.categoryDeltas {
+		batch.CategoryDeltas[id] = delta
+	}
+
+	return batch
+}
+
+// batchItemProblem describes why a single operation of a batch failed
+func batchItemProblem(err error) *Problem {
+	if errors.Is(err, models.ErrNoRecord) {
+		return newProblem(http.StatusNotFound, ErrCodeNotFound, "No expense with this id")
+	}
+	if errors.Is(err, errUnknownCategory) {
+		p := newProblem(http.StatusUnprocessableEntity, ErrCodeValidation, "One or more fields are invalid")
+		p.FieldErrors = map[string]string{"categoryId": "This category does not exist"}
+		return p
+	}
+	if p := budgetProblem(err, "amountInCents", "expenseType"); p != nil {
+		return p
+	}
+	return newProblem(http.StatusInternalServerError, ErrCodeInternal, "")
+}
@@ -6,15 +6,23 @@ import (
 	"net/http"
 
 	"github.com/google/uuid" // router
+	"kweeuhree.personal-budgeting-backend/internal/events"
 	"kweeuhree.personal-budgeting-backend/internal/models"
 	"kweeuhree.personal-budgeting-backend/internal/validator"
 )
 
 // Input struct for creating and updating ExpenseCategorys
 type ExpenseCategoryInput struct {
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	validator.Validator
+	Name                string `json:"name" validate:"required,maxchars=100"`
+	Description         string `json:"description" validate:"maxchars=255"`
+	validator.Validator `json:"-"`
+}
+
+// Input struct for patching ExpenseCategorys, fields left out of the request are nil
+type ExpenseCategoryPatch struct {
+	Name                *string `json:"name" validate:"required,maxchars=100"`
+	Description         *string `json:"description" validate:"maxchars=255"`
+	validator.Validator `json:"-"`
 }
 
 // // Response struct for returning ExpenseCategory data
@@ -23,31 +31,37 @@ type ExpenseCategoryResponse struct {
 	Name              string `json:"name"`
 	Description       string `json:"description"`
 	TotalSum          int64  `json:"totalSum"`
+	Version           int    `json:"version"`
 	Flash             string `json:"flash"`
 }
 
+func newExpenseCategoryResponse(cat *models.ExpenseCategory) ExpenseCategoryResponse {
+	return ExpenseCategoryResponse{
+		ExpenseCategoryId: cat.ExpenseCategoryId,
+		Name:              cat.Name,
+		Description:       cat.Description,
+		TotalSum:          cat.TotalSum,
+		Version:           cat.Version,
+	}
+}
+
 // read all user categories
 func (app *application) categoriesView(w http.ResponseWriter, r *http.Request) {
 	userId := app.sessionManager.Get(r.Context(), "authenticatedUserID").(string)
 	if userId == "" {
-		app.serverError(w, fmt.Errorf("userId not found in session"))
+		app.serverError(w, r, fmt.Errorf("userId not found in session"))
 		return
 	}
 
 	cats, err := app.expenseCategory.All(userId)
 	if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 		return
 	}
 
 	response := make([]ExpenseCategoryResponse, len(cats))
 	for i, cat := range cats {
-		response[i] = ExpenseCategoryResponse{
-			ExpenseCategoryId: cat.ExpenseCategoryId,
-			Name:              cat.Name,
-			Description:       cat.Description,
-			TotalSum:          cat.TotalSum,
-		}
+		response[i] = newExpenseCategoryResponse(cat)
 	}
 
 	encodeJSON(w, http.StatusOK, response)
@@ -57,7 +71,7 @@ func (app *application) categoriesView(w http.ResponseWriter, r *http.Request) {
 func (app *application) specificCategoryExpensesView(w http.ResponseWriter, r *http.Request) {
 	id := app.GetIdFromParams(r, "categoryId")
 	if id == "" {
-		app.notFound(w)
+		app.notFound(w, r)
 		return
 	}
 
@@ -65,9 +79,9 @@ func (app *application) specificCategoryExpensesView(w http.ResponseWriter, r *h
 
 	if err != nil {
 		if errors.Is(err, models.ErrNoRecord) {
-			app.notFound(w)
+			app.notFound(w, r)
 		} else {
-			app.serverError(w, err)
+			app.serverError(w, r, err)
 		}
 		return
 	}
@@ -89,7 +103,7 @@ func (app *application) specificCategoryExpensesView(w http.ResponseWriter, r *h
 func (app *application) categoryCreate(w http.ResponseWriter, r *http.Request) {
 	userId := app.sessionManager.Get(r.Context(), "authenticatedUserID").(string)
 	if userId == "" {
-		app.serverError(w, fmt.Errorf("userId not found in session"))
+		app.serverError(w, r, fmt.Errorf("userId not found in session"))
 		return
 	}
 
@@ -102,53 +116,154 @@ func (app *application) categoryCreate(w http.ResponseWriter, r *http.Request) {
 	// validate input
 	input.Validate()
 	if !input.Valid() {
-		encodeJSON(w, http.StatusBadRequest, input.FieldErrors)
+		app.failedValidation(w, r, input.Validator)
 		return
 	}
 
 	newId := uuid.New().String()
 
-	// Insert the new ExpenseCategory using the ID and body
-	newExpenseCategoryId, err := app.expenseCategory.Insert(newId, userId, input.Name, input.Description, 0)
-	if err != nil {
-		app.serverError(w, err)
-		return
-	}
-
-	app.setFlash(r.Context(), "Expense category has been created.")
-
 	// Create a response that includes both ID and body
 	response := ExpenseCategoryResponse{
-		ExpenseCategoryId: newExpenseCategoryId,
+		ExpenseCategoryId: newId,
 		Name:              input.Name,
 		Description:       input.Description,
 		TotalSum:          0,
-		Flash:             app.getFlash(r.Context()),
+		Version:           1,
+	}
+
+	// Insert the new ExpenseCategory using the ID and body
+	err = app.withTx(r, func(tx *application) error {
+		_, err := tx.expenseCategory.Insert(newId, userId, input.Name, input.Description, 0)
+		if err != nil {
+			return err
+		}
+		err = tx.audit(userId, models.AuditActionCreate, models.AuditEntityCategory, newId, nil, categorySnapshot{
+			ExpenseCategoryId: newId,
+			Name:              input.Name,
+			Description:       input.Description,
+			Version:           1,
+		})
+		if err != nil {
+			return err
+		}
+
+		category := response
+		return tx.publishEvent(userId, events.CategoryCreated, EventPayload{Category: &category})
+	})
+	if err != nil {
+		app.serverError(w, r, err)
+		return
 	}
 
+	app.setFlash(r.Context(), "Expense category has been created.")
+	response.Flash = app.getFlash(r.Context())
+
 	// Write the response struct to the response as JSON
+	w.Header().Set("ETag", etag(response.Version))
 	encodeJSON(w, http.StatusCreated, response)
 }
 
+// patch, only replaces the fields present in the request body
+func (app *application) categoryPatch(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	categoryId := app.GetIdFromParams(r, "categoryId")
+	if categoryId == "" {
+		app.notFound(w, r)
+		return
+	}
+
+	cat, err := app.expenseCategory.Get(categoryId)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w, r)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+	if cat.UserId != userId {
+		app.notFound(w, r)
+		return
+	}
+
+	// Refuse the update if the client edited an older version of the category
+	if !app.checkIfMatch(w, r, cat.Version) {
+		return
+	}
+
+	var input ExpenseCategoryPatch
+	err = decodeJSON(w, r, &input)
+	if err != nil {
+		return
+	}
+
+	input.Validate()
+	if !input.Valid() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+
+	before := snapshotCategory(cat)
+	if input.Name != nil {
+		cat.Name = *input.Name
+	}
+	if input.Description != nil {
+		cat.Description = *input.Description
+	}
+
+	err = app.withTx(r, func(tx *application) error {
+		err := tx.expenseCategory.PutIfVersion(userId, categoryId, cat.Version, cat.Name, cat.Description)
+		if err != nil {
+			return err
+		}
+		cat.Version++
+
+		err = tx.audit(userId, models.AuditActionUpdate, models.AuditEntityCategory, categoryId, before, snapshotCategory(cat))
+		if err != nil {
+			return err
+		}
+
+		category := newExpenseCategoryResponse(cat)
+		return tx.publishEvent(userId, events.CategoryUpdated, EventPayload{Category: &category})
+	})
+	if err != nil {
+		if errors.Is(err, models.ErrVersionConflict) {
+			app.versionConflict(w, r)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	app.setFlash(r.Context(), "Category has been updated.")
+
+	response := newExpenseCategoryResponse(cat)
+	response.Flash = app.getFlash(r.Context())
+
+	w.Header().Set("ETag", etag(cat.Version))
+	encodeJSON(w, http.StatusOK, response)
+}
+
 // delete
 func (app *application) categoryDelete(w http.ResponseWriter, r *http.Request) {
 	userId := app.sessionManager.Get(r.Context(), "authenticatedUserID").(string)
 	if userId == "" {
-		app.serverError(w, fmt.Errorf("userId not found in session"))
+		app.serverError(w, r, fmt.Errorf("userId not found in session"))
 		return
 	}
 
 	categoryId := app.GetIdFromParams(r, "categoryId")
 	if categoryId == "" {
-		app.notFound(w)
+		app.notFound(w, r)
 		app.infoLog.Printf("Exiting due to invalid id")
 		return
 	}
 
 	app.infoLog.Printf("Attempting to delete all expenses per category...")
-	err := app.DeleteAllExpensesByCategory(categoryId, userId)
+	err := app.DeleteAllExpensesByCategory(r, categoryId, userId)
 	if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 		return
 	}
 
@@ -1,6 +1,13 @@
 package main
 
-import "log"
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"kweeuhree.personal-budgeting-backend/internal/events"
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
 
 const (
 	Increment = "increment"
@@ -41,15 +48,42 @@ func calculateTotalSum(currentTotalSum, amount int64, updateType string) int64 {
 	return total
 }
 
-func (app *application) DeleteAllExpensesByCategory(categoryId, userId string) error {
-	err := app.expenses.DeleteAllByCategory(userId, categoryId)
-	if err != nil {
-		return err
-	}
-	err = app.expenseCategory.Delete(categoryId, userId)
-	if err != nil {
-		return err
-	}
+func (app *application) DeleteAllExpensesByCategory(r *http.Request, categoryId, userId string) error {
+	return app.withTx(r, func(tx *application) error {
+		cat, err := tx.expenseCategory.Get(categoryId)
+		if err != nil && !errors.Is(err, models.ErrNoRecord) {
+			return err
+		}
+		// The user has no such category, there is nothing to delete
+		if cat == nil || cat.UserId != userId {
+			return nil
+		}
 
-	return nil
+		exps, err := tx.expenseCategory.AllExpensesPerCategory(categoryId)
+		if err != nil {
+			return err
+		}
+
+		err = tx.expenses.DeleteAllByCategory(userId, categoryId)
+		if err != nil {
+			return err
+		}
+		for _, exp := range exps {
+			err = tx.audit(userId, models.AuditActionDelete, models.AuditEntityExpense, exp.ExpenseId, snapshotExpense(exp), nil)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = tx.expenseCategory.Delete(categoryId, userId)
+		if err != nil {
+			return err
+		}
+		err = tx.audit(userId, models.AuditActionDelete, models.AuditEntityCategory, categoryId, snapshotCategory(cat), nil)
+		if err != nil {
+			return err
+		}
+
+		return tx.publishEvent(userId, events.CategoryDeleted, EventPayload{CategoryId: categoryId})
+	})
 }
@@ -8,17 +8,27 @@ import (
 	"time"
 
 	"github.com/google/uuid" // router
+	"kweeuhree.personal-budgeting-backend/internal/events"
 	"kweeuhree.personal-budgeting-backend/internal/models"
 	"kweeuhree.personal-budgeting-backend/internal/validator"
 )
 
 // Input struct for creating and updating expenses
 type ExpenseInput struct {
-	Description   string `json:"description"`
-	AmountInCents int64  `json:"amountInCents"`
-	CategoryId    string `json:"categoryId"`
-	ExpenseType   string `json:"expenseType"`
-	validator.Validator
+	Description         string `json:"description" validate:"maxchars=255"`
+	AmountInCents       int64  `json:"amountInCents" validate:"positive,max=100000000000000"`
+	CategoryId          string `json:"categoryId" validate:"required,uuid"`
+	ExpenseType         string `json:"expenseType" validate:"required,oneof=checkingBalance|savingsBalance"`
+	validator.Validator `json:"-"`
+}
+
+// Input struct for patching expenses, fields left out of the request are nil
+type ExpensePatch struct {
+	Description         *string `json:"description" validate:"maxchars=255"`
+	AmountInCents       *int64  `json:"amountInCents" validate:"positive,max=100000000000000"`
+	CategoryId          *string `json:"categoryId" validate:"required,uuid"`
+	ExpenseType         *string `json:"expenseType" validate:"required,oneof=checkingBalance|savingsBalance"`
+	validator.Validator `json:"-"`
 }
 
 // // Response struct for returning expense data
@@ -28,6 +38,7 @@ type ExpenseResponse struct {
 	AmountInCents int64     `json:"amountInCents"`
 	Description   string    `json:"description"`
 	ExpenseType   string    `json:"expenseType"`
+	Version       int       `json:"version"`
 	CreatedAt     time.Time `json:"createdAt"`
 	Flash         string    `json:"flash"`
 }
@@ -36,26 +47,19 @@ type ExpenseResponse struct {
 func (app *application) expensesView(w http.ResponseWriter, r *http.Request) {
 	userId := app.sessionManager.Get(r.Context(), "authenticatedUserID").(string)
 	if userId == "" {
-		app.serverError(w, fmt.Errorf("userId not found in session"))
+		app.serverError(w, r, fmt.Errorf("userId not found in session"))
 		return
 	}
 
 	exps, err := app.expenses.All(userId)
 	if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 		return
 	}
 
 	response := make([]ExpenseResponse, len(exps))
 	for i, exp := range exps {
-		response[i] = ExpenseResponse{
-			ExpenseId:     exp.ExpenseId,
-			CategoryId:    &exp.CategoryId,
-			AmountInCents: exp.AmountInCents,
-			Description:   exp.Description,
-			ExpenseType:   exp.ExpenseType,
-			CreatedAt:     exp.CreatedAt,
-		}
+		response[i] = newExpenseResponse(exp)
 	}
 
 	encodeJSON(w, http.StatusOK, response)
@@ -63,10 +67,11 @@ func (app *application) expensesView(w http.ResponseWriter, r *http.Request) {
 
 // read a specific user expense
 func (app *application) specificExpenseView(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
 	id := app.GetIdFromParams(r, "expenseId")
 
 	if id == "" {
-		app.notFound(w)
+		app.notFound(w, r)
 		return
 	}
 
@@ -74,14 +79,21 @@ func (app *application) specificExpenseView(w http.ResponseWriter, r *http.Reque
 
 	if err != nil {
 		if errors.Is(err, models.ErrNoRecord) {
-			app.notFound(w)
+			app.notFound(w, r)
 		} else {
-			app.serverError(w, err)
+			app.serverError(w, r, err)
 		}
 		return
 	}
 
+	// Other users' expenses are reported as not found
+	if exp.UserId != userId {
+		app.notFound(w, r)
+		return
+	}
+
 	// write the Expense data as a plain-text HTTP response body
+	w.Header().Set("ETag", etag(exp.Version))
 	encodeJSON(w, http.StatusOK, exp)
 }
 
@@ -90,7 +102,7 @@ func (app *application) expenseCreate(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Attempting to create an expense")
 	userId := app.sessionManager.Get(r.Context(), "authenticatedUserID").(string)
 	if userId == "" {
-		app.serverError(w, fmt.Errorf("userId not found in session"))
+		app.serverError(w, r, fmt.Errorf("userId not found in session"))
 		return
 	}
 
@@ -106,70 +118,86 @@ func (app *application) expenseCreate(w http.ResponseWriter, r *http.Request) {
 	// validate input
 	input.Validate()
 	if !input.Valid() {
-		encodeJSON(w, http.StatusBadRequest, input.FieldErrors)
+		app.failedValidation(w, r, input.Validator)
 		return
 	}
 
 	// validate the input against existing balance
 	err = app.CurrentBudgetIsValid(userId, input.ExpenseType, input.AmountInCents)
-
 	if err != nil {
-		app.serverError(w, fmt.Errorf("failed to update current budget: %v", err))
+		app.budgetError(w, r, err, "amountInCents", "expenseType")
 		return
 	}
 
 	newId := uuid.New().String()
 
-	id, err := app.expenses.Insert(newId, userId, input.CategoryId, input.Description, input.ExpenseType, input.AmountInCents)
-	if err != nil {
-		app.serverError(w, fmt.Errorf("unable to add an expense %d; %s", input.AmountInCents, err))
-		return
-	}
-	// Update the budget in the database
-	err = app.CalculateAndUpdateBudget(userId, UpdateTypeSubtract, input.ExpenseType, input.AmountInCents, true)
-	if err != nil {
-		app.serverError(w, err)
-		return
+	response := ExpenseResponse{
+		ExpenseId:     newId,
+		CategoryId:    &input.CategoryId,
+		AmountInCents: input.AmountInCents,
+		Description:   input.Description,
+		ExpenseType:   input.ExpenseType,
+		Version:       1,
 	}
 
-	err = app.UpdateCategoryExpenses(userId, input.CategoryId, Increment, input.AmountInCents)
+	err = app.withTx(r, func(tx *application) error {
+		_, err := tx.expenses.Insert(newId, userId, input.CategoryId, input.Description, input.ExpenseType, input.AmountInCents)
+		if err != nil {
+			return fmt.Errorf("unable to add an expense %d; %s", input.AmountInCents, err)
+		}
+		err = tx.audit(userId, models.AuditActionCreate, models.AuditEntityExpense, newId, nil, expenseSnapshot{
+			ExpenseId:     newId,
+			CategoryId:    input.CategoryId,
+			Description:   input.Description,
+			ExpenseType:   input.ExpenseType,
+			AmountInCents: input.AmountInCents,
+			Version:       1,
+		})
+		if err != nil {
+			return err
+		}
+		// Update the budget in the database
+		err = tx.CalculateAndUpdateBudget(userId, UpdateTypeSubtract, input.ExpenseType, input.AmountInCents, true)
+		if err != nil {
+			return err
+		}
+
+		err = tx.UpdateCategoryExpenses(userId, input.CategoryId, Increment, input.AmountInCents)
+		if err != nil {
+			return fmt.Errorf("unable to increment category expenses %d; %s", input.AmountInCents, err)
+		}
+
+		expense := response
+		return tx.publishEvent(userId, events.ExpenseCreated, EventPayload{Expense: &expense})
+	})
 	if err != nil {
-		app.serverError(w, fmt.Errorf("unable to increment category expenses %d; %s", input.AmountInCents, err))
+		app.budgetError(w, r, err, "amountInCents", "expenseType")
 		return
 	}
 
 	app.setFlash(r.Context(), "Expense has been created.")
+	response.Flash = app.getFlash(r.Context())
 
-	response := ExpenseResponse{
-		ExpenseId:     id,
-		CategoryId:    &input.CategoryId,
-		AmountInCents: input.AmountInCents,
-		Description:   input.Description,
-		ExpenseType:   input.ExpenseType,
-		Flash:         app.getFlash(r.Context()),
-	}
-
+	w.Header().Set("ETag", etag(response.Version))
 	err = encodeJSON(w, http.StatusCreated, response)
 	if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 		return
 	}
 }
 
-// update
+// update, replaces every field of the expense
 func (app *application) expenseUpdate(w http.ResponseWriter, r *http.Request) {
 	userId := app.sessionManager.Get(r.Context(), "authenticatedUserID").(string)
 	if userId == "" {
-		app.serverError(w, fmt.Errorf("userId not found in session"))
+		app.serverError(w, r, fmt.Errorf("userId not found in session"))
 		return
 	}
 
-	expenseId := app.GetIdFromParams(r, "expenseId")
-	if expenseId == "" {
-		app.notFound(w)
+	currentExpense, ok := app.expenseForUpdate(w, r, userId)
+	if !ok {
 		return
 	}
-	log.Printf("Current Expense id: %s", expenseId)
 
 	// Decode the JSON body into the input struct
 	var input ExpenseInput
@@ -179,59 +207,113 @@ func (app *application) expenseUpdate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("Received input.AmountInCents: %d", input.AmountInCents)
-
 	// validate input
 	input.Validate()
 	if !input.Valid() {
-		encodeJSON(w, http.StatusBadRequest, input.FieldErrors)
+		app.failedValidation(w, r, input.Validator)
 		return
 	}
 
-	app.setFlash(r.Context(), "Expense has been updated.")
+	updatedExpense := *currentExpense
+	updatedExpense.CategoryId = input.CategoryId
+	updatedExpense.Description = input.Description
+	updatedExpense.ExpenseType = input.ExpenseType
+	updatedExpense.AmountInCents = input.AmountInCents
 
-	if input.AmountInCents != 0 {
-		_, _, _, _, _, _, err := app.CalculateBudgetUpdates(userId, UpdateTypeSubtract, input.ExpenseType, input.AmountInCents, true)
-		if err != nil {
-			app.serverError(w, err)
-			return
-		}
+	app.storeExpenseUpdate(w, r, currentExpense, &updatedExpense)
+}
 
-		response := ExpenseResponse{
-			ExpenseId:     expenseId,
-			AmountInCents: input.AmountInCents,
-			Flash:         app.getFlash(r.Context()),
-		}
+// patch, only replaces the fields present in the request body
+func (app *application) expensePatch(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
 
-		log.Printf("Budget successfully updated")
-		err = encodeJSON(w, http.StatusOK, response)
-		if err != nil {
-			app.serverError(w, err)
-			return
-		}
+	currentExpense, ok := app.expenseForUpdate(w, r, userId)
+	if !ok {
+		return
 	}
 
-	// Update the new Expense
-	err = app.expenses.Put(expenseId, userId, input.CategoryId, input.Description, input.ExpenseType, input.AmountInCents)
+	var input ExpensePatch
+	err := decodeJSON(w, r, &input)
 	if err != nil {
-		app.serverError(w, err)
 		return
 	}
 
-	// Create a response that includes both ID and body
-	response := ExpenseResponse{
-		ExpenseId:     expenseId,
-		CategoryId:    &input.CategoryId,
-		AmountInCents: input.AmountInCents,
-		Description:   input.Description,
-		ExpenseType:   input.ExpenseType,
-		Flash:         app.getFlash(r.Context()),
+	input.Validate()
+	if !input.Valid() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+
+	updatedExpense := *currentExpense
+	if input.CategoryId != nil {
+		updatedExpense.CategoryId = *input.CategoryId
+	}
+	if input.Description != nil {
+		updatedExpense.Description = *input.Description
+	}
+	if input.ExpenseType != nil {
+		updatedExpense.ExpenseType = *input.ExpenseType
+	}
+	if input.AmountInCents != nil {
+		updatedExpense.AmountInCents = *input.AmountInCents
+	}
+
+	app.storeExpenseUpdate(w, r, currentExpense, &updatedExpense)
+}
+
+// Fetch the expense named in the route for an update. Sends a 404 if the user
+// has no such expense, or a 412 if the If-Match header names an older version.
+func (app *application) expenseForUpdate(w http.ResponseWriter, r *http.Request, userId string) (*models.Expense, bool) {
+	expenseId := app.GetIdFromParams(r, "expenseId")
+	if expenseId == "" {
+		app.notFound(w, r)
+		return nil, false
+	}
+
+	currentExpense, err := app.expenses.Get(expenseId)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w, r)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return nil, false
+	}
+	if currentExpense.UserId != userId {
+		app.notFound(w, r)
+		return nil, false
+	}
+
+	if !app.checkIfMatch(w, r, currentExpense.Version) {
+		return nil, false
 	}
 
+	return currentExpense, true
+}
+
+// Store an updated expense and respond with its new representation
+func (app *application) storeExpenseUpdate(w http.ResponseWriter, r *http.Request, currentExpense, updatedExpense *models.Expense) {
+	err := app.UpdateExpense(r, currentExpense, updatedExpense)
+	if err != nil {
+		if errors.Is(err, models.ErrVersionConflict) {
+			app.versionConflict(w, r)
+		} else {
+			app.budgetError(w, r, err, "amountInCents", "expenseType")
+		}
+		return
+	}
+
+	app.setFlash(r.Context(), "Expense has been updated.")
+
+	updatedExpense.Version = currentExpense.Version + 1
+	response := newExpenseResponse(updatedExpense)
+	response.Flash = app.getFlash(r.Context())
+
 	// Write the response struct to the response as JSON
+	w.Header().Set("ETag", etag(updatedExpense.Version))
 	err = encodeJSON(w, http.StatusOK, response)
 	if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 		return
 	}
 }
@@ -241,40 +323,25 @@ func (app *application) expenseDelete(w http.ResponseWriter, r *http.Request) {
 	log.Printf("deleting an expense")
 	userId := app.sessionManager.Get(r.Context(), "authenticatedUserID").(string)
 	if userId == "" {
-		app.serverError(w, fmt.Errorf("userId not found in session"))
+		app.serverError(w, r, fmt.Errorf("userId not found in session"))
 		return
 	}
 
 	expenseId := app.GetIdFromParams(r, "expenseId")
 	if expenseId == "" {
-		app.notFound(w)
+		app.notFound(w, r)
 		log.Printf("Exiting due to invalid id")
 		return
 	}
 	log.Printf("Current Expense id: %s", expenseId)
 
-	deletedExpense, err := app.expenses.Get(expenseId)
+	err := app.DeleteExpense(r, expenseId, userId)
 	if err != nil {
-		app.serverError(w, err)
-		return
-	}
-	// Delete the Expense using the ID
-	err = app.expenses.Delete(expenseId, userId)
-	if err != nil {
-		app.serverError(w, err)
-		return
-	}
-	// add the expense amount back to the budget
-	err = app.CalculateAndUpdateBudget(userId, UpdateTypeAdd, deletedExpense.ExpenseType, deletedExpense.AmountInCents, true)
-	if err != nil {
-		app.serverError(w, fmt.Errorf("unable to increment category expenses %d; %s", deletedExpense.AmountInCents, err))
-		return
-	}
-
-	// Update relevant category expenses
-	err = app.UpdateCategoryExpenses(userId, deletedExpense.CategoryId, Decrement, deletedExpense.AmountInCents)
-	if err != nil {
-		app.serverError(w, fmt.Errorf("unable to increment category expenses %d; %s", deletedExpense.AmountInCents, err))
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w, r)
+		} else {
+			app.serverError(w, r, err)
+		}
 		return
 	}
 
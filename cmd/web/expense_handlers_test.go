@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// Another user's expense is reported as not found by both API versions.
+func TestExpenseViewOtherUser(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	ts.signUpAndLogIn(t, "owner@example.com")
+
+	status := ts.doJSON(t, http.MethodPost, "/api/v2/budgets", map[string]int64{"checkingBalance": 10000}, nil)
+	expectStatus(t, "create budget", status, http.StatusCreated)
+
+	var category ExpenseCategoryResponse
+	status = ts.doJSON(t, http.MethodPost, "/api/v2/categories", map[string]string{"name": "Rent"}, &category)
+	expectStatus(t, "create category", status, http.StatusCreated)
+
+	var expense ExpenseResponse
+	status = ts.doJSON(t, http.MethodPost, "/api/v2/expenses", map[string]any{
+		"amountInCents": 4000,
+		"categoryId":    category.ExpenseCategoryId,
+		"expenseType":   BalanceTypeChecking,
+	}, &expense)
+	expectStatus(t, "create expense", status, http.StatusCreated)
+
+	for _, path := range []string{"/api/expenses/view/", "/api/v2/expenses/"} {
+		status = ts.doJSON(t, http.MethodGet, path+expense.ExpenseId, nil, nil)
+		expectStatus(t, "owner views "+path, status, http.StatusOK)
+	}
+
+	other := ts.newClient(t)
+	other.signUpAndLogIn(t, "other@example.com")
+	for _, path := range []string{"/api/expenses/view/", "/api/v2/expenses/"} {
+		status = other.doJSON(t, http.MethodGet, path+expense.ExpenseId, nil, nil)
+		expectStatus(t, "other user views "+path, status, http.StatusNotFound)
+	}
+}
@@ -1,14 +1,136 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"kweeuhree.personal-budgeting-backend/internal/events"
 	"kweeuhree.personal-budgeting-backend/internal/models"
 )
 
-func (app *application) GetExpensesTotal(exps []*models.Expense) (int64) {
+func (app *application) GetExpensesTotal(exps []*models.Expense) int64 {
 	var total int64
-    for _, exp := range exps {
-        total += exp.AmountInCents
-    }
+	for _, exp := range exps {
+		total += exp.AmountInCents
+	}
 
 	return total
-}
\ No newline at end of file
+}
+
+// Build the JSON representation of a stored expense
+func newExpenseResponse(exp *models.Expense) ExpenseResponse {
+	categoryId := exp.CategoryId
+	return ExpenseResponse{
+		ExpenseId:     exp.ExpenseId,
+		CategoryId:    &categoryId,
+		AmountInCents: exp.AmountInCents,
+		Description:   exp.Description,
+		ExpenseType:   exp.ExpenseType,
+		Version:       exp.Version,
+		CreatedAt:     exp.CreatedAt,
+	}
+}
+
+// Delete an expense of the user, give its amount back to the budget and take
+// it off its category total. Returns models.ErrNoRecord if the user has no
+// expense with that id.
+func (app *application) DeleteExpense(r *http.Request, expenseId, userId string) error {
+	return app.withTx(r, func(tx *application) error {
+		deletedExpense, err := tx.expenses.Get(expenseId)
+		if err != nil {
+			return err
+		}
+		if deletedExpense.UserId != userId {
+			return models.ErrNoRecord
+		}
+
+		// Delete the Expense using the ID
+		err = tx.expenses.Delete(expenseId, userId)
+		if err != nil {
+			return err
+		}
+		err = tx.audit(userId, models.AuditActionDelete, models.AuditEntityExpense, expenseId, snapshotExpense(deletedExpense), nil)
+		if err != nil {
+			return err
+		}
+
+		// add the expense amount back to the budget
+		err = tx.CalculateAndUpdateBudget(userId, UpdateTypeAdd, deletedExpense.ExpenseType, deletedExpense.AmountInCents, true)
+		if err != nil {
+			return fmt.Errorf("unable to update budget by %d: %w", deletedExpense.AmountInCents, err)
+		}
+
+		// Update relevant category expenses
+		err = tx.UpdateCategoryExpenses(userId, deletedExpense.CategoryId, Decrement, deletedExpense.AmountInCents)
+		if err != nil {
+			return fmt.Errorf("unable to decrement category expenses by %d: %w", deletedExpense.AmountInCents, err)
+		}
+
+		return tx.publishEvent(userId, events.ExpenseDeleted, EventPayload{ExpenseId: expenseId})
+	})
+}
+
+// UpdateExpense stores the updated expense, as long as it is still at the
+// version of currentExpense. If the amount or balance type changed, the old
+// amount is given back to its balance and the new amount is taken out of the
+// new one; if the amount or category changed, the category totals follow.
+func (app *application) UpdateExpense(r *http.Request, currentExpense, updatedExpense *models.Expense) error {
+	return app.withTx(r, func(tx *application) error {
+		userId := currentExpense.UserId
+
+		moneyMoved := currentExpense.AmountInCents != updatedExpense.AmountInCents ||
+			currentExpense.ExpenseType != updatedExpense.ExpenseType
+
+		var updatedBudget models.Budget
+		if moneyMoved {
+			currentBudget, err := tx.budget.GetBudgetByUserIdForUpdate(userId)
+			if err != nil {
+				if errors.Is(err, models.ErrNoRecord) {
+					return models.ErrNoBudget
+				}
+				return err
+			}
+
+			// give the old amount back, then check the new amount fits the new balance
+			refundedBudget := applyBudgetUpdate(*currentBudget, UpdateTypeAdd, currentExpense.ExpenseType, currentExpense.AmountInCents, true)
+			if balanceOf(&refundedBudget, updatedExpense.ExpenseType) < updatedExpense.AmountInCents {
+				return fmt.Errorf("%w in %s account", models.ErrInsufficientFunds, updatedExpense.ExpenseType)
+			}
+			updatedBudget = applyBudgetUpdate(refundedBudget, UpdateTypeSubtract, updatedExpense.ExpenseType, updatedExpense.AmountInCents, true)
+		}
+
+		err := tx.expenses.PutIfVersion(currentExpense.ExpenseId, userId, currentExpense.Version, updatedExpense.CategoryId, updatedExpense.Description, updatedExpense.ExpenseType, updatedExpense.AmountInCents)
+		if err != nil {
+			return err
+		}
+
+		updated := *updatedExpense
+		updated.Version = currentExpense.Version + 1
+		err = tx.audit(userId, models.AuditActionUpdate, models.AuditEntityExpense, currentExpense.ExpenseId, snapshotExpense(currentExpense), snapshotExpense(&updated))
+		if err != nil {
+			return err
+		}
+
+		if moneyMoved {
+			err = tx.UpdateBudgetInDB(&updatedBudget)
+			if err != nil {
+				return err
+			}
+		}
+
+		if currentExpense.CategoryId != updatedExpense.CategoryId || currentExpense.AmountInCents != updatedExpense.AmountInCents {
+			err = tx.UpdateCategoryExpenses(userId, currentExpense.CategoryId, Decrement, currentExpense.AmountInCents)
+			if err != nil {
+				return fmt.Errorf("unable to decrement category expenses by %d: %w", currentExpense.AmountInCents, err)
+			}
+			err = tx.UpdateCategoryExpenses(userId, updatedExpense.CategoryId, Increment, updatedExpense.AmountInCents)
+			if err != nil {
+				return fmt.Errorf("unable to increment category expenses by %d: %w", updatedExpense.AmountInCents, err)
+			}
+		}
+
+		expense := newExpenseResponse(&updated)
+		return tx.publishEvent(userId, events.ExpenseUpdated, EventPayload{Expense: &expense})
+	})
+}
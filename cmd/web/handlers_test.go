@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// TestExpenseFlow goes through the routes the frontend uses, on the
+// in-memory store: sign up, log in, create a budget, spend from it and give
+// the money back by deleting the expense
+func TestExpenseFlow(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	// Nothing but the public routes before logging in
+	ts.refreshCSRF(t)
+	status := ts.doJSON(t, http.MethodPost, "/api/budget/create", map[string]int64{"checkingBalance": 1}, nil)
+	expectStatus(t, "create budget logged out", status, http.StatusUnauthorized)
+
+	ts.signUpAndLogIn(t, "flow@example.com")
+
+	var budget BudgetResponse
+	status = ts.doJSON(t, http.MethodPost, "/api/budget/create", map[string]int64{
+		"checkingBalance": 50000,
+		"savingsBalance":  20000,
+	}, &budget)
+	expectStatus(t, "create budget", status, http.StatusCreated)
+	if budget.BudgetTotal != 70000 || budget.BudgetRemaining != 70000 {
+		t.Fatalf("got total %d and remaining %d; want 70000 and 70000", budget.BudgetTotal, budget.BudgetRemaining)
+	}
+
+	var category ExpenseCategoryResponse
+	status = ts.doJSON(t, http.MethodPost, "/api/categories/create", map[string]string{"name": "Groceries"}, &category)
+	expectStatus(t, "create category", status, http.StatusCreated)
+
+	var expense ExpenseResponse
+	status = ts.doJSON(t, http.MethodPost, "/api/expenses/create", map[string]any{
+		"amountInCents": 12345,
+		"categoryId":    category.ExpenseCategoryId,
+		"expenseType":   BalanceTypeChecking,
+		"description":   "Weekly shop",
+	}, &expense)
+	expectStatus(t, "create expense", status, http.StatusCreated)
+
+	// More than is left in savings is refused, and changes nothing
+	var problem Problem
+	status = ts.doJSON(t, http.MethodPost, "/api/expenses/create", map[string]any{
+		"amountInCents": 20001,
+		"categoryId":    category.ExpenseCategoryId,
+		"expenseType":   BalanceTypeSavings,
+	}, &problem)
+	expectStatus(t, "create expense over the balance", status, http.StatusConflict)
+	if problem.Code != ErrCodeInsufficientFunds {
+		t.Errorf("got code %q; want %q", problem.Code, ErrCodeInsufficientFunds)
+	}
+
+	expectBudget(t, ts, "after the expense", BudgetResponse{
+		CheckingBalance: 50000 - 12345,
+		SavingsBalance:  20000,
+		BudgetTotal:     70000 - 12345,
+		BudgetRemaining: 70000 - 12345,
+		TotalSpent:      12345,
+	})
+	expectCategoryTotal(t, ts, category.ExpenseCategoryId, 12345)
+
+	status = ts.doJSON(t, http.MethodDelete, "/api/expenses/delete/"+expense.ExpenseId, nil, nil)
+	expectStatus(t, "delete expense", status, http.StatusOK)
+
+	expectBudget(t, ts, "after deleting the expense", BudgetResponse{
+		CheckingBalance: 50000,
+		SavingsBalance:  20000,
+		BudgetTotal:     70000,
+		BudgetRemaining: 70000,
+		TotalSpent:      0,
+	})
+	expectCategoryTotal(t, ts, category.ExpenseCategoryId, 0)
+
+	// The expense is gone
+	status = ts.doJSON(t, http.MethodDelete, "/api/expenses/delete/"+expense.ExpenseId, nil, nil)
+	expectStatus(t, "delete the expense again", status, http.StatusNotFound)
+}
+
+// expectBudget fails the test when the balances of the budget of the logged
+// in user are not the wanted ones
+func expectBudget(t *testing.T, ts *testServer, step string, want BudgetResponse) {
+	t.Helper()
+
+	var budgets []BudgetResponse
+	status := ts.doJSON(t, http.MethodGet, "/api/v2/budgets", nil, &budgets)
+	expectStatus(t, step, status, http.StatusOK)
+	if len(budgets) != 1 {
+		t.Fatalf("%s: got %d budgets; want 1", step, len(budgets))
+	}
+
+	got := budgets[0]
+	if got.CheckingBalance != want.CheckingBalance || got.SavingsBalance != want.SavingsBalance ||
+		got.BudgetTotal != want.BudgetTotal || got.BudgetRemaining != want.BudgetRemaining ||
+		got.TotalSpent != want.TotalSpent {
+		t.Errorf("%s: got checking %d, savings %d, total %d, remaining %d, spent %d; want %d, %d, %d, %d, %d", step,
+			got.CheckingBalance, got.SavingsBalance, got.BudgetTotal, got.BudgetRemaining, got.TotalSpent,
+			want.CheckingBalance, want.SavingsBalance, want.BudgetTotal, want.BudgetRemaining, want.TotalSpent)
+	}
+}
+
+// expectCategoryTotal fails the test when the total of the category is not
+// the wanted one
+func expectCategoryTotal(t *testing.T, ts *testServer, categoryId string, want int64) {
+	t.Helper()
+
+	var category ExpenseCategoryResponse
+	status := ts.doJSON(t, http.MethodGet, "/api/v2/categories/"+categoryId, nil, &category)
+	expectStatus(t, "view category", status, http.StatusOK)
+	if category.TotalSum != want {
+		t.Errorf("got category total %d; want %d", category.TotalSum, want)
+	}
+}
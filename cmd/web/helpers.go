@@ -3,59 +3,250 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"reflect"
 	"runtime/debug"
+	"strconv"
+	"strings"
 
 	"github.com/julienschmidt/httprouter"
+	"kweeuhree.personal-budgeting-backend/internal/events"
+	"kweeuhree.personal-budgeting-backend/internal/models"
+	"kweeuhree.personal-budgeting-backend/internal/validator"
 )
 
 // The serverError helper writes an error message and stack trace to the errorLog,
-// then sends a generic 500 Internal Server Error response to the user.
+// then sends a generic 500 Internal Server Error problem response to the user.
 // -- use the debug.Stack() function to get a stack trace for the current goroutine and append it to the
 // -- log message. Being able to see the execution path of the
 // -- application via the stack trace can be helpful when you’re trying to debug errors.
-func (app *application) serverError(w http.ResponseWriter, err error) {
-	trace := fmt.Sprintf("%s\n%s", err.Error(), debug.Stack())
+func (app *application) serverError(w http.ResponseWriter, r *http.Request, err error) {
+	trace := fmt.Sprintf("[%s] %s\n%s", requestIdFromContext(r.Context()), err.Error(), debug.Stack())
 	// report the file name and line number one step back in the stack trace
 	// to have a clearer idea of where the error actually originated from
 	// set frame depth to 2
 	app.errorLog.Output(2, trace)
 
-	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	// Never leak the underlying error to the user, the request id is enough
+	// to find the trace in the logs
+	app.errorResponse(w, r, http.StatusInternalServerError, ErrCodeInternal, "")
 }
 
 // The clientError helper sends a specific status code and corresponding description
-// to the user. We'll use this later in the book to send responses like 400
-// "Bad Request" when there's a problem with the request that the user sent.
+// to the user, e.g. 400 "Bad Request" when there's a problem with the request that the user sent.
 // -- use the http.StatusText() function to automatically generate a human-friendly text
 // representation of a given HTTP status code. For example,
 // http.StatusText(400) will return the string "Bad Request".
-func (app *application) clientError(w http.ResponseWriter, status int) {
-	http.Error(w, http.StatusText(status), status)
+func (app *application) clientError(w http.ResponseWriter, r *http.Request, status int) {
+	app.errorResponse(w, r, status, errorCodeForStatus(status), "")
 }
 
 // For consistency, we'll also implement a notFound helper. This is simply a
 // convenience wrapper around clientError which sends a 404 Not Found
 // response to the user.
-func (app *application) notFound(w http.ResponseWriter) {
-	app.clientError(w, http.StatusNotFound)
+func (app *application) notFound(w http.ResponseWriter, r *http.Request) {
+	app.clientError(w, r, http.StatusNotFound)
 }
 
-func decodeJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
-	err := json.NewDecoder(r.Body).Decode(dst)
+// The errorResponse helper writes a problem response with the given status,
+// machine-readable code and human-readable detail
+func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	err := writeProblem(w, r, newProblem(status, code, detail))
+	if err != nil {
+		app.errorLog.Printf("[%s] failed to write error response: %v", requestIdFromContext(r.Context()), err)
+	}
+}
+
+// The failedValidation helper sends a 400 Bad Request problem response
+// carrying the field and non-field errors collected by the validator
+func (app *application) failedValidation(w http.ResponseWriter, r *http.Request, v validator.Validator) {
+	p := newProblem(http.StatusBadRequest, ErrCodeValidation, "One or more fields are invalid")
+	p.FieldErrors = v.FieldErrors
+	p.NonFieldErrors = v.NonFieldErrors
+
+	err := writeProblem(w, r, p)
 	if err != nil {
-		fmt.Printf("Could not decode JSON, error: %s", err)
-		errorResponse := map[string]string{
-			"error":   "Bad Request",
-			"message": "Invalid JSON in request body", // More detailed message
-			"details": err.Error(),                    // Include the error details for debugging (optional)
+		app.errorLog.Printf("[%s] failed to write error response: %v", requestIdFromContext(r.Context()), err)
+	}
+}
+
+// The preconditionFailed helper sends a 412 Precondition Failed problem
+// response when a write was based on an outdated version of a resource
+func (app *application) preconditionFailed(w http.ResponseWriter, r *http.Request) {
+	app.errorResponse(w, r, http.StatusPreconditionFailed, ErrCodePreconditionFailed, "The resource was modified since it was last read, fetch it again and retry")
+}
+
+// The versionConflict helper reports a write that lost a race with another
+// request. A client that sent If-Match made its write depend on the version
+// it read and gets 412 Precondition Failed; any other client gets 409
+// Conflict, since it did not ask for a version and can simply retry.
+func (app *application) versionConflict(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("If-Match") != "" {
+		app.preconditionFailed(w, r)
+		return
+	}
+	app.errorResponse(w, r, http.StatusConflict, ErrCodeEditConflict, "The resource was changed by another request, please retry")
+}
+
+// Format a row version as a strong entity tag for the ETag header
+func etag(version int) string {
+	return strconv.Quote(strconv.Itoa(version))
+}
+
+// The checkIfMatch helper compares the If-Match header of a write request
+// with the current version of the resource. Requests without the header are
+// let through. On a mismatch it sends a 412 response and returns false.
+func (app *application) checkIfMatch(w http.ResponseWriter, r *http.Request, version int) bool {
+	if ifMatches(r, version) {
+		return true
+	}
+
+	app.preconditionFailed(w, r)
+	return false
+}
+
+// ifMatches reports whether the If-Match header of the request, if any,
+// matches the version
+func ifMatches(r *http.Request, version int) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+
+	current := etag(version)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == current {
+			return true
 		}
-		encodeJSON(w, http.StatusBadRequest, errorResponse)
+	}
+	return false
+}
 
-		return err
+// Map a status code to the error code used when no more specific code applies
+func errorCodeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return ErrCodeBadRequest
+	case http.StatusUnauthorized:
+		return ErrCodeUnauthenticated
+	case http.StatusForbidden:
+		return ErrCodeForbidden
+	case http.StatusNotFound:
+		return ErrCodeNotFound
+	case http.StatusMethodNotAllowed:
+		return ErrCodeMethodNotAllowed
+	default:
+		if status >= http.StatusInternalServerError {
+			return ErrCodeInternal
+		}
+		return ErrCodeBadRequest
+	}
+}
+
+// maxRequestBodyBytes caps the size of a JSON request body at 1MB
+const maxRequestBodyBytes = 1_048_576
+
+// decodeJSON strictly decodes a single JSON value from the request body into
+// dst. The request must be sent as application/json, the body is capped at
+// maxRequestBodyBytes, and unknown fields or trailing data are rejected.
+// On failure it writes a problem response describing what was wrong with the
+// body, so callers only need to return.
+func decodeJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
+	contentType := r.Header.Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "application/json" {
+		p := newProblem(http.StatusUnsupportedMediaType, ErrCodeUnsupportedMediaType, "Content-Type header must be application/json")
+		writeProblem(w, r, p)
+		return fmt.Errorf("unsupported content type %q", contentType)
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodyBytes)
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	err = dec.Decode(dst)
+	if err == nil {
+		// Decode again to make sure the body contained only a single JSON value
+		err = dec.Decode(&struct{}{})
+		if !errors.Is(err, io.EOF) {
+			err = errors.New("body must only contain a single JSON value")
+			writeProblem(w, r, newProblem(http.StatusBadRequest, ErrCodeInvalidJSON, "Body must only contain a single JSON value"))
+			return err
+		}
+		return nil
+	}
+
+	writeProblem(w, r, decodeProblem(err))
+	return err
+}
+
+// decodeProblem translates an error from json.Decoder into a precise problem
+// response, naming the offending field where the decoder reports one
+func decodeProblem(err error) *Problem {
+	var syntaxError *json.SyntaxError
+	var unmarshalTypeError *json.UnmarshalTypeError
+	var maxBytesError *http.MaxBytesError
+
+	switch {
+	case errors.As(err, &syntaxError):
+		return newProblem(http.StatusBadRequest, ErrCodeInvalidJSON, fmt.Sprintf("Body contains badly-formed JSON (at character %d)", syntaxError.Offset))
+
+	// Decode() can also return io.ErrUnexpectedEOF for syntax errors in the JSON
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return newProblem(http.StatusBadRequest, ErrCodeInvalidJSON, "Body contains badly-formed JSON")
+
+	case errors.As(err, &unmarshalTypeError):
+		if unmarshalTypeError.Field == "" {
+			return newProblem(http.StatusBadRequest, ErrCodeInvalidJSON, fmt.Sprintf("Body must be a JSON object, not %s", unmarshalTypeError.Value))
+		}
+		p := newProblem(http.StatusBadRequest, ErrCodeInvalidJSON, fmt.Sprintf("Body contains an incorrect JSON type for field %q", unmarshalTypeError.Field))
+		p.FieldErrors = map[string]string{
+			unmarshalTypeError.Field: fmt.Sprintf("This field must be of type %s", jsonTypeName(unmarshalTypeError.Type.Kind())),
+		}
+		return p
+
+	case errors.Is(err, io.EOF):
+		return newProblem(http.StatusBadRequest, ErrCodeInvalidJSON, "Body must not be empty")
+
+	// There is no distinct error type for unknown fields, so the field name
+	// is pulled out of the message: json: unknown field "<name>"
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		fieldName := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		p := newProblem(http.StatusBadRequest, ErrCodeInvalidJSON, fmt.Sprintf("Body contains unknown field %q", fieldName))
+		p.FieldErrors = map[string]string{fieldName: "This field is not allowed"}
+		return p
+
+	case errors.As(err, &maxBytesError):
+		return newProblem(http.StatusRequestEntityTooLarge, ErrCodeBodyTooLarge, fmt.Sprintf("Body must not be larger than %d bytes", maxBytesError.Limit))
+
+	default:
+		return newProblem(http.StatusBadRequest, ErrCodeInvalidJSON, "Invalid JSON in request body")
+	}
+}
+
+// jsonTypeName returns the JSON name for the Go kind a field decodes into
+func jsonTypeName(kind reflect.Kind) string {
+	switch kind {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	default:
+		return "object"
 	}
-	return nil
 }
 
 func encodeJSON(w http.ResponseWriter, status int, data interface{}) error {
@@ -97,3 +288,82 @@ func (app *application) isAuthenticated(r *http.Request) bool {
 	}
 	return isAuthenticated
 }
+
+// The withTx helper runs fn against a copy of the application whose models
+// share one database transaction, so that a change spanning the budget,
+// expenses and categories is stored completely or not at all. Events
+// published by fn are written to the webhook outbox in the same transaction,
+// and streamed to the open event streams once it commits. Audit entries are
+// written in the transaction too, with r as the actor. Calls nested in fn
+// join the outer transaction.
+func (app *application) withTx(r *http.Request, fn func(txApp *application) error) error {
+	if app.pendingEvents != nil {
+		return fn(app)
+	}
+
+	txApp := *app
+	txApp.actor = app.auditActorFrom(r)
+	txApp.pendingEvents = &[]events.Event{}
+
+	err := app.store.InTx(func(repos *models.Repositories) error {
+		txApp.user = repos.Users
+		txApp.budget = repos.Budgets
+		txApp.expenses = repos.Expenses
+		txApp.expenseCategory = repos.ExpenseCategories
+		txApp.idempotencyKeys = repos.IdempotencyKeys
+		txApp.webhooks = repos.Webhooks
+		txApp.auditLog = repos.AuditLog
+		txApp.passwordResets = repos.PasswordResets
+		txApp.emailVerifications = repos.EmailVerifications
+		txApp.twoFactor = repos.TwoFactor
+		txApp.loginAttempts = repos.LoginAttempts
+		txApp.apiTokens = repos.APITokens
+		txApp.userIdentities = repos.UserIdentities
+		txApp.userSessions = repos.UserSessions
+		txApp.stats = repos.Stats
+		return fn(&txApp)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Tell the idempotency middleware that the request changed something
+	if committed, ok := r.Context().Value(idempotencyCommitContextKey).(*bool); ok {
+		*committed = true
+	}
+
+	for _, event := range *txApp.pendingEvents {
+		app.events.Publish(event.UserId, event.Type, event.Data)
+	}
+	return nil
+}
+
+// background runs fn in a new goroutine, and logs a panic in fn instead of
+// letting it crash the server
+func (app *application) background(fn func()) {
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				app.errorLog.Printf("%s\n%s", err, debug.Stack())
+			}
+		}()
+		fn()
+	}()
+}
+
+// destroyUserSessions ends every recorded session of the user, on every
+// device, and returns how many it ended. The session of the current request
+// is left to the caller, it is saved again when the request ends.
+func (app *application) destroyUserSessions(userId string) (int, error) {
+	sessions, err := app.userSessions.All(userId)
+	if err != nil {
+		return 0, err
+	}
+	for _, s := range sessions {
+		err = app.destroySession(s.Token)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(sessions), nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
+
+const (
+	// idempotencyKeyHeader names the request header clients use to mark
+	// retries of the same mutating request
+	idempotencyKeyHeader = "Idempotency-Key"
+	// idempotentReplayedHeader is set on responses replayed from a stored key
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+)
+
+// idempotencyRecorder tees everything a handler writes so that the response
+// can be stored against the idempotency key once the handler has returned
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *idempotencyRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// The idempotency middleware makes mutating requests that carry an
+// Idempotency-Key header safe to retry. The first request with a key is
+// processed and its response stored for the user; a retry with the same key
+// and the same request replays that response instead of running the handler
+// again. It must run after requireAuthentication, as keys are stored per user.
+func (app *application) idempotency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" || !isMutatingMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyLength {
+			app.errorResponse(w, r, http.StatusBadRequest, ErrCodeBadRequest,
+				fmt.Sprintf("The %s header must not be longer than %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength))
+			return
+		}
+
+		userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+		// Read the body to hash it, then put it back for the handler
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodyBytes))
+		if err != nil {
+			writeProblem(w, r, decodeProblem(err))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		requestHash := hashRequest(r, body)
+
+		err = app.idempotencyKeys.Reserve(userId, key, requestHash)
+		if err != nil {
+			if errors.Is(err, models.ErrDuplicateIdempotencyKey) {
+				app.replayIdempotentResponse(w, r, userId, key, requestHash)
+			} else {
+				app.serverError(w, r, err)
+			}
+			return
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w}
+
+		// withTx sets committed once the handler's transaction commits
+		committed := false
+		r = r.WithContext(context.WithValue(r.Context(), idempotencyCommitContextKey, &committed))
+
+		// Free the key if the handler panics or fails on our side before it
+		// changed anything, so that the client can retry instead of being
+		// locked out for a day. Once a transaction has committed the key stays
+		// reserved, even if storing the response fails, as a retry would apply
+		// the change a second time. Handlers that write outside withTx do so
+		// in one statement as their last step, so their 5xx responses mean
+		// nothing was written.
+		stored := false
+		defer func() {
+			if stored || committed {
+				return
+			}
+			err := app.idempotencyKeys.Release(userId, key)
+			if err != nil {
+				app.errorLog.Printf("[%s] idempotency: unable to release key: %v", requestIdFromContext(r.Context()), err)
+			}
+		}()
+
+		next.ServeHTTP(rec, r)
+
+		if !committed && (rec.status == 0 || rec.status >= http.StatusInternalServerError) {
+			return
+		}
+		// A handler that writes nothing answers 200 OK
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		// After a commit the response is stored whatever its status, so that
+		// retries learn what happened to the original request
+		err = app.idempotencyKeys.Complete(userId, key, rec.status,
+			rec.Header().Get("Content-Type"), rec.Header().Get("ETag"), rec.body.Bytes())
+		if err != nil {
+			app.errorLog.Printf("[%s] idempotency: unable to store response: %v", requestIdFromContext(r.Context()), err)
+			return
+		}
+		stored = true
+	})
+}
+
+// Respond to a retry of a request whose key is already stored
+func (app *application) replayIdempotentResponse(w http.ResponseWriter, r *http.Request, userId, key, requestHash string) {
+	stored, err := app.idempotencyKeys.Get(userId, key)
+	if err != nil {
+		// The original request failed and released the key in the meantime
+		if errors.Is(err, models.ErrNoRecord) {
+			app.errorResponse(w, r, http.StatusConflict, ErrCodeIdempotencyInProgress,
+				"A request with this idempotency key was just processed, please retry")
+			return
+		}
+		app.serverError(w, r, err)
+		return
+	}
+
+	if stored.RequestHash != requestHash {
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, ErrCodeIdempotencyKeyReused,
+			"This idempotency key was already used for a different request")
+		return
+	}
+
+	if stored.ResponseStatus == 0 {
+		app.errorResponse(w, r, http.StatusConflict, ErrCodeIdempotencyInProgress,
+			"A request with this idempotency key is still being processed")
+		return
+	}
+
+	if stored.ContentType != "" {
+		w.Header().Set("Content-Type", stored.ContentType)
+	}
+	if stored.ETag != "" {
+		w.Header().Set("ETag", stored.ETag)
+	}
+	w.Header().Set(idempotentReplayedHeader, "true")
+	w.WriteHeader(stored.ResponseStatus)
+	w.Write(stored.ResponseBody)
+}
+
+// The hash ties a key to one request, so that reusing a key for a different
+// request is reported instead of silently replaying the wrong response
+func hashRequest(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func isMutatingMethod(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// Periodically remove idempotency keys older than models.IdempotencyKeyTTL
+func (app *application) expireIdempotencyKeys(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n, err := app.idempotencyKeys.DeleteExpired()
+		if err != nil {
+			app.errorLog.Printf("idempotency: unable to delete expired keys: %v", err)
+			continue
+		}
+		if n > 0 {
+			app.infoLog.Printf("idempotency: deleted %d expired keys", n)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
+
+// setUpExpenses signs a user up with a budget and a category, and returns
+// their id and the body of a request creating an expense in that category
+func setUpExpenses(t *testing.T, ts *testServer, email string) (string, map[string]any) {
+	t.Helper()
+
+	userId := ts.signUpAndLogIn(t, email)
+	status := ts.doJSON(t, http.MethodPost, "/api/v2/budgets", map[string]int64{"checkingBalance": 100000}, nil)
+	expectStatus(t, "create budget", status, http.StatusCreated)
+
+	var category ExpenseCategoryResponse
+	status = ts.doJSON(t, http.MethodPost, "/api/v2/categories", map[string]string{"name": "Rent"}, &category)
+	expectStatus(t, "create category", status, http.StatusCreated)
+
+	return userId, map[string]any{
+		"amountInCents": 1000,
+		"categoryId":    category.ExpenseCategoryId,
+		"expenseType":   BalanceTypeChecking,
+	}
+}
+
+// countExpenses returns the number of expenses of the logged in user
+func countExpenses(t *testing.T, ts *testServer) int {
+	t.Helper()
+
+	var expenses []ExpenseResponse
+	status := ts.doJSON(t, http.MethodGet, "/api/v2/expenses", nil, &expenses)
+	expectStatus(t, "list expenses", status, http.StatusOK)
+	return len(expenses)
+}
+
+func TestIdempotencyReplay(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	_, expense := setUpExpenses(t, ts, "replay@example.com")
+
+	ts.header.Set(idempotencyKeyHeader, "create-rent")
+	res, first := ts.do(t, http.MethodPost, "/api/v2/expenses", expense)
+	expectStatus(t, "first request", res.StatusCode, http.StatusCreated)
+	if res.Header.Get(idempotentReplayedHeader) != "" {
+		t.Errorf("got %s on the first request; want none", idempotentReplayedHeader)
+	}
+
+	res, retry := ts.do(t, http.MethodPost, "/api/v2/expenses", expense)
+	expectStatus(t, "retry", res.StatusCode, http.StatusCreated)
+	if res.Header.Get(idempotentReplayedHeader) != "true" {
+		t.Errorf("got %s %q; want true", idempotentReplayedHeader, res.Header.Get(idempotentReplayedHeader))
+	}
+	if string(retry) != string(first) {
+		t.Errorf("got replayed body %q; want %q", retry, first)
+	}
+
+	// Reusing the key for a different request is refused
+	expense["amountInCents"] = 2000
+	var problem Problem
+	status := ts.doJSON(t, http.MethodPost, "/api/v2/expenses", expense, &problem)
+	expectStatus(t, "different request", status, http.StatusUnprocessableEntity)
+	if problem.Code != ErrCodeIdempotencyKeyReused {
+		t.Errorf("got code %q; want %q", problem.Code, ErrCodeIdempotencyKeyReused)
+	}
+
+	// Keys are per user
+	other := ts.newClient(t)
+	_, otherExpense := setUpExpenses(t, other, "replay-other@example.com")
+	other.header.Set(idempotencyKeyHeader, "create-rent")
+	status = other.doJSON(t, http.MethodPost, "/api/v2/expenses", otherExpense, nil)
+	expectStatus(t, "same key for another user", status, http.StatusCreated)
+
+	ts.header.Del(idempotencyKeyHeader)
+	if n := countExpenses(t, ts); n != 1 {
+		t.Errorf("got %d expenses; want 1", n)
+	}
+}
+
+// A request that failed before changing anything frees its key, so that the
+// client can retry it
+func TestIdempotencyReleaseOnFailure(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	userId, expense := setUpExpenses(t, ts, "release@example.com")
+
+	ts.header.Set(idempotencyKeyHeader, "too-much")
+	expense["amountInCents"] = 200000
+	status := ts.doJSON(t, http.MethodPost, "/api/v2/expenses", expense, nil)
+	expectStatus(t, "over the balance", status, http.StatusConflict)
+
+	// A 4xx response is stored and replayed like any other
+	res, _ := ts.do(t, http.MethodPost, "/api/v2/expenses", expense)
+	expectStatus(t, "retry over the balance", res.StatusCode, http.StatusConflict)
+	if res.Header.Get(idempotentReplayedHeader) != "true" {
+		t.Errorf("got %s %q; want true", idempotentReplayedHeader, res.Header.Get(idempotentReplayedHeader))
+	}
+
+	app.idempotencyKeys = &failingIdempotencyKeys{IdempotencyRepository: app.idempotencyKeys}
+	ts.header.Set(idempotencyKeyHeader, "unstored")
+	expense["amountInCents"] = 1000
+	expense["categoryId"] = "not-a-category"
+	status = ts.doJSON(t, http.MethodPost, "/api/v2/expenses", expense, nil)
+	if status >= http.StatusInternalServerError {
+		t.Fatalf("got status %d for an unknown category", status)
+	}
+
+	// Nothing was written, so the key was freed when storing the response failed
+	app.idempotencyKeys = app.idempotencyKeys.(*failingIdempotencyKeys).IdempotencyRepository
+	_, err := app.idempotencyKeys.Get(userId, "unstored")
+	if !errors.Is(err, models.ErrNoRecord) {
+		t.Errorf("got error %v; want models.ErrNoRecord", err)
+	}
+}
+
+// Once the handler's transaction has committed the key stays reserved, even
+// when its response cannot be stored, so that a retry does not create the
+// expense a second time
+func TestIdempotencyKeepsCommittedKey(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	_, expense := setUpExpenses(t, ts, "committed@example.com")
+
+	app.idempotencyKeys = &failingIdempotencyKeys{IdempotencyRepository: app.idempotencyKeys}
+
+	ts.header.Set(idempotencyKeyHeader, "create-once")
+	status := ts.doJSON(t, http.MethodPost, "/api/v2/expenses", expense, nil)
+	expectStatus(t, "first request", status, http.StatusCreated)
+
+	var problem Problem
+	status = ts.doJSON(t, http.MethodPost, "/api/v2/expenses", expense, &problem)
+	expectStatus(t, "retry", status, http.StatusConflict)
+	if problem.Code != ErrCodeIdempotencyInProgress {
+		t.Errorf("got code %q; want %q", problem.Code, ErrCodeIdempotencyInProgress)
+	}
+
+	ts.header.Del(idempotencyKeyHeader)
+	if n := countExpenses(t, ts); n != 1 {
+		t.Errorf("got %d expenses; want 1", n)
+	}
+}
+
+// Concurrent retries of one request create a single expense: one of them is
+// processed, the others are told it is in progress or replay its response
+func TestIdempotencyConcurrentRetries(t *testing.T) {
+	app := newSQLiteTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	_, expense := setUpExpenses(t, ts, "concurrent@example.com")
+	ts.header.Set(idempotencyKeyHeader, "create-concurrently")
+
+	const retries = 8
+	statuses := make([]int, retries)
+	replayed := make([]bool, retries)
+
+	var wg sync.WaitGroup
+	for i := 0; i < retries; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, _ := ts.do(t, http.MethodPost, "/api/v2/expenses", expense)
+			statuses[i] = res.StatusCode
+			replayed[i] = res.Header.Get(idempotentReplayedHeader) == "true"
+		}(i)
+	}
+	wg.Wait()
+
+	processed := 0
+	for i, status := range statuses {
+		switch {
+		case status == http.StatusCreated && !replayed[i]:
+			processed++
+		case status == http.StatusCreated, status == http.StatusConflict:
+		default:
+			t.Errorf("got status %d; want %d or %d", status, http.StatusCreated, http.StatusConflict)
+		}
+	}
+	if processed != 1 {
+		t.Errorf("got %d processed requests; want 1", processed)
+	}
+
+	ts.header.Del(idempotencyKeyHeader)
+	if n := countExpenses(t, ts); n != 1 {
+		t.Errorf("got %d expenses; want 1", n)
+	}
+}
+
+// failingIdempotencyKeys cannot store responses
+type failingIdempotencyKeys struct {
+	models.IdempotencyRepository
+}
+
+func (f *failingIdempotencyKeys) Complete(userId, idempotencyKey string, status int, contentType, etag string, body []byte) error {
+	return errors.New("idempotency keys are unavailable")
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
+
+// loginFailureWindow is how long a failed login counts. The count of a key
+// starts over once its last failure is older.
+const loginFailureWindow = 15 * time.Minute
+
+// define loginLimit type, how failed logins slow down and lock out the
+// logins of a key
+type loginLimit struct {
+	// freeFailures are not slowed down. Every failure after them doubles
+	// the wait before the next login, starting at a second, up to maxDelay.
+	freeFailures int
+	maxDelay     time.Duration
+	// lockAfter failures refuse the logins of the key for lockout
+	lockAfter int
+	lockout   time.Duration
+}
+
+// The limits of one account, and of one client address, which may be shared
+// by the users of a network and so allows more failures
+var (
+	accountLoginLimit = loginLimit{freeFailures: 3, maxDelay: 30 * time.Second, lockAfter: 10, lockout: 15 * time.Minute}
+	clientLoginLimit  = loginLimit{freeFailures: 20, maxDelay: 30 * time.Second, lockAfter: 100, lockout: 15 * time.Minute}
+)
+
+// retryAfter returns how long the key of the failed logins must wait
+// before its next login, and whether it is locked out
+func (l loginLimit) retryAfter(a *models.LoginAttempt, now time.Time) (time.Duration, bool) {
+	if a.LockedUntil != nil && now.Before(*a.LockedUntil) {
+		return a.LockedUntil.Sub(now), true
+	}
+	if a.Failures <= l.freeFailures || now.Sub(a.LastFailureAt) >= loginFailureWindow {
+		return 0, false
+	}
+
+	delay := l.maxDelay
+	if doublings := a.Failures - l.freeFailures - 1; doublings < 30 {
+		delay = min(time.Second<<doublings, l.maxDelay)
+	}
+	return max(a.LastFailureAt.Add(delay).Sub(now), 0), false
+}
+
+// define loginThrottle type, a key failed logins are counted against
+type loginThrottle struct {
+	key   string
+	limit loginLimit
+	// failures of the key, the login included, once reserveLogin counted it
+	failures int
+}
+
+// loginThrottles returns the keys a login of the email from the client of
+// the request counts against
+func (app *application) loginThrottles(r *http.Request, email string) []loginThrottle {
+	return []loginThrottle{
+		{key: "ip:" + clientNetwork(app.clientIP(r)), limit: clientLoginLimit},
+		{key: accountLoginKey(email), limit: accountLoginLimit},
+	}
+}
+
+// accountLoginKey returns the key of the account of the email. The email is
+// hashed, so that mistyped and unknown addresses are not stored.
+func accountLoginKey(email string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return "account:" + hex.EncodeToString(sum[:])
+}
+
+// reserveLogin tells the client to wait, with a 429 response, if a key of
+// the login has to. Otherwise it counts the login as failed before the
+// password or code is checked, so that concurrent guesses cannot all pass
+// on the same count, and reports that the login may go ahead. The caller
+// then calls failLogin or releaseLogin.
+func (app *application) reserveLogin(w http.ResponseWriter, r *http.Request, throttles []loginThrottle) bool {
+	now := time.Now()
+	var wait time.Duration
+	var locked bool
+	seen := make([]int, len(throttles))
+	for i, t := range throttles {
+		a, err := app.loginAttempts.Get(t.key)
+		if err != nil {
+			if errors.Is(err, models.ErrNoRecord) {
+				continue
+			}
+			app.serverError(w, r, err)
+			return false
+		}
+		if now.Sub(a.LastFailureAt) < loginFailureWindow {
+			seen[i] = a.Failures
+		}
+		keyWait, keyLocked := t.limit.retryAfter(a, now)
+		wait = max(wait, keyWait)
+		locked = locked || keyLocked
+	}
+	if wait > 0 {
+		app.tooManyLogins(w, r, wait, locked)
+		return false
+	}
+
+	// A login beyond the free failures may only go ahead on the count it
+	// was allowed on. When another one was counted in the meantime, this
+	// one waits for the result of the other.
+	raced := false
+	for i := range throttles {
+		a, err := app.loginAttempts.RecordFailure(throttles[i].key, loginFailureWindow)
+		if err != nil {
+			app.releaseReserved(throttles[:i])
+			app.serverError(w, r, err)
+			return false
+		}
+		throttles[i].failures = a.Failures
+		if a.Failures > throttles[i].limit.freeFailures+1 && a.Failures != seen[i]+1 {
+			raced = true
+		}
+	}
+	if raced {
+		app.releaseReserved(throttles)
+		app.tooManyLogins(w, r, time.Second, false)
+		return false
+	}
+	return true
+}
+
+// tooManyLogins writes the 429 response of a login that has to wait
+func (app *application) tooManyLogins(w http.ResponseWriter, r *http.Request, wait time.Duration, locked bool) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	if locked {
+		app.errorResponse(w, r, http.StatusTooManyRequests, ErrCodeLoginLocked, "Too many failed logins, please try again later")
+	} else {
+		app.errorResponse(w, r, http.StatusTooManyRequests, ErrCodeRateLimited, "Please wait a moment before trying to log in again")
+	}
+}
+
+// failLogin keeps the login reserved by reserveLogin counted as failed, and
+// locks out the keys that reached their limit
+func (app *application) failLogin(throttles []loginThrottle) error {
+	for _, t := range throttles {
+		if t.failures < t.limit.lockAfter {
+			continue
+		}
+		until := time.Now().Add(t.limit.lockout)
+		err := app.loginAttempts.Lock(t.key, until)
+		if err != nil {
+			return err
+		}
+		app.infoLog.Printf("login: %s locked out until %s after %d failed logins", t.key, until.UTC().Format(time.RFC3339), t.failures)
+	}
+	return nil
+}
+
+// releaseLogin takes back the count of a login reserved by reserveLogin
+// which did not fail
+func (app *application) releaseLogin(throttles []loginThrottle) error {
+	for _, t := range throttles {
+		err := app.loginAttempts.ForgetFailure(t.key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseReserved takes back the counts of a login that did not go ahead,
+// logging rather than returning the error, as the response is already an
+// error
+func (app *application) releaseReserved(throttles []loginThrottle) {
+	if err := app.releaseLogin(throttles); err != nil {
+		app.errorLog.Printf("login: unable to take back a reserved login: %v", err)
+	}
+}
+
+// expireLoginAttempts forgets the failed logins which no longer count,
+// every interval
+func (app *application) expireLoginAttempts(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n, err := app.loginAttempts.DeleteStale(time.Now().Add(-loginFailureWindow))
+		if err != nil {
+			app.errorLog.Printf("login: unable to delete stale failed logins: %v", err)
+			continue
+		}
+		if n > 0 {
+			app.infoLog.Printf("login: deleted %d stale failed logins", n)
+		}
+	}
+}
+
+// clientIP returns the address of the client of the request. Behind a
+// trusted proxy it is the last address of X-Forwarded-For, the one the proxy
+// added; the addresses before it are set by the client.
+func (app *application) clientIP(r *http.Request) string {
+	if app.trustProxy {
+		if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			addresses := strings.Split(forwarded[len(forwarded)-1], ",")
+			if ip := strings.TrimSpace(addresses[len(addresses)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// clientNetwork returns the /64 network of an IPv6 address, which a client
+// usually has the whole of, and any other address as it is
+func clientNetwork(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || !addr.Is6() || addr.Is4In6() {
+		return ip
+	}
+	prefix, err := addr.Prefix(64)
+	if err != nil {
+		return ip
+	}
+	return prefix.String()
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
+
+// setLoginLimits replaces the limits of accounts and client addresses for
+// the test
+func setLoginLimits(t *testing.T, account, client loginLimit) {
+	t.Helper()
+
+	accountBefore, clientBefore := accountLoginLimit, clientLoginLimit
+	t.Cleanup(func() {
+		accountLoginLimit, clientLoginLimit = accountBefore, clientBefore
+	})
+	accountLoginLimit, clientLoginLimit = account, client
+}
+
+// accountFailures returns the failed logins counted against the account of
+// the email
+func accountFailures(t *testing.T, app *application, email string) int {
+	t.Helper()
+
+	a, err := app.loginAttempts.Get(accountLoginKey(email))
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			return 0
+		}
+		t.Fatal(err)
+	}
+	return a.Failures
+}
+
+// expectThrottled checks a 429 response and its Retry-After header
+func expectThrottled(t *testing.T, step string, res *http.Response, body []byte, wantCode string, wantRetryAfter int) {
+	t.Helper()
+
+	expectStatus(t, step, res.StatusCode, http.StatusTooManyRequests)
+	if got, _ := strconv.Atoi(res.Header.Get("Retry-After")); got < 1 || got > wantRetryAfter {
+		t.Errorf("%s: got Retry-After %q; want 1 to %d", step, res.Header.Get("Retry-After"), wantRetryAfter)
+	}
+	var problem Problem
+	if err := json.Unmarshal(body, &problem); err != nil {
+		t.Fatal(err)
+	}
+	if problem.Code != wantCode {
+		t.Errorf("%s: got code %q; want %q", step, problem.Code, wantCode)
+	}
+}
+
+func TestLoginThrottle(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	const email = "throttle@example.com"
+	ts.signUpAndLogIn(t, email)
+
+	visitor := ts.newClient(t)
+	visitor.refreshCSRF(t)
+	login := func(password string) (*http.Response, []byte) {
+		return visitor.do(t, http.MethodPost, "/api/users/login", map[string]string{"email": email, "password": password})
+	}
+
+	// The free failures, and the first one after them, are checked
+	for i := 0; i <= accountLoginLimit.freeFailures; i++ {
+		res, _ := login("wrong-password")
+		expectStatus(t, "wrong password", res.StatusCode, http.StatusUnauthorized)
+	}
+	res, body := login(testPassword)
+	expectThrottled(t, "right password too early", res, body, ErrCodeRateLimited, 1)
+	if n := accountFailures(t, app, email); n != accountLoginLimit.freeFailures+1 {
+		t.Errorf("got %d failures; want %d, the refused login not counted", n, accountLoginLimit.freeFailures+1)
+	}
+
+	// Enough failures lock the account out, whatever the password
+	setLoginLimits(t, loginLimit{freeFailures: 100, lockAfter: 2, lockout: time.Hour}, clientLoginLimit)
+	if err := app.loginAttempts.Reset(accountLoginKey(email)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		res, _ := login("wrong-password")
+		expectStatus(t, "wrong password", res.StatusCode, http.StatusUnauthorized)
+	}
+	res, body = login(testPassword)
+	expectThrottled(t, "right password when locked out", res, body, ErrCodeLoginLocked, 3600)
+}
+
+// A login that succeeds takes back the count it was reserved with
+func TestLoginThrottleSuccess(t *testing.T) {
+	// A single free failure of the address, which successful logins must
+	// not use up
+	setLoginLimits(t, accountLoginLimit, loginLimit{freeFailures: 1, maxDelay: 30 * time.Second, lockAfter: 100, lockout: time.Hour})
+
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	const email = "success@example.com"
+	ts.signUpAndLogIn(t, email)
+
+	for i := 0; i < 5; i++ {
+		ts.logIn(t, email)
+	}
+	if n := accountFailures(t, app, email); n != 0 {
+		t.Errorf("got %d failures of the account; want none", n)
+	}
+
+	// Nor do the right passwords of account changes
+	for i := 0; i < 5; i++ {
+		status := ts.doJSON(t, http.MethodPost, "/api/users/2fa/enroll", map[string]string{"currentPassword": testPassword}, nil)
+		expectStatus(t, "enroll with the right password", status, http.StatusOK)
+	}
+	if n := accountFailures(t, app, email); n != 0 {
+		t.Errorf("got %d failures of the account; want none", n)
+	}
+}
+
+// The current password of account changes counts like the password of a
+// login
+func TestConfirmPasswordThrottle(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	const email = "confirm@example.com"
+	ts.signUpAndLogIn(t, email)
+
+	change := func(password string) (*http.Response, []byte) {
+		return ts.do(t, http.MethodPut, "/api/users/account/password", map[string]string{
+			"currentPassword": password,
+			"newPassword":     "n3w-pa$$word",
+		})
+	}
+
+	for i := 0; i <= accountLoginLimit.freeFailures; i++ {
+		res, _ := change("wrong-password")
+		expectStatus(t, "wrong current password", res.StatusCode, http.StatusForbidden)
+	}
+	res, body := change(testPassword)
+	expectThrottled(t, "right current password too early", res, body, ErrCodeRateLimited, 1)
+
+	// The failures hold back logins of the account too
+	visitor := ts.newClient(t)
+	visitor.refreshCSRF(t)
+	res, body = visitor.do(t, http.MethodPost, "/api/users/login", map[string]string{"email": email, "password": testPassword})
+	expectThrottled(t, "login after the wrong current passwords", res, body, ErrCodeRateLimited, 1)
+}
+
+// Concurrent guesses cannot get more than the free failures checked at once,
+// whether at a login or at an account change
+func TestLoginThrottleConcurrent(t *testing.T) {
+	tests := []struct {
+		name       string
+		wantStatus int
+		guess      func(t *testing.T, ts *testServer, email string) (*http.Response, []byte)
+	}{
+		{"login", http.StatusUnauthorized, func(t *testing.T, ts *testServer, email string) (*http.Response, []byte) {
+			return ts.do(t, http.MethodPost, "/api/users/login", map[string]string{"email": email, "password": "wrong-password"})
+		}},
+		{"confirm password", http.StatusForbidden, func(t *testing.T, ts *testServer, email string) (*http.Response, []byte) {
+			return ts.do(t, http.MethodDelete, "/api/users/account", map[string]string{"currentPassword": "wrong-password"})
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app.routes())
+			const email = "concurrent-login@example.com"
+			ts.signUpAndLogIn(t, email)
+
+			// Slow the password check down, so that the guesses run at
+			// the same time
+			app.user = &slowUsers{UserRepository: app.user}
+
+			const requests = 20
+			statuses := make([]int, requests)
+			var wg sync.WaitGroup
+			for i := 0; i < requests; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					res, _ := tt.guess(t, ts, email)
+					statuses[i] = res.StatusCode
+				}(i)
+			}
+			wg.Wait()
+
+			checked := 0
+			for _, status := range statuses {
+				switch status {
+				case tt.wantStatus:
+					checked++
+				case http.StatusTooManyRequests:
+				default:
+					t.Errorf("got status %d; want %d or %d", status, tt.wantStatus, http.StatusTooManyRequests)
+				}
+			}
+			if checked == 0 || checked > accountLoginLimit.freeFailures+1 {
+				t.Errorf("got %d checked passwords; want 1 to %d", checked, accountLoginLimit.freeFailures+1)
+			}
+			// The refused guesses are not counted
+			if n := accountFailures(t, app, email); n != checked {
+				t.Errorf("got %d failures; want %d", n, checked)
+			}
+		})
+	}
+}
+
+// slowUsers takes a while to check passwords
+type slowUsers struct {
+	models.UserRepository
+}
+
+func (s *slowUsers) Authenticate(email, password string) (string, error) {
+	time.Sleep(50 * time.Millisecond)
+	return s.UserRepository.Authenticate(email, password)
+}
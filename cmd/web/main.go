@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	// The driver’s init() function must be run so that it can register itself with the
 	// database/sql package. To ensure this, we use the blank identifier to import
 	// the package. This is a common pattern in Go for initializing SQL drivers.
@@ -13,25 +14,76 @@ import (
 	"time"
 
 	"kweeuhree.personal-budgeting-backend/internal/config"
+	"kweeuhree.personal-budgeting-backend/internal/events"
+	"kweeuhree.personal-budgeting-backend/internal/integrity"
+	"kweeuhree.personal-budgeting-backend/internal/mailer"
+	"kweeuhree.personal-budgeting-backend/internal/migrations"
 	"kweeuhree.personal-budgeting-backend/internal/models"
+	"kweeuhree.personal-budgeting-backend/internal/pgstore"
+	"kweeuhree.personal-budgeting-backend/internal/sqlitestore"
+	"kweeuhree.personal-budgeting-backend/internal/webhooks"
 
 	// Load environment variables for development
 	"github.com/joho/godotenv"
 
 	"github.com/alexedwards/scs/mysqlstore"
 	"github.com/alexedwards/scs/v2"
+	_ "github.com/jackc/pgx/v5/stdlib"
 )
 
 // Define an application struct to hold the application-wide dependencies for
 // the web application
 type application struct {
+	store           models.Store
 	errorLog        *log.Logger
 	infoLog         *log.Logger
-	user            *models.UserModel
-	budget          *models.BudgetModel
-	expenses        *models.ExpenseModel
-	expenseCategory *models.ExpenseCategoryModel
-	sessionManager  *scs.SessionManager
+	user            models.UserRepository
+	budget          models.BudgetRepository
+	expenses        models.ExpenseRepository
+	expenseCategory models.ExpenseCategoryRepository
+	idempotencyKeys models.IdempotencyRepository
+	events          *events.Hub
+	webhooks        models.WebhookRepository
+	auditLog        models.AuditRepository
+	passwordResets  models.PasswordResetRepository
+	// emailVerifications holds the tokens emailed to verify addresses
+	emailVerifications models.EmailVerificationRepository
+	twoFactor          models.TwoFactorRepository
+	// loginAttempts counts failed logins to slow down password guessing
+	loginAttempts models.LoginAttemptRepository
+	apiTokens     models.APITokenRepository
+	// userIdentities links the accounts of single sign-on providers to users
+	userIdentities models.UserIdentityRepository
+	// userSessions lists the sessions each user is logged in with
+	userSessions models.UserSessionRepository
+	stats        models.StatsRepository
+	mailer       mailer.Mailer
+	// passwordResetURL is the frontend page linked from reset emails
+	passwordResetURL string
+	// emailVerificationURL is the frontend page linked from verification emails
+	emailVerificationURL string
+	// unverifiedAccess is what users who have not verified their email may
+	// do, one of the config.UnverifiedAccess values. Empty means full access.
+	unverifiedAccess string
+	// ssoProviders are the OpenID Connect providers users can log in with
+	ssoProviders []*ssoProvider
+	// ssoRedirectURL is the frontend page users land on after a single sign-on
+	ssoRedirectURL string
+	// eventHeartbeat is how often open event streams are kept alive and
+	// checked to still be authorized
+	eventHeartbeat time.Duration
+	// webhookAllowPrivate lets webhooks point to loopback and private addresses
+	webhookAllowPrivate bool
+	// trustProxy takes the client address from X-Forwarded-For
+	trustProxy   bool
+	integrity    *integrity.Checker
+	adminUserIds []string
+	// pendingEvents collects the events published inside withTx, it is nil
+	// outside of a transaction
+	pendingEvents *[]events.Event
+	// actor made the changes of the transaction, it is recorded in the audit log
+	actor          *auditActor
+	sessionManager *scs.SessionManager
 }
 
 const (
@@ -71,29 +123,89 @@ func main() {
 	}
 
 	// Initialize connection with relevant database connection string
-	db, err := openDB(cfg.DSN)
+	dialect, err := models.DialectFor(cfg.Driver)
+	if err != nil {
+		errorLog.Fatalf("Error loading configuration: %v", err)
+	}
+
+	db, err := openDB(dialect, cfg.DSN)
 	if err != nil {
 		errorLog.Fatalf("Database connection failed: %v", err)
 	}
 	defer db.Close()
 
-	// Create a new MySQL session store using the connection pool
-	store := mysqlstore.New(db)
-	// Use the MySQL session store with the session manager
-	cfg.SessionManager.Store = store
+	// Bring the schema up to date before anything uses it
+	if cfg.AutoMigrate {
+		migrator, err := migrations.New(db, dialect, infoLog)
+		if err != nil {
+			errorLog.Fatalf("Loading migrations failed: %v", err)
+		}
+		_, err = migrator.Up()
+		if err != nil {
+			errorLog.Fatalf("Migration failed: %v", err)
+		}
+	}
+
+	// Keep the sessions in the same database as the rest of the data
+	switch dialect {
+	case models.SQLite:
+		cfg.SessionManager.Store = sqlitestore.New(db)
+	case models.Postgres:
+		cfg.SessionManager.Store = pgstore.New(db)
+	default:
+		cfg.SessionManager.Store = mysqlstore.New(db)
+	}
 
-	budgetModel := models.NewBudgetModel(db, infoLog, errorLog)
+	store := models.NewSQLStore(db, dialect, infoLog, errorLog)
 
 	// Initialize application with its dependencies
-	app := &application{
-		errorLog:        errorLog,
-		infoLog:         infoLog,
-		user:            &models.UserModel{DB: db},
-		budget:          budgetModel,
-		expenses:        &models.ExpenseModel{DB: db},
-		expenseCategory: &models.ExpenseCategoryModel{DB: db},
-		sessionManager:  cfg.SessionManager,
+	app := newApplication(store, infoLog, errorLog)
+	app.integrity = &integrity.Checker{DB: db, Dialect: dialect, InfoLog: infoLog, ErrorLog: errorLog}
+	app.adminUserIds = cfg.AdminUserIds
+	app.sessionManager = cfg.SessionManager
+	app.mailer = cfg.Mailer
+	app.passwordResetURL = cfg.PasswordResetURL
+	app.emailVerificationURL = cfg.EmailVerificationURL
+	app.unverifiedAccess = cfg.UnverifiedAccess
+	app.trustProxy = cfg.TrustProxy
+	app.ssoProviders = newSSOProviders(cfg.SSOProviders, cfg.SSOCallbackURL)
+	app.ssoRedirectURL = cfg.SSORedirectURL
+	app.webhookAllowPrivate = cfg.WebhookAllowPrivate
+
+	// Record the sessions logged in before sessions were recorded, so that
+	// logging a user out everywhere ends them too
+	recorded, err := app.recordStoredSessions()
+	if err != nil {
+		errorLog.Fatalf("Recording sessions failed: %v", err)
 	}
+	if recorded > 0 {
+		infoLog.Printf("sessions: recorded %d sessions", recorded)
+	}
+
+	// Remove stored idempotent responses once they can no longer be replayed
+	go app.expireIdempotencyKeys(time.Hour)
+
+	// Remove password reset tokens once they have expired
+	go app.expirePasswordResets(time.Hour)
+
+	// Remove email verification tokens once they have expired
+	go app.expireEmailVerifications(time.Hour)
+
+	// Forget failed logins once they no longer slow down or lock out logins
+	go app.expireLoginAttempts(time.Hour)
+
+	// Remove API tokens a while after they expired
+	go app.expireAPITokens(time.Hour)
+
+	// Forget the sessions which expired
+	go app.expireUserSessions(time.Hour)
+
+	// Remove audit entries once they are older than the retention period
+	go app.expireAuditEntries(time.Hour, cfg.AuditRetention)
+
+	// Deliver the events of the webhook outbox, retrying failed deliveries
+	dispatcher := webhooks.NewDispatcher(app.webhooks, errorLog, cfg.WebhookAllowPrivate)
+	go dispatcher.Run(context.Background(), webhookDispatchInterval)
 
 	infoLog.Printf("Configuring server for %s...", env)
 	srv := &http.Server{
@@ -131,9 +243,39 @@ func main() {
 	}
 }
 
-// The openDB() function wraps sql.Open() and returns a sql.DB connection pool for a given dsn
-func openDB(dsn string) (*sql.DB, error) {
-	db, err := sql.Open("mysql", dsn)
+// newApplication returns an application whose models are the repositories
+// of store. The session manager, mailer, integrity checker, administrators
+// and access policy of unverified users are left for the caller to set.
+func newApplication(store models.Store, infoLog, errorLog *log.Logger) *application {
+	repos := store.Repositories()
+	return &application{
+		store:              store,
+		errorLog:           errorLog,
+		infoLog:            infoLog,
+		user:               repos.Users,
+		budget:             repos.Budgets,
+		expenses:           repos.Expenses,
+		expenseCategory:    repos.ExpenseCategories,
+		idempotencyKeys:    repos.IdempotencyKeys,
+		events:             events.NewHub(eventReplayBuffer),
+		eventHeartbeat:     eventHeartbeatInterval,
+		webhooks:           repos.Webhooks,
+		auditLog:           repos.AuditLog,
+		passwordResets:     repos.PasswordResets,
+		emailVerifications: repos.EmailVerifications,
+		twoFactor:          repos.TwoFactor,
+		loginAttempts:      repos.LoginAttempts,
+		apiTokens:          repos.APITokens,
+		userIdentities:     repos.UserIdentities,
+		userSessions:       repos.UserSessions,
+		stats:              repos.Stats,
+	}
+}
+
+// The openDB() function wraps sql.Open() and returns a sql.DB connection pool
+// for a given dsn of the database of the dialect
+func openDB(dialect models.Dialect, dsn string) (*sql.DB, error) {
+	db, err := sql.Open(dialect.Driver(), dsn)
 	if err != nil {
 		return nil, err
 	}
@@ -5,7 +5,11 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"slices"
 
+	"kweeuhree.personal-budgeting-backend/internal/config"
+
+	"github.com/google/uuid"
 	// double submit cookies
 	"github.com/justinas/nosurf"
 )
@@ -18,8 +22,8 @@ func secureHeaders(next http.Handler) http.Handler {
 		// Handle OPTIONS requests for CORS preflight
 		if r.Method == http.MethodOptions {
 			w.Header().Set("Access-Control-Allow-Origin", reactAddress)
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-CSRF-Token")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-CSRF-Token, If-Match, Idempotency-Key")
 			w.Header().Set("Access-Control-Allow-Credentials", "true") // Allow credentials (cookies)
 			w.WriteHeader(http.StatusOK)                               // Respond with HTTP 200 OK for preflight
 			return
@@ -28,16 +32,19 @@ func secureHeaders(next http.Handler) http.Handler {
 		w.Header().Set("Access-Control-Allow-Origin", reactAddress)
 
 		// Allow specific HTTP methods
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
 
 		// Allow specific headers
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-CSRF-Token")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-CSRF-Token, If-Match, Idempotency-Key")
 		w.Header().Set("Content-Security-Policy", "default-src 'self'; style-src 'self' fonts.googleapis.com; font-src fonts.gstatic.com")
 		w.Header().Set("Referrer-Policy", "origin-when-cross-origin")
 		w.Header().Set("X-Content-Type-Options", "nosniff")
 		w.Header().Set("X-Frame-Options", "deny")
 		w.Header().Set("X-XSS-Protection", "0")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		// Let the frontend read the request id to quote it in bug reports, the
+		// ETag to send back in If-Match, and whether a response was replayed
+		w.Header().Set("Access-Control-Expose-Headers", "X-Request-Id, ETag, Idempotent-Replayed")
 
 		next.ServeHTTP(w, r)
 	})
@@ -50,11 +57,7 @@ func (app *application) requireAuthentication(next http.Handler) http.Handler {
 		// the chain are executed.
 		if !app.isAuthenticated(r) {
 			app.errorLog.Println("Authenticated request blocked.")
-			response := map[string]string{
-				"status":  "401 Unauthorized",
-				"message": "You must be logged in to access this resource",
-			}
-			encodeJSON(w, http.StatusUnauthorized, response)
+			app.errorResponse(w, r, http.StatusUnauthorized, ErrCodeUnauthenticated, "You must be logged in to access this resource")
 			return
 		}
 		// Otherwise set the "Cache-Control: no-store" header so that pages
@@ -67,8 +70,87 @@ func (app *application) requireAuthentication(next http.Handler) http.Handler {
 	})
 }
 
+// Only let the users with one of the roles through, it must run after
+// requireAuthentication. The users listed in ADMIN_USER_IDS are admins
+// whatever their role, so that they can appoint the first admins.
+func (app *application) requireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+			role, err := app.userRole(userId)
+			if err != nil {
+				app.serverError(w, r, err)
+				return
+			}
+			if !slices.Contains(roles, role) {
+				app.errorResponse(w, r, http.StatusForbidden, ErrCodeForbidden, "You are not allowed to access this resource")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Hold back users who have not verified their email address, as far as the
+// UNVERIFIED_ACCESS policy says. Read-only access lets safe requests
+// through. It must run after requireAuthentication.
+func (app *application) requireVerifiedEmail(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch app.unverifiedAccess {
+		case "", config.UnverifiedAccessFull:
+			next.ServeHTTP(w, r)
+			return
+		case config.UnverifiedAccessReadOnly:
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+		verified, err := app.user.IsEmailVerified(userId)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		if !verified {
+			app.errorResponse(w, r, http.StatusForbidden, ErrCodeEmailUnverified, "Please verify your email address first")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Load the session of the request, and save it once the request is
+// handled. A request with an API token gets a fresh session instead, which
+// is never saved, so that scripts do not leave sessions behind.
+func (app *application) loadSession(next http.Handler) http.Handler {
+	loadAndSave := app.sessionManager.LoadAndSave(next)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := bearerToken(r); !ok {
+			loadAndSave.ServeHTTP(w, r)
+			return
+		}
+		ctx, err := app.sessionManager.Load(r.Context(), "")
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A request with an API token is authenticated by the token alone,
+		// a session cookie sent along is ignored
+		if token, ok := bearerToken(r); ok {
+			app.authenticateAPIToken(w, r, token, next)
+			return
+		}
+
 		// Retrieve the authenticatedUserId value from the session
 		id := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
 
@@ -79,10 +161,10 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 		// Otherwise, we check to see if a user with that ID exists in our
-		// database.
-		exists, err := app.user.Exists(id)
+		// database, and was not disabled by an admin.
+		active, err := app.user.IsActive(id)
 		if err != nil {
-			app.serverError(w, err)
+			app.serverError(w, r, err)
 			return
 		}
 		// If a matching user is found, we know that the request is
@@ -90,7 +172,12 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// create a new copy of the request (with an isAuthenticatedContextKey
 
 		// value of true in the request context) and assign it to r.
-		if exists {
+		if active {
+			err = app.touchSession(r, id)
+			if err != nil {
+				app.serverError(w, r, err)
+				return
+			}
 			ctx := context.WithValue(r.Context(), isAuthenticatedContextKey, true)
 			r = r.WithContext(ctx)
 		}
@@ -112,13 +199,27 @@ func noSurf(next http.Handler) http.Handler {
 	}
 
 	csrfHandler := nosurf.New(next)
+	// Report CSRF failures with the same problem envelope as every other error
+	csrfHandler.SetFailureHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeProblem(w, r, newProblem(http.StatusBadRequest, ErrCodeCSRF, nosurf.Reason(r).Error()))
+	}))
 	csrfHandler.SetBaseCookie(http.Cookie{
 		HttpOnly: true,
 		Path:     "/",
 		Secure:   true,
 		SameSite: sameSite,
 	})
-	return csrfHandler
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Browsers do not send an API token on their own, so a request with
+		// one cannot be forged. The authenticate middleware rejects it if
+		// the token is not valid.
+		if _, ok := bearerToken(r); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		csrfHandler.ServeHTTP(w, r)
+	})
 }
 
 // Returns the CSRF token as a JSON response
@@ -130,13 +231,26 @@ func (app *application) CSRFToken(w http.ResponseWriter, r *http.Request) {
 
 	err := encodeJSON(w, http.StatusOK, map[string]string{"csrf_token": token})
 	if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 	}
 }
 
+// Assign every request a unique id, store it in the request context and echo
+// it back in the X-Request-Id header, so that problem responses and log
+// lines can be correlated
+func requestId(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := uuid.New().String()
+		w.Header().Set("X-Request-Id", id)
+
+		ctx := context.WithValue(r.Context(), requestIdContextKey, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 func (app *application) logRequest(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		app.infoLog.Printf("%s - %s %s %s", r.RemoteAddr, r.Proto, r.Method,
+		app.infoLog.Printf("[%s] %s - %s %s %s", requestIdFromContext(r.Context()), r.RemoteAddr, r.Proto, r.Method,
 			r.URL.RequestURI())
 		next.ServeHTTP(w, r)
 	})
@@ -171,7 +285,7 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 				w.Header().Set("Connection", "close")
 				// Call the app.serverError helper method to return a 500
 				// Internal Server response.
-				app.serverError(w, fmt.Errorf("%s", err))
+				app.serverError(w, r, fmt.Errorf("%s", err))
 			}
 		}()
 		next.ServeHTTP(w, r)
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"kweeuhree.personal-budgeting-backend/internal/mailer"
+	"kweeuhree.personal-budgeting-backend/internal/models"
+	"kweeuhree.personal-budgeting-backend/internal/validator"
+)
+
+// ForgotPasswordInput struct for requesting a password reset email
+type ForgotPasswordInput struct {
+	Email               string `json:"email" validate:"required,email"`
+	validator.Validator `json:"-"`
+}
+
+// ResetPasswordInput struct for choosing a new password with a reset token
+type ResetPasswordInput struct {
+	Token               string `json:"token" validate:"required,maxchars=255"`
+	Password            string `json:"password" validate:"required,minchars=8,maxchars=72"`
+	validator.Validator `json:"-"`
+}
+
+type PasswordResetResponse struct {
+	Flash string `json:"flash"`
+}
+
+// send a password reset link to the email of an account. The response is
+// the same whether an account exists for the email or not, so that it
+// cannot be used to find out who has an account.
+func (app *application) forgotPassword(w http.ResponseWriter, r *http.Request) {
+	var form ForgotPasswordInput
+	if err := decodeJSON(w, r, &form); err != nil {
+		return
+	}
+
+	form.Validate()
+	if !form.Valid() {
+		app.failedValidation(w, r, form.Validator)
+		return
+	}
+
+	user, err := app.user.GetByEmail(form.Email)
+	switch {
+	case err == nil:
+		token, err := app.issuePasswordReset(user.UserId)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		// Send in the background, so that the response does not take
+		// longer when the account exists
+		app.background(func() {
+			err := app.sendPasswordReset(user, token)
+			if err != nil {
+				app.errorLog.Printf("password reset: unable to email %s: %v", user.UserId, err)
+			}
+		})
+	case !errors.Is(err, models.ErrNoRecord):
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.setFlash(r.Context(), "If an account exists for this email, a link to reset its password is on its way.")
+
+	err = encodeJSON(w, http.StatusAccepted, PasswordResetResponse{Flash: app.getFlash(r.Context())})
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// choose a new password with the token of a reset email. The token can only
+// be used once, and every session of the user ends, on every device.
+func (app *application) resetPassword(w http.ResponseWriter, r *http.Request) {
+	var form ResetPasswordInput
+	if err := decodeJSON(w, r, &form); err != nil {
+		return
+	}
+
+	form.Validate()
+	if !form.Valid() {
+		app.failedValidation(w, r, form.Validator)
+		return
+	}
+
+	var userId string
+	err := app.withTx(r, func(tx *application) error {
+		var err error
+		userId, err = tx.passwordResets.Consume(hashToken(form.Token))
+		if err != nil {
+			return err
+		}
+		err = tx.user.UpdatePassword(userId, form.Password)
+		if err != nil {
+			return err
+		}
+		return tx.audit(userId, models.AuditActionPasswordReset, models.AuditEntityUser, userId, nil, nil)
+	})
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidResetToken) {
+			form.AddFieldError("token", "This link is invalid or has expired")
+			p := newProblem(http.StatusBadRequest, ErrCodeInvalidResetToken, "The password reset link is invalid or has expired")
+			p.FieldErrors = form.FieldErrors
+			writeProblem(w, r, p)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	_, err = app.destroyUserSessions(userId)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// Log out the current session as well
+	err = app.sessionManager.RenewToken(r.Context())
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.sessionManager.Remove(r.Context(), "authenticatedUserID")
+	app.sessionManager.Remove(r.Context(), sessionLastSeenKey)
+	app.setFlash(r.Context(), "Your password was changed. Please log in.")
+
+	err = encodeJSON(w, http.StatusOK, PasswordResetResponse{Flash: app.getFlash(r.Context())})
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// issuePasswordReset stores a new reset token of the user and returns it
+func (app *application) issuePasswordReset(userId string) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	err = app.passwordResets.Insert(hashToken(token), userId, time.Now().Add(models.PasswordResetTTL))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// sendPasswordReset emails the user a link to the reset page of the
+// frontend, carrying the token
+func (app *application) sendPasswordReset(user *models.User, token string) error {
+	link, err := url.Parse(app.passwordResetURL)
+	if err != nil {
+		return err
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+
+	return app.mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"Someone asked to reset the password of your Personal Budgeting account. "+
+			"To choose a new password, open this link within %s:\n\n%s\n\n"+
+			"If it wasn't you, ignore this email; your password stays the same.\n",
+			displayNameOrEmail(user.DisplayName, user.Email), models.PasswordResetTTL, link),
+	})
+}
+
+// newToken returns 32 random bytes, encoded to be used in a URL
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the SHA-256 hash of a token, the form it is stored in
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// expirePasswordResets deletes the reset tokens that expired, every interval
+func (app *application) expirePasswordResets(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n, err := app.passwordResets.DeleteExpired()
+		if err != nil {
+			app.errorLog.Printf("password reset: unable to delete expired tokens: %v", err)
+			continue
+		}
+		if n > 0 {
+			app.infoLog.Printf("password reset: deleted %d expired tokens", n)
+		}
+	}
+}
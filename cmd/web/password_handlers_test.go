@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+const resetSubject = "Reset your password"
+
+// The response to a reset request is the same whether an account exists for
+// the email or not, and only an existing account is emailed
+func TestForgotPasswordUnknownEmail(t *testing.T) {
+	app := newTestApplication(t)
+	dir := useFileMailer(t, app)
+	ts := newTestServer(t, app.routes())
+	ts.signUpAndLogIn(t, "known@example.com")
+
+	visitor := ts.newClient(t)
+	visitor.refreshCSRF(t)
+
+	res, unknown := visitor.do(t, http.MethodPost, "/api/users/password/forgot", map[string]string{"email": "unknown@example.com"})
+	expectStatus(t, "unknown email", res.StatusCode, http.StatusAccepted)
+	res, known := visitor.do(t, http.MethodPost, "/api/users/password/forgot", map[string]string{"email": "known@example.com"})
+	expectStatus(t, "known email", res.StatusCode, http.StatusAccepted)
+
+	if string(unknown) != string(known) {
+		t.Errorf("got %q for an unknown email and %q for a known one; want the same", unknown, known)
+	}
+
+	waitForMails(t, dir, "known@example.com", resetSubject, 1)
+	if mails := readMails(t, dir, "unknown@example.com", resetSubject); len(mails) != 0 {
+		t.Errorf("got %d emails to the unknown address; want none", len(mails))
+	}
+}
+
+// A reset token changes the password once, and every session of the user
+// ends
+func TestResetPassword(t *testing.T) {
+	app := newTestApplication(t)
+	dir := useFileMailer(t, app)
+	laptop := newTestServer(t, app.routes())
+	const email = "reset@example.com"
+	laptop.signUpAndLogIn(t, email)
+	phone := laptop.newClient(t)
+	phone.logIn(t, email)
+
+	visitor := laptop.newClient(t)
+	visitor.refreshCSRF(t)
+	status := visitor.doJSON(t, http.MethodPost, "/api/users/password/forgot", map[string]string{"email": email}, nil)
+	expectStatus(t, "forgot password", status, http.StatusAccepted)
+	token := mailToken(t, waitForMails(t, dir, email, resetSubject, 1)[0])
+
+	const newPassword = "n3w-pa$$word"
+	reset := map[string]string{"token": token, "password": newPassword}
+	status = visitor.doJSON(t, http.MethodPost, "/api/users/password/reset", reset, nil)
+	expectStatus(t, "reset password", status, http.StatusOK)
+
+	// The token is single use
+	visitor.refreshCSRF(t)
+	reset["password"] = "an0ther-pa$$word"
+	var problem Problem
+	status = visitor.doJSON(t, http.MethodPost, "/api/users/password/reset", reset, &problem)
+	expectStatus(t, "reuse the token", status, http.StatusBadRequest)
+	if problem.Code != ErrCodeInvalidResetToken {
+		t.Errorf("got code %q; want %q", problem.Code, ErrCodeInvalidResetToken)
+	}
+
+	for name, client := range map[string]*testServer{"laptop": laptop, "phone": phone} {
+		status = client.doJSON(t, http.MethodGet, "/api/users/sessions", nil, nil)
+		expectStatus(t, name+" after the reset", status, http.StatusUnauthorized)
+	}
+
+	visitor.refreshCSRF(t)
+	status = visitor.doJSON(t, http.MethodPost, "/api/users/login", map[string]string{"email": email, "password": testPassword}, nil)
+	expectStatus(t, "log in with the old password", status, http.StatusUnauthorized)
+	status = visitor.doJSON(t, http.MethodPost, "/api/users/login", map[string]string{"email": email, "password": newPassword}, nil)
+	expectStatus(t, "log in with the new password", status, http.StatusOK)
+}
+
+func TestResetPasswordExpiredToken(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	userId := ts.signUpAndLogIn(t, "expired@example.com")
+
+	token, err := newToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = app.passwordResets.Insert(hashToken(token), userId, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var problem Problem
+	status := ts.doJSON(t, http.MethodPost, "/api/users/password/reset", map[string]string{
+		"token":    token,
+		"password": "n3w-pa$$word",
+	}, &problem)
+	expectStatus(t, "expired token", status, http.StatusBadRequest)
+	if problem.Code != ErrCodeInvalidResetToken {
+		t.Errorf("got code %q; want %q", problem.Code, ErrCodeInvalidResetToken)
+	}
+
+	// The password is unchanged and the session still works
+	status = ts.doJSON(t, http.MethodGet, "/api/users/sessions", nil, nil)
+	expectStatus(t, "session after the failed reset", status, http.StatusOK)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Stable, machine-readable error codes returned in the "code" member of
+// every problem response. Clients should switch on these instead of
+// parsing the human-readable title or detail.
+const (
+	ErrCodeInternal              = "internal_error"
+	ErrCodeBadRequest            = "bad_request"
+	ErrCodeInvalidJSON           = "invalid_json"
+	ErrCodeUnsupportedMediaType  = "unsupported_media_type"
+	ErrCodeBodyTooLarge          = "body_too_large"
+	ErrCodeValidation            = "validation_failed"
+	ErrCodeNotFound              = "not_found"
+	ErrCodeMethodNotAllowed      = "method_not_allowed"
+	ErrCodeUnauthenticated       = "unauthenticated"
+	ErrCodeForbidden             = "forbidden"
+	ErrCodeInvalidCredentials    = "invalid_credentials"
+	ErrCodeEmailInUse            = "email_in_use"
+	ErrCodeCSRF                  = "csrf_failed"
+	ErrCodeNoBudget              = "no_budget"
+	ErrCodeInsufficientFunds     = "insufficient_funds"
+	ErrCodeInvalidAmount         = "invalid_amount"
+	ErrCodeInvalidBalanceType    = "invalid_balance_type"
+	ErrCodeBalanceLimit          = "balance_limit"
+	ErrCodePreconditionFailed    = "precondition_failed"
+	ErrCodeIdempotencyKeyReused  = "idempotency_key_reused"
+	ErrCodeIdempotencyInProgress = "idempotency_in_progress"
+	ErrCodeEditConflict          = "edit_conflict"
+	ErrCodeBatchFailed           = "batch_failed"
+	ErrCodeBatchAborted          = "batch_aborted"
+	ErrCodeInvalidResetToken     = "invalid_reset_token"
+	ErrCodeInvalidVerifyToken    = "invalid_verification_token"
+	ErrCodeEmailAlreadyVerified  = "email_already_verified"
+	ErrCodeEmailUnverified       = "email_unverified"
+	ErrCodeRateLimited           = "rate_limited"
+	ErrCodeLoginLocked           = "login_locked"
+	ErrCodeInvalidToken          = "invalid_token"
+	ErrCodeInsufficientScope     = "insufficient_scope"
+	ErrCodeTwoFactorEnabled      = "two_factor_enabled"
+	ErrCodeTwoFactorDisabled     = "two_factor_disabled"
+	ErrCodeInvalidTwoFactorCode  = "invalid_two_factor_code"
+	ErrCodeAccountDisabled       = "account_disabled"
+	ErrCodeCannotChangeSelf      = "cannot_change_self"
+)
+
+// Error codes of a single sign-on, sent to the frontend in the error query
+// parameter of the redirect instead of a problem response
+const (
+	ErrCodeSSOFailed            = "sso_failed"
+	ErrCodeSSODenied            = "sso_denied"
+	ErrCodeSSOEmailUnverified   = "sso_email_unverified"
+	ErrCodeSSOAccountUnverified = "sso_account_unverified"
+	ErrCodeSSOAccountDisabled   = "sso_account_disabled"
+)
+
+// problemContentType is the media type defined by RFC 7807 for problem details
+const problemContentType = "application/problem+json"
+
+// Problem is the single error envelope used by every handler and middleware.
+// It follows RFC 7807 (problem details for HTTP APIs) and adds a stable error
+// code, field-level validation errors and the id of the request that failed.
+type Problem struct {
+	Type           string            `json:"type"`
+	Title          string            `json:"title"`
+	Status         int               `json:"status"`
+	Code           string            `json:"code"`
+	Detail         string            `json:"detail,omitempty"`
+	Instance       string            `json:"instance,omitempty"`
+	RequestId      string            `json:"requestId,omitempty"`
+	FieldErrors    map[string]string `json:"fieldErrors,omitempty"`
+	NonFieldErrors []string          `json:"nonFieldErrors,omitempty"`
+	// Results reports the outcome of every item of a rejected batch request
+	Results any `json:"results,omitempty"`
+}
+
+// newProblem returns a Problem for the given status and code. The type is
+// left as "about:blank", which RFC 7807 defines as "the title is the
+// HTTP status text and carries no additional semantics".
+func newProblem(status int, code, detail string) *Problem {
+	return &Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Code:   code,
+		Detail: detail,
+	}
+}
+
+// writeProblem fills in the request-specific members of the problem and
+// writes it to the response as application/problem+json.
+func writeProblem(w http.ResponseWriter, r *http.Request, p *Problem) error {
+	if r != nil {
+		p.Instance = r.URL.Path
+		p.RequestId = requestIdFromContext(r.Context())
+	}
+
+	jsonData, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", problemContentType)
+	w.WriteHeader(p.Status)
+	_, err = w.Write(jsonData)
+	return err
+}
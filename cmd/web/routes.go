@@ -7,6 +7,7 @@ import (
 
 	"github.com/julienschmidt/httprouter" // router
 	"github.com/justinas/alice"           // middleware
+	"kweeuhree.personal-budgeting-backend/internal/models"
 )
 
 func (app *application) routes() http.Handler {
@@ -36,6 +37,11 @@ func (app *application) routes() http.Handler {
 		http.ServeFile(w, r, indexPath)
 	})
 
+	// Report unsupported methods on known routes as a problem response
+	router.MethodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.clientError(w, r, http.StatusMethodNotAllowed)
+	})
+
 	router.GET("/check-index", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		indexPath := "/opt/render/project/go/src/github.com/kweeuhree/personal-budgeting-backend/ui/static/index.html"
 		if _, err := os.Stat(indexPath); os.IsNotExist(err) {
@@ -61,20 +67,60 @@ func (app *application) routes() http.Handler {
 	})
 
 	// uprotected application routes using the "dynamic" middleware chain, use nosurf middleware
-	dynamic := alice.New(app.sessionManager.LoadAndSave, noSurf, app.authenticate)
+	dynamic := alice.New(app.loadSession, noSurf, app.authenticate)
 
 	// csrf token route
 	router.Handler(http.MethodGet, "/api/csrf-token", dynamic.ThenFunc(app.CSRFToken))
 	// unprotected user routes
 	router.Handler(http.MethodPost, "/api/users/signup", dynamic.ThenFunc(app.userSignup))
 	router.Handler(http.MethodPost, "/api/users/login", dynamic.ThenFunc(app.userLogin))
-
-	// protected application routes, which uses requireAuthentication middleware
-	protected := dynamic.Append(app.requireAuthentication)
+	router.Handler(http.MethodPost, "/api/users/login/2fa", dynamic.ThenFunc(app.userLoginTwoFactor))
+	router.Handler(http.MethodGet, "/api/users/sso", dynamic.ThenFunc(app.ssoProvidersView))
+	router.Handler(http.MethodGet, "/api/users/sso/:provider", dynamic.ThenFunc(app.ssoStart))
+	router.Handler(http.MethodGet, "/api/users/sso/:provider/callback", dynamic.ThenFunc(app.ssoCallback))
+	router.Handler(http.MethodPost, "/api/users/password/forgot", dynamic.ThenFunc(app.forgotPassword))
+	router.Handler(http.MethodPost, "/api/users/password/reset", dynamic.ThenFunc(app.resetPassword))
+	router.Handler(http.MethodPost, "/api/users/email/verify", dynamic.ThenFunc(app.verifyEmail))
+
+	// routes for any logged in user, which lets mutating requests be retried
+	// safely with an Idempotency-Key
+	signedIn := dynamic.Append(app.requireAuthentication, app.idempotency)
+
+	// protected application routes, which are also held back from users who
+	// have not verified their email, as far as UNVERIFIED_ACCESS says
+	protected := dynamic.Append(app.requireAuthentication, app.requireVerifiedEmail, app.idempotency)
 
 	// protected user routes
 	router.Handler(http.MethodGet, "/api/users/view/:userId", protected.ThenFunc(app.viewSpecificUser))
-	router.Handler(http.MethodPost, "/api/users/logout", protected.ThenFunc(app.userLogout))
+	router.Handler(http.MethodPost, "/api/users/logout", signedIn.ThenFunc(app.userLogout))
+	router.Handler(http.MethodPost, "/api/users/email/resend", signedIn.ThenFunc(app.resendVerificationEmail))
+
+	// account settings, open to unverified users so that they can fix a
+	// mistyped email or leave
+	router.Handler(http.MethodPut, "/api/users/account/display-name", signedIn.ThenFunc(app.updateDisplayName))
+	router.Handler(http.MethodPut, "/api/users/account/email", signedIn.ThenFunc(app.changeEmail))
+	router.Handler(http.MethodPut, "/api/users/account/password", signedIn.ThenFunc(app.changePassword))
+	router.Handler(http.MethodGet, "/api/users/account/export", signedIn.ThenFunc(app.exportAccount))
+	router.Handler(http.MethodDelete, "/api/users/account", signedIn.ThenFunc(app.deleteAccount))
+
+	// the sessions of the user on their devices
+	router.Handler(http.MethodGet, "/api/users/sessions", signedIn.ThenFunc(app.sessionsView))
+	router.Handler(http.MethodDelete, "/api/users/sessions", signedIn.ThenFunc(app.sessionsRevokeAll))
+	router.Handler(http.MethodDelete, "/api/users/sessions/:sessionId", signedIn.ThenFunc(app.sessionRevoke))
+
+	// personal API tokens, managed from a session only
+	router.Handler(http.MethodGet, "/api/users/tokens", protected.ThenFunc(app.apiTokensView))
+	router.Handler(http.MethodPost, "/api/users/tokens", protected.ThenFunc(app.apiTokenCreate))
+	router.Handler(http.MethodDelete, "/api/users/tokens/:tokenId", protected.ThenFunc(app.apiTokenDelete))
+
+	// two-factor authentication
+	router.Handler(http.MethodGet, "/api/users/2fa", signedIn.ThenFunc(app.twoFactorStatus))
+	router.Handler(http.MethodPost, "/api/users/2fa/enroll", signedIn.ThenFunc(app.enrollTwoFactor))
+	router.Handler(http.MethodPost, "/api/users/2fa/confirm", signedIn.ThenFunc(app.confirmTwoFactor))
+	router.Handler(http.MethodPost, "/api/users/2fa/disable", signedIn.ThenFunc(app.disableTwoFactor))
+
+	// server-sent events stream of the changes to the data of the user
+	router.Handler(http.MethodGet, "/api/events", protected.ThenFunc(app.eventsStream))
 
 	// budget routes
 	router.Handler(http.MethodGet, "/api/budget/:budgetId/view", protected.ThenFunc(app.budgetView))
@@ -87,6 +133,7 @@ func (app *application) routes() http.Handler {
 	router.Handler(http.MethodGet, "/api/expenses/view", protected.ThenFunc(app.expensesView))
 	router.Handler(http.MethodGet, "/api/expenses/view/:expenseId", protected.ThenFunc(app.specificExpenseView))
 	router.Handler(http.MethodPost, "/api/expenses/create", protected.ThenFunc(app.expenseCreate))
+	router.Handler(http.MethodPost, "/api/expenses/batch", protected.ThenFunc(app.expenseBatch))
 	router.Handler(http.MethodPut, "/api/expenses/update/:expenseId", protected.ThenFunc(app.expenseUpdate))
 	router.Handler(http.MethodDelete, "/api/expenses/delete/:expenseId", protected.ThenFunc(app.expenseDelete))
 
@@ -96,9 +143,68 @@ func (app *application) routes() http.Handler {
 	router.Handler(http.MethodPost, "/api/categories/create", protected.ThenFunc(app.categoryCreate))
 	router.Handler(http.MethodDelete, "/api/categories/delete/:categoryId", protected.ThenFunc(app.categoryDelete))
 
+	// admin routes, only for the admins and the users listed in ADMIN_USER_IDS
+	admin := protected.Append(app.requireRole(models.RoleAdmin))
+	router.Handler(http.MethodGet, "/api/admin/integrity", admin.ThenFunc(app.adminIntegrityCheck))
+	router.Handler(http.MethodPost, "/api/admin/integrity/repair", admin.ThenFunc(app.adminIntegrityRepair))
+	router.Handler(http.MethodGet, "/api/admin/stats", admin.ThenFunc(app.adminStats))
+	router.Handler(http.MethodGet, "/api/admin/users", admin.ThenFunc(app.adminUsersView))
+	router.Handler(http.MethodGet, "/api/admin/users/:userId", admin.ThenFunc(app.adminUserView))
+	router.Handler(http.MethodPost, "/api/admin/users/:userId/disable", admin.ThenFunc(app.adminUserDisable))
+	router.Handler(http.MethodPost, "/api/admin/users/:userId/enable", admin.ThenFunc(app.adminUserEnable))
+	router.Handler(http.MethodPost, "/api/admin/users/:userId/logout", admin.ThenFunc(app.adminUserLogout))
+	router.Handler(http.MethodPut, "/api/admin/users/:userId/role", admin.ThenFunc(app.adminUserSetRole))
+
+	// audit trail of the user
+	router.Handler(http.MethodGet, "/api/audit", protected.ThenFunc(app.auditLogView))
+
+	// webhook routes
+	router.Handler(http.MethodGet, "/api/webhooks", protected.ThenFunc(app.webhooksView))
+	router.Handler(http.MethodPost, "/api/webhooks", protected.ThenFunc(app.webhookCreate))
+	router.Handler(http.MethodDelete, "/api/webhooks/:webhookId", protected.ThenFunc(app.webhookDelete))
+	router.Handler(http.MethodGet, "/api/webhooks/:webhookId/deliveries", protected.ThenFunc(app.webhookDeliveriesView))
+
+	app.routesV2(router, dynamic, signedIn, protected)
+
 	// Create a middleware chain containing our 'standard' middleware
 	// which will be used for every request our application receives.
-	standard := alice.New(app.recoverPanic, app.logRequest, secureHeaders)
+	standard := alice.New(requestId, app.recoverPanic, app.logRequest, secureHeaders)
 	// Return the 'standard' middleware chain followed by the servemux.
 	return standard.Then(router)
 }
+
+// The v2 routes are resource oriented: the HTTP method says what happens to
+// the resource, and the path only names it. They are served side by side with
+// the v1 routes above and share the same middleware chains.
+func (app *application) routesV2(router *httprouter.Router, dynamic, signedIn, protected alice.Chain) {
+	const v2 = "/api/v2"
+
+	router.Handler(http.MethodGet, v2+"/csrf-token", dynamic.ThenFunc(app.CSRFToken))
+
+	// users and sessions
+	router.Handler(http.MethodPost, v2+"/users", dynamic.ThenFunc(app.userSignup))
+	router.Handler(http.MethodPost, v2+"/sessions", dynamic.ThenFunc(app.userLogin))
+	router.Handler(http.MethodDelete, v2+"/sessions/current", signedIn.ThenFunc(app.userLogout))
+
+	// budgets
+	router.Handler(http.MethodGet, v2+"/budgets", protected.ThenFunc(app.budgetsList))
+	router.Handler(http.MethodPost, v2+"/budgets", protected.ThenFunc(app.budgetCreate))
+	router.Handler(http.MethodGet, v2+"/budgets/:budgetId", protected.ThenFunc(app.budgetView))
+	router.Handler(http.MethodPatch, v2+"/budgets/:budgetId", protected.ThenFunc(app.budgetUpdateV2))
+	router.Handler(http.MethodDelete, v2+"/budgets/:budgetId", protected.ThenFunc(app.budgetDeleteV2))
+
+	// expenses
+	router.Handler(http.MethodGet, v2+"/expenses", protected.ThenFunc(app.expensesView))
+	router.Handler(http.MethodPost, v2+"/expenses", protected.ThenFunc(app.expenseCreate))
+	router.Handler(http.MethodGet, v2+"/expenses/:expenseId", protected.ThenFunc(app.expenseViewV2))
+	router.Handler(http.MethodPatch, v2+"/expenses/:expenseId", protected.ThenFunc(app.expensePatch))
+	router.Handler(http.MethodDelete, v2+"/expenses/:expenseId", protected.ThenFunc(app.expenseDeleteV2))
+
+	// expense categories
+	router.Handler(http.MethodGet, v2+"/categories", protected.ThenFunc(app.categoriesView))
+	router.Handler(http.MethodPost, v2+"/categories", protected.ThenFunc(app.categoryCreate))
+	router.Handler(http.MethodGet, v2+"/categories/:categoryId/expenses", protected.ThenFunc(app.categoryExpensesViewV2))
+	router.Handler(http.MethodGet, v2+"/categories/:categoryId", protected.ThenFunc(app.categoryViewV2))
+	router.Handler(http.MethodPatch, v2+"/categories/:categoryId", protected.ThenFunc(app.categoryPatch))
+	router.Handler(http.MethodDelete, v2+"/categories/:categoryId", protected.ThenFunc(app.categoryDeleteV2))
+}
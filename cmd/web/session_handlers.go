@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
+
+// sessionTouchInterval is how often the last use of a session is written,
+// so that the session is not saved again on every request
+const sessionTouchInterval = time.Minute
+
+// sessionUserAgentMaxChars is how much of the User-Agent header is kept
+const sessionUserAgentMaxChars = 255
+
+// sessionLastSeenKey holds when the session was last recorded as used, as a
+// Unix time, so that the record is not written on every request
+const sessionLastSeenKey = "sessionLastSeen"
+
+// Response struct for returning a session of the user
+type SessionResponse struct {
+	SessionId string `json:"sessionId"`
+	// CreatedAt is left out for the sessions logged in before their
+	// details were recorded
+	CreatedAt  *time.Time `json:"createdAt,omitempty"`
+	LastSeenAt time.Time  `json:"lastSeenAt"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	IP         string     `json:"ip"`
+	UserAgent  string     `json:"userAgent"`
+	// Current is set on the session the request was made with
+	Current bool `json:"current"`
+}
+
+// Response struct for returning how many sessions were ended
+type RevokeSessionsResponse struct {
+	Revoked int    `json:"revoked"`
+	Flash   string `json:"flash"`
+}
+
+// Snapshot of the sessions ended by the user, as recorded in the audit log
+type revokedSessionsSnapshot struct {
+	SessionIds []string `json:"sessionIds"`
+}
+
+// read the sessions of the logged in user, the most recently used first
+func (app *application) sessionsView(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+	currentToken := app.sessionManager.Token(r.Context())
+
+	sessions, err := app.userSessions.All(userId)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	response := []SessionResponse{}
+	for _, s := range sessions {
+		response = append(response, SessionResponse{
+			SessionId:  s.SessionId,
+			CreatedAt:  s.CreatedAt,
+			LastSeenAt: s.LastSeenAt,
+			ExpiresAt:  s.ExpiresAt,
+			IP:         s.IP,
+			UserAgent:  s.UserAgent,
+			Current:    s.Token == currentToken,
+		})
+	}
+
+	encodeJSON(w, http.StatusOK, response)
+}
+
+// end a session of the logged in user. Ending the current session logs
+// the user out.
+func (app *application) sessionRevoke(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	sessionId := app.GetIdFromParams(r, "sessionId")
+	if sessionId == "" {
+		app.notFound(w, r)
+		return
+	}
+
+	revoked, err := app.revokeSessions(r, userId, func(id string) bool { return id == sessionId })
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if len(revoked) == 0 {
+		app.notFound(w, r)
+		return
+	}
+
+	app.setFlash(r.Context(), "The session was logged out.")
+	err = encodeJSON(w, http.StatusOK, RevokeSessionsResponse{Revoked: len(revoked), Flash: app.getFlash(r.Context())})
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// end every session of the logged in user, the current one included
+func (app *application) sessionsRevokeAll(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	revoked, err := app.revokeSessions(r, userId, func(string) bool { return true })
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.setFlash(r.Context(), "You were logged out everywhere.")
+	err = encodeJSON(w, http.StatusOK, RevokeSessionsResponse{Revoked: len(revoked), Flash: app.getFlash(r.Context())})
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// revokeSessions destroys the sessions of the user whose id matches, and
+// records them in the audit log. If the current session is one of them, it
+// is logged out under a new token, since the request saves it again when it
+// ends. Returns the ids of the sessions it ended.
+func (app *application) revokeSessions(r *http.Request, userId string, match func(sessionId string) bool) ([]string, error) {
+	currentToken := app.sessionManager.Token(r.Context())
+
+	sessions, err := app.userSessions.All(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	revoked := []string{}
+	revokedCurrent := false
+	for _, s := range sessions {
+		if !match(s.SessionId) {
+			continue
+		}
+		err = app.destroySession(s.Token)
+		if err != nil {
+			return nil, err
+		}
+		revoked = append(revoked, s.SessionId)
+		revokedCurrent = revokedCurrent || s.Token == currentToken
+	}
+	if len(revoked) == 0 {
+		return revoked, nil
+	}
+
+	err = app.withTx(r, func(tx *application) error {
+		return tx.audit(userId, models.AuditActionLogout, models.AuditEntityUser, userId, nil, revokedSessionsSnapshot{
+			SessionIds: revoked,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if revokedCurrent {
+		err = app.sessionManager.RenewToken(r.Context())
+		if err != nil {
+			return nil, err
+		}
+		app.sessionManager.Remove(r.Context(), "authenticatedUserID")
+		app.sessionManager.Remove(r.Context(), sessionLastSeenKey)
+	}
+	return revoked, nil
+}
+
+// recordSession records the session the user just logged in with, under a
+// new session id
+func (app *application) recordSession(r *http.Request, userId string) error {
+	sessionId, err := newToken()
+	if err != nil {
+		return err
+	}
+
+	ctx := r.Context()
+	now := time.Now().UTC().Truncate(time.Second)
+	app.sessionManager.Put(ctx, sessionLastSeenKey, now.Unix())
+	return app.userSessions.Insert(&models.UserSession{
+		Token:     app.sessionManager.Token(ctx),
+		SessionId: sessionId,
+		UserId:    userId,
+		IP:        app.clientIP(r),
+		UserAgent: truncateChars(r.UserAgent(), sessionUserAgentMaxChars),
+		CreatedAt: &now,
+		ExpiresAt: app.sessionManager.Deadline(ctx).UTC().Truncate(time.Second),
+	})
+}
+
+// touchSession records that the logged in session of the request was used,
+// unless that was already recorded in the last sessionTouchInterval.
+// Sessions logged in before they were recorded are recorded now, without
+// the time they were logged in.
+func (app *application) touchSession(r *http.Request, userId string) error {
+	ctx := r.Context()
+	lastSeen := time.Unix(app.sessionManager.GetInt64(ctx, sessionLastSeenKey), 0)
+	if time.Since(lastSeen) < sessionTouchInterval {
+		return nil
+	}
+
+	sessionId, err := newToken()
+	if err != nil {
+		return err
+	}
+	err = app.userSessions.Touch(&models.UserSession{
+		Token:     app.sessionManager.Token(ctx),
+		SessionId: sessionId,
+		UserId:    userId,
+		IP:        app.clientIP(r),
+		UserAgent: truncateChars(r.UserAgent(), sessionUserAgentMaxChars),
+		ExpiresAt: app.sessionManager.Deadline(ctx).UTC().Truncate(time.Second),
+	})
+	if err != nil {
+		return err
+	}
+	app.sessionManager.Put(ctx, sessionLastSeenKey, time.Now().Unix())
+	return nil
+}
+
+// forgetSession removes the record of the session of the request, which
+// is being logged out. Call it before the token of the session is renewed.
+func (app *application) forgetSession(ctx context.Context) error {
+	app.sessionManager.Remove(ctx, sessionLastSeenKey)
+	return app.userSessions.Delete(app.sessionManager.Token(ctx))
+}
+
+// destroySession ends the session of the token, on whichever device it is,
+// and removes its record
+func (app *application) destroySession(token string) error {
+	err := app.sessionManager.Store.Delete(token)
+	if err != nil {
+		return err
+	}
+	return app.userSessions.Delete(token)
+}
+
+// expireUserSessions removes the records of the sessions that expired,
+// every interval
+func (app *application) expireUserSessions(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n, err := app.userSessions.DeleteExpired(time.Now())
+		if err != nil {
+			app.errorLog.Printf("sessions: unable to delete expired sessions: %v", err)
+			continue
+		}
+		if n > 0 {
+			app.infoLog.Printf("sessions: deleted %d expired sessions", n)
+		}
+	}
+}
+
+// recordStoredSessions records the logged in sessions of the session store
+// which have no record, those logged in before sessions were recorded, so
+// that they are listed and ended with the other sessions of their user. The
+// sessions of users who no longer exist are ended. Returns how many
+// sessions it recorded.
+func (app *application) recordStoredSessions() (int, error) {
+	store, ok := app.sessionManager.Store.(scs.IterableStore)
+	if !ok {
+		return 0, nil
+	}
+	stored, err := store.All()
+	if err != nil {
+		return 0, err
+	}
+
+	// The tokens recorded for each user, read once per user
+	recorded := map[string]map[string]bool{}
+	n := 0
+	for token, b := range stored {
+		// A session which cannot be decoded cannot be loaded either
+		deadline, values, err := app.sessionManager.Codec.Decode(b)
+		if err != nil {
+			continue
+		}
+		userId, _ := values["authenticatedUserID"].(string)
+		if userId == "" {
+			continue
+		}
+
+		tokens, ok := recorded[userId]
+		if !ok {
+			exists, err := app.user.Exists(userId)
+			if err != nil {
+				return n, err
+			}
+			if !exists {
+				tokens = nil
+			} else {
+				sessions, err := app.userSessions.All(userId)
+				if err != nil {
+					return n, err
+				}
+				tokens = map[string]bool{}
+				for _, s := range sessions {
+					tokens[s.Token] = true
+				}
+			}
+			recorded[userId] = tokens
+		}
+		if tokens == nil {
+			err = app.sessionManager.Store.Delete(token)
+			if err != nil {
+				return n, err
+			}
+			continue
+		}
+		if tokens[token] {
+			continue
+		}
+
+		sessionId, err := newToken()
+		if err != nil {
+			return n, err
+		}
+		err = app.userSessions.Insert(&models.UserSession{
+			Token:     token,
+			SessionId: sessionId,
+			UserId:    userId,
+			ExpiresAt: deadline.UTC().Truncate(time.Second),
+		})
+		if err != nil {
+			return n, err
+		}
+		tokens[token] = true
+		n++
+	}
+	return n, nil
+}
+
+// truncateChars returns the first n characters of s
+func truncateChars(s string, n int) string {
+	if runes := []rune(s); len(runes) > n {
+		return string(runes[:n])
+	}
+	return s
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// listSessions returns the sessions the client sees, and the session of the
+// client among them
+func listSessions(t *testing.T, ts *testServer) ([]SessionResponse, *SessionResponse) {
+	t.Helper()
+
+	var sessions []SessionResponse
+	status := ts.doJSON(t, http.MethodGet, "/api/users/sessions", nil, &sessions)
+	expectStatus(t, "list sessions", status, http.StatusOK)
+
+	var current *SessionResponse
+	for i := range sessions {
+		if sessions[i].Current {
+			if current != nil {
+				t.Fatal("more than one session is current")
+			}
+			current = &sessions[i]
+		}
+	}
+	if current == nil {
+		t.Fatal("no session is current")
+	}
+	return sessions, current
+}
+
+func TestSessions(t *testing.T) {
+	app := newTestApplication(t)
+	laptop := newTestServer(t, app.routes())
+	const email = "sessions@example.com"
+	userId := laptop.signUpAndLogIn(t, email)
+
+	phone := laptop.newClient(t)
+	phone.header.Set("User-Agent", "phone")
+	phone.logIn(t, email)
+
+	sessions, current := listSessions(t, laptop)
+	if len(sessions) != 2 {
+		t.Fatalf("got %d sessions; want 2", len(sessions))
+	}
+	if current.CreatedAt == nil {
+		t.Error("the time of the login was not recorded")
+	}
+	_, phoneSession := listSessions(t, phone)
+	if phoneSession.SessionId == current.SessionId || phoneSession.UserAgent != "phone" {
+		t.Errorf("got session %+v of the phone", phoneSession)
+	}
+
+	// The laptop logs the phone out
+	var revoked RevokeSessionsResponse
+	status := laptop.doJSON(t, http.MethodDelete, "/api/users/sessions/"+phoneSession.SessionId, nil, &revoked)
+	expectStatus(t, "revoke the phone", status, http.StatusOK)
+	if revoked.Revoked != 1 {
+		t.Errorf("revoked %d sessions; want 1", revoked.Revoked)
+	}
+	res, _ := phone.do(t, http.MethodGet, "/api/users/sessions", nil)
+	expectStatus(t, "phone after the revoke", res.StatusCode, http.StatusUnauthorized)
+	status = laptop.doJSON(t, http.MethodDelete, "/api/users/sessions/"+phoneSession.SessionId, nil, nil)
+	expectStatus(t, "revoke the phone again", status, http.StatusNotFound)
+
+	// Changing the password keeps the laptop logged in and ends the others
+	phone.logIn(t, email)
+	status = laptop.doJSON(t, http.MethodPut, "/api/users/account/password", map[string]string{
+		"currentPassword": testPassword,
+		"newPassword":     testPassword,
+	}, nil)
+	expectStatus(t, "change password", status, http.StatusOK)
+	res, _ = phone.do(t, http.MethodGet, "/api/users/sessions", nil)
+	expectStatus(t, "phone after the password change", res.StatusCode, http.StatusUnauthorized)
+	sessions, _ = listSessions(t, laptop)
+	if len(sessions) != 1 {
+		t.Errorf("got %d sessions after the password change; want 1", len(sessions))
+	}
+
+	// Logging out everywhere ends the current session too
+	phone.logIn(t, email)
+	status = laptop.doJSON(t, http.MethodDelete, "/api/users/sessions", nil, &revoked)
+	expectStatus(t, "revoke all", status, http.StatusOK)
+	if revoked.Revoked != 2 {
+		t.Errorf("revoked %d sessions; want 2", revoked.Revoked)
+	}
+	for _, ts := range []*testServer{laptop, phone} {
+		res, _ = ts.do(t, http.MethodGet, "/api/users/sessions", nil)
+		expectStatus(t, "after revoking all", res.StatusCode, http.StatusUnauthorized)
+	}
+
+	// Logging out removes the record of the session
+	laptop.logIn(t, email)
+	laptop.refreshCSRF(t)
+	status = laptop.doJSON(t, http.MethodPost, "/api/users/logout", nil, nil)
+	expectStatus(t, "logout", status, http.StatusOK)
+	left, err := app.userSessions.All(userId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 0 {
+		t.Errorf("%d sessions are recorded after logging out everywhere; want 0", len(left))
+	}
+}
+
+// The sessions logged in before sessions were recorded are recorded from the
+// session store, so that a password change ends them too
+func TestRecordStoredSessions(t *testing.T) {
+	app := newSQLiteTestApplication(t)
+	laptop := newTestServer(t, app.routes())
+	const email = "stored-sessions@example.com"
+	laptop.signUpAndLogIn(t, email)
+	phone := laptop.newClient(t)
+	phone.logIn(t, email)
+
+	// The phone logged in before its session was recorded, and has not
+	// made a request since
+	phoneToken := sessionCookie(t, phone).Value
+	if err := app.userSessions.Delete(phoneToken); err != nil {
+		t.Fatal(err)
+	}
+	// A session of a user who no longer exists
+	b, err := app.sessionManager.Codec.Encode(time.Now().Add(time.Hour), map[string]interface{}{
+		"authenticatedUserID": "no-such-user",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.sessionManager.Store.Commit("orphan-token", b, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	recorded, err := app.recordStoredSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorded != 1 {
+		t.Errorf("recorded %d sessions; want 1", recorded)
+	}
+	if _, found, err := app.sessionManager.Store.Find("orphan-token"); err != nil || found {
+		t.Errorf("got found %t, error %v for the session of the missing user; want it ended", found, err)
+	}
+	recorded, err = app.recordStoredSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorded != 0 {
+		t.Errorf("recorded %d sessions again; want 0", recorded)
+	}
+
+	sessions, _ := listSessions(t, laptop)
+	if len(sessions) != 2 {
+		t.Errorf("got %d sessions; want 2", len(sessions))
+	}
+
+	status := laptop.doJSON(t, http.MethodPut, "/api/users/account/password", map[string]string{
+		"currentPassword": testPassword,
+		"newPassword":     "n3w-pa$$word",
+	}, nil)
+	expectStatus(t, "change password", status, http.StatusOK)
+	res, _ := phone.do(t, http.MethodGet, "/api/users/sessions", nil)
+	expectStatus(t, "phone after the password change", res.StatusCode, http.StatusUnauthorized)
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"kweeuhree.personal-budgeting-backend/internal/config"
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
+
+const (
+	// ssoLoginTimeout is how long a user has to log in at the provider
+	ssoLoginTimeout = 10 * time.Minute
+	// ssoRequestTimeout bounds the requests made to a provider
+	ssoRequestTimeout = 10 * time.Second
+)
+
+// Session keys of a single sign-on waiting for the provider to send the user
+// back, and when it started as a Unix time
+const (
+	ssoProviderKey  = "ssoProvider"
+	ssoStateKey     = "ssoState"
+	ssoNonceKey     = "ssoNonce"
+	ssoVerifierKey  = "ssoVerifier"
+	ssoStartedAtKey = "ssoStartedAt"
+)
+
+// errSSOLogin is returned when the provider vouched for the user, but the
+// user cannot be logged in with it; code tells the frontend why
+type errSSOLogin struct {
+	code string
+}
+
+func (e errSSOLogin) Error() string {
+	return "sso: " + e.code
+}
+
+// define ssoProvider type, an OpenID Connect provider from the config. The
+// provider is discovered on its first use, so that a provider which is down
+// does not keep the server from starting.
+type ssoProvider struct {
+	config.SSOProvider
+	callbackURL string
+
+	mu       sync.Mutex
+	oauth2   *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// newSSOProviders returns the providers of the config, sending the users
+// back to callbackURL followed by /{provider}/callback
+func newSSOProviders(providers []config.SSOProvider, callbackURL string) []*ssoProvider {
+	ssoProviders := []*ssoProvider{}
+	for _, p := range providers {
+		ssoProviders = append(ssoProviders, &ssoProvider{
+			SSOProvider: p,
+			callbackURL: callbackURL + "/" + p.Id + "/callback",
+		})
+	}
+	return ssoProviders
+}
+
+// discover fetches the configuration of the provider the first time it is
+// called, and returns the client of the provider and the verifier of its ID
+// tokens
+func (p *ssoProvider) discover(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.oauth2 != nil {
+		return p.oauth2, p.verifier, nil
+	}
+
+	provider, err := oidc.NewProvider(ssoContext(ctx), p.Issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("discovering %s: %w", p.Id, err)
+	}
+
+	p.oauth2 = &oauth2.Config{
+		ClientID:     p.ClientId,
+		ClientSecret: p.ClientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  p.callbackURL,
+		Scopes:       append([]string{oidc.ScopeOpenID}, p.Scopes...),
+	}
+	p.verifier = provider.VerifierContext(ssoContext(context.Background()), &oidc.Config{ClientID: p.ClientId})
+	return p.oauth2, p.verifier, nil
+}
+
+// ssoContext returns a context whose requests to a provider time out
+func ssoContext(ctx context.Context) context.Context {
+	return oidc.ClientContext(ctx, &http.Client{Timeout: ssoRequestTimeout})
+}
+
+// ssoClaims are the claims of an ID token the user is looked up and created by
+type ssoClaims struct {
+	Subject           string `json:"sub"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+}
+
+// displayName returns the name the provider knows the user by, or the start
+// of their email
+func (c *ssoClaims) displayName() string {
+	name := strings.TrimSpace(c.Name)
+	if name == "" {
+		name = strings.TrimSpace(c.PreferredUsername)
+	}
+	if name == "" {
+		name, _, _ = strings.Cut(c.Email, "@")
+	}
+	return truncateChars(name, 255)
+}
+
+// Response struct for returning the providers users can log in with
+type SSOProviderResponse struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// read the single sign-on providers
+func (app *application) ssoProvidersView(w http.ResponseWriter, r *http.Request) {
+	response := []SSOProviderResponse{}
+	for _, p := range app.ssoProviders {
+		response = append(response, SSOProviderResponse{Id: p.Id, Name: p.Name})
+	}
+
+	encodeJSON(w, http.StatusOK, response)
+}
+
+// start a single sign-on, the user is redirected to the provider
+func (app *application) ssoStart(w http.ResponseWriter, r *http.Request) {
+	p := app.ssoProvider(app.GetIdFromParams(r, "provider"))
+	if p == nil {
+		app.notFound(w, r)
+		return
+	}
+
+	client, _, err := p.discover(r.Context())
+	if err != nil {
+		app.errorLog.Printf("sso: %v", err)
+		app.ssoRedirect(w, r, url.Values{"error": {ErrCodeSSOFailed}})
+		return
+	}
+
+	state, err := newToken()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	nonce, err := newToken()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	// The provider sends the state back, it ties the callback to this session
+	ctx := r.Context()
+	app.sessionManager.Put(ctx, ssoProviderKey, p.Id)
+	app.sessionManager.Put(ctx, ssoStateKey, state)
+	app.sessionManager.Put(ctx, ssoNonceKey, nonce)
+	app.sessionManager.Put(ctx, ssoVerifierKey, verifier)
+	app.sessionManager.Put(ctx, ssoStartedAtKey, time.Now().Unix())
+
+	authURL := client.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// finish a single sign-on, the provider sends the user back with a code
+// that is exchanged for their ID token. The user is redirected to the
+// frontend, logged in or with the code of the error.
+func (app *application) ssoCallback(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	providerId := app.sessionManager.PopString(ctx, ssoProviderKey)
+	state := app.sessionManager.PopString(ctx, ssoStateKey)
+	nonce := app.sessionManager.PopString(ctx, ssoNonceKey)
+	verifier := app.sessionManager.PopString(ctx, ssoVerifierKey)
+	startedAt := time.Unix(app.sessionManager.GetInt64(ctx, ssoStartedAtKey), 0)
+	app.sessionManager.Remove(ctx, ssoStartedAtKey)
+
+	p := app.ssoProvider(app.GetIdFromParams(r, "provider"))
+	if p == nil {
+		app.notFound(w, r)
+		return
+	}
+
+	query := r.URL.Query()
+	if state == "" || providerId != p.Id || time.Since(startedAt) > ssoLoginTimeout ||
+		subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state)) != 1 {
+		app.ssoRedirect(w, r, url.Values{"error": {ErrCodeSSOFailed}})
+		return
+	}
+	// The user said no, or the provider refused them
+	if query.Get("error") != "" {
+		app.ssoRedirect(w, r, url.Values{"error": {ErrCodeSSODenied}})
+		return
+	}
+
+	claims, err := app.exchangeSSOCode(ctx, p, query.Get("code"), verifier, nonce)
+	if err != nil {
+		app.errorLog.Printf("sso: %s: %v", p.Id, err)
+		app.ssoRedirect(w, r, url.Values{"error": {ErrCodeSSOFailed}})
+		return
+	}
+
+	var user *models.User
+	err = app.withTx(r, func(tx *application) error {
+		user, err = tx.ssoUser(p.Id, claims)
+		// A disabled user is not logged in, nor linked to the account
+		if err == nil && user.Disabled() {
+			return errSSOLogin{code: ErrCodeSSOAccountDisabled}
+		}
+		return err
+	})
+	if err != nil {
+		var loginErr errSSOLogin
+		if errors.As(err, &loginErr) {
+			app.ssoRedirect(w, r, url.Values{"error": {loginErr.code}})
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+	// With two-factor authentication on, the frontend asks for the code and
+	// sends it to userLoginTwoFactor
+	tf, err := app.twoFactor.Get(user.UserId)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if tf.Enabled() {
+		err = app.startTwoFactorLogin(ctx, user.UserId)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		app.setFlash(ctx, "Enter the code from your authenticator app.")
+		app.ssoRedirect(w, r, url.Values{"twoFactorRequired": {"true"}})
+		return
+	}
+
+	err = app.logIn(r, user.UserId, user.Email)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.ssoRedirect(w, r, nil)
+}
+
+// exchangeSSOCode exchanges the code of the callback for the ID token of the
+// user, and returns its claims once the token is verified
+func (app *application) exchangeSSOCode(ctx context.Context, p *ssoProvider, code, verifier, nonce string) (*ssoClaims, error) {
+	client, idTokenVerifier, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ssoContext(ctx), ssoRequestTimeout)
+	defer cancel()
+
+	token, err := client.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, fmt.Errorf("exchanging the code: %w", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("no id_token in the token response")
+	}
+	idToken, err := idTokenVerifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(nonce)) != 1 {
+		return nil, errors.New("the nonce of the id_token does not match")
+	}
+
+	claims := &ssoClaims{}
+	err = idToken.Claims(claims)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("the id_token has no subject")
+	}
+	return claims, nil
+}
+
+// ssoUser returns the user the account of the provider is linked to. An
+// account which is not linked yet is linked by its email, which the provider
+// must have verified, to the user with that email if they verified it too,
+// or to a new user.
+func (app *application) ssoUser(providerId string, claims *ssoClaims) (*models.User, error) {
+	identity, err := app.userIdentities.Get(providerId, claims.Subject)
+	if err == nil {
+		return app.user.Get(identity.UserId)
+	}
+	if !errors.Is(err, models.ErrNoRecord) {
+		return nil, err
+	}
+
+	if claims.Email == "" || !claims.EmailVerified {
+		return nil, errSSOLogin{code: ErrCodeSSOEmailUnverified}
+	}
+
+	user, err := app.user.GetByEmail(claims.Email)
+	switch {
+	case err == nil:
+		// Whoever signed up with an email they did not verify may not own
+		// it, the account is only linked once they do
+		if user.EmailVerifiedAt == nil {
+			return nil, errSSOLogin{code: ErrCodeSSOAccountUnverified}
+		}
+	case errors.Is(err, models.ErrNoRecord):
+		user, err = app.createSSOUser(claims)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	err = app.userIdentities.Insert(providerId, claims.Subject, user.UserId, claims.Email)
+	if err != nil {
+		return nil, err
+	}
+	err = app.audit(user.UserId, models.AuditActionLinkIdentity, models.AuditEntityUser, user.UserId, nil, ssoIdentitySnapshot{
+		Provider: providerId,
+		Email:    claims.Email,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// createSSOUser creates the user of an account of a provider. The provider
+// verified their email. Their password is random, they can set one with a
+// password reset.
+func (app *application) createSSOUser(claims *ssoClaims) (*models.User, error) {
+	password, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	user := &models.User{Email: claims.Email, DisplayName: claims.displayName()}
+	user.UserId, err = app.CreateAndStoreUser(user.Email, user.DisplayName, password)
+	if err != nil {
+		return nil, err
+	}
+	err = app.user.MarkEmailVerified(user.UserId)
+	if err != nil {
+		return nil, err
+	}
+	err = app.audit(user.UserId, models.AuditActionCreate, models.AuditEntityUser, user.UserId, nil, userSnapshot{
+		UserId:      user.UserId,
+		Email:       user.Email,
+		DisplayName: user.DisplayName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// ssoIdentitySnapshot is the audited state of a linked account of a provider
+type ssoIdentitySnapshot struct {
+	Provider string `json:"provider"`
+	Email    string `json:"email"`
+}
+
+// ssoProvider returns the provider with the id, or nil
+func (app *application) ssoProvider(id string) *ssoProvider {
+	for _, p := range app.ssoProviders {
+		if p.Id == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// ssoRedirect sends the user back to the frontend with the outcome of the
+// single sign-on in the query
+func (app *application) ssoRedirect(w http.ResponseWriter, r *http.Request, outcome url.Values) {
+	link, err := url.Parse(app.ssoRedirectURL)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	query := link.Query()
+	for key, values := range outcome {
+		query[key] = values
+	}
+	link.RawQuery = query.Encode()
+
+	http.Redirect(w, r, link.String(), http.StatusFound)
+}
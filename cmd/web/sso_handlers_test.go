@@ -0,0 +1,283 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"kweeuhree.personal-budgeting-backend/internal/config"
+	"kweeuhree.personal-budgeting-backend/internal/mockoidc"
+)
+
+// ssoRedirectTarget is the frontend page the tests are sent back to
+const ssoRedirectTarget = "https://frontend.example/sso"
+
+// newSSOTestServer returns a test server whose application logs in with the
+// mock provider, under the id "mock"
+func newSSOTestServer(t *testing.T) (*application, *testServer) {
+	t.Helper()
+
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	useMockProvider(t, app, ts)
+
+	return app, ts
+}
+
+// useMockProvider starts the mock provider and sets up the application of
+// ts to log in with it, under the id "mock"
+func useMockProvider(t *testing.T, app *application, ts *testServer) {
+	t.Helper()
+
+	var provider *mockoidc.Provider
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provider.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	provider, err := mockoidc.New(srv.URL, "budgeting", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app.ssoProviders = newSSOProviders([]config.SSOProvider{{
+		Id:           "mock",
+		Name:         "Mock",
+		Issuer:       srv.URL,
+		ClientId:     "budgeting",
+		ClientSecret: "secret",
+		Scopes:       []string{"email", "profile"},
+	}}, ts.URL+"/api/users/sso")
+	app.ssoRedirectURL = ssoRedirectTarget
+}
+
+// ssoLogin goes through a single sign-on with the mock provider, as a
+// browser would. The form of the provider is filled in with the claims, and
+// can be changed by tamperForm; the callback the provider sends the browser
+// back to can be changed by tamperCallback. It returns the query the
+// frontend is sent back with.
+func ssoLogin(t *testing.T, ts *testServer, claims url.Values, tamperForm, tamperCallback func(url.Values)) url.Values {
+	t.Helper()
+
+	res, _ := ts.do(t, http.MethodGet, "/api/users/sso/mock", nil)
+	expectStatus(t, "start", res.StatusCode, http.StatusFound)
+	authURL, err := res.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The hidden fields of the login form are the query of the authorization
+	// request
+	form := authURL.Query()
+	for name, values := range claims {
+		form[name] = values
+	}
+	form.Set("action", "allow")
+	if tamperForm != nil {
+		tamperForm(form)
+	}
+
+	browser := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	authURL.RawQuery = ""
+	res, err = browser.PostForm(authURL.String(), form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	expectStatus(t, "authorize", res.StatusCode, http.StatusFound)
+	callback, err := res.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(callback.String(), ts.URL+"/api/users/sso/mock/callback?") {
+		t.Fatalf("the provider sent the browser to %s", callback)
+	}
+
+	query := callback.Query()
+	if tamperCallback != nil {
+		tamperCallback(query)
+	}
+	res, _ = ts.do(t, http.MethodGet, callback.Path+"?"+query.Encode(), nil)
+	expectStatus(t, "callback", res.StatusCode, http.StatusFound)
+	outcome, err := res.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(outcome.String(), ssoRedirectTarget) {
+		t.Fatalf("the callback sent the browser to %s", outcome)
+	}
+	return outcome.Query()
+}
+
+// verifiedClaims are the claims of an account whose email the provider
+// verified
+func verifiedClaims(subject, email string) url.Values {
+	return url.Values{
+		"sub":            {subject},
+		"email":          {email},
+		"email_verified": {"true"},
+		"name":           {"Single Sign-On"},
+	}
+}
+
+// expectLoggedIn fails the test if the client is logged in and should not
+// be, or the other way around
+func expectLoggedIn(t *testing.T, ts *testServer, want bool) {
+	t.Helper()
+
+	res, _ := ts.do(t, http.MethodGet, "/api/users/2fa", nil)
+	if loggedIn := res.StatusCode == http.StatusOK; loggedIn != want {
+		t.Errorf("got status %d; want logged in %t", res.StatusCode, want)
+	}
+}
+
+func TestSSOCallbackCreatesAndLinksUser(t *testing.T) {
+	app, ts := newSSOTestServer(t)
+
+	outcome := ssoLogin(t, ts, verifiedClaims("subject-1", "sso@example.com"), nil, nil)
+	if outcome.Get("error") != "" {
+		t.Fatalf("got error %q", outcome.Get("error"))
+	}
+	expectLoggedIn(t, ts, true)
+
+	user, err := app.user.GetByEmail("sso@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.EmailVerifiedAt == nil {
+		t.Error("the email of the new user is not verified")
+	}
+	identity, err := app.userIdentities.Get("mock", "subject-1")
+	if err != nil || identity.UserId != user.UserId {
+		t.Fatalf("got identity %+v, %v; want one of user %s", identity, err, user.UserId)
+	}
+
+	// The account is found by its subject the next time, whatever its email
+	// is by then
+	other := ts.newClient(t)
+	outcome = ssoLogin(t, other, verifiedClaims("subject-1", "renamed@example.com"), nil, nil)
+	if outcome.Get("error") != "" {
+		t.Fatalf("second login: got error %q", outcome.Get("error"))
+	}
+	expectLoggedIn(t, other, true)
+	if _, err := app.user.GetByEmail("renamed@example.com"); err == nil {
+		t.Error("the second login created a user")
+	}
+}
+
+func TestSSOCallbackLinksVerifiedEmail(t *testing.T) {
+	app, ts := newSSOTestServer(t)
+
+	const email = "password@example.com"
+	owner := ts.newClient(t)
+	userId := owner.signUpAndLogIn(t, email)
+
+	// Whoever signed up did not prove they own the email yet
+	outcome := ssoLogin(t, ts, verifiedClaims("subject-2", email), nil, nil)
+	if got := outcome.Get("error"); got != ErrCodeSSOAccountUnverified {
+		t.Errorf("got error %q; want %q", got, ErrCodeSSOAccountUnverified)
+	}
+	expectLoggedIn(t, ts, false)
+
+	err := app.user.MarkEmailVerified(userId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outcome = ssoLogin(t, ts, verifiedClaims("subject-2", email), nil, nil)
+	if outcome.Get("error") != "" {
+		t.Fatalf("got error %q", outcome.Get("error"))
+	}
+	expectLoggedIn(t, ts, true)
+
+	identity, err := app.userIdentities.Get("mock", "subject-2")
+	if err != nil || identity.UserId != userId {
+		t.Errorf("got identity %+v, %v; want one of user %s", identity, err, userId)
+	}
+}
+
+func TestSSOCallbackRefuses(t *testing.T) {
+	otherChallenge := sha256.Sum256([]byte("not the verifier of the session"))
+
+	tests := []struct {
+		name           string
+		claims         url.Values
+		tamperForm     func(url.Values)
+		tamperCallback func(url.Values)
+		wantError      string
+	}{
+		{
+			name:      "unverified email",
+			claims:    url.Values{"sub": {"subject-3"}, "email": {"unverified@example.com"}},
+			wantError: ErrCodeSSOEmailUnverified,
+		},
+		{
+			name:      "no email",
+			claims:    url.Values{"sub": {"subject-4"}, "email_verified": {"true"}},
+			wantError: ErrCodeSSOEmailUnverified,
+		},
+		{
+			name:   "denied",
+			claims: verifiedClaims("subject-5", "denied@example.com"),
+			tamperForm: func(form url.Values) {
+				form.Set("action", "deny")
+			},
+			wantError: ErrCodeSSODenied,
+		},
+		{
+			name:   "state of another login",
+			claims: verifiedClaims("subject-6", "state@example.com"),
+			tamperCallback: func(query url.Values) {
+				query.Set("state", "forged")
+			},
+			wantError: ErrCodeSSOFailed,
+		},
+		{
+			name:   "no state",
+			claims: verifiedClaims("subject-7", "nostate@example.com"),
+			tamperCallback: func(query url.Values) {
+				query.Del("state")
+			},
+			wantError: ErrCodeSSOFailed,
+		},
+		{
+			name:   "nonce of another login",
+			claims: verifiedClaims("subject-8", "nonce@example.com"),
+			tamperForm: func(form url.Values) {
+				form.Set("nonce", "forged")
+			},
+			wantError: ErrCodeSSOFailed,
+		},
+		{
+			// The code was requested for another verifier, the provider
+			// refuses to exchange it for the one of the session
+			name:   "code challenge of another verifier",
+			claims: verifiedClaims("subject-9", "pkce@example.com"),
+			tamperForm: func(form url.Values) {
+				form.Set("code_challenge", base64.RawURLEncoding.EncodeToString(otherChallenge[:]))
+			},
+			wantError: ErrCodeSSOFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, ts := newSSOTestServer(t)
+
+			outcome := ssoLogin(t, ts, tt.claims, tt.tamperForm, tt.tamperCallback)
+			if got := outcome.Get("error"); got != tt.wantError {
+				t.Errorf("got error %q; want %q", got, tt.wantError)
+			}
+			expectLoggedIn(t, ts, false)
+
+			if _, err := app.userIdentities.Get("mock", tt.claims.Get("sub")); err == nil {
+				t.Error("the account was linked")
+			}
+		})
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	"kweeuhree.personal-budgeting-backend/internal/integrity"
+	"kweeuhree.personal-budgeting-backend/internal/mailer"
+	"kweeuhree.personal-budgeting-backend/internal/migrations"
+	"kweeuhree.personal-budgeting-backend/internal/models"
+	"kweeuhree.personal-budgeting-backend/internal/models/memory"
+	"kweeuhree.personal-budgeting-backend/internal/sqlitestore"
+)
+
+// newTestApplication returns an application on the in-memory store, with
+// the sessions kept in memory too and the logs discarded
+func newTestApplication(t *testing.T) *application {
+	t.Helper()
+
+	discard := log.New(io.Discard, "", 0)
+	app := newApplication(memory.NewStore(), discard, discard)
+
+	sessionManager := scs.New()
+	sessionManager.Lifetime = 12 * time.Hour
+	sessionManager.Cookie.Secure = true
+	app.sessionManager = sessionManager
+
+	return app
+}
+
+// newSQLiteTestApplication returns an application on a migrated SQLite
+// database in a temporary file, which also keeps the sessions and is read by
+// the integrity checker
+func newSQLiteTestApplication(t *testing.T) *application {
+	t.Helper()
+
+	dsn := fmt.Sprintf("file:%s?_foreign_keys=on&_busy_timeout=5000&_txlock=immediate&_journal_mode=WAL",
+		filepath.Join(t.TempDir(), "budgeting.db"))
+	db, err := sql.Open(models.SQLite.Driver(), dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	discard := log.New(io.Discard, "", 0)
+	migrator, err := migrations.New(db, models.SQLite, discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	app := newApplication(models.NewSQLStore(db, models.SQLite, discard, discard), discard, discard)
+	app.integrity = &integrity.Checker{DB: db, Dialect: models.SQLite, InfoLog: discard, ErrorLog: discard}
+
+	sessionManager := scs.New()
+	sessionManager.Lifetime = 12 * time.Hour
+	sessionManager.Cookie.Secure = true
+	sessionManager.Store = sqlitestore.NewWithCleanupInterval(db, 0)
+	app.sessionManager = sessionManager
+
+	return app
+}
+
+// testServer is a client of an HTTPS test server which keeps the cookies it
+// is sent, like a browser, and the CSRF token of its session
+type testServer struct {
+	URL       string
+	client    *http.Client
+	csrfToken string
+	// header is sent with every request
+	header http.Header
+}
+
+func newTestServer(t *testing.T, h http.Handler) *testServer {
+	t.Helper()
+
+	ts := httptest.NewTLSServer(h)
+	t.Cleanup(ts.Close)
+
+	client := ts.Client()
+	// Return redirects to the test instead of following them
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	return newTestClient(t, ts.URL, client)
+}
+
+// newClient returns another client of the same server, with cookies of its
+// own, for a second user or device
+func (ts *testServer) newClient(t *testing.T) *testServer {
+	t.Helper()
+
+	client := *ts.client
+	return newTestClient(t, ts.URL, &client)
+}
+
+func newTestClient(t *testing.T, url string, client *http.Client) *testServer {
+	t.Helper()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Jar = jar
+
+	return &testServer{URL: url, client: client, header: http.Header{}}
+}
+
+// do sends the request with a JSON body, when body is not nil, and returns
+// the response with its body read
+func (ts *testServer) do(t *testing.T, method, path string, body any) (*http.Response, []byte) {
+	t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, ts.URL+path, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if ts.csrfToken != "" {
+		req.Header.Set("X-CSRF-Token", ts.csrfToken)
+	}
+	for name, values := range ts.header {
+		req.Header[name] = values
+	}
+
+	res, err := ts.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, resBody
+}
+
+// doJSON sends the request and decodes the JSON response into dst
+func (ts *testServer) doJSON(t *testing.T, method, path string, body, dst any) int {
+	t.Helper()
+
+	res, resBody := ts.do(t, method, path, body)
+	if dst != nil && len(resBody) > 0 {
+		if err := json.Unmarshal(resBody, dst); err != nil {
+			t.Fatalf("%s %s: decoding %q: %v", method, path, resBody, err)
+		}
+	}
+	return res.StatusCode
+}
+
+// refreshCSRF reads the CSRF token of the session, which changes when the
+// session token is renewed
+func (ts *testServer) refreshCSRF(t *testing.T) {
+	t.Helper()
+
+	var out struct {
+		CSRFToken string `json:"csrf_token"`
+	}
+	if status := ts.doJSON(t, http.MethodGet, "/api/csrf-token", nil, &out); status != http.StatusOK {
+		t.Fatalf("csrf token: status %d", status)
+	}
+	ts.csrfToken = out.CSRFToken
+}
+
+// signUpAndLogIn creates a user with the email and logs them in, and
+// returns their id
+func (ts *testServer) signUpAndLogIn(t *testing.T, email string) string {
+	t.Helper()
+
+	ts.refreshCSRF(t)
+	status := ts.doJSON(t, http.MethodPost, "/api/users/signup", map[string]string{
+		"email":       email,
+		"displayName": "Test User",
+		"password":    testPassword,
+	}, nil)
+	if status != http.StatusCreated && status != http.StatusOK {
+		t.Fatalf("signup %s: status %d", email, status)
+	}
+
+	return ts.logIn(t, email)
+}
+
+// logIn logs the user in with testPassword and returns their id
+func (ts *testServer) logIn(t *testing.T, email string) string {
+	t.Helper()
+
+	ts.refreshCSRF(t)
+	var out struct {
+		UserId string `json:"userId"`
+	}
+	status := ts.doJSON(t, http.MethodPost, "/api/users/login", map[string]string{
+		"email":    email,
+		"password": testPassword,
+	}, &out)
+	if status != http.StatusOK {
+		t.Fatalf("login %s: status %d", email, status)
+	}
+	ts.refreshCSRF(t)
+	return out.UserId
+}
+
+// testPassword is the password of the users the tests sign up
+const testPassword = "pa$$word123"
+
+// useFileMailer makes the application write its emails to a temporary
+// directory, and returns the directory
+func useFileMailer(t *testing.T, app *application) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	app.mailer = mailer.NewFile("budgeting@example.com", dir)
+	app.passwordResetURL = "https://budgeting.example.com/reset-password"
+	app.emailVerificationURL = "https://budgeting.example.com/verify-email"
+	return dir
+}
+
+// waitForMails waits until n emails with the subject were sent to the
+// address, as they are sent in the background, and returns them oldest first
+func waitForMails(t *testing.T, dir, to, subject string, n int) []string {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mails := readMails(t, dir, to, subject)
+		if len(mails) >= n {
+			return mails
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d emails %q to %s; want %d", len(mails), subject, to, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// readMails returns the emails with the subject sent to the address so far,
+// oldest first
+func readMails(t *testing.T, dir, to, subject string) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mails := []string{}
+	for _, entry := range entries {
+		b, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mail := string(b)
+		if strings.Contains(mail, "\r\nTo: "+to+"\r\n") && strings.Contains(mail, "\r\nSubject: "+subject+"\r\n") {
+			mails = append(mails, mail)
+		}
+	}
+	return mails
+}
+
+var mailLink = regexp.MustCompile(`https://\S+`)
+
+// mailToken returns the token of the link in the email
+func mailToken(t *testing.T, mail string) string {
+	t.Helper()
+
+	link, err := url.Parse(mailLink.FindString(mail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := link.Query().Get("token")
+	if token == "" {
+		t.Fatalf("no token in the email %q", mail)
+	}
+	return token
+}
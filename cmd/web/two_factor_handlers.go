@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"image/png"
+	"net/http"
+	"strings"
+	"time"
+
+	"kweeuhree.personal-budgeting-backend/internal/models"
+	"kweeuhree.personal-budgeting-backend/internal/validator"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+// Settings of the TOTP codes, the defaults of authenticator apps
+const (
+	totpIssuer = "Personal Budgeting"
+	totpPeriod = 30
+	// totpSkew is how many periods before and after the current one are
+	// accepted, for clocks that drift
+	totpSkew = 1
+	// totpQRCodeSize is the width and height of the QR code image
+	totpQRCodeSize = 256
+)
+
+// recoveryCodeCount is how many recovery codes are handed out when
+// two-factor authentication is turned on
+const recoveryCodeCount = 10
+
+// Limits of the second step of a login
+const (
+	twoFactorLoginTTL      = 5 * time.Minute
+	twoFactorLoginAttempts = 5
+)
+
+// Session keys of a login waiting for its second factor, when it started as
+// a Unix time, and the random id its codes are counted under. The user is
+// not authenticated until the code is checked.
+const (
+	pendingTwoFactorUserIDKey = "pendingTwoFactorUserID"
+	pendingTwoFactorAtKey     = "pendingTwoFactorAt"
+	pendingTwoFactorIDKey     = "pendingTwoFactorID"
+)
+
+// EnrollTwoFactorInput struct for starting the enrollment in two-factor
+// authentication
+type EnrollTwoFactorInput struct {
+	CurrentPassword     string `json:"currentPassword" validate:"required"`
+	validator.Validator `json:"-"`
+}
+
+// TwoFactorCodeInput struct for a code of the authenticator app, or a
+// recovery code
+type TwoFactorCodeInput struct {
+	Code                string `json:"code" validate:"required,maxchars=64"`
+	validator.Validator `json:"-"`
+}
+
+// DisableTwoFactorInput struct for turning two-factor authentication off
+type DisableTwoFactorInput struct {
+	CurrentPassword     string `json:"currentPassword" validate:"required"`
+	Code                string `json:"code" validate:"required,maxchars=64"`
+	validator.Validator `json:"-"`
+}
+
+// Response struct of the enrollment. QRCode is a data URL of a PNG image of
+// the otpauth URI, for authenticator apps to scan.
+type TwoFactorEnrollmentResponse struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauthUri"`
+	QRCode     string `json:"qrCode"`
+}
+
+// Response struct of the confirmation. The recovery codes are only ever
+// shown once.
+type TwoFactorRecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+	Flash         string   `json:"flash"`
+}
+
+type TwoFactorStatusResponse struct {
+	Enabled                bool `json:"enabled"`
+	RemainingRecoveryCodes int  `json:"remainingRecoveryCodes"`
+}
+
+// report whether two-factor authentication is on for the logged in user
+func (app *application) twoFactorStatus(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	tf, err := app.twoFactor.Get(userId)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	response := TwoFactorStatusResponse{Enabled: tf.Enabled()}
+	if tf.Enabled() {
+		response.RemainingRecoveryCodes, err = app.twoFactor.RemainingRecoveryCodes(userId)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+
+	err = encodeJSON(w, http.StatusOK, response)
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// start the enrollment of the logged in user in two-factor authentication.
+// The new secret takes effect once a code of it is confirmed.
+func (app *application) enrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	var form EnrollTwoFactorInput
+	if err := decodeJSON(w, r, &form); err != nil {
+		return
+	}
+
+	form.Validate()
+	if !form.Valid() {
+		app.failedValidation(w, r, form.Validator)
+		return
+	}
+
+	user, ok := app.confirmPassword(w, r, userId, form.CurrentPassword, &form.Validator)
+	if !ok {
+		return
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      totpIssuer,
+		AccountName: user.Email,
+		Period:      totpPeriod,
+	})
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.twoFactor.Enroll(userId, key.Secret())
+	if err != nil {
+		if errors.Is(err, models.ErrTwoFactorEnabled) {
+			app.errorResponse(w, r, http.StatusConflict, ErrCodeTwoFactorEnabled, "Two-factor authentication is already on")
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	qrCode, err := qrCodeDataURL(key)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = encodeJSON(w, http.StatusOK, TwoFactorEnrollmentResponse{
+		Secret:     key.Secret(),
+		OTPAuthURI: key.URL(),
+		QRCode:     qrCode,
+	})
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// turn two-factor authentication on with a code of the enrolled secret, and
+// hand out the recovery codes
+func (app *application) confirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	var form TwoFactorCodeInput
+	if err := decodeJSON(w, r, &form); err != nil {
+		return
+	}
+
+	form.Validate()
+	if !form.Valid() {
+		app.failedValidation(w, r, form.Validator)
+		return
+	}
+
+	tf, err := app.twoFactor.Get(userId)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	switch {
+	case tf.Enabled():
+		app.errorResponse(w, r, http.StatusConflict, ErrCodeTwoFactorEnabled, "Two-factor authentication is already on")
+		return
+	case tf.Secret == "":
+		app.errorResponse(w, r, http.StatusConflict, ErrCodeTwoFactorDisabled, "Start the enrollment in two-factor authentication first")
+		return
+	}
+
+	recoveryCodes, recoveryCodeHashes, err := newRecoveryCodes()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.withTx(r, func(tx *application) error {
+		// Recovery codes do not exist yet, the code has to come from the app
+		step, ok := totpStep(tf.Secret, form.Code, time.Now())
+		if !ok {
+			return models.ErrInvalidTwoFactorCode
+		}
+		err := tx.twoFactor.UseStep(userId, step)
+		if err != nil {
+			return err
+		}
+		err = tx.twoFactor.Enable(userId, recoveryCodeHashes)
+		if err != nil {
+			return err
+		}
+		return tx.audit(userId, models.AuditActionEnableTwoFactor, models.AuditEntityUser, userId, nil, nil)
+	})
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidTwoFactorCode) {
+			app.invalidTwoFactorCode(w, r, &form.Validator, http.StatusBadRequest)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	app.setFlash(r.Context(), "Two-factor authentication is on. Keep your recovery codes somewhere safe.")
+
+	err = encodeJSON(w, http.StatusOK, TwoFactorRecoveryCodesResponse{
+		RecoveryCodes: recoveryCodes,
+		Flash:         app.getFlash(r.Context()),
+	})
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// turn two-factor authentication off, with the password and a code
+func (app *application) disableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	var form DisableTwoFactorInput
+	if err := decodeJSON(w, r, &form); err != nil {
+		return
+	}
+
+	form.Validate()
+	if !form.Valid() {
+		app.failedValidation(w, r, form.Validator)
+		return
+	}
+
+	_, ok := app.confirmPassword(w, r, userId, form.CurrentPassword, &form.Validator)
+	if !ok {
+		return
+	}
+
+	tf, err := app.twoFactor.Get(userId)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if !tf.Enabled() {
+		app.errorResponse(w, r, http.StatusConflict, ErrCodeTwoFactorDisabled, "Two-factor authentication is already off")
+		return
+	}
+
+	err = app.withTx(r, func(tx *application) error {
+		err := tx.checkTwoFactorCode(userId, tf, form.Code)
+		if err != nil {
+			return err
+		}
+		err = tx.twoFactor.Disable(userId)
+		if err != nil {
+			return err
+		}
+		return tx.audit(userId, models.AuditActionDisableTwoFactor, models.AuditEntityUser, userId, nil, nil)
+	})
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidTwoFactorCode) {
+			app.invalidTwoFactorCode(w, r, &form.Validator, http.StatusBadRequest)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	app.setFlash(r.Context(), "Two-factor authentication is off.")
+
+	err = encodeJSON(w, http.StatusOK, UserResponse{Flash: app.getFlash(r.Context())})
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// finish a login that is waiting for its second factor, with a code of the
+// authenticator app or a recovery code
+func (app *application) userLoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var form TwoFactorCodeInput
+	if err := decodeJSON(w, r, &form); err != nil {
+		return
+	}
+
+	form.Validate()
+	if !form.Valid() {
+		app.failedValidation(w, r, form.Validator)
+		return
+	}
+
+	ctx := r.Context()
+	userId := app.sessionManager.GetString(ctx, pendingTwoFactorUserIDKey)
+	startedAt := time.Unix(app.sessionManager.GetInt64(ctx, pendingTwoFactorAtKey), 0)
+	loginId := app.sessionManager.GetString(ctx, pendingTwoFactorIDKey)
+	if userId == "" || loginId == "" || time.Since(startedAt) > twoFactorLoginTTL {
+		app.clearPendingTwoFactor(ctx)
+		app.errorResponse(w, r, http.StatusUnauthorized, ErrCodeUnauthenticated, "Log in with your email and password first")
+		return
+	}
+
+	user, err := app.user.Get(userId)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	// An admin may have disabled the user since the first step
+	if user.Disabled() {
+		app.clearPendingTwoFactor(ctx)
+		app.errorResponse(w, r, http.StatusForbidden, ErrCodeAccountDisabled, "Your account has been disabled")
+		return
+	}
+
+	// Wrong codes count against the account like wrong passwords, so that
+	// starting the login over does not give more guesses
+	throttles := app.loginThrottles(r, user.Email)
+	if !app.reserveLogin(w, r, throttles) {
+		return
+	}
+
+	// The codes of the login are counted in the store rather than in the
+	// session, which is only saved once the request ends, so that each of
+	// concurrent guesses gets a number of its own
+	attempt, err := app.loginAttempts.RecordFailure(twoFactorLoginKey(loginId), twoFactorLoginTTL)
+	if err != nil {
+		app.releaseReserved(throttles)
+		app.serverError(w, r, err)
+		return
+	}
+	if attempt.Failures > twoFactorLoginAttempts {
+		app.releaseReserved(throttles)
+		app.clearPendingTwoFactor(ctx)
+		app.errorResponse(w, r, http.StatusUnauthorized, ErrCodeUnauthenticated, "Log in with your email and password first")
+		return
+	}
+
+	tf, err := app.twoFactor.Get(userId)
+	if err != nil {
+		app.releaseReserved(throttles)
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.withTx(r, func(tx *application) error {
+		return tx.checkTwoFactorCode(userId, tf, form.Code)
+	})
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidTwoFactorCode) {
+			if err := app.failLogin(throttles); err != nil {
+				app.serverError(w, r, err)
+				return
+			}
+			// Start the login over after too many wrong codes
+			if attempt.Failures >= twoFactorLoginAttempts {
+				app.clearPendingTwoFactor(ctx)
+			}
+			app.invalidTwoFactorCode(w, r, &form.Validator, http.StatusUnauthorized)
+		} else {
+			app.releaseReserved(throttles)
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	// The code was right, the login did not fail
+	err = app.releaseLogin(throttles)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.clearPendingTwoFactor(ctx)
+	app.completeLogin(w, r, userId, user.Email)
+}
+
+// checkTwoFactorCode accepts a TOTP code of the secret which was not used
+// before, or an unused recovery code, and uses it up. Returns
+// models.ErrInvalidTwoFactorCode otherwise.
+func (app *application) checkTwoFactorCode(userId string, tf *models.TwoFactor, code string) error {
+	code = strings.TrimSpace(code)
+	if step, ok := totpStep(tf.Secret, code, time.Now()); ok {
+		return app.twoFactor.UseStep(userId, step)
+	}
+	return app.twoFactor.UseRecoveryCode(userId, hashToken(normalizeRecoveryCode(code)))
+}
+
+// startTwoFactorLogin marks the session as waiting for the second factor of
+// the user, who is not logged in yet
+func (app *application) startTwoFactorLogin(ctx context.Context, userId string) error {
+	id, err := newToken()
+	if err != nil {
+		return err
+	}
+	err = app.sessionManager.RenewToken(ctx)
+	if err != nil {
+		return err
+	}
+	app.sessionManager.Remove(ctx, "authenticatedUserID")
+	app.sessionManager.Put(ctx, pendingTwoFactorUserIDKey, userId)
+	app.sessionManager.Put(ctx, pendingTwoFactorAtKey, time.Now().Unix())
+	app.sessionManager.Put(ctx, pendingTwoFactorIDKey, id)
+	return nil
+}
+
+func (app *application) clearPendingTwoFactor(ctx context.Context) {
+	app.sessionManager.Remove(ctx, pendingTwoFactorUserIDKey)
+	app.sessionManager.Remove(ctx, pendingTwoFactorAtKey)
+	app.sessionManager.Remove(ctx, pendingTwoFactorIDKey)
+}
+
+// twoFactorLoginKey returns the key the codes of a pending login are counted
+// under, which expireLoginAttempts forgets with the failed logins
+func twoFactorLoginKey(id string) string {
+	return "2fa:" + id
+}
+
+// invalidTwoFactorCode writes the problem of a wrong code
+func (app *application) invalidTwoFactorCode(w http.ResponseWriter, r *http.Request, v *validator.Validator, status int) {
+	v.AddFieldError("code", "This code is invalid or was already used")
+	p := newProblem(status, ErrCodeInvalidTwoFactorCode, "The two-factor code is invalid or was already used")
+	p.FieldErrors = v.FieldErrors
+	writeProblem(w, r, p)
+}
+
+// totpStep returns the time step of the code if it is a code of the secret
+// around t
+func totpStep(secret, code string, t time.Time) (int64, bool) {
+	if secret == "" || len(code) != int(otp.DigitsSix) {
+		return 0, false
+	}
+	opts := totp.ValidateOpts{
+		Period:    totpPeriod,
+		Digits:    otp.DigitsSix,
+		Algorithm: otp.AlgorithmSHA1,
+	}
+	for skew := -totpSkew; skew <= totpSkew; skew++ {
+		at := t.Add(time.Duration(skew*totpPeriod) * time.Second)
+		expected, err := totp.GenerateCodeCustom(secret, at, opts)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return at.Unix() / totpPeriod, true
+		}
+	}
+	return 0, false
+}
+
+// recoveryCodeEncoding spells recovery codes in lower case letters and
+// digits, without padding
+var recoveryCodeEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// newRecoveryCodes returns recoveryCodeCount random codes, formatted as
+// xxxxx-xxxxx, and their hashes
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		code := recoveryCodeEncoding.EncodeToString(b)[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashToken(code)
+	}
+	return codes, hashes, nil
+}
+
+// normalizeRecoveryCode drops the separator and spaces of a recovery code
+// typed in by hand
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// qrCodeDataURL returns a PNG image of the otpauth URI of the key as a data
+// URL
+func qrCodeDataURL(key *otp.Key) (string, error) {
+	img, err := key.Image(totpQRCodeSize, totpQRCodeSize)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = png.Encode(&buf, img)
+	if err != nil {
+		return "", err
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
+
+// enableTwoFactor turns two-factor authentication on for the logged in user,
+// and returns the secret, the code it was confirmed with and the recovery
+// codes
+func enableTwoFactor(t *testing.T, ts *testServer) (string, string, []string) {
+	t.Helper()
+
+	var enrollment TwoFactorEnrollmentResponse
+	status := ts.doJSON(t, http.MethodPost, "/api/users/2fa/enroll", map[string]string{
+		"currentPassword": testPassword,
+	}, &enrollment)
+	expectStatus(t, "enroll in two-factor", status, http.StatusOK)
+
+	code := totpCode(t, enrollment.Secret, time.Now())
+	var confirmed TwoFactorRecoveryCodesResponse
+	status = ts.doJSON(t, http.MethodPost, "/api/users/2fa/confirm", map[string]string{"code": code}, &confirmed)
+	expectStatus(t, "confirm two-factor", status, http.StatusOK)
+	return enrollment.Secret, code, confirmed.RecoveryCodes
+}
+
+// startLogin logs the user in with testPassword, which leaves the login
+// waiting for the second factor
+func startLogin(t *testing.T, ts *testServer, email string) {
+	t.Helper()
+
+	ts.refreshCSRF(t)
+	var user UserResponse
+	status := ts.doJSON(t, http.MethodPost, "/api/users/login", map[string]string{
+		"email":    email,
+		"password": testPassword,
+	}, &user)
+	expectStatus(t, "log in with the password", status, http.StatusOK)
+	if !user.TwoFactorRequired || user.UserId != "" {
+		t.Fatalf("got %+v; want twoFactorRequired without a user", user)
+	}
+	ts.refreshCSRF(t)
+}
+
+// finishLogin sends the second factor, and checks the problem code when the
+// login is refused
+func finishLogin(t *testing.T, ts *testServer, step, code string, wantStatus int, wantCode string) {
+	t.Helper()
+
+	var problem Problem
+	status := ts.doJSON(t, http.MethodPost, "/api/users/login/2fa", map[string]string{"code": code}, &problem)
+	expectStatus(t, step, status, wantStatus)
+	if wantCode != "" && problem.Code != wantCode {
+		t.Errorf("%s: got code %q; want %q", step, problem.Code, wantCode)
+	}
+	if status == http.StatusOK {
+		ts.refreshCSRF(t)
+	}
+}
+
+func TestTwoFactorEnrollment(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	const email = "enroll@example.com"
+	ts.signUpAndLogIn(t, email)
+
+	var problem Problem
+	status := ts.doJSON(t, http.MethodPost, "/api/users/2fa/confirm", map[string]string{"code": "123456"}, &problem)
+	expectStatus(t, "confirm before enrolling", status, http.StatusConflict)
+	if problem.Code != ErrCodeTwoFactorDisabled {
+		t.Errorf("got code %q; want %q", problem.Code, ErrCodeTwoFactorDisabled)
+	}
+
+	status = ts.doJSON(t, http.MethodPost, "/api/users/2fa/enroll", map[string]string{
+		"currentPassword": "wrong-password",
+	}, nil)
+	expectStatus(t, "enroll with a wrong password", status, http.StatusForbidden)
+
+	// Enrolling again replaces the secret, whose codes no longer confirm
+	var first TwoFactorEnrollmentResponse
+	status = ts.doJSON(t, http.MethodPost, "/api/users/2fa/enroll", map[string]string{
+		"currentPassword": testPassword,
+	}, &first)
+	expectStatus(t, "enroll", status, http.StatusOK)
+	if first.Secret == "" || !strings.HasPrefix(first.OTPAuthURI, "otpauth://totp/") || !strings.HasPrefix(first.QRCode, "data:image/png;base64,") {
+		t.Errorf("got enrollment %+v; want a secret, its URI and a QR code", first)
+	}
+
+	var second TwoFactorEnrollmentResponse
+	status = ts.doJSON(t, http.MethodPost, "/api/users/2fa/enroll", map[string]string{
+		"currentPassword": testPassword,
+	}, &second)
+	expectStatus(t, "enroll again", status, http.StatusOK)
+
+	status = ts.doJSON(t, http.MethodPost, "/api/users/2fa/confirm", map[string]string{
+		"code": totpCode(t, first.Secret, time.Now()),
+	}, &problem)
+	expectStatus(t, "confirm with the replaced secret", status, http.StatusBadRequest)
+	if problem.Code != ErrCodeInvalidTwoFactorCode {
+		t.Errorf("got code %q; want %q", problem.Code, ErrCodeInvalidTwoFactorCode)
+	}
+
+	var tfStatus TwoFactorStatusResponse
+	status = ts.doJSON(t, http.MethodGet, "/api/users/2fa", nil, &tfStatus)
+	expectStatus(t, "status before confirming", status, http.StatusOK)
+	if tfStatus.Enabled {
+		t.Error("two-factor is on before it was confirmed")
+	}
+
+	var confirmed TwoFactorRecoveryCodesResponse
+	status = ts.doJSON(t, http.MethodPost, "/api/users/2fa/confirm", map[string]string{
+		"code": totpCode(t, second.Secret, time.Now()),
+	}, &confirmed)
+	expectStatus(t, "confirm", status, http.StatusOK)
+	if len(confirmed.RecoveryCodes) != recoveryCodeCount {
+		t.Errorf("got %d recovery codes; want %d", len(confirmed.RecoveryCodes), recoveryCodeCount)
+	}
+
+	status = ts.doJSON(t, http.MethodGet, "/api/users/2fa", nil, &tfStatus)
+	expectStatus(t, "status", status, http.StatusOK)
+	if !tfStatus.Enabled || tfStatus.RemainingRecoveryCodes != recoveryCodeCount {
+		t.Errorf("got %+v; want on with %d recovery codes", tfStatus, recoveryCodeCount)
+	}
+
+	status = ts.doJSON(t, http.MethodPost, "/api/users/2fa/enroll", map[string]string{
+		"currentPassword": testPassword,
+	}, &problem)
+	expectStatus(t, "enroll while on", status, http.StatusConflict)
+	if problem.Code != ErrCodeTwoFactorEnabled {
+		t.Errorf("got code %q; want %q", problem.Code, ErrCodeTwoFactorEnabled)
+	}
+
+	// The password alone no longer logs in
+	other := ts.newClient(t)
+	startLogin(t, other, email)
+	status = other.doJSON(t, http.MethodGet, "/api/users/sessions", nil, nil)
+	expectStatus(t, "session after the password", status, http.StatusUnauthorized)
+	finishLogin(t, other, "second factor", totpCode(t, second.Secret, time.Now().Add(totpPeriod*time.Second)), http.StatusOK, "")
+	status = other.doJSON(t, http.MethodGet, "/api/users/sessions", nil, nil)
+	expectStatus(t, "session after the second factor", status, http.StatusOK)
+}
+
+// A code of the app is accepted once, even within its period
+func TestTwoFactorCodeReuse(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	const email = "reuse@example.com"
+	ts.signUpAndLogIn(t, email)
+	secret, confirmCode, _ := enableTwoFactor(t, ts)
+
+	client := ts.newClient(t)
+	startLogin(t, client, email)
+	finishLogin(t, client, "code of the confirmation", confirmCode, http.StatusUnauthorized, ErrCodeInvalidTwoFactorCode)
+
+	next := totpCode(t, secret, time.Now().Add(totpPeriod*time.Second))
+	finishLogin(t, client, "next code", next, http.StatusOK, "")
+
+	client = ts.newClient(t)
+	startLogin(t, client, email)
+	finishLogin(t, client, "next code again", next, http.StatusUnauthorized, ErrCodeInvalidTwoFactorCode)
+}
+
+// Each recovery code logs in once, however it is typed
+func TestTwoFactorRecoveryCodes(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	const email = "recovery@example.com"
+	ts.signUpAndLogIn(t, email)
+	_, _, codes := enableTwoFactor(t, ts)
+
+	for i, code := range codes {
+		switch i {
+		case 1:
+			code = strings.ToUpper(code)
+		case 2:
+			code = strings.ReplaceAll(code, "-", " ")
+		}
+		client := ts.newClient(t)
+		startLogin(t, client, email)
+		finishLogin(t, client, "recovery code "+code, code, http.StatusOK, "")
+
+		var tfStatus TwoFactorStatusResponse
+		status := client.doJSON(t, http.MethodGet, "/api/users/2fa", nil, &tfStatus)
+		expectStatus(t, "status", status, http.StatusOK)
+		if want := len(codes) - i - 1; tfStatus.RemainingRecoveryCodes != want {
+			t.Errorf("got %d remaining recovery codes; want %d", tfStatus.RemainingRecoveryCodes, want)
+		}
+	}
+
+	client := ts.newClient(t)
+	startLogin(t, client, email)
+	finishLogin(t, client, "used recovery code", codes[0], http.StatusUnauthorized, ErrCodeInvalidTwoFactorCode)
+}
+
+// The second step has to come within twoFactorLoginTTL of the first
+func TestTwoFactorLoginTimeout(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	const email = "timeout@example.com"
+	ts.signUpAndLogIn(t, email)
+	secret, _, _ := enableTwoFactor(t, ts)
+
+	client := ts.newClient(t)
+	startLogin(t, client, email)
+
+	// Move the start of the pending login back in the stored session
+	ctx, err := app.sessionManager.Load(context.Background(), sessionCookie(t, client).Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.sessionManager.Put(ctx, pendingTwoFactorAtKey, time.Now().Add(-twoFactorLoginTTL-time.Second).Unix())
+	if _, _, err = app.sessionManager.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	code := totpCode(t, secret, time.Now().Add(totpPeriod*time.Second))
+	finishLogin(t, client, "code after the timeout", code, http.StatusUnauthorized, ErrCodeUnauthenticated)
+	status := client.doJSON(t, http.MethodGet, "/api/users/sessions", nil, nil)
+	expectStatus(t, "session after the timeout", status, http.StatusUnauthorized)
+
+	// Starting over works
+	startLogin(t, client, email)
+	finishLogin(t, client, "code of a new login", code, http.StatusOK, "")
+}
+
+// After twoFactorLoginAttempts wrong codes the login starts over, even when
+// the codes are sent at the same time
+func TestTwoFactorLoginAttempts(t *testing.T) {
+	// Lift the limits of the account and the client, so that the limit of
+	// the login is the one reached
+	defer func(account, client loginLimit) {
+		accountLoginLimit, clientLoginLimit = account, client
+	}(accountLoginLimit, clientLoginLimit)
+	accountLoginLimit = loginLimit{freeFailures: 100, lockAfter: 100}
+	clientLoginLimit = accountLoginLimit
+
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	const email = "attempts@example.com"
+	ts.signUpAndLogIn(t, email)
+	secret, _, _ := enableTwoFactor(t, ts)
+	code := totpCode(t, secret, time.Now().Add(totpPeriod*time.Second))
+
+	client := ts.newClient(t)
+	startLogin(t, client, email)
+	for i := 0; i < twoFactorLoginAttempts; i++ {
+		finishLogin(t, client, "wrong code", "000000", http.StatusUnauthorized, ErrCodeInvalidTwoFactorCode)
+	}
+	finishLogin(t, client, "right code after the limit", code, http.StatusUnauthorized, ErrCodeUnauthenticated)
+
+	// Slow the requests down after they count the code, so that they run
+	// at the same time
+	startLogin(t, client, email)
+	app.twoFactor = &slowTwoFactor{TwoFactorRepository: app.twoFactor}
+	const requests = 3 * twoFactorLoginAttempts
+	problems := make([]Problem, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client.doJSON(t, http.MethodPost, "/api/users/login/2fa", map[string]string{"code": "000000"}, &problems[i])
+		}(i)
+	}
+	wg.Wait()
+
+	checked := 0
+	for _, problem := range problems {
+		switch problem.Code {
+		case ErrCodeInvalidTwoFactorCode:
+			checked++
+		case ErrCodeUnauthenticated:
+		default:
+			t.Errorf("got code %q; want %q or %q", problem.Code, ErrCodeInvalidTwoFactorCode, ErrCodeUnauthenticated)
+		}
+	}
+	if checked != twoFactorLoginAttempts {
+		t.Errorf("got %d checked codes; want %d", checked, twoFactorLoginAttempts)
+	}
+
+	finishLogin(t, client, "right code after concurrent guesses", code, http.StatusUnauthorized, ErrCodeUnauthenticated)
+}
+
+// slowTwoFactor takes a while to read the two-factor settings of a user
+type slowTwoFactor struct {
+	models.TwoFactorRepository
+}
+
+func (s *slowTwoFactor) Get(userId string) (*models.TwoFactor, error) {
+	time.Sleep(50 * time.Millisecond)
+	return s.TwoFactorRepository.Get(userId)
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
@@ -13,24 +12,30 @@ import (
 
 // userSignUpInput struct for creating a new user
 type UserSignUpInput struct {
-	Email               string `form:"email"`
-	DisplayName         string `form:"displayName"`
-	Password            string `form:"password"`
-	validator.Validator `form:"-"`
+	Email               string `json:"email" validate:"required,email,maxchars=255"`
+	DisplayName         string `json:"displayName" validate:"required,maxchars=255"`
+	Password            string `json:"password" validate:"required,minchars=8,maxchars=72"`
+	validator.Validator `json:"-"`
 }
 
 type UserResponse struct {
-	UserId      string          `json:"userId"`
-	Email       string          `json:"email"`
-	DisplayName string          `json:"displayName"`
-	Budget      *BudgetResponse `json:"budget"`
-	Flash       string          `json:"flash"`
+	UserId      string `json:"userId"`
+	Email       string `json:"email"`
+	DisplayName string `json:"displayName"`
+	// EmailVerified is left out of the responses that are not about the
+	// account, such as logout
+	EmailVerified *bool `json:"emailVerified,omitempty"`
+	// TwoFactorRequired is set instead of the user when the login waits for
+	// a code of the authenticator app
+	TwoFactorRequired bool            `json:"twoFactorRequired,omitempty"`
+	Budget            *BudgetResponse `json:"budget"`
+	Flash             string          `json:"flash"`
 }
 
 type UserLoginInput struct {
-	Email               string `form:"email"`
-	Password            string `form:"password"`
-	validator.Validator `form:"-"`
+	Email               string `json:"email" validate:"required,email"`
+	Password            string `json:"password" validate:"required"`
+	validator.Validator `json:"-"`
 }
 
 // user authentication routes
@@ -44,44 +49,68 @@ func (app *application) userSignup(w http.ResponseWriter, r *http.Request) {
 	err := decodeJSON(w, r, &form)
 	if err != nil {
 		log.Printf("Error decoding JSON: %v. Request Method: %s, Request URL: %s", err, r.Method, r.URL)
+		return
 	}
 
-	log.Printf("Received new user details: %s", form)
+	log.Printf("Received new user details: %s", form.Email)
 
 	form.Validate()
 	if !form.Valid() {
-		err := encodeJSON(w, http.StatusOK, form.FieldErrors)
-		if err != nil {
-			return
-		}
+		app.failedValidation(w, r, form.Validator)
+		return
 	}
 
-	newUserId, err := app.CreateAndStoreUser(form.Email, form.DisplayName, form.Password)
+	var newUserId, verificationToken string
+	err = app.withTx(r, func(tx *application) error {
+		newUserId, err = tx.CreateAndStoreUser(form.Email, form.DisplayName, form.Password)
+		if err != nil {
+			return err
+		}
+		verificationToken, err = tx.issueEmailVerification(newUserId)
+		if err != nil {
+			return err
+		}
+		return tx.audit(newUserId, models.AuditActionCreate, models.AuditEntityUser, newUserId, nil, userSnapshot{
+			UserId:      newUserId,
+			Email:       form.Email,
+			DisplayName: form.DisplayName,
+		})
+	})
 	if err != nil {
 		if errors.Is(err, models.ErrDuplicateEmail) {
-			encodeJSON(w, http.StatusConflict, map[string]interface{}{
-				"error": "Email already in use",
-				"field": "email",
-			})
+			form.AddFieldError("email", "Email already in use")
+			p := newProblem(http.StatusConflict, ErrCodeEmailInUse, "Email already in use")
+			p.FieldErrors = form.FieldErrors
+			writeProblem(w, r, p)
 		} else {
-			app.serverError(w, err)
+			app.serverError(w, r, err)
 		}
 		return
 	}
 
-	app.setFlash(r.Context(), "Your signup was successful. Please log in.")
+	// The account exists once the transaction is committed, so only email
+	// the link now
+	app.sendEmailVerificationInBackground(&models.User{
+		UserId:      newUserId,
+		Email:       form.Email,
+		DisplayName: form.DisplayName,
+	}, verificationToken)
+
+	app.setFlash(r.Context(), "Your signup was successful. Please check your email to verify your address, then log in.")
 
 	// Create a response that includes both ID and body
+	emailVerified := false
 	response := UserResponse{
-		UserId: newUserId,
-		Email:  form.Email,
-		Flash:  app.getFlash(r.Context()),
+		UserId:        newUserId,
+		Email:         form.Email,
+		EmailVerified: &emailVerified,
+		Flash:         app.getFlash(r.Context()),
 	}
 
 	// Write the response struct to the response as JSON
 	err = encodeJSON(w, http.StatusOK, response)
 	if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 		return
 	}
 
@@ -93,17 +122,19 @@ func (app *application) userLogin(w http.ResponseWriter, r *http.Request) {
 	// Decode the form data into the userLoginInput struct
 	var form UserLoginInput
 	if err := decodeJSON(w, r, &form); err != nil {
-		app.clientError(w, http.StatusBadRequest)
 		return
 	}
 
 	// Validate input
 	form.Validate()
 	if !form.Valid() {
-		if err := encodeJSON(w, http.StatusOK, form.FieldErrors); err != nil {
-			app.serverError(w, err)
-			return
-		}
+		app.failedValidation(w, r, form.Validator)
+		return
+	}
+
+	// Slow down and lock out guessing, before spending a bcrypt comparison
+	throttles := app.loginThrottles(r, form.Email)
+	if !app.reserveLogin(w, r, throttles) {
 		return
 	}
 
@@ -111,26 +142,64 @@ func (app *application) userLogin(w http.ResponseWriter, r *http.Request) {
 	id, err := app.user.Authenticate(form.Email, form.Password)
 	if err != nil {
 		if errors.Is(err, models.ErrInvalidCredentials) {
-			form.AddNonFieldError("Email or password is incorrect")
-			if encodeErr := encodeJSON(w, http.StatusUnauthorized, form.FieldErrors); encodeErr != nil {
-				app.serverError(w, encodeErr)
+			if err := app.failLogin(throttles); err != nil {
+				app.serverError(w, r, err)
 				return
 			}
+			form.AddNonFieldError("Email or password is incorrect")
+			p := newProblem(http.StatusUnauthorized, ErrCodeInvalidCredentials, "Email or password is incorrect")
+			p.NonFieldErrors = form.NonFieldErrors
+			writeProblem(w, r, p)
+		} else if errors.Is(err, models.ErrAccountDisabled) {
+			app.releaseReserved(throttles)
+			app.errorResponse(w, r, http.StatusForbidden, ErrCodeAccountDisabled, "Your account has been disabled")
 		} else {
-			app.serverError(w, err)
+			app.releaseReserved(throttles)
+			app.serverError(w, r, err)
 		}
 		return
 	}
 
-	// Renew session token
-	if err := app.sessionManager.RenewToken(r.Context()); err != nil {
-		app.serverError(w, err)
+	// The password was right, the login did not fail
+	err = app.releaseLogin(throttles)
+	if err != nil {
+		app.serverError(w, r, err)
 		return
 	}
 
-	// Set flash message
-	app.sessionManager.Put(r.Context(), "authenticatedUserID", id)
-	app.setFlash(r.Context(), "Login successful!")
+	// With two-factor authentication on, the user is only logged in once
+	// the code is checked by userLoginTwoFactor
+	tf, err := app.twoFactor.Get(id)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if tf.Enabled() {
+		err = app.startTwoFactorLogin(r.Context(), id)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		app.setFlash(r.Context(), "Enter the code from your authenticator app.")
+
+		err = encodeJSON(w, http.StatusOK, UserResponse{TwoFactorRequired: true, Flash: app.getFlash(r.Context())})
+		if err != nil {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	app.completeLogin(w, r, id, form.Email)
+}
+
+// completeLogin logs the user in on the session of the request, and writes
+// the user with their budget to the response
+func (app *application) completeLogin(w http.ResponseWriter, r *http.Request, id, email string) {
+	err := app.logIn(r, id, email)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
 
 	userName, err := app.user.GetUserNameByUserId(id)
 	if err != nil {
@@ -138,6 +207,12 @@ func (app *application) userLogin(w http.ResponseWriter, r *http.Request) {
 		userName = ""
 	}
 
+	emailVerified, err := app.user.IsEmailVerified(id)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
 	var budget *models.Budget
 	budget, err = app.budget.GetBudgetByUserId(id)
 	if err != nil {
@@ -146,40 +221,65 @@ func (app *application) userLogin(w http.ResponseWriter, r *http.Request) {
 
 	var returnbudget *BudgetResponse
 	if budget != nil {
-		returnbudget = &BudgetResponse{
-			BudgetId:        budget.BudgetId,
-			CheckingBalance: budget.CheckingBalance,
-			SavingsBalance:  budget.SavingsBalance,
-			BudgetTotal:     budget.BudgetTotal,
-			BudgetRemaining: budget.BudgetRemaining,
-			TotalSpent:      budget.TotalSpent,
-		}
+		budgetResponse := newBudgetResponse(budget)
+		returnbudget = &budgetResponse
 	} else {
 		returnbudget = nil
 	}
 
 	response := UserResponse{
-		UserId:      id,
-		Email:       form.Email,
-		DisplayName: userName,
-		Budget:      returnbudget,
-		Flash:       app.getFlash(r.Context()),
+		UserId:        id,
+		Email:         email,
+		DisplayName:   userName,
+		EmailVerified: &emailVerified,
+		Budget:        returnbudget,
+		Flash:         app.getFlash(r.Context()),
 	}
 
 	// Write response
 	if err := encodeJSON(w, http.StatusOK, response); err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 		return
 	}
 }
 
+// logIn logs the user in on the session of the request, whichever way
+// they proved who they are
+func (app *application) logIn(r *http.Request, id, email string) error {
+	// Renew session token
+	if err := app.sessionManager.RenewToken(r.Context()); err != nil {
+		return err
+	}
+
+	// Set flash message
+	app.sessionManager.Put(r.Context(), "authenticatedUserID", id)
+	app.setFlash(r.Context(), "Login successful!")
+
+	// The failed logins of the client address keep counting, one account
+	// logging in does not vouch for the others guessed from it
+	return app.withTx(r, func(tx *application) error {
+		err := tx.loginAttempts.Reset(accountLoginKey(email))
+		if err != nil {
+			return err
+		}
+		// Remember when and from where, so that the user can tell their
+		// sessions apart
+		err = tx.recordSession(r, id)
+		if err != nil {
+			return err
+		}
+		return tx.audit(id, models.AuditActionLogin, models.AuditEntityUser, id, nil, nil)
+	})
+}
+
 // view specific user
 func (app *application) viewSpecificUser(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("Attempting to view a specific user...")
 	userId := app.GetIdFromParams(r, "userId")
 	budget, err := app.budget.GetBudgetByUserId(userId)
 	if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
+		return
 	}
 
 	encodeJSON(w, http.StatusOK, budget)
@@ -187,10 +287,26 @@ func (app *application) viewSpecificUser(w http.ResponseWriter, r *http.Request)
 
 // logout the user
 func (app *application) userLogout(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+	err := app.withTx(r, func(tx *application) error {
+		return tx.audit(userId, models.AuditActionLogout, models.AuditEntityUser, userId, nil, nil)
+	})
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// the session is no longer one of the user's
+	err = app.forgetSession(r.Context())
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
 	// change session ID
-	err := app.sessionManager.RenewToken(r.Context())
+	err = app.sessionManager.RenewToken(r.Context())
 	if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 		return
 	}
 	// remove authenticatedUserID from the session data so that the user is logged out
@@ -205,8 +321,7 @@ func (app *application) userLogout(w http.ResponseWriter, r *http.Request) {
 	// Write the response struct to the response as JSON
 	err = encodeJSON(w, http.StatusOK, response)
 	if err != nil {
-		app.serverError(w, err)
-		json.NewEncoder(w).Encode(err)
+		app.serverError(w, r, err)
 		return
 	}
 
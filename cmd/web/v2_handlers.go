@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
+
+// Handlers for the /api/v2 routes whose behavior differs from their v1
+// counterparts. Every other v2 route reuses the v1 handler as is.
+
+// read the budgets of the user, a user has at most one budget
+func (app *application) budgetsList(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	response := []BudgetResponse{}
+
+	budget, err := app.budget.GetBudgetByUserId(userId)
+	if err != nil && !errors.Is(err, models.ErrNoRecord) {
+		app.serverError(w, r, err)
+		return
+	}
+	if budget != nil {
+		response = append(response, newBudgetResponse(budget))
+	}
+
+	encodeJSON(w, http.StatusOK, response)
+}
+
+// delete the budget of the user, responds with 204 No Content
+func (app *application) budgetDeleteV2(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	budgetId := app.GetIdFromParams(r, "budgetId")
+	if budgetId == "" {
+		app.notFound(w, r)
+		return
+	}
+
+	err := app.DeleteAllBudgetDetails(r, budgetId, userId)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w, r)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// update the budget of the user, responds with 200 OK
+func (app *application) budgetUpdateV2(w http.ResponseWriter, r *http.Request) {
+	app.updateBudget(w, r, http.StatusOK)
+}
+
+// read a specific expense of the user
+func (app *application) expenseViewV2(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	expenseId := app.GetIdFromParams(r, "expenseId")
+	if expenseId == "" {
+		app.notFound(w, r)
+		return
+	}
+
+	exp, err := app.expenses.Get(expenseId)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w, r)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	// Other users' expenses are reported as not found
+	if exp.UserId != userId {
+		app.notFound(w, r)
+		return
+	}
+
+	w.Header().Set("ETag", etag(exp.Version))
+	encodeJSON(w, http.StatusOK, newExpenseResponse(exp))
+}
+
+// delete a specific expense of the user, responds with 204 No Content
+func (app *application) expenseDeleteV2(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	expenseId := app.GetIdFromParams(r, "expenseId")
+	if expenseId == "" {
+		app.notFound(w, r)
+		return
+	}
+
+	err := app.DeleteExpense(r, expenseId, userId)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w, r)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// read a specific category of the user
+func (app *application) categoryViewV2(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	categoryId := app.GetIdFromParams(r, "categoryId")
+	if categoryId == "" {
+		app.notFound(w, r)
+		return
+	}
+
+	cat, err := app.expenseCategory.Get(categoryId)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w, r)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	// Other users' categories are reported as not found
+	if cat.UserId != userId {
+		app.notFound(w, r)
+		return
+	}
+
+	w.Header().Set("ETag", etag(cat.Version))
+	encodeJSON(w, http.StatusOK, newExpenseCategoryResponse(cat))
+}
+
+// read all expenses of a specific category of the user
+func (app *application) categoryExpensesViewV2(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	categoryId := app.GetIdFromParams(r, "categoryId")
+	if categoryId == "" {
+		app.notFound(w, r)
+		return
+	}
+
+	exps, err := app.expenseCategory.AllExpensesPerCategory(categoryId)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	expenses := []ExpenseResponse{}
+	for _, exp := range exps {
+		if exp.UserId != userId {
+			continue
+		}
+		expenses = append(expenses, newExpenseResponse(exp))
+	}
+
+	var total int64
+	for _, exp := range expenses {
+		total += exp.AmountInCents
+	}
+
+	response := map[string]interface{}{
+		"totalSpent": total,
+		"expenses":   expenses,
+	}
+
+	encodeJSON(w, http.StatusOK, response)
+}
+
+// delete a category of the user and all of its expenses, responds with 204 No Content
+func (app *application) categoryDeleteV2(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	categoryId := app.GetIdFromParams(r, "categoryId")
+	if categoryId == "" {
+		app.notFound(w, r)
+		return
+	}
+
+	err := app.DeleteAllExpensesByCategory(r, categoryId, userId)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
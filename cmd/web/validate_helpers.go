@@ -1,44 +1,143 @@
 package main
 
 import (
-	"strconv"
+	"fmt"
+	"strings"
 
+	"kweeuhree.personal-budgeting-backend/internal/events"
 	"kweeuhree.personal-budgeting-backend/internal/validator"
 )
 
+// Field constraints are declared once in the `validate` tags of each input
+// struct, the Validate() methods only add the rules that span several fields.
+
 func (input *ExpenseInput) Validate() {
-	amountInCentsStr := strconv.FormatInt(input.AmountInCents, 10)
-	input.CheckField(validator.NotBlank(amountInCentsStr), "amountInCents", "This field cannot be blank")
+	input.ValidateStruct(input)
+}
+
+func (input *ExpensePatch) Validate() {
+	input.ValidateStruct(input)
+}
+
+func (input *ExpenseBatchInput) Validate() {
+	input.ValidateStruct(input)
+	input.CheckField(len(input.Operations) > 0, "operations", "At least one operation is required")
+	input.CheckField(len(input.Operations) <= maxBatchOperations, "operations", fmt.Sprintf("No more than %d operations can be sent at once", maxBatchOperations))
+}
+
+// each operation needs the fields of the expense it creates or changes
+func (op *ExpenseBatchOperation) Validate() {
+	op.ValidateStruct(op)
+
+	switch op.Op {
+	case BatchOpCreate:
+		op.CheckField(op.CategoryId != nil, "categoryId", "This field cannot be blank")
+		op.CheckField(op.AmountInCents != nil, "amountInCents", "This field cannot be blank")
+		op.CheckField(op.ExpenseType != nil, "expenseType", "This field cannot be blank")
+	case BatchOpUpdate, BatchOpDelete:
+		op.CheckField(validator.NotBlank(op.ExpenseId), "expenseId", "This field cannot be blank")
+	case BatchOpRecategorize:
+		op.CheckField(validator.NotBlank(op.ExpenseId), "expenseId", "This field cannot be blank")
+		op.CheckField(op.CategoryId != nil, "categoryId", "This field cannot be blank")
+	}
+}
+
+func (input *ExpenseCategoryPatch) Validate() {
+	input.ValidateStruct(input)
 }
 
 func (input *ExpenseCategoryInput) Validate() {
-	input.CheckField(validator.NotBlank(input.Name), "amountInCents", "This field cannot be blank")
+	input.ValidateStruct(input)
+}
+
+func (input *IntegrityRepairInput) Validate() {
+	input.ValidateStruct(input)
+}
+
+func (input *AuditLogQuery) Validate() {
+	input.ValidateStruct(input)
+}
+
+func (input *AdminUserQuery) Validate() {
+	input.ValidateStruct(input)
+}
+
+func (input *AdminStatsQuery) Validate() {
+	input.ValidateStruct(input)
+}
+
+func (input *SetRoleInput) Validate() {
+	input.ValidateStruct(input)
+}
+
+func (input *WebhookInput) Validate() {
+	input.ValidateStruct(input)
+	input.CheckField(validWebhookEvents(input.Events), "events", fmt.Sprintf("Events must be some of: %s", strings.Join(events.Types, ", ")))
+}
+
+func (input *APITokenInput) Validate() {
+	input.ValidateStruct(input)
+	input.CheckField(len(input.Scopes) > 0, "scopes", "Grant at least one scope")
+	input.CheckField(validAPITokenScopes(input.Scopes), "scopes", fmt.Sprintf("Scopes must be some of: %s", strings.Join(apiTokenScopes, ", ")))
 }
 
 func (form *UserSignUpInput) Validate() {
-	form.CheckField(validator.NotBlank(form.DisplayName), "displayName", "This field cannot be blank")
-	form.CheckField(validator.NotBlank(form.Email), "email", "This field cannot be blank")
-	form.CheckField(validator.Matches(form.Email, validator.EmailRX), "email", "This field must be a valid email address")
-	form.CheckField(validator.NotBlank(form.Password), "password", "This field cannot be blank")
-	form.CheckField(validator.MinChars(form.Password, 8), "password", "This field must be at least 8 characters long")
+	form.ValidateStruct(form)
 }
 
 // checks that email and password are provided
 // and also check the format of the email address as
 // a UX-nicety (in case the user makes a typo).
 func (form *UserLoginInput) Validate() {
-	form.CheckField(validator.NotBlank(form.Email), "email", "This field cannot be blank")
-	form.CheckField(validator.Matches(form.Email, validator.EmailRX), "email", "This field must be a valid email address")
-	form.CheckField(validator.NotBlank(form.Password), "password", "This field cannot be blank")
+	form.ValidateStruct(form)
+}
+
+func (form *ForgotPasswordInput) Validate() {
+	form.ValidateStruct(form)
+}
+
+func (form *ResetPasswordInput) Validate() {
+	form.ValidateStruct(form)
+}
+
+func (form *VerifyEmailInput) Validate() {
+	form.ValidateStruct(form)
+}
+
+func (form *UpdateDisplayNameInput) Validate() {
+	form.ValidateStruct(form)
+}
+
+func (form *ChangeEmailInput) Validate() {
+	form.ValidateStruct(form)
+}
+
+func (form *ChangePasswordInput) Validate() {
+	form.ValidateStruct(form)
+}
+
+func (form *DeleteAccountInput) Validate() {
+	form.ValidateStruct(form)
+}
+
+func (form *EnrollTwoFactorInput) Validate() {
+	form.ValidateStruct(form)
+}
+
+func (form *TwoFactorCodeInput) Validate() {
+	form.ValidateStruct(form)
+}
+
+func (form *DisableTwoFactorInput) Validate() {
+	form.ValidateStruct(form)
 }
 
+// a new budget has to start with some money in either balance
 func (input *BudgetInput) Validate() {
-	checkingBalanceStr := strconv.FormatInt(input.CheckingBalance, 10)
-	input.CheckField(validator.NotBlank(checkingBalanceStr), "checkingBalance", "This field cannot be blank")
+	input.ValidateStruct(input)
+	input.CheckField(input.CheckingBalance+input.SavingsBalance > 0, "checkingBalance", "Either checking or savings balance must be greater than zero")
 }
 
 func (input *BudgetUpdate) Validate() {
-	sumInCentsStr := strconv.FormatInt(input.UpdateSumInCents, 10)
-	input.CheckField(validator.NotBlank(sumInCentsStr), "updateSumInCents", "This field cannot be blank")
-	input.CheckField(validator.NotBlank(input.UpdateType), "updateType", "This field cannot be blank")
+	input.ValidateStruct(input)
 }
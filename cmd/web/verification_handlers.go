@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"kweeuhree.personal-budgeting-backend/internal/mailer"
+	"kweeuhree.personal-budgeting-backend/internal/models"
+	"kweeuhree.personal-budgeting-backend/internal/validator"
+)
+
+// Limits of how often a verification email is sent to one user, the
+// signup email included
+const (
+	verificationResendInterval = time.Minute
+	verificationsPerHour       = 5
+)
+
+// VerifyEmailInput struct for verifying an email address with the token of
+// a verification email
+type VerifyEmailInput struct {
+	Token               string `json:"token" validate:"required,maxchars=255"`
+	validator.Validator `json:"-"`
+}
+
+type EmailVerificationResponse struct {
+	Flash string `json:"flash"`
+}
+
+// verify the email address of an account with the token of a verification
+// email. The user does not have to be logged in, the link may be opened on
+// another device.
+func (app *application) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	var form VerifyEmailInput
+	if err := decodeJSON(w, r, &form); err != nil {
+		return
+	}
+
+	form.Validate()
+	if !form.Valid() {
+		app.failedValidation(w, r, form.Validator)
+		return
+	}
+
+	err := app.withTx(r, func(tx *application) error {
+		userId, err := tx.emailVerifications.Consume(hashToken(form.Token))
+		if err != nil {
+			return err
+		}
+		err = tx.user.MarkEmailVerified(userId)
+		if err != nil {
+			return err
+		}
+		return tx.audit(userId, models.AuditActionVerifyEmail, models.AuditEntityUser, userId, nil, nil)
+	})
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidVerificationToken) {
+			form.AddFieldError("token", "This link is invalid or has expired")
+			p := newProblem(http.StatusBadRequest, ErrCodeInvalidVerifyToken, "The email verification link is invalid or has expired")
+			p.FieldErrors = form.FieldErrors
+			writeProblem(w, r, p)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	app.setFlash(r.Context(), "Your email address was verified.")
+
+	err = encodeJSON(w, http.StatusOK, EmailVerificationResponse{Flash: app.getFlash(r.Context())})
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// send the logged in user a new verification email. A new email can be sent
+// once a minute, and five times an hour.
+func (app *application) resendVerificationEmail(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	var user *models.User
+	var token string
+	var retryAfter time.Duration
+	err := app.withTx(r, func(tx *application) error {
+		// Lock the user, so that concurrent requests wait for each other
+		// instead of all counting the same emails and sending one each
+		var err error
+		user, err = tx.user.GetForUpdate(userId)
+		if err != nil || user.EmailVerifiedAt != nil {
+			return err
+		}
+
+		now := time.Now()
+		recent, err := tx.emailVerifications.CountSince(userId, now.Add(-verificationResendInterval))
+		if err != nil {
+			return err
+		}
+		if recent > 0 {
+			retryAfter = verificationResendInterval
+			return nil
+		}
+		hourly, err := tx.emailVerifications.CountSince(userId, now.Add(-time.Hour))
+		if err != nil {
+			return err
+		}
+		if hourly >= verificationsPerHour {
+			retryAfter = time.Hour
+			return nil
+		}
+
+		token, err = tx.issueEmailVerification(userId)
+		return err
+	})
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if user.EmailVerifiedAt != nil {
+		app.errorResponse(w, r, http.StatusConflict, ErrCodeEmailAlreadyVerified, "Your email address is already verified")
+		return
+	}
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+		app.errorResponse(w, r, http.StatusTooManyRequests, ErrCodeRateLimited, "A verification email was sent recently, please try again later")
+		return
+	}
+
+	app.sendEmailVerificationInBackground(user, token)
+	app.setFlash(r.Context(), "A new verification email is on its way.")
+
+	err = encodeJSON(w, http.StatusAccepted, EmailVerificationResponse{Flash: app.getFlash(r.Context())})
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// issueEmailVerification stores a new verification token of the user and
+// returns it
+func (app *application) issueEmailVerification(userId string) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	err = app.emailVerifications.Insert(hashToken(token), userId, time.Now().Add(models.EmailVerificationTTL))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// sendEmailVerificationInBackground emails the user a link to the
+// verification page of the frontend, carrying the token, without holding up
+// the response
+func (app *application) sendEmailVerificationInBackground(user *models.User, token string) {
+	app.background(func() {
+		err := app.sendEmailVerification(user, token)
+		if err != nil {
+			app.errorLog.Printf("email verification: unable to email %s: %v", user.UserId, err)
+		}
+	})
+}
+
+func (app *application) sendEmailVerification(user *models.User, token string) error {
+	link, err := url.Parse(app.emailVerificationURL)
+	if err != nil {
+		return err
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+
+	return app.mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"Welcome to Personal Budgeting! To verify your email address, "+
+			"open this link within %s:\n\n%s\n\n"+
+			"If you didn't sign up, ignore this email.\n",
+			displayNameOrEmail(user.DisplayName, user.Email), models.EmailVerificationTTL, link),
+	})
+}
+
+// expireEmailVerifications deletes the verification tokens that expired,
+// every interval
+func (app *application) expireEmailVerifications(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n, err := app.emailVerifications.DeleteExpired()
+		if err != nil {
+			app.errorLog.Printf("email verification: unable to delete expired tokens: %v", err)
+			continue
+		}
+		if n > 0 {
+			app.infoLog.Printf("email verification: deleted %d expired tokens", n)
+		}
+	}
+}
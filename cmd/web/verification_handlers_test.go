@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+
+	"kweeuhree.personal-budgeting-backend/internal/config"
+)
+
+const verifySubject = "Verify your email address"
+
+// What users who have not verified their email may do depends on the
+// UNVERIFIED_ACCESS policy. Once verified they may do everything.
+func TestUnverifiedAccess(t *testing.T) {
+	tests := []struct {
+		policy    string
+		wantRead  int
+		wantWrite int
+	}{
+		{config.UnverifiedAccessFull, http.StatusOK, http.StatusCreated},
+		{config.UnverifiedAccessReadOnly, http.StatusOK, http.StatusForbidden},
+		{config.UnverifiedAccessNone, http.StatusForbidden, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.unverifiedAccess = tt.policy
+			dir := useFileMailer(t, app)
+			ts := newTestServer(t, app.routes())
+			const email = "unverified@example.com"
+			ts.signUpAndLogIn(t, email)
+
+			status := ts.doJSON(t, http.MethodGet, "/api/v2/expenses", nil, nil)
+			expectStatus(t, "read before verifying", status, tt.wantRead)
+			var problem Problem
+			status = ts.doJSON(t, http.MethodPost, "/api/v2/categories", map[string]string{"name": "Rent"}, &problem)
+			expectStatus(t, "write before verifying", status, tt.wantWrite)
+			if tt.wantWrite == http.StatusForbidden && problem.Code != ErrCodeEmailUnverified {
+				t.Errorf("got code %q; want %q", problem.Code, ErrCodeEmailUnverified)
+			}
+
+			// The account pages stay open, so that the user can verify
+			status = ts.doJSON(t, http.MethodGet, "/api/users/sessions", nil, nil)
+			expectStatus(t, "account page before verifying", status, http.StatusOK)
+
+			token := mailToken(t, waitForMails(t, dir, email, verifySubject, 1)[0])
+			status = ts.doJSON(t, http.MethodPost, "/api/users/email/verify", map[string]string{"token": token}, nil)
+			expectStatus(t, "verify", status, http.StatusOK)
+
+			status = ts.doJSON(t, http.MethodGet, "/api/v2/expenses", nil, nil)
+			expectStatus(t, "read after verifying", status, http.StatusOK)
+			status = ts.doJSON(t, http.MethodPost, "/api/v2/categories", map[string]string{"name": "Food"}, nil)
+			expectStatus(t, "write after verifying", status, http.StatusCreated)
+		})
+	}
+}
+
+// ageVerifications makes every verification email of the SQLite test
+// application look as if it was sent the given SQLite time modifier ago,
+// such as '-2 minutes'
+func ageVerifications(t *testing.T, app *application, modifier string) {
+	t.Helper()
+
+	_, err := app.integrity.DB.Exec(`UPDATE email_verifications
+			SET createdAt = strftime('%Y-%m-%d %H:%M:%S+00:00', createdAt, ?)`, modifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A verification email can be resent once a minute and five times an hour,
+// the signup email included
+func TestResendVerificationLimits(t *testing.T) {
+	app := newSQLiteTestApplication(t)
+	dir := useFileMailer(t, app)
+	ts := newTestServer(t, app.routes())
+	const email = "resend@example.com"
+	ts.signUpAndLogIn(t, email)
+	waitForMails(t, dir, email, verifySubject, 1)
+
+	expectRateLimited := func(name, retryAfter string) {
+		t.Helper()
+
+		res, _ := ts.do(t, http.MethodPost, "/api/users/email/resend", nil)
+		expectStatus(t, name, res.StatusCode, http.StatusTooManyRequests)
+		if got := res.Header.Get("Retry-After"); got != retryAfter {
+			t.Errorf("%s: got Retry-After %q; want %q", name, got, retryAfter)
+		}
+	}
+
+	expectRateLimited("resend right after signup", "60")
+
+	// Four more emails fit in the hour, a minute apart
+	for i := 2; i <= verificationsPerHour; i++ {
+		ageVerifications(t, app, "-61 seconds")
+		status := ts.doJSON(t, http.MethodPost, "/api/users/email/resend", nil, nil)
+		expectStatus(t, "resend a minute later", status, http.StatusAccepted)
+		waitForMails(t, dir, email, verifySubject, i)
+	}
+
+	ageVerifications(t, app, "-61 seconds")
+	expectRateLimited("resend a sixth time in the hour", "3600")
+
+	// Every email of the hour carries a token that still works, until one
+	// of them is used
+	mails := readMails(t, dir, email, verifySubject)
+	status := ts.doJSON(t, http.MethodPost, "/api/users/email/verify", map[string]string{"token": mailToken(t, mails[0])}, nil)
+	expectStatus(t, "verify with the first email", status, http.StatusOK)
+
+	var problem Problem
+	status = ts.doJSON(t, http.MethodPost, "/api/users/email/resend", nil, &problem)
+	expectStatus(t, "resend once verified", status, http.StatusConflict)
+	if problem.Code != ErrCodeEmailAlreadyVerified {
+		t.Errorf("got code %q; want %q", problem.Code, ErrCodeEmailAlreadyVerified)
+	}
+}
+
+// Concurrent resends send a single email
+func TestResendVerificationConcurrent(t *testing.T) {
+	app := newSQLiteTestApplication(t)
+	dir := useFileMailer(t, app)
+	ts := newTestServer(t, app.routes())
+	const email = "concurrent-resend@example.com"
+	ts.signUpAndLogIn(t, email)
+	waitForMails(t, dir, email, verifySubject, 1)
+	ageVerifications(t, app, "-61 seconds")
+
+	const requests = 8
+	statuses := make([]int, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, _ := ts.do(t, http.MethodPost, "/api/users/email/resend", nil)
+			statuses[i] = res.StatusCode
+		}(i)
+	}
+	wg.Wait()
+
+	sent := 0
+	for _, status := range statuses {
+		switch status {
+		case http.StatusAccepted:
+			sent++
+		case http.StatusTooManyRequests:
+		default:
+			t.Errorf("got status %d; want %d or %d", status, http.StatusAccepted, http.StatusTooManyRequests)
+		}
+	}
+	if sent != 1 {
+		t.Errorf("got %d sent emails; want 1", sent)
+	}
+	waitForMails(t, dir, email, verifySubject, 2)
+}
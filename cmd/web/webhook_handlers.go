@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"kweeuhree.personal-budgeting-backend/internal/events"
+	"kweeuhree.personal-budgeting-backend/internal/models"
+	"kweeuhree.personal-budgeting-backend/internal/validator"
+	"kweeuhree.personal-budgeting-backend/internal/webhooks"
+)
+
+const (
+	// webhookDispatchInterval is how often the dispatcher looks for due deliveries
+	webhookDispatchInterval = 10 * time.Second
+	// webhookDeliveryLogLimit is the number of deliveries returned by the delivery log
+	webhookDeliveryLogLimit = 100
+)
+
+// Input struct for registering a webhook, an empty events list subscribes to
+// every event
+type WebhookInput struct {
+	URL                 string   `json:"url" validate:"required,maxchars=2048,url"`
+	Events              []string `json:"events"`
+	validator.Validator `json:"-"`
+}
+
+// Response struct for returning webhook data, the secret is only returned
+// when the webhook is created
+type WebhookResponse struct {
+	WebhookId string    `json:"webhookId"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Response struct for returning an entry of the delivery log
+type WebhookDeliveryResponse struct {
+	DeliveryId     string     `json:"deliveryId"`
+	EventId        string     `json:"eventId"`
+	EventType      string     `json:"eventType"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  *time.Time `json:"nextAttemptAt,omitempty"`
+	LastStatusCode int        `json:"lastStatusCode,omitempty"`
+	LastError      string     `json:"lastError,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	DeliveredAt    *time.Time `json:"deliveredAt,omitempty"`
+}
+
+// Body of a webhook delivery. Id is the same for every delivery of an event,
+// receivers can use it to ignore duplicates.
+type WebhookBody struct {
+	Id        string       `json:"id"`
+	Type      string       `json:"type"`
+	CreatedAt time.Time    `json:"createdAt"`
+	Data      EventPayload `json:"data"`
+}
+
+func newWebhookResponse(wh *models.Webhook) WebhookResponse {
+	return WebhookResponse{
+		WebhookId: wh.WebhookId,
+		URL:       wh.URL,
+		Events:    append([]string{}, wh.Events...),
+		CreatedAt: wh.CreatedAt,
+	}
+}
+
+func newWebhookDeliveryResponse(d *models.WebhookDelivery) WebhookDeliveryResponse {
+	response := WebhookDeliveryResponse{
+		DeliveryId:     d.DeliveryId,
+		EventId:        d.EventId,
+		EventType:      d.EventType,
+		Status:         d.Status,
+		Attempts:       d.Attempts,
+		LastStatusCode: d.LastStatusCode,
+		LastError:      d.LastError,
+		CreatedAt:      d.CreatedAt,
+		DeliveredAt:    d.DeliveredAt,
+	}
+	if d.Status == models.DeliveryPending {
+		nextAttemptAt := d.NextAttemptAt
+		response.NextAttemptAt = &nextAttemptAt
+	}
+	return response
+}
+
+// read all webhooks of the user
+func (app *application) webhooksView(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	webhooks, err := app.webhooks.All(userId)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	response := []WebhookResponse{}
+	for _, wh := range webhooks {
+		response = append(response, newWebhookResponse(wh))
+	}
+
+	encodeJSON(w, http.StatusOK, response)
+}
+
+// register a webhook, the response carries the signing secret once
+func (app *application) webhookCreate(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	var input WebhookInput
+	err := decodeJSON(w, r, &input)
+	if err != nil {
+		return
+	}
+
+	input.Validate()
+	if input.Valid() {
+		// Refuse receivers inside our own network, the dispatcher checks the
+		// address again every time it connects
+		err = webhooks.CheckURL(r.Context(), input.URL, app.webhookAllowPrivate)
+		input.CheckField(err == nil, "url", "This field must be the URL of a public address")
+	}
+	if !input.Valid() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+
+	secret, err := newWebhookSecret()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	wh := &models.Webhook{
+		WebhookId: uuid.New().String(),
+		UserId:    userId,
+		URL:       input.URL,
+		Secret:    secret,
+		Events:    input.Events,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	err = app.webhooks.Insert(wh.WebhookId, userId, wh.URL, wh.Secret, wh.Events)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	response := newWebhookResponse(wh)
+	response.Secret = wh.Secret
+
+	encodeJSON(w, http.StatusCreated, response)
+}
+
+// delete a webhook together with its delivery log
+func (app *application) webhookDelete(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	webhookId := app.GetIdFromParams(r, "webhookId")
+	if webhookId == "" {
+		app.notFound(w, r)
+		return
+	}
+
+	err := app.webhooks.Delete(webhookId, userId)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w, r)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// read the latest deliveries of a webhook, newest first
+func (app *application) webhookDeliveriesView(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	webhookId := app.GetIdFromParams(r, "webhookId")
+	if webhookId == "" {
+		app.notFound(w, r)
+		return
+	}
+
+	_, err := app.webhooks.Get(webhookId, userId)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w, r)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	deliveries, err := app.webhooks.Deliveries(webhookId, userId, webhookDeliveryLogLimit)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	response := []WebhookDeliveryResponse{}
+	for _, d := range deliveries {
+		response = append(response, newWebhookDeliveryResponse(d))
+	}
+
+	encodeJSON(w, http.StatusOK, response)
+}
+
+// Generate the secret a webhook signs its deliveries with
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// Check the event filter of a webhook only names known event types
+func validWebhookEvents(eventTypes []string) bool {
+	for _, eventType := range eventTypes {
+		if !slices.Contains(events.Types, eventType) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestWebhookCreateRefusesPrivateAddresses(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	ts.signUpAndLogIn(t, "webhooks@example.com")
+
+	tests := []struct {
+		url  string
+		want int
+	}{
+		{"http://127.0.0.1:8080/hooks", http.StatusBadRequest},
+		{"http://localhost/hooks", http.StatusBadRequest},
+		{"http://169.254.169.254/latest/meta-data/", http.StatusBadRequest},
+		{"http://192.168.1.10/hooks", http.StatusBadRequest},
+		{"https://93.184.216.34/hooks", http.StatusCreated},
+	}
+	for _, tt := range tests {
+		var problem Problem
+		status := ts.doJSON(t, http.MethodPost, "/api/webhooks", map[string]any{"url": tt.url}, &problem)
+		if status != tt.want {
+			t.Errorf("%s: got status %d; want %d", tt.url, status, tt.want)
+		}
+		if tt.want == http.StatusBadRequest && problem.FieldErrors["url"] == "" {
+			t.Errorf("%s: no error for the url field", tt.url)
+		}
+	}
+
+	// Receivers on localhost are allowed when the configuration says so
+	app.webhookAllowPrivate = true
+	status := ts.doJSON(t, http.MethodPost, "/api/webhooks", map[string]any{"url": "http://localhost:8080/hooks"}, nil)
+	expectStatus(t, "localhost allowed", status, http.StatusCreated)
+}
@@ -0,0 +1,9 @@
+// Package docs embeds the OpenAPI specification of the API, so that the
+// tests can check the v2 routes against the same document that is
+// published on the Redocly page.
+package docs
+
+import _ "embed"
+
+//go:embed openapi.yaml
+var OpenAPI []byte
@@ -7,21 +7,60 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/alexedwards/scs/v2"
 	"github.com/go-sql-driver/mysql"
+	"kweeuhree.personal-budgeting-backend/internal/mailer"
 )
 
 type Config struct {
-	Addr           string
-	DSN            string
-	TLSConfig      *tls.Config
-	DebugPprof     bool
-	SessionManager *scs.SessionManager
-	ErrorLog       *log.Logger
+	Addr       string
+	DSN        string
+	TLSConfig  *tls.Config
+	DebugPprof bool
+	// Storage backend, DB_DRIVER: mysql, the default, sqlite or postgres
+	Driver string
+	// Apply pending schema migrations at startup, AUTO_MIGRATE
+	AutoMigrate bool
+	// How long audit log entries are kept, AUDIT_RETENTION_DAYS
+	AuditRetention time.Duration
+	// Users allowed to call the admin endpoints whatever their role,
+	// ADMIN_USER_IDS. They appoint the first admins.
+	AdminUserIds []string
+	// Sends the emails of the application, MAILER: log, the default, file or smtp
+	Mailer mailer.Mailer
+	// Page of the frontend that resets a password, PASSWORD_RESET_URL. The
+	// token is added as the token query parameter.
+	PasswordResetURL string
+	// Page of the frontend that verifies an email address,
+	// EMAIL_VERIFICATION_URL. The token is added as the token query parameter.
+	EmailVerificationURL string
+	// What users who have not verified their email may do, UNVERIFIED_ACCESS
+	UnverifiedAccess string
+	// Take the address of the client from the X-Forwarded-For header set by
+	// a reverse proxy, TRUST_PROXY
+	TrustProxy bool
+	// OpenID Connect providers users can log in with, OIDC_PROVIDERS
+	SSOProviders []SSOProvider
+	// Address of the single sign-on routes of the API, SSO_CALLBACK_URL. The
+	// providers send the users back to it followed by /{provider}/callback.
+	SSOCallbackURL string
+	// Page of the frontend the users land on after a single sign-on,
+	// SSO_REDIRECT_URL. The outcome is added as query parameters.
+	SSORedirectURL string
+	// Let webhooks be registered for, and delivered to, loopback and private
+	// addresses, WEBHOOK_ALLOW_PRIVATE. Meant for receivers on localhost
+	// during development.
+	WebhookAllowPrivate bool
+	SessionManager      *scs.SessionManager
+	ErrorLog            *log.Logger
 }
 
 const (
@@ -61,10 +100,20 @@ func devConfig(errorLog *log.Logger) *Config {
 		errorLog.Fatalf("failed to load environment variables")
 	}
 
-	// Local MySQL instance
-	// Define new command-line flag for the mysql dsn string
+	driver := dbDriver(errorLog)
+
+	// Local MySQL or Postgres instance, or SQLite file
+	// Define new command-line flag for the dsn string
 	DSNstring := fmt.Sprintf("%s:%s@/%s?parseTime=true", envVars...)
-	dsn := flag.String("dsn", DSNstring, "MySQL data source name")
+	switch driver {
+	case sqliteDriver:
+		DSNstring = sqliteDSN()
+	case postgresDriver:
+		DSNstring = postgresDSN(dbUser, dbPassword, "localhost", os.Getenv("DB_PORT"), dbName, url.Values{
+			"sslmode": {"disable"},
+		})
+	}
+	dsn := flag.String("dsn", DSNstring, "data source name of the DB_DRIVER database")
 	addr := flag.String("addr", port, "HTTP network address")
 	flag.Parse()
 	// Session manager configuration
@@ -73,11 +122,24 @@ func devConfig(errorLog *log.Logger) *Config {
 	sessionManager.Lifetime = 12 * time.Hour
 
 	return &Config{
-		Addr:           *addr,
-		DSN:            *dsn,
-		TLSConfig:      tlsConfig,
-		DebugPprof:     true,
-		SessionManager: sessionManager,
+		Addr:                 *addr,
+		Driver:               driver,
+		DSN:                  *dsn,
+		TLSConfig:            tlsConfig,
+		DebugPprof:           true,
+		AutoMigrate:          autoMigrate(errorLog),
+		AuditRetention:       auditRetention(errorLog),
+		AdminUserIds:         adminUserIds(),
+		Mailer:               newMailer(errorLog),
+		PasswordResetURL:     passwordResetURL("http://localhost:5173/reset-password"),
+		EmailVerificationURL: emailVerificationURL("http://localhost:5173/verify-email"),
+		UnverifiedAccess:     unverifiedAccess(errorLog),
+		TrustProxy:           trustProxy(false, errorLog),
+		SSOProviders:         ssoProviders(errorLog),
+		SSOCallbackURL:       ssoCallbackURL(fmt.Sprintf("https://localhost%s/api/users/sso", *addr)),
+		SSORedirectURL:       ssoRedirectURL("http://localhost:5173/sso"),
+		WebhookAllowPrivate:  webhookAllowPrivate(true, errorLog),
+		SessionManager:       sessionManager,
 	}
 }
 
@@ -97,6 +159,61 @@ func prodConfig(errorLog *log.Logger) *Config {
 		errorLog.Fatalf("failed to load environment variables")
 	}
 
+	driver := dbDriver(errorLog)
+
+	// Production DSN, a self-hosted install may use an SQLite file instead
+	var DSNstring string
+	switch driver {
+	case mysqlDriver:
+		registerAivenTLS(caAivenCert, errorLog)
+		DSNstring = fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?tls=aiven&parseTime=true",
+			dbUser, dbPassword, dbHost, dbPort, dbName)
+	case postgresDriver:
+		// Verify the server against the Aiven CA certificate
+		DSNstring = postgresDSN(dbUser, dbPassword, dbHost, dbPort, dbName, url.Values{
+			"sslmode":     {"verify-full"},
+			"sslrootcert": {caAivenCert},
+		})
+	case sqliteDriver:
+		DSNstring = sqliteDSN()
+	}
+
+	dsn := flag.String("dsn", DSNstring, "data source name of the DB_DRIVER database")
+
+	// Session manager configuration
+	sessionManager := scs.New()
+
+	sessionManager.Lifetime = 12 * time.Hour
+	sessionManager.Cookie.HttpOnly = true
+	sessionManager.Cookie.Secure = true
+	sessionManager.Cookie.SameSite = http.SameSiteNoneMode
+	sessionManager.Cookie.Path = "/"
+
+	return &Config{
+		Addr:                 fmt.Sprintf(":%s", dbPort),
+		Driver:               driver,
+		DSN:                  *dsn,
+		DebugPprof:           false,
+		AutoMigrate:          autoMigrate(errorLog),
+		AuditRetention:       auditRetention(errorLog),
+		AdminUserIds:         adminUserIds(),
+		Mailer:               newMailer(errorLog),
+		PasswordResetURL:     passwordResetURL("https://personal-budgeting.onrender.com/reset-password"),
+		EmailVerificationURL: emailVerificationURL("https://personal-budgeting.onrender.com/verify-email"),
+		UnverifiedAccess:     unverifiedAccess(errorLog),
+		TrustProxy:           trustProxy(true, errorLog), // behind the proxy of Render
+		SSOProviders:         ssoProviders(errorLog),
+		SSOCallbackURL:       ssoCallbackURL("https://personal-budgeting-backend.onrender.com/api/users/sso"),
+		SSORedirectURL:       ssoRedirectURL("https://personal-budgeting.onrender.com/sso"),
+		WebhookAllowPrivate:  webhookAllowPrivate(false, errorLog),
+		SessionManager:       sessionManager,
+		TLSConfig:            tlsConfig,
+	}
+}
+
+// registerAivenTLS() registers the CA certificate of the Aiven MySQL
+// service with the MySQL driver, under the name used in the DSN
+func registerAivenTLS(caAivenCert string, errorLog *log.Logger) {
 	// Load Aiven CA certificate
 	rootCertPool := x509.NewCertPool()
 	pem, err := os.ReadFile(caAivenCert)
@@ -114,27 +231,301 @@ func prodConfig(errorLog *log.Logger) *Config {
 	if err != nil {
 		errorLog.Fatalf("failed to register TLS config: %v", err)
 	}
+}
 
-	// Production DSN
-	DSNstring := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?tls=aiven&parseTime=true",
-		dbUser, dbPassword, dbHost, dbPort, dbName)
+// Values of DB_DRIVER
+const (
+	mysqlDriver    = "mysql"
+	sqliteDriver   = "sqlite"
+	postgresDriver = "postgres"
+)
 
-	dsn := flag.String("dsn", DSNstring, "Aiven MySQL data source name")
+// defaultSQLitePath is the database file used when SQLITE_PATH is not set
+const defaultSQLitePath = "budgeting.db"
 
-	// Session manager configuration
-	sessionManager := scs.New()
+// dbDriver() reads the storage backend, MySQL unless DB_DRIVER says otherwise
+func dbDriver(errorLog *log.Logger) string {
+	switch driver := os.Getenv("DB_DRIVER"); driver {
+	case "", mysqlDriver:
+		return mysqlDriver
+	case sqliteDriver, postgresDriver:
+		return driver
+	default:
+		errorLog.Fatalf("DB_DRIVER must be %s, %s or %s, got %q", mysqlDriver, sqliteDriver, postgresDriver, driver)
+		return ""
+	}
+}
 
-	sessionManager.Lifetime = 12 * time.Hour
-	sessionManager.Cookie.HttpOnly = true
-	sessionManager.Cookie.Secure = true
-	sessionManager.Cookie.SameSite = http.SameSiteNoneMode
-	sessionManager.Cookie.Path = "/"
+// sqliteDSN() returns the DSN of the SQLite file in SQLITE_PATH. Foreign
+// keys are off by default in SQLite. Write transactions take the write lock
+// when they begin, and wait for each other instead of failing with "database
+// is locked".
+func sqliteDSN() string {
+	path := os.Getenv("SQLITE_PATH")
+	if path == "" {
+		path = defaultSQLitePath
+	}
+	return fmt.Sprintf("file:%s?_foreign_keys=on&_busy_timeout=5000&_txlock=immediate&_journal_mode=WAL", path)
+}
 
-	return &Config{
-		Addr:           fmt.Sprintf(":%s", dbPort),
-		DSN:            *dsn,
-		DebugPprof:     false,
-		SessionManager: sessionManager,
-		TLSConfig:      tlsConfig,
+// postgresDSN() returns the URL of a Postgres database. The port is left
+// out when it is empty, and defaults to 5432.
+func postgresDSN(user, password, host, port, dbName string, params url.Values) string {
+	if port != "" {
+		host = net.JoinHostPort(host, port)
+	}
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(user, password),
+		Host:     host,
+		Path:     "/" + dbName,
+		RawQuery: params.Encode(),
+	}
+	return u.String()
+}
+
+// autoMigrate() reads whether pending migrations are applied at startup
+func autoMigrate(errorLog *log.Logger) bool {
+	value := os.Getenv("AUTO_MIGRATE")
+	if value == "" {
+		return false
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		errorLog.Fatalf("AUTO_MIGRATE must be true or false, got %q", value)
+	}
+	return enabled
+}
+
+// trustProxy() reads whether the application runs behind a reverse proxy,
+// or returns fallback
+func trustProxy(fallback bool, errorLog *log.Logger) bool {
+	value := os.Getenv("TRUST_PROXY")
+	if value == "" {
+		return fallback
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		errorLog.Fatalf("TRUST_PROXY must be true or false, got %q", value)
+	}
+	return enabled
+}
+
+// webhookAllowPrivate() reads whether webhooks may point to addresses that
+// are not public, or returns fallback
+func webhookAllowPrivate(fallback bool, errorLog *log.Logger) bool {
+	value := os.Getenv("WEBHOOK_ALLOW_PRIVATE")
+	if value == "" {
+		return fallback
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		errorLog.Fatalf("WEBHOOK_ALLOW_PRIVATE must be true or false, got %q", value)
+	}
+	return enabled
+}
+
+// defaultAuditRetentionDays is used when AUDIT_RETENTION_DAYS is not set
+const defaultAuditRetentionDays = 365
+
+// auditRetention() reads how many days audit log entries are kept
+func auditRetention(errorLog *log.Logger) time.Duration {
+	days := defaultAuditRetentionDays
+	if value := os.Getenv("AUDIT_RETENTION_DAYS"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			errorLog.Fatalf("AUDIT_RETENTION_DAYS must be a positive number of days, got %q", value)
+		}
+		days = n
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// adminUserIds() reads the comma separated ids of the administrators
+func adminUserIds() []string {
+	userIds := []string{}
+	for _, userId := range strings.Split(os.Getenv("ADMIN_USER_IDS"), ",") {
+		if userId = strings.TrimSpace(userId); userId != "" {
+			userIds = append(userIds, userId)
+		}
+	}
+	return userIds
+}
+
+// Defaults of the mailer settings
+const (
+	defaultMailFrom = "Personal Budgeting <no-reply@personal-budgeting.onrender.com>"
+	defaultMailDir  = "mail"
+	defaultSMTPPort = 587
+)
+
+// newMailer() returns the mailer selected by MAILER. The log mailer, the
+// default, and the file mailer, which writes to MAIL_DIR, do not send
+// anything. The SMTP mailer reads SMTP_HOST, SMTP_PORT, SMTP_USERNAME and
+// SMTP_PASSWORD. Every mailer sends from MAIL_FROM.
+func newMailer(errorLog *log.Logger) mailer.Mailer {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = defaultMailFrom
+	}
+
+	switch kind := os.Getenv("MAILER"); kind {
+	case "", "log":
+		return mailer.NewLog(from, log.New(os.Stdout, "MAIL\t", log.Ldate|log.Ltime))
+	case "file":
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = defaultMailDir
+		}
+		return mailer.NewFile(from, dir)
+	case "smtp":
+		host := os.Getenv("SMTP_HOST")
+		if host == "" {
+			errorLog.Fatal("SMTP_HOST must be set when MAILER is smtp")
+		}
+		port := defaultSMTPPort
+		if value := os.Getenv("SMTP_PORT"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				errorLog.Fatalf("SMTP_PORT must be a port number, got %q", value)
+			}
+			port = n
+		}
+		return mailer.NewSMTP(host, port, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), from)
+	default:
+		errorLog.Fatalf("MAILER must be log, file or smtp, got %q", kind)
+		return nil
+	}
+}
+
+// passwordResetURL() reads the page that resets a password, or returns
+// fallback
+func passwordResetURL(fallback string) string {
+	if value := os.Getenv("PASSWORD_RESET_URL"); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// emailVerificationURL() reads the page that verifies an email address, or
+// returns fallback
+func emailVerificationURL(fallback string) string {
+	if value := os.Getenv("EMAIL_VERIFICATION_URL"); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Values of UNVERIFIED_ACCESS
+const (
+	// UnverifiedAccessFull lets unverified users do everything
+	UnverifiedAccessFull = "full"
+	// UnverifiedAccessReadOnly lets unverified users read their data, but
+	// not change it
+	UnverifiedAccessReadOnly = "read-only"
+	// UnverifiedAccessNone keeps unverified users out of their data
+	UnverifiedAccessNone = "none"
+)
+
+// unverifiedAccess() reads what users who have not verified their email may
+// do, read-only unless UNVERIFIED_ACCESS says otherwise
+func unverifiedAccess(errorLog *log.Logger) string {
+	switch value := os.Getenv("UNVERIFIED_ACCESS"); value {
+	case "":
+		return UnverifiedAccessReadOnly
+	case UnverifiedAccessFull, UnverifiedAccessReadOnly, UnverifiedAccessNone:
+		return value
+	default:
+		errorLog.Fatalf("UNVERIFIED_ACCESS must be %s, %s or %s, got %q",
+			UnverifiedAccessFull, UnverifiedAccessReadOnly, UnverifiedAccessNone, value)
+		return ""
+	}
+}
+
+// define SSOProvider type, an OpenID Connect provider users can log in with
+type SSOProvider struct {
+	// Id names the provider in the routes, and in the OIDC_<ID>_ variables
+	Id string
+	// Name is shown to the users, OIDC_<ID>_NAME, the id by default
+	Name string
+	// Issuer is the URL the provider is discovered at, OIDC_<ID>_ISSUER
+	Issuer       string
+	ClientId     string
+	ClientSecret string
+	// Scopes are asked for besides openid, OIDC_<ID>_SCOPES, email and
+	// profile by default
+	Scopes []string
+}
+
+// ssoProviders() reads the comma separated ids of OIDC_PROVIDERS, and the
+// OIDC_<ID>_ISSUER, OIDC_<ID>_CLIENT_ID and OIDC_<ID>_CLIENT_SECRET of each
+func ssoProviders(errorLog *log.Logger) []SSOProvider {
+	providers := []SSOProvider{}
+	for _, id := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		id = strings.ToLower(strings.TrimSpace(id))
+		if id == "" {
+			continue
+		}
+		if !validProviderId(id) {
+			errorLog.Fatalf("OIDC_PROVIDERS ids must be letters, digits and dashes, got %q", id)
+		}
+		for _, p := range providers {
+			if p.Id == id {
+				errorLog.Fatalf("OIDC_PROVIDERS lists %q twice", id)
+			}
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(id, "-", "_")) + "_"
+		p := SSOProvider{
+			Id:           id,
+			Name:         os.Getenv(prefix + "NAME"),
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientId:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			Scopes:       strings.Fields(strings.ReplaceAll(os.Getenv(prefix+"SCOPES"), ",", " ")),
+		}
+		if p.Issuer == "" || p.ClientId == "" {
+			errorLog.Fatalf("%sISSUER and %sCLIENT_ID must be set for the %s provider", prefix, prefix, id)
+		}
+		if p.Name == "" {
+			p.Name = id
+		}
+		if len(p.Scopes) == 0 {
+			p.Scopes = []string{"email", "profile"}
+		}
+		providers = append(providers, p)
+	}
+	return providers
+}
+
+// validProviderId() reports whether the id is lowercase letters, digits and
+// dashes, which fit in a path and in the names of the variables
+func validProviderId(id string) bool {
+	if len(id) > 50 {
+		return false
+	}
+	for _, c := range id {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// ssoCallbackURL() reads the address of the single sign-on routes, or
+// returns fallback
+func ssoCallbackURL(fallback string) string {
+	if value := os.Getenv("SSO_CALLBACK_URL"); value != "" {
+		return strings.TrimSuffix(value, "/")
+	}
+	return fallback
+}
+
+// ssoRedirectURL() reads the page users land on after a single sign-on, or
+// returns fallback
+func ssoRedirectURL(fallback string) string {
+	if value := os.Getenv("SSO_REDIRECT_URL"); value != "" {
+		return value
 	}
+	return fallback
 }
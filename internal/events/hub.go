@@ -0,0 +1,163 @@
+// Package events implements the in-process publish/subscribe hub behind the
+// server-sent events stream. Handlers publish an event after every change to
+// the data of a user, and every open stream of that user receives it.
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types published by the handlers
+const (
+	ExpenseCreated  = "expense.created"
+	ExpenseUpdated  = "expense.updated"
+	ExpenseDeleted  = "expense.deleted"
+	BudgetCreated   = "budget.created"
+	BudgetUpdated   = "budget.updated"
+	BudgetDeleted   = "budget.deleted"
+	CategoryCreated = "category.created"
+	CategoryUpdated = "category.updated"
+	CategoryDeleted = "category.deleted"
+	// ResyncRequired is sent instead of a replay when the events a client
+	// missed are no longer buffered, the client should reload its data
+	ResyncRequired = "resync.required"
+)
+
+// Types lists the event types describing a change, which webhooks can
+// subscribe to
+var Types = []string{
+	ExpenseCreated, ExpenseUpdated, ExpenseDeleted,
+	BudgetCreated, BudgetUpdated, BudgetDeleted,
+	CategoryCreated, CategoryUpdated, CategoryDeleted,
+}
+
+// subscriberBuffer is the number of events a slow subscriber can fall behind
+// before it is disconnected
+const subscriberBuffer = 32
+
+// define Event type, Id increases by one for every published event
+type Event struct {
+	Id        uint64
+	Type      string
+	UserId    string
+	Data      any
+	CreatedAt time.Time
+}
+
+// define Subscription type, Events is closed when the hub drops the subscriber
+type Subscription struct {
+	Events <-chan Event
+	userId string
+	events chan Event
+}
+
+// define Hub type which fans events out to the subscribers of each user and
+// keeps the last events in a bounded buffer so that reconnecting clients can
+// resume where they left off
+type Hub struct {
+	mu          sync.Mutex
+	lastId      uint64
+	buffer      []Event
+	next        int
+	subscribers map[string]map[*Subscription]struct{}
+}
+
+// NewHub returns a hub which keeps the last bufferSize events for replay
+func NewHub(bufferSize int) *Hub {
+	return &Hub{
+		buffer:      make([]Event, 0, bufferSize),
+		subscribers: make(map[string]map[*Subscription]struct{}),
+	}
+}
+
+// Publish sends an event to every subscriber of the user and returns it
+func (h *Hub) Publish(userId, eventType string, data any) Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastId++
+	event := Event{
+		Id:        h.lastId,
+		Type:      eventType,
+		UserId:    userId,
+		Data:      data,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	if len(h.buffer) < cap(h.buffer) {
+		h.buffer = append(h.buffer, event)
+	} else if cap(h.buffer) > 0 {
+		h.buffer[h.next] = event
+		h.next = (h.next + 1) % cap(h.buffer)
+	}
+
+	for sub := range h.subscribers[userId] {
+		select {
+		case sub.events <- event:
+		default:
+			// The subscriber stopped reading, drop it so that it reconnects
+			// and resumes from the replay buffer
+			h.remove(sub)
+		}
+	}
+
+	return event
+}
+
+// Subscribe registers a subscriber for the events of the user. If
+// lastEventId is not zero, the buffered events of the user published after it
+// are returned for replay; ok is false if some of them were already dropped
+// from the buffer.
+func (h *Hub) Subscribe(userId string, lastEventId uint64) (sub *Subscription, missed []Event, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	events := make(chan Event, subscriberBuffer)
+	sub = &Subscription{Events: events, userId: userId, events: events}
+	if h.subscribers[userId] == nil {
+		h.subscribers[userId] = make(map[*Subscription]struct{})
+	}
+	h.subscribers[userId][sub] = struct{}{}
+
+	if lastEventId == 0 || lastEventId >= h.lastId {
+		return sub, nil, true
+	}
+
+	// The oldest buffered event is at h.next once the buffer is full
+	ordered := append(append([]Event{}, h.buffer[h.next:]...), h.buffer[:h.next]...)
+	if len(ordered) == 0 || ordered[0].Id > lastEventId+1 {
+		return sub, nil, false
+	}
+
+	for _, event := range ordered {
+		if event.Id > lastEventId && event.UserId == userId {
+			missed = append(missed, event)
+		}
+	}
+	return sub, missed, true
+}
+
+// Unsubscribe removes the subscriber, it is safe to call more than once
+func (h *Hub) Unsubscribe(sub *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.remove(sub)
+}
+
+func (h *Hub) remove(sub *Subscription) {
+	subs, ok := h.subscribers[sub.userId]
+	if !ok {
+		return
+	}
+	if _, ok := subs[sub]; !ok {
+		return
+	}
+
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(h.subscribers, sub.userId)
+	}
+	close(sub.events)
+}
@@ -0,0 +1,170 @@
+package events_test
+
+import (
+	"slices"
+	"testing"
+
+	"kweeuhree.personal-budgeting-backend/internal/events"
+)
+
+// ids returns the ids of the events
+func ids(evs []events.Event) []uint64 {
+	out := make([]uint64, len(evs))
+	for i, e := range evs {
+		out[i] = e.Id
+	}
+	return out
+}
+
+func TestPublish(t *testing.T) {
+	hub := events.NewHub(10)
+	alice, _, _ := hub.Subscribe("alice", 0)
+	bob, _, _ := hub.Subscribe("bob", 0)
+	defer hub.Unsubscribe(alice)
+	defer hub.Unsubscribe(bob)
+
+	published := hub.Publish("alice", events.ExpenseCreated, "data")
+
+	select {
+	case event := <-alice.Events:
+		if event.Id != published.Id || event.Type != events.ExpenseCreated || event.Data != "data" {
+			t.Errorf("got event %+v; want %+v", event, published)
+		}
+	default:
+		t.Error("alice got no event")
+	}
+
+	select {
+	case event := <-bob.Events:
+		t.Errorf("bob got alice's event %+v", event)
+	default:
+	}
+}
+
+func TestSubscribeReplay(t *testing.T) {
+	hub := events.NewHub(10)
+	for i := 0; i < 3; i++ {
+		hub.Publish("alice", events.ExpenseCreated, i)
+		hub.Publish("bob", events.ExpenseCreated, i)
+	}
+	// alice's events are 1, 3 and 5, bob's 2, 4 and 6
+
+	tests := []struct {
+		name        string
+		lastEventId uint64
+		wantMissed  []uint64
+		wantOk      bool
+	}{
+		{"new stream", 0, nil, true},
+		{"up to date", 6, nil, true},
+		{"ahead of the hub", 100, nil, true},
+		{"missed some", 2, []uint64{3, 5}, true},
+		{"missed after the first", 1, []uint64{3, 5}, true},
+		{"missed only bob's", 5, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sub, missed, ok := hub.Subscribe("alice", tt.lastEventId)
+			defer hub.Unsubscribe(sub)
+
+			if ok != tt.wantOk {
+				t.Errorf("got ok %t; want %t", ok, tt.wantOk)
+			}
+			if !slices.Equal(ids(missed), tt.wantMissed) {
+				t.Errorf("got missed %v; want %v", ids(missed), tt.wantMissed)
+			}
+		})
+	}
+}
+
+// Once the buffer is full the oldest events are overwritten, and clients
+// that missed an overwritten event are told to resync
+func TestSubscribeReplayOverflow(t *testing.T) {
+	hub := events.NewHub(3)
+	for i := 0; i < 7; i++ {
+		hub.Publish("alice", events.ExpenseCreated, i)
+	}
+	// The buffer wrapped around and holds 5, 6 and 7
+
+	tests := []struct {
+		name        string
+		lastEventId uint64
+		wantMissed  []uint64
+		wantOk      bool
+	}{
+		{"oldest buffered is next", 4, []uint64{5, 6, 7}, true},
+		{"within the buffer", 5, []uint64{6, 7}, true},
+		{"overwritten", 3, nil, false},
+		{"long gone", 1, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sub, missed, ok := hub.Subscribe("alice", tt.lastEventId)
+			defer hub.Unsubscribe(sub)
+
+			if ok != tt.wantOk {
+				t.Errorf("got ok %t; want %t", ok, tt.wantOk)
+			}
+			if !slices.Equal(ids(missed), tt.wantMissed) {
+				t.Errorf("got missed %v; want %v", ids(missed), tt.wantMissed)
+			}
+		})
+	}
+}
+
+func TestSubscribeWithoutBuffer(t *testing.T) {
+	hub := events.NewHub(0)
+	hub.Publish("alice", events.ExpenseCreated, nil)
+	hub.Publish("alice", events.ExpenseCreated, nil)
+
+	sub, missed, ok := hub.Subscribe("alice", 1)
+	defer hub.Unsubscribe(sub)
+	if ok || missed != nil {
+		t.Errorf("got %v, %t; want nil, false", ids(missed), ok)
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	hub := events.NewHub(10)
+	sub, _, _ := hub.Subscribe("alice", 0)
+	other, _, _ := hub.Subscribe("alice", 0)
+	defer hub.Unsubscribe(other)
+
+	hub.Unsubscribe(sub)
+	// Safe to call more than once
+	hub.Unsubscribe(sub)
+
+	if _, open := <-sub.Events; open {
+		t.Error("got an open channel after Unsubscribe")
+	}
+
+	// The remaining subscriber of the user still receives events
+	hub.Publish("alice", events.ExpenseCreated, nil)
+	select {
+	case <-other.Events:
+	default:
+		t.Error("the other subscriber got no event")
+	}
+}
+
+// A subscriber that stops reading is dropped instead of blocking Publish
+func TestSlowSubscriberDropped(t *testing.T) {
+	hub := events.NewHub(10)
+	sub, _, _ := hub.Subscribe("alice", 0)
+	defer hub.Unsubscribe(sub)
+
+	const published = 100
+	for i := 0; i < published; i++ {
+		hub.Publish("alice", events.ExpenseCreated, i)
+	}
+
+	received := 0
+	for range sub.Events {
+		received++
+	}
+	if received == 0 || received >= published {
+		t.Errorf("got %d buffered events before the drop; want between 0 and %d", received, published)
+	}
+}
@@ -0,0 +1,255 @@
+// Package integrity recomputes the counters that are derived from the
+// expenses of a user: the totalSpent and budgetRemaining of the budget, and
+// the totalSum of every expense category. It reports where the stored
+// counters drifted from the expenses, and can repair them.
+package integrity
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
+
+// Fields that are checked
+const (
+	FieldTotalSpent      = "totalSpent"
+	FieldBudgetRemaining = "budgetRemaining"
+	FieldTotalSum        = "totalSum"
+)
+
+// define Discrepancy type, a counter whose stored value does not match the
+// value recomputed from the expenses. EntityType is one of the audited
+// entities of the models package.
+type Discrepancy struct {
+	EntityType string
+	EntityId   string
+	Field      string
+	Stored     int64
+	Expected   int64
+}
+
+// define Report type, the outcome of checking the counters of a user.
+// Repaired is set once the discrepancies have been written back.
+type Report struct {
+	UserId        string
+	Discrepancies []Discrepancy
+	Repaired      bool
+}
+
+// OK returns true if every counter of the user matched the expenses
+func (r *Report) OK() bool {
+	return len(r.Discrepancies) == 0
+}
+
+// define Actor type, who asked for a repair. It is recorded in the audit log.
+type Actor struct {
+	UserId    string
+	SessionId string
+	IP        string
+	RequestId string
+}
+
+// define Checker type which wraps a sql.DB connection pool
+type Checker struct {
+	DB       *sql.DB
+	Dialect  models.Dialect
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// UserIds returns the ids of every user, to check them all
+func (c *Checker) UserIds() ([]string, error) {
+	users := &models.UserModel{DB: models.Bind(c.DB, c.Dialect), Dialect: c.Dialect}
+	return users.AllIds()
+}
+
+// Check compares the counters of the user with the values recomputed from
+// their expenses, without changing anything
+func (c *Checker) Check(userId string) (*Report, error) {
+	report, _, _, err := c.check(models.Bind(c.DB, c.Dialect), userId)
+	return report, err
+}
+
+// Repair checks the counters of the user and writes the recomputed values
+// back in a single transaction, recording every change in the audit log.
+// The budget of the user is locked while the expenses are read, so that a
+// concurrent change either waits for the repair or fails with
+// ErrVersionConflict instead of being counted twice. SQLite has no row
+// locks, its write transactions already exclude each other.
+func (c *Checker) Repair(userId string, actor Actor) (*Report, error) {
+	tx, err := c.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	db := models.Bind(tx, c.Dialect)
+
+	_, err = db.Exec(`SELECT budgetId FROM budget WHERE userId = ?`+c.Dialect.ForUpdate(), userId)
+	if err != nil {
+		return nil, err
+	}
+
+	report, budget, categories, err := c.check(db, userId)
+	if err != nil {
+		return nil, err
+	}
+	if report.OK() {
+		return report, nil
+	}
+
+	budgets := models.NewBudgetModel(db, c.Dialect, c.InfoLog, c.ErrorLog)
+	expenseCategories := &models.ExpenseCategoryModel{DB: db}
+	audit := &models.AuditModel{DB: db, Dialect: c.Dialect}
+
+	for _, d := range report.Discrepancies {
+		switch d.EntityType {
+		case models.AuditEntityBudget:
+			// both budget fields are written at once, below
+			continue
+		case models.AuditEntityCategory:
+			err = expenseCategories.PutTotalSum(userId, d.EntityId, d.Expected)
+			if err != nil {
+				return nil, err
+			}
+			err = audit.Insert(repairEntry(userId, actor, d.EntityType, d.EntityId,
+				map[string]int64{FieldTotalSum: d.Stored},
+				map[string]int64{FieldTotalSum: d.Expected}))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if budget != nil {
+		before := map[string]int64{}
+		after := map[string]int64{}
+		for _, d := range report.Discrepancies {
+			if d.EntityType == models.AuditEntityBudget {
+				before[d.Field] = d.Stored
+				after[d.Field] = d.Expected
+			}
+		}
+
+		if len(after) > 0 {
+			totalSpent, budgetRemaining := expectedBudget(budget, categories)
+			err = budgets.PutIfVersion(budget.BudgetId, userId, budget.Version, budget.CheckingBalance, budget.SavingsBalance,
+				budget.BudgetTotal, budgetRemaining, totalSpent)
+			if err != nil {
+				return nil, err
+			}
+			err = audit.Insert(repairEntry(userId, actor, models.AuditEntityBudget, budget.BudgetId, before, after))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	report.Repaired = true
+	return report, nil
+}
+
+// check reads the budget, categories and expenses of the user and compares
+// the stored counters with the recomputed ones. It also returns the budget,
+// nil if the user has none, and the recomputed category totals.
+func (c *Checker) check(db models.DBTX, userId string) (*Report, *models.Budget, map[string]int64, error) {
+	budgets := models.NewBudgetModel(db, c.Dialect, c.InfoLog, c.ErrorLog)
+	expenses := &models.ExpenseModel{DB: db, Dialect: c.Dialect}
+	expenseCategories := &models.ExpenseCategoryModel{DB: db}
+
+	budget, err := budgets.GetBudgetByUserId(userId)
+	if err != nil && !errors.Is(err, models.ErrNoRecord) {
+		return nil, nil, nil, err
+	}
+
+	cats, err := expenseCategories.All(userId)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	exps, err := expenses.All(userId)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Every category counts, even those without expenses
+	totals := map[string]int64{}
+	for _, cat := range cats {
+		totals[cat.ExpenseCategoryId] = 0
+	}
+	for _, exp := range exps {
+		totals[exp.CategoryId] += exp.AmountInCents
+	}
+
+	report := &Report{UserId: userId, Discrepancies: []Discrepancy{}}
+
+	if budget != nil {
+		totalSpent, budgetRemaining := expectedBudget(budget, totals)
+		if budget.TotalSpent != totalSpent {
+			report.Discrepancies = append(report.Discrepancies, Discrepancy{
+				EntityType: models.AuditEntityBudget,
+				EntityId:   budget.BudgetId,
+				Field:      FieldTotalSpent,
+				Stored:     budget.TotalSpent,
+				Expected:   totalSpent,
+			})
+		}
+		if budget.BudgetRemaining != budgetRemaining {
+			report.Discrepancies = append(report.Discrepancies, Discrepancy{
+				EntityType: models.AuditEntityBudget,
+				EntityId:   budget.BudgetId,
+				Field:      FieldBudgetRemaining,
+				Stored:     budget.BudgetRemaining,
+				Expected:   budgetRemaining,
+			})
+		}
+	}
+
+	for _, cat := range cats {
+		if cat.TotalSum != totals[cat.ExpenseCategoryId] {
+			report.Discrepancies = append(report.Discrepancies, Discrepancy{
+				EntityType: models.AuditEntityCategory,
+				EntityId:   cat.ExpenseCategoryId,
+				Field:      FieldTotalSum,
+				Stored:     cat.TotalSum,
+				Expected:   totals[cat.ExpenseCategoryId],
+			})
+		}
+	}
+
+	return report, budget, totals, nil
+}
+
+// expectedBudget returns the totalSpent and budgetRemaining the budget should
+// have: everything spent on expenses, and what is left in the checking and
+// savings balances
+func expectedBudget(budget *models.Budget, categoryTotals map[string]int64) (totalSpent, budgetRemaining int64) {
+	for _, total := range categoryTotals {
+		totalSpent += total
+	}
+	return totalSpent, budget.CheckingBalance + budget.SavingsBalance
+}
+
+func repairEntry(userId string, actor Actor, entityType, entityId string, before, after map[string]int64) *models.AuditEntry {
+	entry := &models.AuditEntry{
+		UserId:     userId,
+		ActorId:    actor.UserId,
+		SessionId:  actor.SessionId,
+		IP:         actor.IP,
+		RequestId:  actor.RequestId,
+		Action:     models.AuditActionRepair,
+		EntityType: entityType,
+		EntityId:   entityId,
+	}
+	// Maps of int64 always marshal
+	entry.Before, _ = json.Marshal(before)
+	entry.After, _ = json.Marshal(after)
+	return entry
+}
@@ -0,0 +1,184 @@
+package integrity_test
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"kweeuhree.personal-budgeting-backend/internal/integrity"
+	"kweeuhree.personal-budgeting-backend/internal/migrations"
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
+
+// newTestChecker returns a checker of a migrated SQLite database in a
+// temporary file, and the store of its models
+func newTestChecker(t *testing.T) (*integrity.Checker, *models.SQLStore) {
+	t.Helper()
+
+	dsn := fmt.Sprintf("file:%s?_foreign_keys=on&_busy_timeout=5000&_txlock=immediate&_journal_mode=WAL",
+		filepath.Join(t.TempDir(), "budgeting.db"))
+	db, err := sql.Open(models.SQLite.Driver(), dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	discard := log.New(io.Discard, "", 0)
+	migrator, err := migrations.New(db, models.SQLite, discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	checker := &integrity.Checker{DB: db, Dialect: models.SQLite, InfoLog: discard, ErrorLog: discard}
+	return checker, models.NewSQLStore(db, models.SQLite, discard, discard)
+}
+
+func TestCheckAndRepair(t *testing.T) {
+	checker, store := newTestChecker(t)
+	repos := store.Repositories()
+	db := models.Bind(store.DB, store.Dialect)
+
+	userId := uuid.New().String()
+	err := repos.Users.Insert(userId, "drift@example.com", "Test User", "pa$$word123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	budgetId := uuid.New().String()
+	_, err = repos.Budgets.Insert(budgetId, userId, 9000, 1000, 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rent := uuid.New().String()
+	_, err = repos.ExpenseCategories.Insert(rent, userId, "Rent", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	food := uuid.New().String()
+	_, err = repos.ExpenseCategories.Insert(food, userId, "Food", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, amount := range []int64{500, 250} {
+		_, err = repos.Expenses.Insert(uuid.New().String(), userId, rent, "", "checkingBalance", amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Store the counters the handlers would have written
+	_, err = db.Exec(`UPDATE budget SET totalSpent = 750, budgetRemaining = 10000 WHERE budgetId = ?`, budgetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repos.ExpenseCategories.PutTotalSum(userId, rent, 750)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := checker.Check(userId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("got discrepancies %+v before the drift; want none", report.Discrepancies)
+	}
+
+	// Drift the budget and both categories
+	_, err = db.Exec(`UPDATE budget SET totalSpent = 700, budgetRemaining = 9999 WHERE budgetId = ?`, budgetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repos.ExpenseCategories.PutTotalSum(userId, rent, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repos.ExpenseCategories.PutTotalSum(userId, food, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]integrity.Discrepancy{
+		budgetId + " " + integrity.FieldTotalSpent: {
+			EntityType: models.AuditEntityBudget, EntityId: budgetId, Field: integrity.FieldTotalSpent, Stored: 700, Expected: 750,
+		},
+		budgetId + " " + integrity.FieldBudgetRemaining: {
+			EntityType: models.AuditEntityBudget, EntityId: budgetId, Field: integrity.FieldBudgetRemaining, Stored: 9999, Expected: 10000,
+		},
+		rent + " " + integrity.FieldTotalSum: {
+			EntityType: models.AuditEntityCategory, EntityId: rent, Field: integrity.FieldTotalSum, Stored: 1000, Expected: 750,
+		},
+		food + " " + integrity.FieldTotalSum: {
+			EntityType: models.AuditEntityCategory, EntityId: food, Field: integrity.FieldTotalSum, Stored: 40, Expected: 0,
+		},
+	}
+
+	report, err = checker.Check(userId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectDiscrepancies(t, report, want)
+	if report.Repaired {
+		t.Error("Check reported a repair")
+	}
+
+	adminId := uuid.New().String()
+	report, err = checker.Repair(userId, integrity.Actor{UserId: adminId, RequestId: "request-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectDiscrepancies(t, report, want)
+	if !report.Repaired {
+		t.Error("got Repaired false; want true")
+	}
+
+	report, err = checker.Check(userId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Errorf("got discrepancies %+v after the repair; want none", report.Discrepancies)
+	}
+
+	// The budget is audited once, each category once
+	entries, err := repos.AuditLog.List(userId, models.AuditFilter{Action: models.AuditActionRepair, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("got %d repair entries; want 3", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.ActorId != adminId || entry.RequestId != "request-1" {
+			t.Errorf("got actor %q and request %q; want %q and request-1", entry.ActorId, entry.RequestId, adminId)
+		}
+	}
+
+	// Repairing counters that match writes nothing
+	report, err = checker.Repair(userId, integrity.Actor{UserId: adminId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Repaired {
+		t.Errorf("got %+v; want no discrepancies and no repair", report)
+	}
+}
+
+func expectDiscrepancies(t *testing.T, report *integrity.Report, want map[string]integrity.Discrepancy) {
+	t.Helper()
+
+	if len(report.Discrepancies) != len(want) {
+		t.Fatalf("got %d discrepancies %+v; want %d", len(report.Discrepancies), report.Discrepancies, len(want))
+	}
+	for _, d := range report.Discrepancies {
+		if w, ok := want[d.EntityId+" "+d.Field]; !ok || d != w {
+			t.Errorf("got discrepancy %+v; want %+v", d, w)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// Package mailer sends the emails of the application. Mailer is implemented
+// by SMTP, which delivers them, and by Log and File, which only record them
+// for local development.
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInvalidHeader = errors.New("mailer: header contains a line break")
+
+// define Message type, a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends messages
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// define SMTP type, a Mailer which delivers messages through an SMTP server.
+// The connection is upgraded with STARTTLS when the server offers it.
+type SMTP struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+func NewSMTP(host string, port int, username, password, from string) *SMTP {
+	return &SMTP{
+		Host:     host,
+		Port:     port,
+		Username: username,
+		Password: password,
+		From:     from,
+	}
+}
+
+func (m *SMTP) Send(msg Message) error {
+	content, err := format(m.From, msg, time.Now())
+	if err != nil {
+		return err
+	}
+
+	// Servers without authentication, such as a local relay, need no
+	// credentials
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	addr := net.JoinHostPort(m.Host, strconv.Itoa(m.Port))
+	return smtp.SendMail(addr, auth, m.From, []string{msg.To}, content)
+}
+
+// define Log type, a Mailer which writes messages to a logger instead of
+// sending them
+type Log struct {
+	From   string
+	Logger *log.Logger
+}
+
+func NewLog(from string, logger *log.Logger) *Log {
+	return &Log{From: from, Logger: logger}
+}
+
+func (m *Log) Send(msg Message) error {
+	content, err := format(m.From, msg, time.Now())
+	if err != nil {
+		return err
+	}
+	m.Logger.Printf("mailer: message to %s\n%s", msg.To, content)
+	return nil
+}
+
+// define File type, a Mailer which writes every message to its own .eml file
+// in Dir instead of sending it
+type File struct {
+	From string
+	Dir  string
+
+	mu sync.Mutex
+	n  int
+}
+
+func NewFile(from, dir string) *File {
+	return &File{From: from, Dir: dir}
+}
+
+func (m *File) Send(msg Message) error {
+	now := time.Now()
+	content, err := format(m.From, msg, now)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(m.Dir, 0o755)
+	if err != nil {
+		return err
+	}
+
+	// Number the files so that messages sent within the same second keep
+	// their order
+	m.mu.Lock()
+	m.n++
+	name := fmt.Sprintf("%s-%04d.eml", now.UTC().Format("20060102T150405Z"), m.n)
+	m.mu.Unlock()
+
+	return os.WriteFile(filepath.Join(m.Dir, name), content, 0o600)
+}
+
+// format returns the message with its headers, with CRLF line endings
+func format(from string, msg Message, date time.Time) ([]byte, error) {
+	for _, header := range []string{from, msg.To, msg.Subject} {
+		if strings.ContainsAny(header, "\r\n") {
+			return nil, ErrInvalidHeader
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return []byte(b.String()), nil
+}
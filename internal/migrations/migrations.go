@@ -0,0 +1,422 @@
+// Package migrations applies the versioned schema migrations embedded in the
+// binary. Every change to the schema ships as a pair of files,
+// NNNN_name.up.sql and NNNN_name.down.sql, in the directory of each
+// dialect, and the applied versions are recorded in the schema_migrations
+// table. Every dialect has the same versions.
+//
+// A migration runs in a transaction, but MySQL commits DDL statements
+// implicitly, so there a migration that fails halfway is not rolled back.
+// Keep each migration small enough to be fixed by hand. SQLite and Postgres
+// roll the whole migration back.
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
+
+//go:embed mysql/*.sql sqlite/*.sql postgres/*.sql
+var files embed.FS
+
+// lockName is the MySQL named lock held while migrating, so that two
+// instances starting at once do not apply the same migration. Postgres takes
+// an advisory lock on the checksum of the name. SQLite databases are not
+// shared between instances.
+const lockName = "schema_migrations"
+
+// lockTimeout is how long to wait for another instance to finish migrating
+const lockTimeout = 30 * time.Second
+
+var (
+	ErrLocked         = errors.New("migrations: another migration is running")
+	ErrUnknownVersion = errors.New("migrations: applied version has no migration")
+)
+
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// define Migration type, one versioned change to the schema
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// define Status type, a migration and whether it was applied
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// define Migrator type which applies migrations to a sql.DB connection pool
+type Migrator struct {
+	db         *sql.DB
+	dialect    models.Dialect
+	migrations []Migration
+	infoLog    *log.Logger
+}
+
+// New returns a Migrator for the migrations of the dialect embedded in the
+// binary
+func New(db *sql.DB, dialect models.Dialect, infoLog *log.Logger) (*Migrator, error) {
+	migrations, err := Load(files, dialect.Name())
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, dialect: dialect, migrations: migrations, infoLog: infoLog}, nil
+}
+
+// Load reads the migrations of dir, ordered by version. Every version needs
+// both an up and a down file.
+func Load(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int64]*Migration{}
+	for _, entry := range entries {
+		match := fileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migrations: unexpected file %s", entry.Name())
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migrations: %s: %w", entry.Name(), err)
+		}
+
+		content, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migrations: version %d is used by %s and %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := []Migration{}
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migrations: %04d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Up applies every pending migration, oldest first, and returns the ones it
+// applied
+func (m *Migrator) Up() ([]Migration, error) {
+	ctx := context.Background()
+	conn, unlock, err := m.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	applied, err := appliedVersions(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	done := []Migration{}
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		err = exec(ctx, conn, migration.Up,
+			m.dialect.Rebind(`INSERT INTO schema_migrations (version, name, appliedAt) VALUES(?, ?, `+m.dialect.Now()+`)`),
+			migration.Version, migration.Name)
+		if err != nil {
+			return done, fmt.Errorf("migrations: %04d_%s up: %w", migration.Version, migration.Name, err)
+		}
+		m.infoLog.Printf("migrations: applied %04d_%s", migration.Version, migration.Name)
+		done = append(done, migration)
+	}
+	return done, nil
+}
+
+// Down reverts the latest steps applied migrations, newest first, and
+// returns the ones it reverted
+func (m *Migrator) Down(steps int) ([]Migration, error) {
+	if steps < 1 {
+		return nil, errors.New("migrations: steps must be at least 1")
+	}
+
+	ctx := context.Background()
+	conn, unlock, err := m.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	applied, err := appliedVersions(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]int64, 0, len(applied))
+	for version := range applied {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] > versions[j] })
+	if steps < len(versions) {
+		versions = versions[:steps]
+	}
+
+	done := []Migration{}
+	for _, version := range versions {
+		migration, ok := m.find(version)
+		if !ok {
+			return done, fmt.Errorf("%w: %d", ErrUnknownVersion, version)
+		}
+		err = exec(ctx, conn, migration.Down, m.dialect.Rebind(`DELETE FROM schema_migrations WHERE version = ?`), version)
+		if err != nil {
+			return done, fmt.Errorf("migrations: %04d_%s down: %w", migration.Version, migration.Name, err)
+		}
+		m.infoLog.Printf("migrations: reverted %04d_%s", migration.Version, migration.Name)
+		done = append(done, migration)
+	}
+	return done, nil
+}
+
+// Baseline records every migration up to version as applied without running
+// it. It is meant for databases created before migrations existed, whose
+// schema already matches that version.
+func (m *Migrator) Baseline(version int64) error {
+	ctx := context.Background()
+	conn, unlock, err := m.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, ok := m.find(version); !ok {
+		return fmt.Errorf("%w: %d", ErrUnknownVersion, version)
+	}
+
+	applied, err := appliedVersions(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range m.migrations {
+		if migration.Version > version {
+			break
+		}
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		_, err = conn.ExecContext(ctx, m.dialect.Rebind(`INSERT INTO schema_migrations (version, name, appliedAt) VALUES(?, ?, `+m.dialect.Now()+`)`),
+			migration.Version, migration.Name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Status lists every migration and whether it was applied
+func (m *Migrator) Status() ([]Status, error) {
+	ctx := context.Background()
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	err = m.createTable(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedVersions(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []Status{}
+	for _, migration := range m.migrations {
+		appliedAt, ok := applied[migration.Version]
+		statuses = append(statuses, Status{Migration: migration, Applied: ok, AppliedAt: appliedAt})
+	}
+	return statuses, nil
+}
+
+func (m *Migrator) find(version int64) (Migration, bool) {
+	for _, migration := range m.migrations {
+		if migration.Version == version {
+			return migration, true
+		}
+	}
+	return Migration{}, false
+}
+
+// lock takes the migration lock on a dedicated connection, named and
+// advisory locks belong to the connection that took them. The returned
+// function releases the lock and the connection.
+func (m *Migrator) lock(ctx context.Context) (*sql.Conn, func(), error) {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var unlock func()
+	switch m.dialect {
+	case models.MySQL:
+		var got sql.NullInt64
+		err = conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, ?)`, lockName, int(lockTimeout.Seconds())).Scan(&got)
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		if got.Int64 != 1 {
+			conn.Close()
+			return nil, nil, ErrLocked
+		}
+		unlock = func() {
+			var released sql.NullInt64
+			conn.QueryRowContext(context.Background(), `SELECT RELEASE_LOCK(?)`, lockName).Scan(&released)
+			conn.Close()
+		}
+	case models.Postgres:
+		key := int64(crc32.ChecksumIEEE([]byte(lockName)))
+		lockCtx, cancel := context.WithTimeout(ctx, lockTimeout)
+		_, err = conn.ExecContext(lockCtx, `SELECT pg_advisory_lock($1)`, key)
+		cancel()
+		if err != nil {
+			conn.Close()
+			if errors.Is(err, context.DeadlineExceeded) {
+				return nil, nil, ErrLocked
+			}
+			return nil, nil, err
+		}
+		unlock = func() {
+			conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, key)
+			conn.Close()
+		}
+	default:
+		unlock = func() { conn.Close() }
+	}
+
+	err = m.createTable(ctx, conn)
+	if err != nil {
+		unlock()
+		return nil, nil, err
+	}
+	return conn, unlock, nil
+}
+
+func (m *Migrator) createTable(ctx context.Context, conn *sql.Conn) error {
+	// Postgres has no datetime type
+	timeType := "datetime"
+	if m.dialect == models.Postgres {
+		timeType = "timestamp(0)"
+	}
+	_, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version bigint NOT NULL,
+		name varchar(255) NOT NULL,
+		appliedAt `+timeType+` NOT NULL,
+		PRIMARY KEY (version)
+	)`)
+	return err
+}
+
+// appliedVersions returns when each applied version was applied
+func appliedVersions(ctx context.Context, conn *sql.Conn) (map[int64]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT version, appliedAt FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int64]time.Time{}
+	for rows.Next() {
+		var version int64
+		var appliedAt time.Time
+		err = rows.Scan(&version, &appliedAt)
+		if err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+// exec runs the statements of a migration one at a time, the drivers do
+// not accept several statements in one call, then records the migration
+// with the record statement. Everything runs in one transaction.
+func exec(ctx context.Context, conn *sql.Conn, script string, record string, args ...any) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range statements(script) {
+		_, err = tx.ExecContext(ctx, stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, record, args...)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// statements splits a script on the semicolons that end a line. Lines
+// starting with -- are comments.
+func statements(script string) []string {
+	stmts := []string{}
+	var current strings.Builder
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		current.WriteString(line)
+		current.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			stmts = append(stmts, strings.TrimSuffix(strings.TrimSpace(current.String()), ";"))
+			current.Reset()
+		}
+	}
+	if rest := strings.TrimSpace(current.String()); rest != "" {
+		stmts = append(stmts, rest)
+	}
+	return stmts
+}
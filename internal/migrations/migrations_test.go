@@ -0,0 +1,389 @@
+package migrations_test
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	"kweeuhree.personal-budgeting-backend/internal/migrations"
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
+
+// The migrations of the three dialects are compared without a database, by
+// replaying their CREATE TABLE, DROP TABLE and ALTER TABLE statements into
+// a list of tables and columns. The SQLite migrations are also run for real.
+
+var dialects = []string{"mysql", "sqlite", "postgres"}
+
+var (
+	createTable = regexp.MustCompile("(?is)^CREATE TABLE (?:IF NOT EXISTS )?[`\"]?(\\w+)[`\"]?\\s*\\((.*)\\)[^)]*$")
+	dropTable   = regexp.MustCompile("(?i)^DROP TABLE (?:IF EXISTS )?[`\"]?(\\w+)[`\"]?$")
+	alterTable  = regexp.MustCompile("(?is)^ALTER TABLE [`\"]?(\\w+)[`\"]?\\s(.*)$")
+	// alterColumn matches each clause of an ALTER TABLE, MySQL changes
+	// several columns in one statement
+	alterColumn = regexp.MustCompile("(?i)\\b(ADD|DROP) COLUMN [`\"]?(\\w+)[`\"]?")
+)
+
+// tableConstraints start the lines of a CREATE TABLE that are not columns
+var tableConstraints = []string{"PRIMARY", "UNIQUE", "KEY", "INDEX", "CONSTRAINT", "FOREIGN", "CHECK"}
+
+// schema maps the lower case name of each table to its sorted, lower case
+// column names
+type schema map[string][]string
+
+// apply replays the statements of a migration script on the schema
+func (s schema) apply(t *testing.T, script string) {
+	t.Helper()
+
+	for _, stmt := range splitStatements(script) {
+		if m := createTable.FindStringSubmatch(stmt); m != nil {
+			columns := []string{}
+			for _, line := range strings.Split(m[2], "\n") {
+				fields := strings.Fields(strings.TrimSuffix(strings.TrimSpace(line), ","))
+				if len(fields) == 0 || slices.Contains(tableConstraints, strings.ToUpper(fields[0])) {
+					continue
+				}
+				columns = append(columns, strings.ToLower(strings.Trim(fields[0], "`\"")))
+			}
+			slices.Sort(columns)
+			s[strings.ToLower(m[1])] = columns
+			continue
+		}
+		if m := dropTable.FindStringSubmatch(stmt); m != nil {
+			delete(s, strings.ToLower(m[1]))
+			continue
+		}
+		if m := alterTable.FindStringSubmatch(stmt); m != nil {
+			table := strings.ToLower(m[1])
+			columns, ok := s[table]
+			if !ok {
+				t.Fatalf("%s: unknown table %s", stmt, table)
+			}
+			for _, clause := range alterColumn.FindAllStringSubmatch(m[2], -1) {
+				column := strings.ToLower(clause[2])
+				if strings.EqualFold(clause[1], "ADD") {
+					columns = append(columns, column)
+				} else {
+					columns = slices.DeleteFunc(columns, func(c string) bool { return c == column })
+				}
+			}
+			slices.Sort(columns)
+			s[table] = columns
+		}
+	}
+}
+
+func (s schema) clone() schema {
+	out := schema{}
+	for table, columns := range s {
+		out[table] = slices.Clone(columns)
+	}
+	return out
+}
+
+// splitStatements splits a script on the semicolons that end a line,
+// skipping comments, the way the migrator runs it
+func splitStatements(script string) []string {
+	stmts := []string{}
+	var current strings.Builder
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		current.WriteString(line + "\n")
+		if strings.HasSuffix(trimmed, ";") {
+			stmts = append(stmts, strings.TrimSuffix(strings.TrimSpace(current.String()), ";"))
+			current.Reset()
+		}
+	}
+	return stmts
+}
+
+// loadDialects returns the migrations of every dialect
+func loadDialects(t *testing.T) map[string][]migrations.Migration {
+	t.Helper()
+
+	loaded := map[string][]migrations.Migration{}
+	for _, dialect := range dialects {
+		ms, err := migrations.Load(os.DirFS("."), dialect)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded[dialect] = ms
+	}
+	return loaded
+}
+
+// staticSchemas replays the up migrations of the dialect and returns the
+// schema after each version, index 0 being the empty schema
+func staticSchemas(t *testing.T, ms []migrations.Migration) []schema {
+	t.Helper()
+
+	s := schema{}
+	schemas := []schema{s.clone()}
+	for _, m := range ms {
+		s.apply(t, m.Up)
+		schemas = append(schemas, s.clone())
+	}
+	return schemas
+}
+
+// Every dialect has the same migrations, and each of them leaves the same
+// tables and columns behind, going up and coming back down
+func TestDialectsMatch(t *testing.T) {
+	loaded := loadDialects(t)
+	sqlite := loaded["sqlite"]
+
+	for _, dialect := range dialects {
+		ms := loaded[dialect]
+		if len(ms) != len(sqlite) {
+			t.Fatalf("%s has %d migrations; sqlite has %d", dialect, len(ms), len(sqlite))
+		}
+		for i, m := range ms {
+			if m.Version != sqlite[i].Version || m.Name != sqlite[i].Name {
+				t.Errorf("%s migration %d is %04d_%s; sqlite has %04d_%s", dialect, i, m.Version, m.Name, sqlite[i].Version, sqlite[i].Name)
+			}
+		}
+	}
+
+	want := staticSchemas(t, sqlite)
+	for _, dialect := range dialects {
+		t.Run(dialect, func(t *testing.T) {
+			ms := loaded[dialect]
+			up := staticSchemas(t, ms)
+			for i := range ms {
+				if !reflect.DeepEqual(up[i+1], want[i+1]) {
+					t.Errorf("after %04d_%s up: got %v; want %v", ms[i].Version, ms[i].Name, up[i+1], want[i+1])
+				}
+			}
+
+			// Each down migration restores the schema of the version before
+			for i := len(ms) - 1; i >= 0; i-- {
+				down := up[i+1].clone()
+				down.apply(t, ms[i].Down)
+				if !reflect.DeepEqual(down, up[i]) {
+					t.Errorf("after %04d_%s down: got %v; want %v", ms[i].Version, ms[i].Name, down, up[i])
+				}
+			}
+		})
+	}
+}
+
+// openSQLite opens a new SQLite database in a temporary file
+func openSQLite(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := fmt.Sprintf("file:%s?_foreign_keys=on&_busy_timeout=5000&_txlock=immediate&_journal_mode=WAL",
+		filepath.Join(t.TempDir(), "budgeting.db"))
+	db, err := sql.Open(models.SQLite.Driver(), dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// liveSchema returns the tables and columns of the SQLite database, and a
+// description of every column, index and foreign key to compare schemas in
+// full
+func liveSchema(t *testing.T, db *sql.DB) (schema, []string) {
+	t.Helper()
+
+	rows, err := db.Query(`SELECT name FROM sqlite_master
+			WHERE type = 'table' AND name NOT LIKE 'sqlite_%' AND name != 'schema_migrations' ORDER BY name`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, name)
+	}
+	if err := rows.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := schema{}
+	full := []string{}
+	for _, table := range tables {
+		columns := []string{}
+		for _, column := range queryStrings(t, db, `SELECT name || ' ' || type || ' ' || "notnull" || ' ' || IFNULL(dflt_value, 'NULL') || ' ' || pk
+				FROM pragma_table_info(?)`, table) {
+			columns = append(columns, strings.ToLower(strings.Fields(column)[0]))
+			full = append(full, table+" column "+column)
+		}
+		slices.Sort(columns)
+		s[strings.ToLower(table)] = columns
+
+		for _, fk := range queryStrings(t, db, `SELECT "table" || ' ' || "from" || ' ' || "to" FROM pragma_foreign_key_list(?)`, table) {
+			full = append(full, table+" references "+fk)
+		}
+	}
+	for _, index := range queryStrings(t, db, `SELECT tbl_name || ' ' || name || ' ' || IFNULL(sql, '')
+			FROM sqlite_master WHERE type = 'index' ORDER BY name`) {
+		full = append(full, "index "+index)
+	}
+	slices.Sort(full)
+	return s, full
+}
+
+func queryStrings(t *testing.T, db *sql.DB, query string, args ...any) []string {
+	t.Helper()
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	out := []string{}
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, s)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// The SQLite migrations go up, come back down one at a time to an empty
+// database, and go up again to the same schema
+func TestUpDownUp(t *testing.T) {
+	db := openSQLite(t)
+	migrator, err := migrations.New(db, models.SQLite, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms := loadDialects(t)["sqlite"]
+	want := staticSchemas(t, ms)
+
+	applied, err := migrator.Up()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(ms) {
+		t.Fatalf("applied %d migrations; want %d", len(applied), len(ms))
+	}
+	s, first := liveSchema(t, db)
+	if !reflect.DeepEqual(s, want[len(ms)]) {
+		t.Fatalf("got schema %v; want %v", s, want[len(ms)])
+	}
+
+	for i := len(ms) - 1; i >= 0; i-- {
+		reverted, err := migrator.Down(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reverted) != 1 || reverted[0].Version != ms[i].Version {
+			t.Fatalf("reverted %v; want %04d_%s", reverted, ms[i].Version, ms[i].Name)
+		}
+		s, _ = liveSchema(t, db)
+		if !reflect.DeepEqual(s, want[i]) {
+			t.Errorf("after %04d_%s down: got schema %v; want %v", ms[i].Version, ms[i].Name, s, want[i])
+		}
+	}
+
+	statuses, err := migrator.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if status.Applied {
+			t.Errorf("%04d_%s is still applied", status.Version, status.Name)
+		}
+	}
+
+	_, err = migrator.Up()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, again := liveSchema(t, db)
+	if !reflect.DeepEqual(again, first) {
+		t.Errorf("got schema\n%s\nafter up, down and up; want\n%s", strings.Join(again, "\n"), strings.Join(first, "\n"))
+	}
+
+	// Down stops at the oldest migration
+	reverted, err := migrator.Down(len(ms) + 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reverted) != len(ms) {
+		t.Errorf("reverted %d migrations; want %d", len(reverted), len(ms))
+	}
+	_, err = migrator.Down(0)
+	if err == nil {
+		t.Error("Down(0) returned no error")
+	}
+}
+
+// Baseline records the migrations of a database that already has their
+// schema, without running them
+func TestBaseline(t *testing.T) {
+	db := openSQLite(t)
+	migrator, err := migrations.New(db, models.SQLite, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms := loadDialects(t)["sqlite"]
+	latest := ms[len(ms)-1].Version
+
+	// A database whose schema was created before migrations were recorded
+	_, err = migrator.Up()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`DELETE FROM schema_migrations`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = migrator.Baseline(latest + 1)
+	if !errors.Is(err, migrations.ErrUnknownVersion) {
+		t.Errorf("got error %v; want %v", err, migrations.ErrUnknownVersion)
+	}
+
+	err = migrator.Baseline(latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses, err := migrator.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if !status.Applied {
+			t.Errorf("%04d_%s was not recorded", status.Version, status.Name)
+		}
+	}
+
+	applied, err := migrator.Up()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 0 {
+		t.Errorf("applied %d migrations after the baseline; want none", len(applied))
+	}
+
+	// A second baseline changes nothing
+	err = migrator.Baseline(latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
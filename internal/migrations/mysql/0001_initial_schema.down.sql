@@ -0,0 +1,5 @@
+DROP TABLE `expenses`;
+DROP TABLE `expensecategory`;
+DROP TABLE `budget`;
+DROP TABLE `sessions`;
+DROP TABLE `users`;
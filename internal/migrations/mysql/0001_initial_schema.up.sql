@@ -0,0 +1,58 @@
+CREATE TABLE `users` (
+  `userId` varchar(36) NOT NULL,
+  `email` varchar(255) NOT NULL,
+  `hashedPassword` varchar(255) NOT NULL,
+  `createdAt` datetime NOT NULL,
+  `displayName` varchar(255) DEFAULT NULL,
+  PRIMARY KEY (`userId`),
+  UNIQUE KEY `idx_users_email` (`email`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE `sessions` (
+  `token` char(43) NOT NULL,
+  `data` blob NOT NULL,
+  `expiry` timestamp(6) NOT NULL,
+  PRIMARY KEY (`token`),
+  KEY `sessions_expiry_idx` (`expiry`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE `budget` (
+  `budgetId` varchar(36) NOT NULL,
+  `userId` varchar(36) NOT NULL,
+  `checkingBalance` bigint NOT NULL,
+  `savingsBalance` bigint DEFAULT '0',
+  `budgetTotal` bigint NOT NULL,
+  `budgetRemaining` bigint NOT NULL,
+  `totalSpent` bigint DEFAULT '0',
+  `updatedAt` datetime NOT NULL,
+  `createdAt` datetime NOT NULL,
+  PRIMARY KEY (`budgetId`),
+  KEY `userId` (`userId`),
+  CONSTRAINT `budget_ibfk_1` FOREIGN KEY (`userId`) REFERENCES `users` (`userId`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE `expensecategory` (
+  `expenseCategoryId` varchar(36) NOT NULL,
+  `userId` varchar(36) NOT NULL,
+  `name` varchar(100) NOT NULL,
+  `description` varchar(255) DEFAULT NULL,
+  `totalSum` bigint DEFAULT '0',
+  PRIMARY KEY (`expenseCategoryId`),
+  KEY `userId` (`userId`),
+  CONSTRAINT `expensecategory_ibfk_1` FOREIGN KEY (`userId`) REFERENCES `users` (`userId`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE `expenses` (
+  `expenseId` varchar(36) NOT NULL,
+  `userId` varchar(36) NOT NULL,
+  `categoryId` varchar(255) DEFAULT NULL,
+  `description` varchar(255) DEFAULT NULL,
+  `expenseType` varchar(36) NOT NULL,
+  `amountInCents` bigint NOT NULL,
+  `createdAt` datetime NOT NULL,
+  PRIMARY KEY (`expenseId`),
+  KEY `userId` (`userId`),
+  KEY `expenses_ibfk_2` (`categoryId`),
+  CONSTRAINT `expenses_ibfk_1` FOREIGN KEY (`userId`) REFERENCES `users` (`userId`),
+  CONSTRAINT `expenses_ibfk_2` FOREIGN KEY (`categoryId`) REFERENCES `expensecategory` (`expenseCategoryId`) ON DELETE SET NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1,4 @@
+-- Row versions for ETag and If-Match checks
+ALTER TABLE `budget` ADD COLUMN `version` int NOT NULL DEFAULT '1';
+ALTER TABLE `expenses` ADD COLUMN `version` int NOT NULL DEFAULT '1';
+ALTER TABLE `expensecategory` ADD COLUMN `version` int NOT NULL DEFAULT '1';
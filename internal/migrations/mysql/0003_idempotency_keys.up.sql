@@ -0,0 +1,12 @@
+CREATE TABLE `idempotency_keys` (
+  `userId` varchar(36) NOT NULL,
+  `idempotencyKey` varchar(255) NOT NULL,
+  `requestHash` char(64) NOT NULL,
+  `responseStatus` int NOT NULL DEFAULT '0',
+  `contentType` varchar(255) DEFAULT NULL,
+  `etag` varchar(64) DEFAULT NULL,
+  `responseBody` mediumblob,
+  `createdAt` datetime NOT NULL,
+  PRIMARY KEY (`userId`,`idempotencyKey`),
+  KEY `idempotency_keys_createdAt_idx` (`createdAt`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1,30 @@
+CREATE TABLE `webhooks` (
+  `webhookId` varchar(36) NOT NULL,
+  `userId` varchar(36) NOT NULL,
+  `url` varchar(2048) NOT NULL,
+  `secret` varchar(100) NOT NULL,
+  `events` varchar(1000) NOT NULL DEFAULT '',
+  `createdAt` datetime NOT NULL,
+  PRIMARY KEY (`webhookId`),
+  KEY `webhooks_userId_idx` (`userId`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Outbox of the events to deliver, written in the transaction of the change
+CREATE TABLE `webhook_deliveries` (
+  `deliveryId` varchar(36) NOT NULL,
+  `webhookId` varchar(36) NOT NULL,
+  `userId` varchar(36) NOT NULL,
+  `eventId` varchar(36) NOT NULL,
+  `eventType` varchar(50) NOT NULL,
+  `payload` mediumblob NOT NULL,
+  `status` varchar(20) NOT NULL,
+  `attempts` int NOT NULL DEFAULT '0',
+  `nextAttemptAt` datetime NOT NULL,
+  `lastStatusCode` int DEFAULT NULL,
+  `lastError` text,
+  `createdAt` datetime NOT NULL,
+  `deliveredAt` datetime DEFAULT NULL,
+  PRIMARY KEY (`deliveryId`),
+  KEY `webhook_deliveries_due_idx` (`status`,`nextAttemptAt`),
+  KEY `webhook_deliveries_webhookId_idx` (`webhookId`,`createdAt`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1,18 @@
+CREATE TABLE `audit_log` (
+  `auditId` bigint NOT NULL AUTO_INCREMENT,
+  `userId` varchar(36) NOT NULL,
+  `actorId` varchar(36) NOT NULL,
+  `sessionId` varchar(16) NOT NULL DEFAULT '',
+  `ip` varchar(45) NOT NULL DEFAULT '',
+  `requestId` varchar(36) NOT NULL DEFAULT '',
+  `action` varchar(20) NOT NULL,
+  `entityType` varchar(20) NOT NULL,
+  `entityId` varchar(36) NOT NULL,
+  `beforeSnapshot` json DEFAULT NULL,
+  `afterSnapshot` json DEFAULT NULL,
+  `createdAt` datetime NOT NULL,
+  PRIMARY KEY (`auditId`),
+  KEY `audit_log_userId_idx` (`userId`,`auditId`),
+  KEY `audit_log_entity_idx` (`userId`,`entityType`,`entityId`),
+  KEY `audit_log_createdAt_idx` (`createdAt`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
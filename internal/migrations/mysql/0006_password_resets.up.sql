@@ -0,0 +1,11 @@
+-- Password reset tokens, stored as the SHA-256 hash of the token
+CREATE TABLE `password_resets` (
+  `tokenHash` char(64) NOT NULL,
+  `userId` varchar(36) NOT NULL,
+  `expiresAt` datetime NOT NULL,
+  `createdAt` datetime NOT NULL,
+  PRIMARY KEY (`tokenHash`),
+  KEY `password_resets_userId_idx` (`userId`),
+  KEY `password_resets_expiresAt_idx` (`expiresAt`),
+  CONSTRAINT `password_resets_ibfk_1` FOREIGN KEY (`userId`) REFERENCES `users` (`userId`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1,15 @@
+-- Accounts that existed before verification are treated as verified
+ALTER TABLE `users` ADD COLUMN `emailVerifiedAt` datetime DEFAULT NULL;
+UPDATE `users` SET `emailVerifiedAt` = `createdAt`;
+
+-- Email verification tokens, stored as the SHA-256 hash of the token
+CREATE TABLE `email_verifications` (
+  `tokenHash` char(64) NOT NULL,
+  `userId` varchar(36) NOT NULL,
+  `expiresAt` datetime NOT NULL,
+  `createdAt` datetime NOT NULL,
+  PRIMARY KEY (`tokenHash`),
+  KEY `email_verifications_userId_idx` (`userId`, `createdAt`),
+  KEY `email_verifications_expiresAt_idx` (`expiresAt`),
+  CONSTRAINT `email_verifications_ibfk_1` FOREIGN KEY (`userId`) REFERENCES `users` (`userId`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1,5 @@
+DROP TABLE `recovery_codes`;
+ALTER TABLE `users`
+  DROP COLUMN `totpSecret`,
+  DROP COLUMN `totpEnabledAt`,
+  DROP COLUMN `totpLastStep`;
@@ -0,0 +1,17 @@
+-- TOTP two-factor authentication. The secret is set at enrollment, and 2FA
+-- is on once totpEnabledAt is. totpLastStep is the time step of the last
+-- code accepted, so that a code cannot be used twice.
+ALTER TABLE `users`
+  ADD COLUMN `totpSecret` varchar(64) DEFAULT NULL,
+  ADD COLUMN `totpEnabledAt` datetime DEFAULT NULL,
+  ADD COLUMN `totpLastStep` bigint NOT NULL DEFAULT '0';
+
+-- One-time recovery codes, stored as the SHA-256 hash of the code
+CREATE TABLE `recovery_codes` (
+  `userId` varchar(36) NOT NULL,
+  `codeHash` char(64) NOT NULL,
+  `usedAt` datetime DEFAULT NULL,
+  `createdAt` datetime NOT NULL,
+  PRIMARY KEY (`userId`, `codeHash`),
+  CONSTRAINT `recovery_codes_ibfk_1` FOREIGN KEY (`userId`) REFERENCES `users` (`userId`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1,11 @@
+-- Failed logins per client address and per account, to slow down and lock
+-- out password guessing. Accounts are keyed by the SHA-256 hash of the
+-- email, so that mistyped or unknown addresses are not stored.
+CREATE TABLE `login_attempts` (
+  `attemptKey` varchar(100) NOT NULL,
+  `failures` int NOT NULL,
+  `lastFailureAt` datetime NOT NULL,
+  `lockedUntil` datetime DEFAULT NULL,
+  PRIMARY KEY (`attemptKey`),
+  KEY `login_attempts_lastFailureAt_idx` (`lastFailureAt`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1,18 @@
+-- Personal API tokens, stored as the SHA-256 hash of the token. The prefix
+-- is the start of the token, shown to tell the tokens apart.
+CREATE TABLE `api_tokens` (
+  `tokenId` varchar(36) NOT NULL,
+  `userId` varchar(36) NOT NULL,
+  `name` varchar(100) NOT NULL,
+  `tokenPrefix` varchar(16) NOT NULL,
+  `tokenHash` char(64) NOT NULL,
+  `scopes` varchar(255) NOT NULL,
+  `expiresAt` datetime NOT NULL,
+  `lastUsedAt` datetime DEFAULT NULL,
+  `createdAt` datetime NOT NULL,
+  PRIMARY KEY (`tokenId`),
+  UNIQUE KEY `api_tokens_tokenHash_key` (`tokenHash`),
+  KEY `api_tokens_userId_idx` (`userId`),
+  KEY `api_tokens_expiresAt_idx` (`expiresAt`),
+  CONSTRAINT `api_tokens_ibfk_1` FOREIGN KEY (`userId`) REFERENCES `users` (`userId`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
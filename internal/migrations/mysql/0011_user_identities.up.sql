@@ -0,0 +1,12 @@
+-- Accounts of OpenID Connect providers linked to users, by the subject the
+-- provider knows the account as
+CREATE TABLE `user_identities` (
+  `provider` varchar(50) NOT NULL,
+  `subject` varchar(255) NOT NULL,
+  `userId` varchar(36) NOT NULL,
+  `email` varchar(255) NOT NULL,
+  `createdAt` datetime NOT NULL,
+  PRIMARY KEY (`provider`, `subject`),
+  KEY `user_identities_userId_idx` (`userId`),
+  CONSTRAINT `user_identities_ibfk_1` FOREIGN KEY (`userId`) REFERENCES `users` (`userId`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1,3 @@
+DROP INDEX `users_createdAt_idx` ON `users`;
+ALTER TABLE `users` DROP COLUMN `disabledAt`;
+ALTER TABLE `users` DROP COLUMN `role`;
@@ -0,0 +1,19 @@
+-- The logged in sessions of each user, by the token of the session in the
+-- sessions table, so that the sessions of a user can be listed and ended
+-- without reading every session. The sessionId tells the sessions apart
+-- without giving the token away.
+CREATE TABLE `user_sessions` (
+  `token` varchar(64) NOT NULL,
+  `sessionId` varchar(64) NOT NULL,
+  `userId` varchar(36) NOT NULL,
+  `ip` varchar(45) NOT NULL,
+  `userAgent` varchar(255) NOT NULL,
+  `createdAt` datetime DEFAULT NULL,
+  `lastSeenAt` datetime NOT NULL,
+  `expiresAt` datetime NOT NULL,
+  PRIMARY KEY (`token`),
+  UNIQUE KEY `user_sessions_sessionId_key` (`sessionId`),
+  KEY `user_sessions_userId_idx` (`userId`),
+  KEY `user_sessions_expiresAt_idx` (`expiresAt`),
+  CONSTRAINT `user_sessions_ibfk_1` FOREIGN KEY (`userId`) REFERENCES `users` (`userId`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1,50 @@
+CREATE TABLE users (
+  userId varchar(36) NOT NULL PRIMARY KEY,
+  email varchar(255) NOT NULL,
+  hashedPassword varchar(255) NOT NULL,
+  createdAt timestamp(0) NOT NULL,
+  displayName varchar(255) DEFAULT NULL
+);
+CREATE UNIQUE INDEX idx_users_email ON users (email);
+
+-- Session store of internal/pgstore
+CREATE TABLE sessions (
+  token text NOT NULL PRIMARY KEY,
+  data bytea NOT NULL,
+  expiry timestamptz NOT NULL
+);
+CREATE INDEX sessions_expiry_idx ON sessions (expiry);
+
+CREATE TABLE budget (
+  budgetId varchar(36) NOT NULL PRIMARY KEY,
+  userId varchar(36) NOT NULL REFERENCES users (userId),
+  checkingBalance bigint NOT NULL,
+  savingsBalance bigint DEFAULT 0,
+  budgetTotal bigint NOT NULL,
+  budgetRemaining bigint NOT NULL,
+  totalSpent bigint DEFAULT 0,
+  updatedAt timestamp(0) NOT NULL,
+  createdAt timestamp(0) NOT NULL
+);
+CREATE INDEX budget_userId_idx ON budget (userId);
+
+CREATE TABLE expensecategory (
+  expenseCategoryId varchar(36) NOT NULL PRIMARY KEY,
+  userId varchar(36) NOT NULL REFERENCES users (userId),
+  name varchar(100) NOT NULL,
+  description varchar(255) DEFAULT NULL,
+  totalSum bigint DEFAULT 0
+);
+CREATE INDEX expensecategory_userId_idx ON expensecategory (userId);
+
+CREATE TABLE expenses (
+  expenseId varchar(36) NOT NULL PRIMARY KEY,
+  userId varchar(36) NOT NULL REFERENCES users (userId),
+  categoryId varchar(255) DEFAULT NULL REFERENCES expensecategory (expenseCategoryId) ON DELETE SET NULL,
+  description varchar(255) DEFAULT NULL,
+  expenseType varchar(36) NOT NULL,
+  amountInCents bigint NOT NULL,
+  createdAt timestamp(0) NOT NULL
+);
+CREATE INDEX expenses_userId_idx ON expenses (userId);
+CREATE INDEX expenses_categoryId_idx ON expenses (categoryId);
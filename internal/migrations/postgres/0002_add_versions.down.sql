@@ -0,0 +1,3 @@
+ALTER TABLE expensecategory DROP COLUMN version;
+ALTER TABLE expenses DROP COLUMN version;
+ALTER TABLE budget DROP COLUMN version;
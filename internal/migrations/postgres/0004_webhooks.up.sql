@@ -0,0 +1,28 @@
+CREATE TABLE webhooks (
+  webhookId varchar(36) NOT NULL PRIMARY KEY,
+  userId varchar(36) NOT NULL,
+  url varchar(2048) NOT NULL,
+  secret varchar(100) NOT NULL,
+  events varchar(1000) NOT NULL DEFAULT '',
+  createdAt timestamp(0) NOT NULL
+);
+CREATE INDEX webhooks_userId_idx ON webhooks (userId);
+
+-- Outbox of the events to deliver, written in the transaction of the change
+CREATE TABLE webhook_deliveries (
+  deliveryId varchar(36) NOT NULL PRIMARY KEY,
+  webhookId varchar(36) NOT NULL,
+  userId varchar(36) NOT NULL,
+  eventId varchar(36) NOT NULL,
+  eventType varchar(50) NOT NULL,
+  payload bytea NOT NULL,
+  status varchar(20) NOT NULL,
+  attempts integer NOT NULL DEFAULT 0,
+  nextAttemptAt timestamp(0) NOT NULL,
+  lastStatusCode integer DEFAULT NULL,
+  lastError text,
+  createdAt timestamp(0) NOT NULL,
+  deliveredAt timestamp(0) DEFAULT NULL
+);
+CREATE INDEX webhook_deliveries_due_idx ON webhook_deliveries (status, nextAttemptAt);
+CREATE INDEX webhook_deliveries_webhookId_idx ON webhook_deliveries (webhookId, createdAt);
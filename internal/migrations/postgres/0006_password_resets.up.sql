@@ -0,0 +1,9 @@
+-- Password reset tokens, stored as the SHA-256 hash of the token
+CREATE TABLE password_resets (
+  tokenHash char(64) NOT NULL PRIMARY KEY,
+  userId varchar(36) NOT NULL REFERENCES users (userId),
+  expiresAt timestamp(0) NOT NULL,
+  createdAt timestamp(0) NOT NULL
+);
+CREATE INDEX password_resets_userId_idx ON password_resets (userId);
+CREATE INDEX password_resets_expiresAt_idx ON password_resets (expiresAt);
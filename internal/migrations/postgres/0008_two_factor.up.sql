@@ -0,0 +1,15 @@
+-- TOTP two-factor authentication. The secret is set at enrollment, and 2FA
+-- is on once totpEnabledAt is. totpLastStep is the time step of the last
+-- code accepted, so that a code cannot be used twice.
+ALTER TABLE users ADD COLUMN totpSecret varchar(64) DEFAULT NULL;
+ALTER TABLE users ADD COLUMN totpEnabledAt timestamp(0) DEFAULT NULL;
+ALTER TABLE users ADD COLUMN totpLastStep bigint NOT NULL DEFAULT 0;
+
+-- One-time recovery codes, stored as the SHA-256 hash of the code
+CREATE TABLE recovery_codes (
+  userId varchar(36) NOT NULL REFERENCES users (userId),
+  codeHash char(64) NOT NULL,
+  usedAt timestamp(0) DEFAULT NULL,
+  createdAt timestamp(0) NOT NULL,
+  PRIMARY KEY (userId, codeHash)
+);
@@ -0,0 +1,10 @@
+-- Failed logins per client address and per account, to slow down and lock
+-- out password guessing. Accounts are keyed by the SHA-256 hash of the
+-- email, so that mistyped or unknown addresses are not stored.
+CREATE TABLE login_attempts (
+  attemptKey varchar(100) NOT NULL PRIMARY KEY,
+  failures int NOT NULL,
+  lastFailureAt timestamp(0) NOT NULL,
+  lockedUntil timestamp(0) DEFAULT NULL
+);
+CREATE INDEX login_attempts_lastFailureAt_idx ON login_attempts (lastFailureAt);
@@ -0,0 +1,16 @@
+-- Personal API tokens, stored as the SHA-256 hash of the token. The prefix
+-- is the start of the token, shown to tell the tokens apart.
+CREATE TABLE api_tokens (
+  tokenId varchar(36) NOT NULL PRIMARY KEY,
+  userId varchar(36) NOT NULL REFERENCES users (userId),
+  name varchar(100) NOT NULL,
+  tokenPrefix varchar(16) NOT NULL,
+  tokenHash char(64) NOT NULL,
+  scopes varchar(255) NOT NULL,
+  expiresAt timestamp(0) NOT NULL,
+  lastUsedAt timestamp(0) DEFAULT NULL,
+  createdAt timestamp(0) NOT NULL
+);
+CREATE UNIQUE INDEX api_tokens_tokenHash_key ON api_tokens (tokenHash);
+CREATE INDEX api_tokens_userId_idx ON api_tokens (userId);
+CREATE INDEX api_tokens_expiresAt_idx ON api_tokens (expiresAt);
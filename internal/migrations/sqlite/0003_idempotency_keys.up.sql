@@ -0,0 +1,12 @@
+CREATE TABLE idempotency_keys (
+  userId varchar(36) NOT NULL,
+  idempotencyKey varchar(255) NOT NULL,
+  requestHash char(64) NOT NULL,
+  responseStatus integer NOT NULL DEFAULT 0,
+  contentType varchar(255) DEFAULT NULL,
+  etag varchar(64) DEFAULT NULL,
+  responseBody blob,
+  createdAt datetime NOT NULL,
+  PRIMARY KEY (userId, idempotencyKey)
+);
+CREATE INDEX idempotency_keys_createdAt_idx ON idempotency_keys (createdAt);
@@ -0,0 +1,17 @@
+CREATE TABLE audit_log (
+  auditId integer PRIMARY KEY AUTOINCREMENT,
+  userId varchar(36) NOT NULL,
+  actorId varchar(36) NOT NULL,
+  sessionId varchar(16) NOT NULL DEFAULT '',
+  ip varchar(45) NOT NULL DEFAULT '',
+  requestId varchar(36) NOT NULL DEFAULT '',
+  action varchar(20) NOT NULL,
+  entityType varchar(20) NOT NULL,
+  entityId varchar(36) NOT NULL,
+  beforeSnapshot blob DEFAULT NULL,
+  afterSnapshot blob DEFAULT NULL,
+  createdAt datetime NOT NULL
+);
+CREATE INDEX audit_log_userId_idx ON audit_log (userId, auditId);
+CREATE INDEX audit_log_entity_idx ON audit_log (userId, entityType, entityId);
+CREATE INDEX audit_log_createdAt_idx ON audit_log (createdAt);
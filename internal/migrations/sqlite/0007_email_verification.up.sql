@@ -0,0 +1,13 @@
+-- Accounts that existed before verification are treated as verified
+ALTER TABLE users ADD COLUMN emailVerifiedAt datetime DEFAULT NULL;
+UPDATE users SET emailVerifiedAt = createdAt;
+
+-- Email verification tokens, stored as the SHA-256 hash of the token
+CREATE TABLE email_verifications (
+  tokenHash char(64) NOT NULL PRIMARY KEY,
+  userId varchar(36) NOT NULL REFERENCES users (userId),
+  expiresAt datetime NOT NULL,
+  createdAt datetime NOT NULL
+);
+CREATE INDEX email_verifications_userId_idx ON email_verifications (userId, createdAt);
+CREATE INDEX email_verifications_expiresAt_idx ON email_verifications (expiresAt);
@@ -0,0 +1,4 @@
+DROP TABLE recovery_codes;
+ALTER TABLE users DROP COLUMN totpSecret;
+ALTER TABLE users DROP COLUMN totpEnabledAt;
+ALTER TABLE users DROP COLUMN totpLastStep;
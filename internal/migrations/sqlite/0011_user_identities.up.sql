@@ -0,0 +1,11 @@
+-- Accounts of OpenID Connect providers linked to users, by the subject the
+-- provider knows the account as
+CREATE TABLE user_identities (
+  provider varchar(50) NOT NULL,
+  subject varchar(255) NOT NULL,
+  userId varchar(36) NOT NULL REFERENCES users (userId),
+  email varchar(255) NOT NULL,
+  createdAt datetime NOT NULL,
+  PRIMARY KEY (provider, subject)
+);
+CREATE INDEX user_identities_userId_idx ON user_identities (userId);
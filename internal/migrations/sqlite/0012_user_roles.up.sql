@@ -0,0 +1,5 @@
+-- The role of a user decides what they may do, admins can manage the
+-- other users. Disabled users cannot log in.
+ALTER TABLE users ADD COLUMN role varchar(20) NOT NULL DEFAULT 'user';
+ALTER TABLE users ADD COLUMN disabledAt datetime DEFAULT NULL;
+CREATE INDEX users_createdAt_idx ON users (createdAt);
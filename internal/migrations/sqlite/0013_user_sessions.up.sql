@@ -0,0 +1,17 @@
+-- The logged in sessions of each user, by the token of the session in the
+-- sessions table, so that the sessions of a user can be listed and ended
+-- without reading every session. The sessionId tells the sessions apart
+-- without giving the token away.
+CREATE TABLE user_sessions (
+  token varchar(64) NOT NULL PRIMARY KEY,
+  sessionId varchar(64) NOT NULL,
+  userId varchar(36) NOT NULL REFERENCES users (userId),
+  ip varchar(45) NOT NULL,
+  userAgent varchar(255) NOT NULL,
+  createdAt datetime DEFAULT NULL,
+  lastSeenAt datetime NOT NULL,
+  expiresAt datetime NOT NULL
+);
+CREATE UNIQUE INDEX user_sessions_sessionId_key ON user_sessions (sessionId);
+CREATE INDEX user_sessions_userId_idx ON user_sessions (userId);
+CREATE INDEX user_sessions_expiresAt_idx ON user_sessions (expiresAt);
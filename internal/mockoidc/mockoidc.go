@@ -0,0 +1,317 @@
+// Package mockoidc is an OpenID Connect provider for trying out and testing
+// single sign-on locally. It logs in whoever fills in its login form, with
+// the email, name and subject they type, and keeps everything in memory.
+// cmd/mockoidc serves it, and the tests of the web server run it with
+// httptest.
+//
+// It is not meant to be exposed to anyone but its developer.
+package mockoidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// codeTTL is how long an authorization code can be exchanged
+const codeTTL = time.Minute
+
+// idTokenTTL is how long the ID tokens are valid
+const idTokenTTL = time.Hour
+
+// keyId names the signing key in the key set
+const keyId = "mockoidc"
+
+// define authorization type, a login waiting for its code to be exchanged
+type authorization struct {
+	redirectURI   string
+	codeChallenge string
+	nonce         string
+	claims        map[string]any
+	expiresAt     time.Time
+}
+
+// define Provider type, the state of the mock provider
+type Provider struct {
+	issuer       string
+	clientId     string
+	clientSecret string
+	key          *rsa.PrivateKey
+	signer       jose.Signer
+	mux          *http.ServeMux
+
+	mu    sync.Mutex
+	codes map[string]*authorization
+}
+
+// New returns a provider reached at issuer, with a single client. The
+// signing key is generated anew.
+func New(issuer, clientId, clientSecret string) (*Provider, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", keyId))
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Provider{
+		issuer:       strings.TrimSuffix(issuer, "/"),
+		clientId:     clientId,
+		clientSecret: clientSecret,
+		key:          key,
+		signer:       signer,
+		codes:        map[string]*authorization{},
+	}
+
+	p.mux = http.NewServeMux()
+	p.mux.HandleFunc("GET /.well-known/openid-configuration", p.discovery)
+	p.mux.HandleFunc("GET /authorize", p.loginForm)
+	p.mux.HandleFunc("POST /authorize", p.authorize)
+	p.mux.HandleFunc("POST /token", p.token)
+	p.mux.HandleFunc("GET /keys", p.keys)
+	return p, nil
+}
+
+// Issuer returns the URL the provider is reached at
+func (p *Provider) Issuer() string {
+	return p.issuer
+}
+
+// ServeHTTP serves the endpoints of the provider
+func (p *Provider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mux.ServeHTTP(w, r)
+}
+
+// discovery serves the configuration of the provider
+func (p *Provider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                p.issuer,
+		"authorization_endpoint":                p.issuer + "/authorize",
+		"token_endpoint":                        p.issuer + "/token",
+		"jwks_uri":                              p.issuer + "/keys",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      []string{"openid", "email", "profile"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+var loginTemplate = template.Must(template.New("login").Parse(`<!doctype html>
+<title>Mock OpenID Connect login</title>
+<h1>Log in to the mock provider</h1>
+<form method="post">
+  {{range $name, $value := .Query}}<input type="hidden" name="{{$name}}" value="{{index $value 0}}">
+  {{end}}
+  <p><label>Email <input name="email" value="user@example.com"></label></p>
+  <p><label><input type="checkbox" name="email_verified" value="true" checked> Email verified</label></p>
+  <p><label>Name <input name="name" value="Mock User"></label></p>
+  <p><label>Subject <input name="sub" value="mock-user"></label></p>
+  <button name="action" value="allow">Log in</button>
+  <button name="action" value="deny">Deny</button>
+</form>
+`))
+
+// loginForm asks who to log in as, after checking the client and where it
+// wants the user sent back to
+func (p *Provider) loginForm(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if !p.checkAuthorizeRequest(w, query) {
+		return
+	}
+	err := loginTemplate.Execute(w, map[string]any{"Query": query})
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// authorize sends the user back to the client with a code, or with an
+// access_denied error
+func (p *Provider) authorize(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	form := r.PostForm
+	if !p.checkAuthorizeRequest(w, form) {
+		return
+	}
+
+	redirect, _ := url.Parse(form.Get("redirect_uri"))
+	query := redirect.Query()
+	query.Set("state", form.Get("state"))
+
+	if form.Get("action") == "deny" {
+		query.Set("error", "access_denied")
+	} else {
+		code := randomString()
+		p.mu.Lock()
+		p.codes[code] = &authorization{
+			redirectURI:   form.Get("redirect_uri"),
+			codeChallenge: form.Get("code_challenge"),
+			nonce:         form.Get("nonce"),
+			claims: map[string]any{
+				"sub":            form.Get("sub"),
+				"email":          form.Get("email"),
+				"email_verified": form.Get("email_verified") == "true",
+				"name":           form.Get("name"),
+			},
+			expiresAt: time.Now().Add(codeTTL),
+		}
+		p.mu.Unlock()
+		query.Set("code", code)
+	}
+
+	redirect.RawQuery = query.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+// checkAuthorizeRequest checks an authorization request is a code flow of
+// the client with a PKCE challenge
+func (p *Provider) checkAuthorizeRequest(w http.ResponseWriter, values url.Values) bool {
+	switch {
+	case values.Get("client_id") != p.clientId:
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+	case values.Get("response_type") != "code":
+		http.Error(w, "response_type must be code", http.StatusBadRequest)
+	case values.Get("code_challenge_method") != "S256" || values.Get("code_challenge") == "":
+		http.Error(w, "an S256 code_challenge is required", http.StatusBadRequest)
+	default:
+		redirect, err := url.Parse(values.Get("redirect_uri"))
+		if err != nil || !redirect.IsAbs() {
+			http.Error(w, "redirect_uri must be an absolute URL", http.StatusBadRequest)
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// token exchanges a code for an ID token, once
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, "invalid_request")
+		return
+	}
+	form := r.PostForm
+
+	clientId, clientSecret, ok := r.BasicAuth()
+	if ok {
+		clientId, _ = url.QueryUnescape(clientId)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientId, clientSecret = form.Get("client_id"), form.Get("client_secret")
+	}
+	if clientId != p.clientId || subtle.ConstantTimeCompare([]byte(clientSecret), []byte(p.clientSecret)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="mockoidc"`)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	if form.Get("grant_type") != "authorization_code" {
+		tokenError(w, "unsupported_grant_type")
+		return
+	}
+
+	p.mu.Lock()
+	a, ok := p.codes[form.Get("code")]
+	delete(p.codes, form.Get("code"))
+	p.mu.Unlock()
+
+	if !ok || time.Now().After(a.expiresAt) || a.redirectURI != form.Get("redirect_uri") {
+		tokenError(w, "invalid_grant")
+		return
+	}
+	challenge := sha256.Sum256([]byte(form.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(challenge[:]) != a.codeChallenge {
+		tokenError(w, "invalid_grant")
+		return
+	}
+
+	now := time.Now()
+	claims := map[string]any{
+		"iss": p.issuer,
+		"aud": p.clientId,
+		"iat": now.Unix(),
+		"exp": now.Add(idTokenTTL).Unix(),
+	}
+	if a.nonce != "" {
+		claims["nonce"] = a.nonce
+	}
+	for name, value := range a.claims {
+		claims[name] = value
+	}
+
+	idToken, err := p.sign(claims)
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   int(idTokenTTL.Seconds()),
+		"id_token":     idToken,
+	})
+}
+
+// keys serves the public key the ID tokens are signed with
+func (p *Provider) keys(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+		Key:       &p.key.PublicKey,
+		KeyID:     keyId,
+		Algorithm: string(jose.RS256),
+		Use:       "sig",
+	}}})
+}
+
+// sign returns the claims as a signed JWT
+func (p *Provider) sign(claims map[string]any) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed, err := p.signer.Sign(payload)
+	if err != nil {
+		return "", err
+	}
+	return signed.CompactSerialize()
+}
+
+// randomString returns 32 random bytes, base64url encoded
+func randomString() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func tokenError(w http.ResponseWriter, code string) {
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": code})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,137 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+)
+
+// APITokenTouchInterval is how often the last use of a token is written,
+// so that a busy script does not write on every request
+const APITokenTouchInterval = time.Minute
+
+// define APIToken type, a personal token a user's scripts authenticate
+// with. The token itself is only known to the user, Prefix is its start.
+type APIToken struct {
+	TokenId    string
+	UserId     string
+	Name       string
+	Prefix     string
+	Scopes     []string
+	ExpiresAt  time.Time
+	LastUsedAt *time.Time
+	CreatedAt  time.Time
+}
+
+// HasScope returns true if the token was granted the scope
+func (t *APIToken) HasScope(scope string) bool {
+	return slices.Contains(t.Scopes, scope)
+}
+
+// define APITokenModel type which wraps a sql.DB connection pool, or a
+// transaction
+type APITokenModel struct {
+	DB      DBTX
+	Dialect Dialect
+}
+
+// Insert stores a new token of the user with the hash of the token
+func (m *APITokenModel) Insert(tokenId, userId, name, prefix, tokenHash string, scopes []string, expiresAt time.Time) error {
+	stmt := `INSERT INTO api_tokens (tokenId, userId, name, tokenPrefix, tokenHash, scopes, expiresAt, createdAt)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ` + m.Dialect.Now() + `)`
+	_, err := m.DB.Exec(stmt, tokenId, userId, name, prefix, tokenHash, strings.Join(scopes, ","), expiresAt.UTC())
+	return err
+}
+
+// All returns the tokens of the user, expired ones included, in the order
+// they were created
+func (m *APITokenModel) All(userId string) ([]*APIToken, error) {
+	stmt := `SELECT tokenId, userId, name, tokenPrefix, scopes, expiresAt, lastUsedAt, createdAt
+			FROM api_tokens WHERE userId = ?
+			ORDER BY createdAt`
+
+	rows, err := m.DB.Query(stmt, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*APIToken{}
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// GetByHash returns the token with the hash. Returns ErrNoRecord if there is
+// no such token or it expired.
+func (m *APITokenModel) GetByHash(tokenHash string) (*APIToken, error) {
+	stmt := `SELECT tokenId, userId, name, tokenPrefix, scopes, expiresAt, lastUsedAt, createdAt
+			FROM api_tokens WHERE tokenHash = ? AND expiresAt > ?`
+
+	t, err := scanAPIToken(m.DB.QueryRow(stmt, tokenHash, time.Now().UTC()))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+	return t, nil
+}
+
+// Touch records that the token was used, unless that was already recorded
+// in the last APITokenTouchInterval
+func (m *APITokenModel) Touch(tokenId string) error {
+	stmt := `UPDATE api_tokens SET lastUsedAt = ` + m.Dialect.Now() + `
+			WHERE tokenId = ? AND (lastUsedAt IS NULL OR lastUsedAt < ?)`
+	_, err := m.DB.Exec(stmt, tokenId, time.Now().UTC().Add(-APITokenTouchInterval))
+	return err
+}
+
+// Delete revokes the token of the user
+func (m *APITokenModel) Delete(tokenId, userId string) error {
+	result, err := m.DB.Exec(`DELETE FROM api_tokens WHERE tokenId = ? AND userId = ?`, tokenId, userId)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrNoRecord
+	}
+	return nil
+}
+
+// DeleteExpired removes the tokens that expired before the given time and
+// returns how many it removed
+func (m *APITokenModel) DeleteExpired(before time.Time) (int64, error) {
+	result, err := m.DB.Exec(`DELETE FROM api_tokens WHERE expiresAt < ?`, before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func scanAPIToken(row rowScanner) (*APIToken, error) {
+	t := &APIToken{}
+	var scopes string
+	err := row.Scan(&t.TokenId, &t.UserId, &t.Name, &t.Prefix, &scopes, &t.ExpiresAt, &t.LastUsedAt, &t.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if scopes != "" {
+		t.Scopes = strings.Split(scopes, ",")
+	}
+	return t, nil
+}
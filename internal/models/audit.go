@@ -0,0 +1,167 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// Audited entities
+const (
+	AuditEntityUser     = "user"
+	AuditEntityBudget   = "budget"
+	AuditEntityExpense  = "expense"
+	AuditEntityCategory = "category"
+)
+
+// Audited actions
+const (
+	AuditActionCreate = "create"
+	AuditActionUpdate = "update"
+	AuditActionDelete = "delete"
+	AuditActionLogin  = "login"
+	AuditActionLogout = "logout"
+	// AuditActionPasswordReset records a password changed with a reset token
+	AuditActionPasswordReset = "password_reset"
+	// AuditActionPasswordChange records a password changed by the logged in
+	// user
+	AuditActionPasswordChange = "password_change"
+	// AuditActionEnableTwoFactor and AuditActionDisableTwoFactor record
+	// two-factor authentication turned on and off
+	AuditActionEnableTwoFactor  = "enable_2fa"
+	AuditActionDisableTwoFactor = "disable_2fa"
+	// AuditActionVerifyEmail records an email address verified with a token
+	AuditActionVerifyEmail = "verify_email"
+	// AuditActionLinkIdentity records an account of a single sign-on
+	// provider linked to the user
+	AuditActionLinkIdentity = "link_identity"
+	// AuditActionRepair records counters recomputed by the integrity checker
+	AuditActionRepair = "repair"
+	// The admin actions, recorded in the log of the admin, so that they
+	// outlive the accounts they were about. The entity is the user acted on.
+	AuditActionAdminView           = "admin_view"
+	AuditActionAdminSearch         = "admin_search"
+	AuditActionAdminStats          = "admin_stats"
+	AuditActionAdminIntegrityCheck = "admin_integrity_check"
+	AuditActionDisable             = "disable"
+	AuditActionEnable              = "enable"
+	AuditActionForceLogout         = "force_logout"
+	AuditActionRoleChange          = "role_change"
+)
+
+// define AuditEntry type, a row of the append-only audit log. UserId owns the
+// audited data and ActorId made the change; Before and After are JSON
+// snapshots of the entity, nil when it did not exist.
+type AuditEntry struct {
+	AuditId    int64
+	UserId     string
+	ActorId    string
+	SessionId  string
+	IP         string
+	RequestId  string
+	Action     string
+	EntityType string
+	EntityId   string
+	Before     []byte
+	After      []byte
+	CreatedAt  time.Time
+}
+
+// define AuditFilter type, zero fields do not filter. BeforeId pages through
+// the log: only entries older than that id are returned.
+type AuditFilter struct {
+	Action     string
+	EntityType string
+	EntityId   string
+	From       time.Time
+	To         time.Time
+	BeforeId   int64
+	Limit      int
+}
+
+// define AuditModel type which wraps a sql.DB connection pool, or a
+// transaction. Entries are never updated, and only deleted once they are
+// older than the retention period.
+type AuditModel struct {
+	DB      DBTX
+	Dialect Dialect
+}
+
+// insert an entry into the audit log
+func (m *AuditModel) Insert(entry *AuditEntry) error {
+	stmt := `INSERT INTO audit_log (userId, actorId, sessionId, ip, requestId, action, entityType, entityId, beforeSnapshot, afterSnapshot, createdAt)
+			VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ` + m.Dialect.Now() + `)`
+
+	_, err := m.DB.Exec(stmt, entry.UserId, entry.ActorId, entry.SessionId, entry.IP, entry.RequestId,
+		entry.Action, entry.EntityType, entry.EntityId, entry.Before, entry.After)
+	return err
+}
+
+// List returns the entries about the data of the user that match the
+// filter, newest first
+func (m *AuditModel) List(userId string, filter AuditFilter) ([]*AuditEntry, error) {
+	conditions := []string{"userId = ?"}
+	args := []any{userId}
+
+	if filter.Action != "" {
+		conditions = append(conditions, "action = ?")
+		args = append(args, filter.Action)
+	}
+	if filter.EntityType != "" {
+		conditions = append(conditions, "entityType = ?")
+		args = append(args, filter.EntityType)
+	}
+	if filter.EntityId != "" {
+		conditions = append(conditions, "entityId = ?")
+		args = append(args, filter.EntityId)
+	}
+	if !filter.From.IsZero() {
+		conditions = append(conditions, "createdAt >= ?")
+		args = append(args, filter.From.UTC())
+	}
+	if !filter.To.IsZero() {
+		conditions = append(conditions, "createdAt < ?")
+		args = append(args, filter.To.UTC())
+	}
+	if filter.BeforeId > 0 {
+		conditions = append(conditions, "auditId < ?")
+		args = append(args, filter.BeforeId)
+	}
+
+	stmt := `SELECT auditId, userId, actorId, sessionId, ip, requestId, action, entityType, entityId, beforeSnapshot, afterSnapshot, createdAt
+			FROM audit_log
+			WHERE ` + strings.Join(conditions, " and ") + `
+			ORDER BY auditId DESC
+			LIMIT ?`
+	args = append(args, filter.Limit)
+
+	rows, err := m.DB.Query(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*AuditEntry{}
+	for rows.Next() {
+		e := &AuditEntry{}
+		err = rows.Scan(&e.AuditId, &e.UserId, &e.ActorId, &e.SessionId, &e.IP, &e.RequestId, &e.Action,
+			&e.EntityType, &e.EntityId, &e.Before, &e.After, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// DeleteOlderThan removes the entries recorded before cutoff and returns how
+// many were removed
+func (m *AuditModel) DeleteOlderThan(cutoff time.Time) (int64, error) {
+	result, err := m.DB.Exec(`DELETE FROM audit_log WHERE createdAt < ?`, cutoff.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -16,20 +16,29 @@ type Budget struct {
 	BudgetTotal     int64
 	BudgetRemaining int64
 	TotalSpent      int64
+	Version         int
 	UpdatedAt       time.Time
 	CreatedAt       time.Time
 }
 
-// define a Budget model type which wraps a sql.DB connection pool
+// MaxCents caps money amounts and balances, in cents, so that adding them up
+// cannot overflow an int64. It is a trillion in the currency unit. Input
+// structs repeat it in their validate tags.
+const MaxCents int64 = 100_000_000_000_000
+
+// define a Budget model type which wraps a sql.DB connection pool, or a
+// transaction
 type BudgetModel struct {
-	DB       *sql.DB
+	DB       DBTX
+	Dialect  Dialect
 	InfoLog  *log.Logger
 	ErrorLog *log.Logger
 }
 
-func NewBudgetModel(db *sql.DB, infoLog *log.Logger, errorLog *log.Logger) *BudgetModel {
+func NewBudgetModel(db DBTX, dialect Dialect, infoLog *log.Logger, errorLog *log.Logger) *BudgetModel {
 	return &BudgetModel{
 		DB:       db,
+		Dialect:  dialect,
 		InfoLog:  infoLog,
 		ErrorLog: errorLog,
 	}
@@ -41,7 +50,7 @@ func (m *BudgetModel) Insert(budgetId, userId string, checkingBalance, savingsBa
 		budgetId, userId, checkingBalance, savingsBalance, budgetTotal, 
 		budgetRemaining, totalSpent, createdAt, updatedAt
 	) 
-		VALUES (?, ?, ?, ?, ?, ?, ?, UTC_TIMESTAMP(), UTC_TIMESTAMP())`
+		VALUES (?, ?, ?, ?, ?, ?, ?, ` + m.Dialect.Now() + `, ` + m.Dialect.Now() + `)`
 
 	budgetRemaining := budgetTotal
 	totalSpent := int64(0)
@@ -56,7 +65,7 @@ func (m *BudgetModel) Insert(budgetId, userId string, checkingBalance, savingsBa
 
 // return a specific Budget based on its id
 func (m *BudgetModel) Get(budgetId string) (*Budget, error) {
-	stmt := `SELECT budgetId, userId, checkingBalance, savingsBalance, budgetTotal, budgetRemaining, totalSpent, updatedAt, createdAt
+	stmt := `SELECT budgetId, userId, checkingBalance, savingsBalance, budgetTotal, budgetRemaining, totalSpent, version, updatedAt, createdAt
 			FROM budget WHERE budgetId = ?`
 
 	// This returns a pointer to a sql.Row object
@@ -77,6 +86,7 @@ func (m *BudgetModel) Get(budgetId string) (*Budget, error) {
 		&bud.BudgetTotal,
 		&bud.BudgetRemaining,
 		&bud.TotalSpent,
+		&bud.Version,
 		&bud.UpdatedAt,
 		&bud.CreatedAt,
 	)
@@ -93,64 +103,6 @@ func (m *BudgetModel) Get(budgetId string) (*Budget, error) {
 	return bud, nil
 }
 
-// return all created Budgets
-func (m *BudgetModel) All() ([]*Budget, error) {
-	stmt := `SELECT * FROM budget
-			ORDER BY created DESC`
-
-	// Use the Query() method on the connection pool to execute the stmt
-	// this returns a sql.Rows resultset containing the result of query
-	rows, err := m.DB.Query(stmt)
-	if err != nil {
-		return nil, err
-	}
-
-	// We defer rows.Close() to ensure the sql.Rows resultset is always
-	// properly closed.
-	// Defer stmt should come *after* you check for an error from the Query()
-	// method. Otherwise, if Query() returns an error, you'll get a panic trying to close a nil resultset
-	defer rows.Close()
-
-	// Initialize an empty slice to hold the Budget structs
-	budgets := []*Budget{}
-
-	// Use rows.Next to iterate through the rows in the resultset.
-	// If iteration over all the rows completes then the
-	// resultset automatically closes itself and frees-up the underlying
-	// database connection.
-	for rows.Next() {
-		// Create a pointer to a new zeroed Budget struct.
-		bud := &Budget{}
-		// Use rows.Scan() to copy the values from each field in the row to
-		// the new budget object.
-		err = rows.Scan(
-			&bud.BudgetId,
-			&bud.UserId,
-			&bud.CheckingBalance,
-			&bud.SavingsBalance,
-			&bud.BudgetTotal,
-			&bud.BudgetRemaining,
-			&bud.TotalSpent,
-			&bud.CreatedAt,
-			&bud.UpdatedAt,
-		)
-		if err != nil {
-			return nil, err
-		}
-		// Append it to the slice of Budgets.
-		budgets = append(budgets, bud)
-	}
-	// When the rows.Next() loop has finished we call rows.Err() to retrieve
-	// any error that was encountered during the iteration. It's important to
-	// call this - don't assume that a successful iteration was completed
-	// over the whole resultset.
-	if err = rows.Err(); err != nil {
-		return nil, err
-	}
-	// If everything went OK then return the Budgets slice
-	return budgets, nil
-}
-
 // update a Budget
 func (m *BudgetModel) Put(budgetId, userId string, checkingBalance, savingsBalance, budgetTotal, budgetRemaining, totalSpent int64) error {
 	stmt := `UPDATE budget 
@@ -159,7 +111,8 @@ func (m *BudgetModel) Put(budgetId, userId string, checkingBalance, savingsBalan
 			budgetTotal = ?,
 			budgetRemaining = ?,
 			totalSpent = ?,
-			updatedAt = UTC_TIMESTAMP()
+			version = version + 1,
+			updatedAt = ` + m.Dialect.Now() + `
 			WHERE budgetId = ?
 			and userId = ?`
 
@@ -174,6 +127,38 @@ func (m *BudgetModel) Put(budgetId, userId string, checkingBalance, savingsBalan
 	return nil
 }
 
+// update a Budget only if it is still at the given version, otherwise
+// return ErrVersionConflict so that concurrent updates don't clobber each other
+func (m *BudgetModel) PutIfVersion(budgetId, userId string, version int, checkingBalance, savingsBalance, budgetTotal, budgetRemaining, totalSpent int64) error {
+	stmt := `UPDATE budget 
+			SET checkingBalance = ?, 
+			savingsBalance = ?, 
+			budgetTotal = ?,
+			budgetRemaining = ?,
+			totalSpent = ?,
+			version = version + 1,
+			updatedAt = ` + m.Dialect.Now() + `
+			WHERE budgetId = ?
+			and userId = ?
+			and version = ?`
+
+	result, err := m.DB.Exec(stmt, checkingBalance, savingsBalance, budgetTotal, budgetRemaining, totalSpent, budgetId, userId, version)
+	if err != nil {
+		m.ErrorLog.Printf("Error while attempting Budget update for budgetId: %s, userId: %s - %v", budgetId, userId, err)
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrVersionConflict
+	}
+
+	return nil
+}
+
 // delete a Budget
 func (m *BudgetModel) Delete(budgetId, userId string) error {
 	// Execute the statement with the provided id
@@ -193,9 +178,8 @@ func (m *BudgetModel) Delete(budgetId, userId string) error {
 	}
 
 	if rowsAffected == 0 {
-		// No rows were affected, meaning the ID might not exist
-		m.ErrorLog.Printf("No rows affected, possible non-existent ID: %s", budgetId)
-		return nil
+		// No rows were affected, the budget does not exist or is not the user's
+		return ErrNoRecord
 	}
 
 	log.Printf("Deleted successfully")
@@ -204,13 +188,27 @@ func (m *BudgetModel) Delete(budgetId, userId string) error {
 
 // Find a budget based on UserId
 func (m *BudgetModel) GetBudgetByUserId(userId string) (*Budget, error) {
-	stmt := `SELECT budgetId, userId, checkingBalance, savingsBalance, budgetTotal, budgetRemaining, totalSpent 
-			FROM budget WHERE userId = ?`
+	return m.getBudgetByUserId(userId, "")
+}
+
+// return the budget of a user and lock its row until the end of the
+// transaction, so that concurrent changes of the balances wait for each
+// other instead of failing with ErrVersionConflict
+func (m *BudgetModel) GetBudgetByUserIdForUpdate(userId string) (*Budget, error) {
+	return m.getBudgetByUserId(userId, m.Dialect.ForUpdate())
+}
+
+func (m *BudgetModel) getBudgetByUserId(userId, lock string) (*Budget, error) {
+	stmt := `SELECT budgetId, userId, checkingBalance, savingsBalance, budgetTotal, budgetRemaining, totalSpent, version, updatedAt, createdAt
+			FROM budget WHERE userId = ?` + lock
 	row := m.DB.QueryRow(stmt, userId)
 
 	budget := &Budget{}
-	err := row.Scan(&budget.BudgetId, &budget.UserId, &budget.CheckingBalance, &budget.SavingsBalance, &budget.BudgetTotal, &budget.BudgetRemaining, &budget.TotalSpent)
+	err := row.Scan(&budget.BudgetId, &budget.UserId, &budget.CheckingBalance, &budget.SavingsBalance, &budget.BudgetTotal, &budget.BudgetRemaining, &budget.TotalSpent, &budget.Version, &budget.UpdatedAt, &budget.CreatedAt)
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
 		return nil, err
 	}
 
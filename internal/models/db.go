@@ -0,0 +1,71 @@
+package models
+
+import (
+	"database/sql"
+)
+
+// DBTX is implemented by both *sql.DB and *sql.Tx, so that a model can run
+// its statements either directly on the connection pool or as part of a
+// transaction spanning several models
+type DBTX interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// inTx runs fn in a new transaction, or directly in db if db already is a
+// transaction. The transaction is committed if fn returns nil and rolled
+// back otherwise.
+func inTx(db DBTX, fn func(tx DBTX) error) error {
+	if bound, ok := db.(*boundDB); ok {
+		return inTx(bound.db, func(tx DBTX) error {
+			return fn(Bind(tx, bound.dialect))
+		})
+	}
+
+	pool, ok := db.(*sql.DB)
+	if !ok {
+		return fn(db)
+	}
+
+	tx, err := pool.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Bind returns db, with the placeholders of every statement rewritten for
+// the dialect. The models write their statements with ? placeholders and
+// are handed a bound DBTX.
+func Bind(db DBTX, dialect Dialect) DBTX {
+	if _, ok := db.(*boundDB); ok {
+		return db
+	}
+	return &boundDB{db: db, dialect: dialect}
+}
+
+// boundDB is a DBTX that rebinds the statements it runs
+type boundDB struct {
+	db      DBTX
+	dialect Dialect
+}
+
+func (b *boundDB) Exec(query string, args ...any) (sql.Result, error) {
+	return b.db.Exec(b.dialect.Rebind(query), args...)
+}
+
+func (b *boundDB) Query(query string, args ...any) (*sql.Rows, error) {
+	return b.db.Query(b.dialect.Rebind(query), args...)
+}
+
+func (b *boundDB) QueryRow(query string, args ...any) *sql.Row {
+	return b.db.QueryRow(b.dialect.Rebind(query), args...)
+}
@@ -0,0 +1,170 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Dialect holds the SQL that differs between the databases the models run
+// on. The statements of the models are otherwise written in the SQL both
+// databases understand.
+type Dialect interface {
+	// Name is the value of DB_DRIVER that selects the dialect
+	Name() string
+	// Driver is the database/sql driver name
+	Driver() string
+	// Rebind rewrites the ? placeholders of query into the placeholders of
+	// the database
+	Rebind(query string) string
+	// Now is an expression of the current UTC time, to the second
+	Now() string
+	// ForUpdate is appended to a SELECT to lock the rows it reads until the
+	// end of the transaction
+	ForUpdate() string
+	// Upsert returns an INSERT of columns into table which updates the
+	// columns that are not part of key when a row with the same key exists
+	Upsert(table string, key []string, columns []string) string
+	// IsDuplicateKey reports whether err was caused by a primary or unique
+	// key. keyHint, if not empty, must appear in the error message, to tell
+	// the unique keys of a table apart.
+	IsDuplicateKey(err error, keyHint string) bool
+}
+
+// The dialects of the supported databases
+var (
+	MySQL    Dialect = mysqlDialect{}
+	SQLite   Dialect = sqliteDialect{}
+	Postgres Dialect = postgresDialect{}
+)
+
+// DialectFor returns the dialect of a DB_DRIVER value
+func DialectFor(name string) (Dialect, error) {
+	for _, d := range []Dialect{MySQL, SQLite, Postgres} {
+		if d.Name() == name {
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("models: unsupported database driver %q", name)
+}
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) Name() string           { return "mysql" }
+func (mysqlDialect) Driver() string         { return "mysql" }
+func (mysqlDialect) Rebind(q string) string { return q }
+func (mysqlDialect) Now() string            { return "UTC_TIMESTAMP()" }
+func (mysqlDialect) ForUpdate() string      { return " FOR UPDATE" }
+
+func (mysqlDialect) Upsert(table string, key []string, columns []string) string {
+	updates := []string{}
+	for _, column := range nonKeyColumns(key, columns) {
+		updates = append(updates, fmt.Sprintf("%s = VALUES(%s)", column, column))
+	}
+	return insertStmt(table, columns) + " ON DUPLICATE KEY UPDATE " + strings.Join(updates, ", ")
+}
+
+func (mysqlDialect) IsDuplicateKey(err error, keyHint string) bool {
+	var mySQLError *mysql.MySQLError
+	return errors.As(err, &mySQLError) && mySQLError.Number == 1062 &&
+		strings.Contains(mySQLError.Message, keyHint)
+}
+
+// sqliteDialect stores times as text in the format the sqlite3 driver
+// writes time.Time values in, so that they compare correctly with the
+// times passed as arguments
+type sqliteDialect struct{}
+
+func (sqliteDialect) Name() string           { return "sqlite" }
+func (sqliteDialect) Driver() string         { return "sqlite3" }
+func (sqliteDialect) Rebind(q string) string { return q }
+func (sqliteDialect) Now() string            { return "strftime('%Y-%m-%d %H:%M:%S+00:00', 'now')" }
+func (sqliteDialect) ForUpdate() string      { return "" }
+
+func (sqliteDialect) Upsert(table string, key []string, columns []string) string {
+	return onConflictUpsert(table, key, columns)
+}
+
+func (sqliteDialect) IsDuplicateKey(err error, keyHint string) bool {
+	var sqliteError sqlite3.Error
+	if !errors.As(err, &sqliteError) {
+		return false
+	}
+	if sqliteError.ExtendedCode != sqlite3.ErrConstraintUnique && sqliteError.ExtendedCode != sqlite3.ErrConstraintPrimaryKey {
+		return false
+	}
+	return strings.Contains(sqliteError.Error(), keyHint)
+}
+
+// postgresDialect stores times as timestamps without a time zone, in UTC,
+// like MySQL does. Times passed as arguments must be in UTC as well.
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string   { return "postgres" }
+func (postgresDialect) Driver() string { return "pgx" }
+func (postgresDialect) Now() string {
+	return "date_trunc('second', now() AT TIME ZONE 'UTC')"
+}
+func (postgresDialect) ForUpdate() string { return " FOR UPDATE" }
+
+// Rebind numbers the placeholders, $1, $2 and so on. Question marks inside
+// string literals are left alone.
+func (postgresDialect) Rebind(query string) string {
+	var b strings.Builder
+	n := 0
+	inLiteral := false
+	for _, r := range query {
+		switch {
+		case r == '\'':
+			inLiteral = !inLiteral
+		case r == '?' && !inLiteral:
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (postgresDialect) Upsert(table string, key []string, columns []string) string {
+	return onConflictUpsert(table, key, columns)
+}
+
+func (postgresDialect) IsDuplicateKey(err error, keyHint string) bool {
+	var pgError *pgconn.PgError
+	if !errors.As(err, &pgError) || pgError.Code != "23505" {
+		return false
+	}
+	return strings.Contains(pgError.ConstraintName, keyHint) || strings.Contains(pgError.Message, keyHint)
+}
+
+// onConflictUpsert is the upsert of SQLite and Postgres, which share the
+// syntax
+func onConflictUpsert(table string, key []string, columns []string) string {
+	updates := []string{}
+	for _, column := range nonKeyColumns(key, columns) {
+		updates = append(updates, fmt.Sprintf("%s = excluded.%s", column, column))
+	}
+	return insertStmt(table, columns) + " ON CONFLICT (" + strings.Join(key, ", ") + ") DO UPDATE SET " + strings.Join(updates, ", ")
+}
+
+func insertStmt(table string, columns []string) string {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table, strings.Join(columns, ", "), placeholders)
+}
+
+func nonKeyColumns(key []string, columns []string) []string {
+	rest := []string{}
+	for _, column := range columns {
+		if !slices.Contains(key, column) {
+			rest = append(rest, column)
+		}
+	}
+	return rest
+}
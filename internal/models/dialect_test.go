@@ -0,0 +1,60 @@
+package models
+
+import "testing"
+
+func TestPostgresRebind(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT 1", "SELECT 1"},
+		{"SELECT * FROM users WHERE userId = ?", "SELECT * FROM users WHERE userId = $1"},
+		{"UPDATE budget SET totalSpent = ? WHERE budgetId = ? and version = ?", "UPDATE budget SET totalSpent = $1 WHERE budgetId = $2 and version = $3"},
+		{"SELECT '?' FROM users WHERE email = ?", "SELECT '?' FROM users WHERE email = $1"},
+		{"SELECT 'it''s ?', ? FROM users", "SELECT 'it''s ?', $1 FROM users"},
+	}
+	for _, tt := range tests {
+		if got := Postgres.Rebind(tt.query); got != tt.want {
+			t.Errorf("Rebind(%q) = %q; want %q", tt.query, got, tt.want)
+		}
+	}
+
+	// The other databases take the ? placeholders as they are
+	for _, d := range []Dialect{MySQL, SQLite} {
+		const query = "SELECT * FROM users WHERE userId = ?"
+		if got := d.Rebind(query); got != query {
+			t.Errorf("%s: Rebind(%q) = %q", d.Name(), query, got)
+		}
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	key := []string{"token"}
+	columns := []string{"token", "data", "expiry"}
+
+	tests := []struct {
+		dialect Dialect
+		want    string
+	}{
+		{MySQL, "INSERT INTO sessions (token, data, expiry) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE data = VALUES(data), expiry = VALUES(expiry)"},
+		{SQLite, "INSERT INTO sessions (token, data, expiry) VALUES (?, ?, ?) ON CONFLICT (token) DO UPDATE SET data = excluded.data, expiry = excluded.expiry"},
+		{Postgres, "INSERT INTO sessions (token, data, expiry) VALUES (?, ?, ?) ON CONFLICT (token) DO UPDATE SET data = excluded.data, expiry = excluded.expiry"},
+	}
+	for _, tt := range tests {
+		if got := tt.dialect.Upsert("sessions", key, columns); got != tt.want {
+			t.Errorf("%s: got %q; want %q", tt.dialect.Name(), got, tt.want)
+		}
+	}
+}
+
+func TestDialectFor(t *testing.T) {
+	for _, name := range []string{"mysql", "sqlite", "postgres"} {
+		d, err := DialectFor(name)
+		if err != nil || d.Name() != name {
+			t.Errorf("DialectFor(%q) = %v, %v", name, d, err)
+		}
+	}
+	if _, err := DialectFor("oracle"); err == nil {
+		t.Error("DialectFor(\"oracle\") did not fail")
+	}
+}
@@ -0,0 +1,87 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// EmailVerificationTTL is how long an email verification token can be used
+const EmailVerificationTTL = 24 * time.Hour
+
+// define EmailVerificationModel type which wraps a sql.DB connection pool,
+// or a transaction. Like password reset tokens, only the SHA-256 hash of a
+// token is stored.
+type EmailVerificationModel struct {
+	DB      DBTX
+	Dialect Dialect
+}
+
+// Insert stores the hash of a new verification token of the user
+func (m *EmailVerificationModel) Insert(tokenHash, userId string, expiresAt time.Time) error {
+	stmt := `INSERT INTO email_verifications (tokenHash, userId, expiresAt, createdAt)
+			VALUES (?, ?, ?, ` + m.Dialect.Now() + `)`
+	_, err := m.DB.Exec(stmt, tokenHash, userId, expiresAt.UTC())
+	return err
+}
+
+// Consume uses up the token and returns the user it was issued to. Every
+// other token of the user is deleted with it. Returns
+// ErrInvalidVerificationToken if the token is unknown, expired or already
+// used.
+func (m *EmailVerificationModel) Consume(tokenHash string) (string, error) {
+	var userId string
+	stmt := `SELECT userId FROM email_verifications WHERE tokenHash = ? AND expiresAt > ?`
+	err := m.DB.QueryRow(stmt, tokenHash, time.Now().UTC()).Scan(&userId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrInvalidVerificationToken
+		}
+		return "", err
+	}
+
+	// Only one of two concurrent uses of the token deletes it
+	result, err := m.DB.Exec(`DELETE FROM email_verifications WHERE tokenHash = ?`, tokenHash)
+	if err != nil {
+		return "", err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+	if rowsAffected == 0 {
+		return "", ErrInvalidVerificationToken
+	}
+
+	_, err = m.DB.Exec(`DELETE FROM email_verifications WHERE userId = ?`, userId)
+	if err != nil {
+		return "", err
+	}
+	return userId, nil
+}
+
+// CountSince returns how many tokens were issued to the user since the
+// given time, to limit how often they are sent
+func (m *EmailVerificationModel) CountSince(userId string, since time.Time) (int, error) {
+	var n int
+	stmt := `SELECT COUNT(*) FROM email_verifications WHERE userId = ? AND createdAt >= ?`
+	err := m.DB.QueryRow(stmt, userId, since.UTC()).Scan(&n)
+	return n, err
+}
+
+// DeleteAll removes every token of the user, so that the links sent to an
+// address the user no longer has cannot verify the new one
+func (m *EmailVerificationModel) DeleteAll(userId string) error {
+	_, err := m.DB.Exec(`DELETE FROM email_verifications WHERE userId = ?`, userId)
+	return err
+}
+
+// DeleteExpired removes the tokens that can no longer be used and returns
+// how many it removed
+func (m *EmailVerificationModel) DeleteExpired() (int64, error) {
+	result, err := m.DB.Exec(`DELETE FROM email_verifications WHERE expiresAt <= ?`, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
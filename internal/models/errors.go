@@ -18,4 +18,55 @@ var (
 	// ErrDuplicateEmail error will be used if a user tries to
 	// signup with an email address that's already in use
 	ErrDuplicateEmail = errors.New("models: duplicate email")
+
+	// ErrNoBudget error will be used if a user tries to spend money
+	// before creating a budget
+	ErrNoBudget = errors.New("models: no budget for user")
+
+	// ErrInsufficientFunds error will be used if a subtraction would take
+	// the checking or savings balance below zero
+	ErrInsufficientFunds = errors.New("models: insufficient funds")
+
+	// ErrInvalidAmount error will be used if a money amount is zero or negative
+	ErrInvalidAmount = errors.New("models: amount must be positive")
+
+	// ErrBalanceLimit error will be used if an addition would take the
+	// checking or savings balance above MaxCents
+	ErrBalanceLimit = errors.New("models: balance limit exceeded")
+
+	// ErrInvalidBalanceType error will be used if a balance type is neither
+	// checkingBalance nor savingsBalance
+	ErrInvalidBalanceType = errors.New("models: invalid balance type")
+
+	// ErrVersionConflict error will be used if a record was modified by
+	// someone else since the version the caller based its update on
+	ErrVersionConflict = errors.New("models: record was modified concurrently")
+
+	// ErrDuplicateIdempotencyKey error will be used if a user sends an
+	// idempotency key that was already used within its time to live
+	ErrDuplicateIdempotencyKey = errors.New("models: duplicate idempotency key")
+
+	// ErrInvalidResetToken error will be used if a password reset token is
+	// unknown, expired or was already used
+	ErrInvalidResetToken = errors.New("models: invalid password reset token")
+
+	// ErrInvalidVerificationToken error will be used if an email
+	// verification token is unknown, expired or was already used
+	ErrInvalidVerificationToken = errors.New("models: invalid email verification token")
+
+	// ErrTwoFactorEnabled error will be used if a user tries to enroll in
+	// two-factor authentication while it is already on
+	ErrTwoFactorEnabled = errors.New("models: two-factor authentication already enabled")
+
+	// ErrInvalidTwoFactorCode error will be used if a recovery code is
+	// unknown or used, or a TOTP code was already accepted
+	ErrInvalidTwoFactorCode = errors.New("models: invalid two-factor code")
+
+	// ErrDuplicateIdentity error will be used if an account of a single
+	// sign-on provider is already linked to a user
+	ErrDuplicateIdentity = errors.New("models: identity already linked")
+
+	// ErrAccountDisabled error will be used if a user an admin disabled
+	// tries to log in
+	ErrAccountDisabled = errors.New("models: account disabled")
 )
@@ -16,18 +16,21 @@ type Expense struct {
 	Description   string
 	ExpenseType   string
 	AmountInCents int64
+	Version       int
 	CreatedAt     time.Time
 }
 
-// define a Expense model type which wraps a sql.DB connection pool
+// define a Expense model type which wraps a sql.DB connection pool, or a
+// transaction
 type ExpenseModel struct {
-	DB *sql.DB
+	DB      DBTX
+	Dialect Dialect
 }
 
 // insert a new Expense into the database
 func (m *ExpenseModel) Insert(expenseId, userId, categoryId, description, expenseType string, amountInCents int64) (string, error) {
 	stmt := `INSERT INTO expenses (expenseId, userId, categoryId, description, expenseType, amountInCents, createdAt) 	
-			VALUES(?, ?, ?, ?, ?, ?, UTC_TIMESTAMP())`
+			VALUES(?, ?, ?, ?, ?, ?, ` + m.Dialect.Now() + `)`
 
 	_, err := m.DB.Exec(stmt, expenseId, userId, categoryId, description, expenseType, amountInCents)
 	if err != nil {
@@ -40,7 +43,7 @@ func (m *ExpenseModel) Insert(expenseId, userId, categoryId, description, expens
 // return a specific expense based on its id
 func (m *ExpenseModel) Get(expenseId string) (*Expense, error) {
 	// Write the SQL statement we want to execute
-	stmt := `SELECT expenseId, userId, categoryId, description, expenseType, amountInCents, createdAt 
+	stmt := `SELECT expenseId, userId, categoryId, description, expenseType, amountInCents, version, createdAt 
 			FROM expenses WHERE expenseId = ?`
 
 	// This returns a pointer to a sql.Row object
@@ -53,7 +56,7 @@ func (m *ExpenseModel) Get(expenseId string) (*Expense, error) {
 	// Use row.Scan() to copy the values from each field in sql.Row to the
 	// corresponding field in the expense struct.
 	// The arguments to row.Scan are *pointers* to the place to copy the data into
-	err := row.Scan(&exp.ExpenseId, &exp.UserId, &exp.CategoryId, &exp.Description, &exp.ExpenseType, &exp.AmountInCents, &exp.CreatedAt)
+	err := row.Scan(&exp.ExpenseId, &exp.UserId, &exp.CategoryId, &exp.Description, &exp.ExpenseType, &exp.AmountInCents, &exp.Version, &exp.CreatedAt)
 	if err != nil {
 		// If the query returns no rows, then row.Scan() will return a
 		// sql.ErrNoRows error
@@ -69,7 +72,7 @@ func (m *ExpenseModel) Get(expenseId string) (*Expense, error) {
 
 // return the all created Expenses
 func (m *ExpenseModel) All(userId string) ([]*Expense, error) {
-	stmt := `SELECT expenseId, userId, categoryId, description, expenseType, amountInCents, createdAt 
+	stmt := `SELECT expenseId, userId, categoryId, description, expenseType, amountInCents, version, createdAt 
 			FROM expenses 
 			WHERE userId = ? 
 			ORDER BY createdAt DESC`
@@ -99,7 +102,7 @@ func (m *ExpenseModel) All(userId string) ([]*Expense, error) {
 		exp := &Expense{}
 		// Use rows.Scan() to copy the values from each field in the row,
 		// the arguments to row.Scan() must be pointers
-		err = rows.Scan(&exp.ExpenseId, &exp.UserId, &exp.CategoryId, &exp.Description, &exp.ExpenseType, &exp.AmountInCents, &exp.CreatedAt)
+		err = rows.Scan(&exp.ExpenseId, &exp.UserId, &exp.CategoryId, &exp.Description, &exp.ExpenseType, &exp.AmountInCents, &exp.Version, &exp.CreatedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -122,7 +125,8 @@ func (m *ExpenseModel) Put(expenseId, userId, categoryId, description, expenseTy
 			SET categoryId = ?, 
 			description = ?, 
 			expenseType = ?,
-			amountInCents = ?  
+			amountInCents = ?,
+			version = version + 1
 			WHERE expenseId = ?
 			and userId = ?`
 
@@ -137,6 +141,36 @@ func (m *ExpenseModel) Put(expenseId, userId, categoryId, description, expenseTy
 	return nil
 }
 
+// update an Expense only if it is still at the given version, otherwise
+// return ErrVersionConflict
+func (m *ExpenseModel) PutIfVersion(expenseId, userId string, version int, categoryId, description, expenseType string, amountInCents int64) error {
+	stmt := `UPDATE expenses 
+			SET categoryId = ?, 
+			description = ?, 
+			expenseType = ?,
+			amountInCents = ?,
+			version = version + 1
+			WHERE expenseId = ?
+			and userId = ?
+			and version = ?`
+
+	result, err := m.DB.Exec(stmt, categoryId, description, expenseType, amountInCents, expenseId, userId, version)
+	if err != nil {
+		log.Printf("Error while attempting Expense update %s", err)
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrVersionConflict
+	}
+
+	return nil
+}
+
 // delete
 func (m *ExpenseModel) Delete(expenseId, userId string) error {
 	// Execute the statement with the provided id
@@ -0,0 +1,120 @@
+package models
+
+import (
+	"fmt"
+)
+
+// define ExpenseBatch type, the combined result of a batch of expense
+// operations. Updated and deleted expenses, and the budget, carry the
+// version they were read at.
+type ExpenseBatch struct {
+	UserId  string
+	Created []*Expense
+	Updated []*Expense
+	Deleted []*Expense
+	// Budget is nil when the batch leaves the balances untouched
+	Budget *Budget
+	// CategoryDeltas holds how much the batch adds to, or takes out of, the
+	// totalSum of every category it touched. The totals are changed relative
+	// to what is stored, so that expenses written by other requests since
+	// the batch was planned are still counted.
+	CategoryDeltas map[string]int64
+}
+
+// ApplyBatch writes every change of the batch in a single transaction, or in
+// the transaction of the model if it already runs in one. If any expense or
+// the budget was modified since it was read, nothing is written and
+// ErrVersionConflict is returned.
+func (m *ExpenseModel) ApplyBatch(batch *ExpenseBatch) error {
+	return inTx(m.DB, func(tx DBTX) error {
+		return applyBatch(tx, m.Dialect, batch)
+	})
+}
+
+func applyBatch(tx DBTX, dialect Dialect, batch *ExpenseBatch) error {
+	var err error
+
+	for _, exp := range batch.Created {
+		stmt := `INSERT INTO expenses (expenseId, userId, categoryId, description, expenseType, amountInCents, createdAt)
+				VALUES(?, ?, ?, ?, ?, ?, ` + dialect.Now() + `)`
+		_, err = tx.Exec(stmt, exp.ExpenseId, batch.UserId, exp.CategoryId, exp.Description, exp.ExpenseType, exp.AmountInCents)
+		if err != nil {
+			return fmt.Errorf("could not insert expense %s: %w", exp.ExpenseId, err)
+		}
+	}
+
+	for _, exp := range batch.Updated {
+		stmt := `UPDATE expenses
+				SET categoryId = ?,
+				description = ?,
+				expenseType = ?,
+				amountInCents = ?,
+				version = version + 1
+				WHERE expenseId = ?
+				and userId = ?
+				and version = ?`
+		err = execOneRow(tx, stmt, exp.CategoryId, exp.Description, exp.ExpenseType, exp.AmountInCents, exp.ExpenseId, batch.UserId, exp.Version)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, exp := range batch.Deleted {
+		stmt := `DELETE FROM expenses WHERE expenseId = ? and userId = ? and version = ?`
+		err = execOneRow(tx, stmt, exp.ExpenseId, batch.UserId, exp.Version)
+		if err != nil {
+			return err
+		}
+	}
+
+	if b := batch.Budget; b != nil {
+		stmt := `UPDATE budget
+				SET checkingBalance = ?,
+				savingsBalance = ?,
+				budgetTotal = ?,
+				budgetRemaining = ?,
+				totalSpent = ?,
+				version = version + 1,
+				updatedAt = ` + dialect.Now() + `
+				WHERE budgetId = ?
+				and userId = ?
+				and version = ?`
+		err = execOneRow(tx, stmt, b.CheckingBalance, b.SavingsBalance, b.BudgetTotal, b.BudgetRemaining, b.TotalSpent, b.BudgetId, batch.UserId, b.Version)
+		if err != nil {
+			return err
+		}
+	}
+
+	for categoryId, delta := range batch.CategoryDeltas {
+		stmt := `UPDATE expensecategory
+				SET totalSum = CASE WHEN totalSum + ? < 0 THEN 0 ELSE totalSum + ? END,
+				version = version + 1
+				WHERE expenseCategoryId = ? and
+				userId = ?`
+		_, err = tx.Exec(stmt, delta, delta, categoryId, batch.UserId)
+		if err != nil {
+			return fmt.Errorf("could not update total of category %s: %w", categoryId, err)
+		}
+	}
+
+	return nil
+}
+
+// execOneRow runs a versioned statement and returns ErrVersionConflict if it
+// did not change exactly one row
+func execOneRow(tx DBTX, stmt string, args ...any) error {
+	result, err := tx.Exec(stmt, args...)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected != 1 {
+		return ErrVersionConflict
+	}
+
+	return nil
+}
@@ -13,11 +13,13 @@ type ExpenseCategory struct {
 	Name              string
 	Description       string
 	TotalSum          int64
+	Version           int
 }
 
-// define a ExpenseCategory model type which wraps a sql.DB connection pool
+// define a ExpenseCategory model type which wraps a sql.DB connection pool,
+// or a transaction
 type ExpenseCategoryModel struct {
-	DB *sql.DB
+	DB DBTX
 }
 
 // insert a new ExpenseCategory into the database
@@ -37,7 +39,7 @@ func (m *ExpenseCategoryModel) Insert(expenseCategoryId, userId, name, descripti
 
 // return a specific expenseCategory based on its id
 func (m *ExpenseCategoryModel) Get(expenseCategoryId string) (*ExpenseCategory, error) {
-	stmt := `SELECT expenseCategoryId, userId, name, description, totalSum, 
+	stmt := `SELECT expenseCategoryId, userId, name, description, totalSum, version
 			FROM expensecategory WHERE expenseCategoryId = ?`
 
 	// This returns a pointer to a sql.Row object
@@ -50,7 +52,7 @@ func (m *ExpenseCategoryModel) Get(expenseCategoryId string) (*ExpenseCategory,
 	// Use row.Scan() to copy the values from each field in sql.Row to the
 	// corresponding field in the ExpenseCategory struct.
 	// The arguments to row.Scan are *pointers* to the place to copy the data into
-	err := row.Scan(&exp.ExpenseCategoryId, &exp.UserId, &exp.Name, &exp.Description, &exp.TotalSum)
+	err := row.Scan(&exp.ExpenseCategoryId, &exp.UserId, &exp.Name, &exp.Description, &exp.TotalSum, &exp.Version)
 	if err != nil {
 		// If the query returns no rows, then row.Scan() will return a
 		// sql.ErrNoRows error
@@ -66,7 +68,8 @@ func (m *ExpenseCategoryModel) Get(expenseCategoryId string) (*ExpenseCategory,
 
 // return all created ExpenseCategories
 func (m *ExpenseCategoryModel) All(userId string) ([]*ExpenseCategory, error) {
-	stmt := `SELECT * FROM expensecategory
+	stmt := `SELECT expenseCategoryId, userId, name, description, totalSum, version
+			FROM expensecategory
 			WHERE userId = ?`
 
 	// Use the Query() method on the connection pool to execute the stmt
@@ -95,7 +98,7 @@ func (m *ExpenseCategoryModel) All(userId string) ([]*ExpenseCategory, error) {
 		exp := &ExpenseCategory{}
 		// Use rows.Scan() to copy the values from each field in the row to
 		// the new ExpenseCategory object
-		err = rows.Scan(&exp.ExpenseCategoryId, &exp.UserId, &exp.Name, &exp.Description, &exp.TotalSum)
+		err = rows.Scan(&exp.ExpenseCategoryId, &exp.UserId, &exp.Name, &exp.Description, &exp.TotalSum, &exp.Version)
 		if err != nil {
 			return nil, err
 		}
@@ -115,7 +118,7 @@ func (m *ExpenseCategoryModel) All(userId string) ([]*ExpenseCategory, error) {
 
 // return all created ExpenseCategories
 func (m *ExpenseCategoryModel) AllExpensesPerCategory(categoryId string) ([]*Expense, error) {
-	stmt := `SELECT expenseId, userId, categoryId, description, expenseType, amountInCents, createdAt 
+	stmt := `SELECT expenseId, userId, categoryId, description, expenseType, amountInCents, version, createdAt 
 	 		FROM expenses WHERE categoryId = ?
 			ORDER BY createdAt DESC`
 
@@ -144,7 +147,7 @@ func (m *ExpenseCategoryModel) AllExpensesPerCategory(categoryId string) ([]*Exp
 		exp := &Expense{}
 		// Use rows.Scan() to copy the values from each field in the row to
 		// the new ExpenseCategory object
-		err = rows.Scan(&exp.ExpenseId, &exp.UserId, &exp.CategoryId, &exp.Description, &exp.ExpenseType, &exp.AmountInCents, &exp.CreatedAt)
+		err = rows.Scan(&exp.ExpenseId, &exp.UserId, &exp.CategoryId, &exp.Description, &exp.ExpenseType, &exp.AmountInCents, &exp.Version, &exp.CreatedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -166,7 +169,8 @@ func (m *ExpenseCategoryModel) AllExpensesPerCategory(categoryId string) ([]*Exp
 func (m *ExpenseCategoryModel) Put(userId, expenseCategoryId, name, description string) error {
 	stmt := `UPDATE expensecategory 
 			SET name = ?,
-			description = ? 
+			description = ?,
+			version = version + 1
 			WHERE expenseCategoryId = ? and
 			userId = ?`
 
@@ -181,6 +185,34 @@ func (m *ExpenseCategoryModel) Put(userId, expenseCategoryId, name, description
 	return nil
 }
 
+// update the name and description of an expense category only if it is
+// still at the given version, otherwise return ErrVersionConflict
+func (m *ExpenseCategoryModel) PutIfVersion(userId, expenseCategoryId string, version int, name, description string) error {
+	stmt := `UPDATE expensecategory 
+			SET name = ?,
+			description = ?,
+			version = version + 1
+			WHERE expenseCategoryId = ? and
+			userId = ? and
+			version = ?`
+
+	result, err := m.DB.Exec(stmt, name, description, expenseCategoryId, userId, version)
+	if err != nil {
+		log.Printf("Error while attempting ExpenseCategory update %s", err)
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrVersionConflict
+	}
+
+	return nil
+}
+
 // delete an expense category
 func (m *ExpenseCategoryModel) Delete(expenseCategoryId, userId string) error {
 	stmt := `DELETE FROM expensecategory WHERE expenseCategoryId = ? and userId = ?`
@@ -210,7 +242,8 @@ func (m *ExpenseCategoryModel) Delete(expenseCategoryId, userId string) error {
 
 func (m *ExpenseCategoryModel) PutTotalSum(userId, categoryId string, amount int64) error {
 	stmt := `UPDATE expensecategory 
-			SET totalSum = ? 
+			SET totalSum = ?,
+			version = version + 1
 			WHERE expenseCategoryId = ? and
 			userId = ?`
 
@@ -257,7 +290,8 @@ func (m *ExpenseCategoryModel) GetCategoryTotalSum(userId, expenseCategoryId str
 // Void all expense categories totalSums upon resetting user budget
 func (m *ExpenseCategoryModel) VoidAllTotalSums(userId string) error {
 	stmt := `UPDATE expensecategory 
-			SET totalSum = 0 
+			SET totalSum = 0,
+			version = version + 1
 			WHERE userId = ?`
 
 	// Execute the statement
@@ -0,0 +1,113 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// IdempotencyKeyTTL is how long a stored response is replayed for a key
+const IdempotencyKeyTTL = 24 * time.Hour
+
+// define IdempotencyRecord type, a ResponseStatus of 0 means the original
+// request is still being processed
+type IdempotencyRecord struct {
+	UserId         string
+	IdempotencyKey string
+	RequestHash    string
+	ResponseStatus int
+	ContentType    string
+	ETag           string
+	ResponseBody   []byte
+	CreatedAt      time.Time
+}
+
+// define IdempotencyModel type which wraps a sql.DB connection pool, or a
+// transaction
+type IdempotencyModel struct {
+	DB      DBTX
+	Dialect Dialect
+}
+
+// Reserve claims the key for the user before the request is processed.
+// Returns ErrDuplicateIdempotencyKey if the key was already used in the
+// last IdempotencyKeyTTL.
+func (m *IdempotencyModel) Reserve(userId, idempotencyKey, requestHash string) error {
+	// Forget an expired use of the key so that it can be claimed again
+	stmt := `DELETE FROM idempotency_keys
+			WHERE userId = ? AND idempotencyKey = ? AND createdAt < ?`
+	_, err := m.DB.Exec(stmt, userId, idempotencyKey, idempotencyCutoff())
+	if err != nil {
+		return err
+	}
+
+	stmt = `INSERT INTO idempotency_keys (userId, idempotencyKey, requestHash, responseStatus, createdAt)
+			VALUES (?, ?, ?, 0, ` + m.Dialect.Now() + `)`
+	_, err = m.DB.Exec(stmt, userId, idempotencyKey, requestHash)
+	if err != nil {
+		if m.Dialect.IsDuplicateKey(err, "") {
+			return ErrDuplicateIdempotencyKey
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Get returns the stored use of the key by the user
+func (m *IdempotencyModel) Get(userId, idempotencyKey string) (*IdempotencyRecord, error) {
+	stmt := `SELECT userId, idempotencyKey, requestHash, responseStatus, contentType, etag, responseBody, createdAt
+			FROM idempotency_keys WHERE userId = ? AND idempotencyKey = ?`
+
+	rec := &IdempotencyRecord{}
+	var contentType, etag sql.NullString
+	err := m.DB.QueryRow(stmt, userId, idempotencyKey).Scan(&rec.UserId, &rec.IdempotencyKey, &rec.RequestHash,
+		&rec.ResponseStatus, &contentType, &etag, &rec.ResponseBody, &rec.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+	rec.ContentType = contentType.String
+	rec.ETag = etag.String
+
+	return rec, nil
+}
+
+// Complete stores the response of the original request, so that retries
+// with the same key can replay it
+func (m *IdempotencyModel) Complete(userId, idempotencyKey string, status int, contentType, etag string, body []byte) error {
+	stmt := `UPDATE idempotency_keys SET responseStatus = ?, contentType = ?, etag = ?, responseBody = ?
+			WHERE userId = ? AND idempotencyKey = ?`
+
+	_, err := m.DB.Exec(stmt, status, contentType, etag, body, userId, idempotencyKey)
+	return err
+}
+
+// Release forgets the key, so that a request which failed without a
+// response worth replaying can be retried
+func (m *IdempotencyModel) Release(userId, idempotencyKey string) error {
+	stmt := `DELETE FROM idempotency_keys WHERE userId = ? AND idempotencyKey = ?`
+
+	_, err := m.DB.Exec(stmt, userId, idempotencyKey)
+	return err
+}
+
+// DeleteExpired removes every key older than IdempotencyKeyTTL
+func (m *IdempotencyModel) DeleteExpired() (int64, error) {
+	stmt := `DELETE FROM idempotency_keys WHERE createdAt < ?`
+
+	result, err := m.DB.Exec(stmt, idempotencyCutoff())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// idempotencyCutoff returns the time before which keys are expired. It is
+// computed here rather than in SQL, where date arithmetic differs between
+// the databases.
+func idempotencyCutoff() time.Time {
+	return time.Now().UTC().Add(-IdempotencyKeyTTL)
+}
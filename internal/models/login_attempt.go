@@ -0,0 +1,106 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// define LoginAttempt type, the failed logins counted against a key, a
+// client address or an account
+type LoginAttempt struct {
+	Key           string
+	Failures      int
+	LastFailureAt time.Time
+	// LockedUntil is set while logins of the key are refused
+	LockedUntil *time.Time
+}
+
+// define LoginAttemptModel type which wraps a sql.DB connection pool, or a
+// transaction
+type LoginAttemptModel struct {
+	DB      DBTX
+	Dialect Dialect
+}
+
+// Get returns the failed logins of the key, or ErrNoRecord if there are none
+func (m *LoginAttemptModel) Get(key string) (*LoginAttempt, error) {
+	a := &LoginAttempt{}
+	stmt := `SELECT attemptKey, failures, lastFailureAt, lockedUntil FROM login_attempts WHERE attemptKey = ?`
+	err := m.DB.QueryRow(stmt, key).Scan(&a.Key, &a.Failures, &a.LastFailureAt, &a.LockedUntil)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+	return a, nil
+}
+
+// RecordFailure counts a failed login against the key and returns the new
+// count. The count starts over when the last failure is older than window.
+func (m *LoginAttemptModel) RecordFailure(key string, window time.Duration) (*LoginAttempt, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+
+	// failures is assigned first: MySQL assigns from left to right, and
+	// must still see the previous lastFailureAt
+	stmt := `UPDATE login_attempts
+			SET failures = CASE WHEN lastFailureAt < ? THEN 1 ELSE failures + 1 END, lastFailureAt = ?
+			WHERE attemptKey = ?`
+	result, err := m.DB.Exec(stmt, now.Add(-window), now, key)
+	if err != nil {
+		return nil, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	if rowsAffected == 0 {
+		stmt := `INSERT INTO login_attempts (attemptKey, failures, lastFailureAt) VALUES (?, 1, ?)`
+		_, err = m.DB.Exec(stmt, key, now)
+		if err != nil {
+			if !m.Dialect.IsDuplicateKey(err, "") {
+				return nil, err
+			}
+			// A concurrent failure inserted the key first, count on top of it
+			_, err = m.DB.Exec(`UPDATE login_attempts SET failures = failures + 1, lastFailureAt = ? WHERE attemptKey = ?`, now, key)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return m.Get(key)
+}
+
+// ForgetFailure takes back one failure counted against the key, for a login
+// counted before it was checked which turned out not to fail
+func (m *LoginAttemptModel) ForgetFailure(key string) error {
+	_, err := m.DB.Exec(`UPDATE login_attempts SET failures = failures - 1 WHERE attemptKey = ? AND failures > 0`, key)
+	return err
+}
+
+// Lock refuses the logins of the key until the given time
+func (m *LoginAttemptModel) Lock(key string, until time.Time) error {
+	_, err := m.DB.Exec(`UPDATE login_attempts SET lockedUntil = ? WHERE attemptKey = ?`, until.UTC(), key)
+	return err
+}
+
+// Reset forgets the failed logins of the key
+func (m *LoginAttemptModel) Reset(key string) error {
+	_, err := m.DB.Exec(`DELETE FROM login_attempts WHERE attemptKey = ?`, key)
+	return err
+}
+
+// DeleteStale removes the keys whose last failure is older than the given
+// time and which are not locked, and returns how many it removed
+func (m *LoginAttemptModel) DeleteStale(before time.Time) (int64, error) {
+	stmt := `DELETE FROM login_attempts
+			WHERE lastFailureAt < ? AND (lockedUntil IS NULL OR lockedUntil < ?)`
+	result, err := m.DB.Exec(stmt, before.UTC(), time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,122 @@
+package memory
+
+import (
+	"slices"
+	"time"
+
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
+
+type apiTokenRepository struct {
+	s    *Store
+	inTx bool
+}
+
+func (r *apiTokenRepository) Insert(tokenId, userId, name, prefix, tokenHash string, scopes []string, expiresAt time.Time) error {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	if _, ok := d.users[userId]; !ok {
+		return ErrForeignKey
+	}
+	if _, ok := d.apiTokens[tokenId]; ok {
+		return ErrDuplicateKey
+	}
+	for _, t := range d.apiTokens {
+		if t.value.tokenHash == tokenHash {
+			return ErrDuplicateKey
+		}
+	}
+
+	t := models.APIToken{
+		TokenId:   tokenId,
+		UserId:    userId,
+		Name:      name,
+		Prefix:    prefix,
+		ExpiresAt: expiresAt.UTC().Truncate(time.Second),
+		CreatedAt: r.s.now(),
+	}
+	// An empty list is stored as no list, like the scopes column
+	if len(scopes) > 0 {
+		t.Scopes = slices.Clone(scopes)
+	}
+	d.apiTokens[tokenId] = &row[apiToken]{value: apiToken{APIToken: t, tokenHash: tokenHash}, seq: d.next()}
+	return nil
+}
+
+// All returns the tokens of the user in the order they were created
+func (r *apiTokenRepository) All(userId string) ([]*models.APIToken, error) {
+	defer r.s.lock(r.inTx)()
+
+	tokens := []*models.APIToken{}
+	for _, t := range sortedRows(r.s.data.apiTokens, func(t *apiToken) bool { return t.UserId == userId }) {
+		tokens = append(tokens, copyAPIToken(t.value.APIToken))
+	}
+	return tokens, nil
+}
+
+func (r *apiTokenRepository) GetByHash(tokenHash string) (*models.APIToken, error) {
+	defer r.s.lock(r.inTx)()
+
+	now := r.s.Now()
+	for _, t := range r.s.data.apiTokens {
+		if t.value.tokenHash == tokenHash && t.value.ExpiresAt.After(now) {
+			return copyAPIToken(t.value.APIToken), nil
+		}
+	}
+	return nil, models.ErrNoRecord
+}
+
+func (r *apiTokenRepository) Touch(tokenId string) error {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	existing, ok := d.apiTokens[tokenId]
+	if !ok {
+		return nil
+	}
+	now := r.s.now()
+	if existing.value.LastUsedAt != nil && !existing.value.LastUsedAt.Before(now.Add(-models.APITokenTouchInterval)) {
+		return nil
+	}
+	t := existing.value
+	t.LastUsedAt = &now
+	d.apiTokens[tokenId] = &row[apiToken]{value: t, seq: existing.seq}
+	return nil
+}
+
+func (r *apiTokenRepository) Delete(tokenId, userId string) error {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	t, ok := d.apiTokens[tokenId]
+	if !ok || t.value.UserId != userId {
+		return models.ErrNoRecord
+	}
+	delete(d.apiTokens, tokenId)
+	return nil
+}
+
+func (r *apiTokenRepository) DeleteExpired(before time.Time) (int64, error) {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	var n int64
+	for tokenId, t := range d.apiTokens {
+		if t.value.ExpiresAt.Before(before) {
+			delete(d.apiTokens, tokenId)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// copyAPIToken copies the token, scopes and last use included
+func copyAPIToken(t models.APIToken) *models.APIToken {
+	t.Scopes = slices.Clone(t.Scopes)
+	if t.LastUsedAt != nil {
+		lastUsedAt := *t.LastUsedAt
+		t.LastUsedAt = &lastUsedAt
+	}
+	return &t
+}
@@ -0,0 +1,68 @@
+package memory
+
+import (
+	"slices"
+	"time"
+
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
+
+type auditRepository struct {
+	s    *Store
+	inTx bool
+}
+
+func (r *auditRepository) Insert(entry *models.AuditEntry) error {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	d.auditSeq++
+	stored := *entry
+	stored.AuditId = d.auditSeq
+	stored.Before = slices.Clone(entry.Before)
+	stored.After = slices.Clone(entry.After)
+	stored.CreatedAt = r.s.now()
+	d.auditLog = append(d.auditLog, stored)
+	return nil
+}
+
+// List returns the entries about the data of the user that match the
+// filter, newest first
+func (r *auditRepository) List(userId string, filter models.AuditFilter) ([]*models.AuditEntry, error) {
+	defer r.s.lock(r.inTx)()
+	log := r.s.data.auditLog
+
+	entries := []*models.AuditEntry{}
+	for i := len(log) - 1; i >= 0 && len(entries) < filter.Limit; i-- {
+		e := log[i]
+		switch {
+		case e.UserId != userId,
+			filter.Action != "" && e.Action != filter.Action,
+			filter.EntityType != "" && e.EntityType != filter.EntityType,
+			filter.EntityId != "" && e.EntityId != filter.EntityId,
+			!filter.From.IsZero() && e.CreatedAt.Before(filter.From),
+			!filter.To.IsZero() && !e.CreatedAt.Before(filter.To),
+			filter.BeforeId > 0 && e.AuditId >= filter.BeforeId:
+			continue
+		}
+		e.Before = slices.Clone(e.Before)
+		e.After = slices.Clone(e.After)
+		entries = append(entries, &e)
+	}
+	return entries, nil
+}
+
+func (r *auditRepository) DeleteOlderThan(cutoff time.Time) (int64, error) {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	kept := d.auditLog[:0:0]
+	for _, e := range d.auditLog {
+		if !e.CreatedAt.Before(cutoff) {
+			kept = append(kept, e)
+		}
+	}
+	n := int64(len(d.auditLog) - len(kept))
+	d.auditLog = kept
+	return n, nil
+}
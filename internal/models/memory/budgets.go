@@ -0,0 +1,112 @@
+package memory
+
+import (
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
+
+type budgetRepository struct {
+	s    *Store
+	inTx bool
+}
+
+func (r *budgetRepository) Insert(budgetId, userId string, checkingBalance, savingsBalance, budgetTotal int64) (string, error) {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	if _, ok := d.budgets[budgetId]; ok {
+		return "", ErrDuplicateKey
+	}
+	if _, ok := d.users[userId]; !ok {
+		return "", ErrForeignKey
+	}
+
+	now := r.s.now()
+	d.budgets[budgetId] = &row[models.Budget]{
+		value: models.Budget{
+			BudgetId:        budgetId,
+			UserId:          userId,
+			CheckingBalance: checkingBalance,
+			SavingsBalance:  savingsBalance,
+			BudgetTotal:     budgetTotal,
+			BudgetRemaining: budgetTotal,
+			TotalSpent:      0,
+			Version:         1,
+			UpdatedAt:       now,
+			CreatedAt:       now,
+		},
+		seq: d.next(),
+	}
+	return budgetId, nil
+}
+
+func (r *budgetRepository) Get(budgetId string) (*models.Budget, error) {
+	defer r.s.lock(r.inTx)()
+
+	b, ok := r.s.data.budgets[budgetId]
+	if !ok {
+		return nil, models.ErrNoRecord
+	}
+	budget := b.value
+	return &budget, nil
+}
+
+// All returns every budget, newest first
+func (r *budgetRepository) Put(budgetId, userId string, checkingBalance, savingsBalance, budgetTotal, budgetRemaining, totalSpent int64) error {
+	defer r.s.lock(r.inTx)()
+
+	b, ok := r.s.data.budgets[budgetId]
+	if !ok || b.value.UserId != userId {
+		return nil
+	}
+	r.put(&b.value, checkingBalance, savingsBalance, budgetTotal, budgetRemaining, totalSpent)
+	return nil
+}
+
+func (r *budgetRepository) PutIfVersion(budgetId, userId string, version int, checkingBalance, savingsBalance, budgetTotal, budgetRemaining, totalSpent int64) error {
+	defer r.s.lock(r.inTx)()
+
+	b, ok := r.s.data.budgets[budgetId]
+	if !ok || b.value.UserId != userId || b.value.Version != version {
+		return models.ErrVersionConflict
+	}
+	r.put(&b.value, checkingBalance, savingsBalance, budgetTotal, budgetRemaining, totalSpent)
+	return nil
+}
+
+func (r *budgetRepository) put(b *models.Budget, checkingBalance, savingsBalance, budgetTotal, budgetRemaining, totalSpent int64) {
+	b.CheckingBalance = checkingBalance
+	b.SavingsBalance = savingsBalance
+	b.BudgetTotal = budgetTotal
+	b.BudgetRemaining = budgetRemaining
+	b.TotalSpent = totalSpent
+	b.Version++
+	b.UpdatedAt = r.s.now()
+}
+
+func (r *budgetRepository) Delete(budgetId, userId string) error {
+	defer r.s.lock(r.inTx)()
+
+	b, ok := r.s.data.budgets[budgetId]
+	if !ok || b.value.UserId != userId {
+		return models.ErrNoRecord
+	}
+	delete(r.s.data.budgets, budgetId)
+	return nil
+}
+
+func (r *budgetRepository) GetBudgetByUserId(userId string) (*models.Budget, error) {
+	defer r.s.lock(r.inTx)()
+
+	rows := sortedRows(r.s.data.budgets, func(b *models.Budget) bool { return b.UserId == userId })
+	if len(rows) == 0 {
+		return nil, models.ErrNoRecord
+	}
+	budget := rows[0].value
+	return &budget, nil
+}
+
+// The store is locked for the whole of a transaction, so reading the budget
+// is enough to keep others from changing it
+func (r *budgetRepository) GetBudgetByUserIdForUpdate(userId string) (*models.Budget, error) {
+	return r.GetBudgetByUserId(userId)
+}
@@ -0,0 +1,143 @@
+package memory
+
+import (
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
+
+type expenseCategoryRepository struct {
+	s    *Store
+	inTx bool
+}
+
+func (r *expenseCategoryRepository) Insert(expenseCategoryId, userId, name, description string, totalSum int64) (string, error) {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	if _, ok := d.categories[expenseCategoryId]; ok {
+		return "", ErrDuplicateKey
+	}
+	if _, ok := d.users[userId]; !ok {
+		return "", ErrForeignKey
+	}
+
+	d.categories[expenseCategoryId] = &row[models.ExpenseCategory]{
+		value: models.ExpenseCategory{
+			ExpenseCategoryId: expenseCategoryId,
+			UserId:            userId,
+			Name:              name,
+			Description:       description,
+			TotalSum:          totalSum,
+			Version:           1,
+		},
+		seq: d.next(),
+	}
+	return expenseCategoryId, nil
+}
+
+func (r *expenseCategoryRepository) Get(expenseCategoryId string) (*models.ExpenseCategory, error) {
+	defer r.s.lock(r.inTx)()
+
+	c, ok := r.s.data.categories[expenseCategoryId]
+	if !ok {
+		return nil, models.ErrNoRecord
+	}
+	cat := c.value
+	return &cat, nil
+}
+
+// All returns the categories of the user in the order they were created
+func (r *expenseCategoryRepository) All(userId string) ([]*models.ExpenseCategory, error) {
+	defer r.s.lock(r.inTx)()
+
+	cats := []*models.ExpenseCategory{}
+	for _, c := range sortedRows(r.s.data.categories, func(c *models.ExpenseCategory) bool { return c.UserId == userId }) {
+		cat := c.value
+		cats = append(cats, &cat)
+	}
+	return cats, nil
+}
+
+// AllExpensesPerCategory returns the expenses of the category, newest first
+func (r *expenseCategoryRepository) AllExpensesPerCategory(categoryId string) ([]*models.Expense, error) {
+	defer r.s.lock(r.inTx)()
+
+	return newestExpenses(r.s.data, func(e *models.Expense) bool { return e.CategoryId == categoryId }), nil
+}
+
+func (r *expenseCategoryRepository) Put(userId, expenseCategoryId, name, description string) error {
+	defer r.s.lock(r.inTx)()
+
+	c, ok := r.s.data.categories[expenseCategoryId]
+	if !ok || c.value.UserId != userId {
+		return nil
+	}
+	c.value.Name = name
+	c.value.Description = description
+	c.value.Version++
+	return nil
+}
+
+func (r *expenseCategoryRepository) PutIfVersion(userId, expenseCategoryId string, version int, name, description string) error {
+	defer r.s.lock(r.inTx)()
+
+	c, ok := r.s.data.categories[expenseCategoryId]
+	if !ok || c.value.UserId != userId || c.value.Version != version {
+		return models.ErrVersionConflict
+	}
+	c.value.Name = name
+	c.value.Description = description
+	c.value.Version++
+	return nil
+}
+
+// Delete removes the category, its expenses are kept without a category
+func (r *expenseCategoryRepository) Delete(expenseCategoryId, userId string) error {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	c, ok := d.categories[expenseCategoryId]
+	if !ok || c.value.UserId != userId {
+		return nil
+	}
+	delete(d.categories, expenseCategoryId)
+	for _, e := range d.expenses {
+		if e.value.CategoryId == expenseCategoryId {
+			e.value.CategoryId = ""
+		}
+	}
+	return nil
+}
+
+func (r *expenseCategoryRepository) PutTotalSum(userId, categoryId string, amount int64) error {
+	defer r.s.lock(r.inTx)()
+
+	c, ok := r.s.data.categories[categoryId]
+	if !ok || c.value.UserId != userId {
+		return nil
+	}
+	c.value.TotalSum = amount
+	c.value.Version++
+	return nil
+}
+
+func (r *expenseCategoryRepository) GetCategoryTotalSum(userId, expenseCategoryId string) (int64, error) {
+	defer r.s.lock(r.inTx)()
+
+	c, ok := r.s.data.categories[expenseCategoryId]
+	if !ok || c.value.UserId != userId {
+		return 0, models.ErrNoRecord
+	}
+	return c.value.TotalSum, nil
+}
+
+func (r *expenseCategoryRepository) VoidAllTotalSums(userId string) error {
+	defer r.s.lock(r.inTx)()
+
+	for _, c := range r.s.data.categories {
+		if c.value.UserId == userId {
+			c.value.TotalSum = 0
+			c.value.Version++
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package memory
+
+import (
+	"time"
+
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
+
+type emailVerificationRepository struct {
+	s    *Store
+	inTx bool
+}
+
+func (r *emailVerificationRepository) Insert(tokenHash, userId string, expiresAt time.Time) error {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	if _, ok := d.users[userId]; !ok {
+		return ErrForeignKey
+	}
+	if _, ok := d.verifications[tokenHash]; ok {
+		return ErrDuplicateKey
+	}
+	d.verifications[tokenHash] = &row[emailVerification]{
+		value: emailVerification{
+			userId:    userId,
+			expiresAt: expiresAt.UTC().Truncate(time.Second),
+			createdAt: r.s.now(),
+		},
+		seq: d.next(),
+	}
+	return nil
+}
+
+func (r *emailVerificationRepository) Consume(tokenHash string) (string, error) {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	verification, ok := d.verifications[tokenHash]
+	if !ok || !verification.value.expiresAt.After(r.s.Now()) {
+		return "", models.ErrInvalidVerificationToken
+	}
+
+	userId := verification.value.userId
+	for hash, other := range d.verifications {
+		if other.value.userId == userId {
+			delete(d.verifications, hash)
+		}
+	}
+	return userId, nil
+}
+
+func (r *emailVerificationRepository) CountSince(userId string, since time.Time) (int, error) {
+	defer r.s.lock(r.inTx)()
+
+	n := 0
+	for _, verification := range r.s.data.verifications {
+		if verification.value.userId == userId && !verification.value.createdAt.Before(since) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (r *emailVerificationRepository) DeleteAll(userId string) error {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	for hash, verification := range d.verifications {
+		if verification.value.userId == userId {
+			delete(d.verifications, hash)
+		}
+	}
+	return nil
+}
+
+func (r *emailVerificationRepository) DeleteExpired() (int64, error) {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	var n int64
+	now := r.s.Now()
+	for hash, verification := range d.verifications {
+		if !verification.value.expiresAt.After(now) {
+			delete(d.verifications, hash)
+			n++
+		}
+	}
+	return n, nil
+}
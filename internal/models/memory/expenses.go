@@ -0,0 +1,202 @@
+package memory
+
+import (
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
+
+type expenseRepository struct {
+	s    *Store
+	inTx bool
+}
+
+func (r *expenseRepository) Insert(expenseId, userId, categoryId, description, expenseType string, amountInCents int64) (string, error) {
+	defer r.s.lock(r.inTx)()
+
+	err := r.insert(expenseId, userId, categoryId, description, expenseType, amountInCents)
+	if err != nil {
+		return "", err
+	}
+	return expenseId, nil
+}
+
+func (r *expenseRepository) insert(expenseId, userId, categoryId, description, expenseType string, amountInCents int64) error {
+	d := r.s.data
+
+	if _, ok := d.expenses[expenseId]; ok {
+		return ErrDuplicateKey
+	}
+	if _, ok := d.users[userId]; !ok {
+		return ErrForeignKey
+	}
+	if _, ok := d.categories[categoryId]; categoryId != "" && !ok {
+		return ErrForeignKey
+	}
+
+	d.expenses[expenseId] = &row[models.Expense]{
+		value: models.Expense{
+			ExpenseId:     expenseId,
+			UserId:        userId,
+			CategoryId:    categoryId,
+			Description:   description,
+			ExpenseType:   expenseType,
+			AmountInCents: amountInCents,
+			Version:       1,
+			CreatedAt:     r.s.now(),
+		},
+		seq: d.next(),
+	}
+	return nil
+}
+
+func (r *expenseRepository) Get(expenseId string) (*models.Expense, error) {
+	defer r.s.lock(r.inTx)()
+
+	e, ok := r.s.data.expenses[expenseId]
+	if !ok {
+		return nil, models.ErrNoRecord
+	}
+	exp := e.value
+	return &exp, nil
+}
+
+// All returns the expenses of the user, newest first
+func (r *expenseRepository) All(userId string) ([]*models.Expense, error) {
+	defer r.s.lock(r.inTx)()
+
+	return newestExpenses(r.s.data, func(e *models.Expense) bool { return e.UserId == userId }), nil
+}
+
+func (r *expenseRepository) Put(expenseId, userId, categoryId, description, expenseType string, amountInCents int64) error {
+	defer r.s.lock(r.inTx)()
+
+	e, ok := r.s.data.expenses[expenseId]
+	if !ok || e.value.UserId != userId {
+		return nil
+	}
+	return r.put(&e.value, categoryId, description, expenseType, amountInCents)
+}
+
+func (r *expenseRepository) PutIfVersion(expenseId, userId string, version int, categoryId, description, expenseType string, amountInCents int64) error {
+	defer r.s.lock(r.inTx)()
+
+	e, ok := r.s.data.expenses[expenseId]
+	if !ok || e.value.UserId != userId || e.value.Version != version {
+		return models.ErrVersionConflict
+	}
+	return r.put(&e.value, categoryId, description, expenseType, amountInCents)
+}
+
+func (r *expenseRepository) put(e *models.Expense, categoryId, description, expenseType string, amountInCents int64) error {
+	if _, ok := r.s.data.categories[categoryId]; categoryId != "" && !ok {
+		return ErrForeignKey
+	}
+	e.CategoryId = categoryId
+	e.Description = description
+	e.ExpenseType = expenseType
+	e.AmountInCents = amountInCents
+	e.Version++
+	return nil
+}
+
+func (r *expenseRepository) Delete(expenseId, userId string) error {
+	defer r.s.lock(r.inTx)()
+
+	if e, ok := r.s.data.expenses[expenseId]; ok && e.value.UserId == userId {
+		delete(r.s.data.expenses, expenseId)
+	}
+	return nil
+}
+
+func (r *expenseRepository) DeleteAll(userId string) error {
+	defer r.s.lock(r.inTx)()
+
+	for expenseId, e := range r.s.data.expenses {
+		if e.value.UserId == userId {
+			delete(r.s.data.expenses, expenseId)
+		}
+	}
+	return nil
+}
+
+func (r *expenseRepository) DeleteAllByCategory(userId, expenseCategoryId string) error {
+	defer r.s.lock(r.inTx)()
+
+	for expenseId, e := range r.s.data.expenses {
+		if e.value.UserId == userId && e.value.CategoryId == expenseCategoryId {
+			delete(r.s.data.expenses, expenseId)
+		}
+	}
+	return nil
+}
+
+// ApplyBatch writes every change of the batch, or none of them if an
+// expense or the budget was modified since it was read
+func (r *expenseRepository) ApplyBatch(batch *models.ExpenseBatch) error {
+	defer r.s.lock(r.inTx)()
+
+	if r.inTx {
+		return r.applyBatch(batch)
+	}
+	return r.s.atomically(func() error {
+		return r.applyBatch(batch)
+	})
+}
+
+func (r *expenseRepository) applyBatch(batch *models.ExpenseBatch) error {
+	d := r.s.data
+
+	for _, exp := range batch.Created {
+		err := r.insert(exp.ExpenseId, batch.UserId, exp.CategoryId, exp.Description, exp.ExpenseType, exp.AmountInCents)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, exp := range batch.Updated {
+		e, ok := d.expenses[exp.ExpenseId]
+		if !ok || e.value.UserId != batch.UserId || e.value.Version != exp.Version {
+			return models.ErrVersionConflict
+		}
+		err := r.put(&e.value, exp.CategoryId, exp.Description, exp.ExpenseType, exp.AmountInCents)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, exp := range batch.Deleted {
+		e, ok := d.expenses[exp.ExpenseId]
+		if !ok || e.value.UserId != batch.UserId || e.value.Version != exp.Version {
+			return models.ErrVersionConflict
+		}
+		delete(d.expenses, exp.ExpenseId)
+	}
+
+	if b := batch.Budget; b != nil {
+		stored, ok := d.budgets[b.BudgetId]
+		if !ok || stored.value.UserId != batch.UserId || stored.value.Version != b.Version {
+			return models.ErrVersionConflict
+		}
+		budgets := &budgetRepository{s: r.s, inTx: true}
+		budgets.put(&stored.value, b.CheckingBalance, b.SavingsBalance, b.BudgetTotal, b.BudgetRemaining, b.TotalSpent)
+	}
+
+	for categoryId, delta := range batch.CategoryDeltas {
+		if c, ok := d.categories[categoryId]; ok && c.value.UserId == batch.UserId {
+			c.value.TotalSum = max(c.value.TotalSum+delta, 0)
+			c.value.Version++
+		}
+	}
+
+	return nil
+}
+
+// newestExpenses returns copies of the expenses that match, newest first
+func newestExpenses(d *data, match func(*models.Expense) bool) []*models.Expense {
+	rows := sortedRows(d.expenses, match)
+	exps := []*models.Expense{}
+	for i := len(rows) - 1; i >= 0; i-- {
+		exp := rows[i].value
+		exps = append(exps, &exp)
+	}
+	return exps
+}
@@ -0,0 +1,104 @@
+package memory_test
+
+import (
+	"errors"
+	"testing"
+
+	"kweeuhree.personal-budgeting-backend/internal/models"
+	"kweeuhree.personal-budgeting-backend/internal/models/memory"
+)
+
+// newUserWithCategories returns the repositories of a new store holding a
+// user with the given expense categories
+func newUserWithCategories(t *testing.T, userId string, categoryIds ...string) *models.Repositories {
+	t.Helper()
+
+	repos := memory.NewStore().Repositories()
+	err := repos.Users.Insert(userId, userId+"@example.com", "Test User", "pa$$word123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range categoryIds {
+		_, err = repos.ExpenseCategories.Insert(id, userId, id, "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return repos
+}
+
+func TestApplyBatchCategoryDeltas(t *testing.T) {
+	const userId = "user-1"
+	repos := newUserWithCategories(t, userId, "food", "rent")
+
+	if err := repos.ExpenseCategories.PutTotalSum(userId, "food", 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := repos.ExpenseCategories.PutTotalSum(userId, "rent", 300); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another request adds to the food total after the batch was planned
+	if err := repos.ExpenseCategories.PutTotalSum(userId, "food", 1500); err != nil {
+		t.Fatal(err)
+	}
+
+	err := repos.Expenses.ApplyBatch(&models.ExpenseBatch{
+		UserId: userId,
+		Created: []*models.Expense{
+			{ExpenseId: "e1", CategoryId: "food", ExpenseType: "checkingBalance", AmountInCents: 250},
+		},
+		CategoryDeltas: map[string]int64{"food": 250, "rent": -500},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		categoryId string
+		want       int64
+	}{
+		{"food", 1750},
+		// a total never goes below zero
+		{"rent", 0},
+	}
+	for _, tt := range tests {
+		got, err := repos.ExpenseCategories.GetCategoryTotalSum(userId, tt.categoryId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("total of %s: got %d; want %d", tt.categoryId, got, tt.want)
+		}
+	}
+}
+
+func TestApplyBatchConflict(t *testing.T) {
+	const userId = "user-1"
+	repos := newUserWithCategories(t, userId, "food")
+
+	if _, err := repos.Expenses.Insert("e1", userId, "food", "", "checkingBalance", 100); err != nil {
+		t.Fatal(err)
+	}
+
+	// The expense is at version 1, so the batch was planned on a stale copy
+	err := repos.Expenses.ApplyBatch(&models.ExpenseBatch{
+		UserId:         userId,
+		Deleted:        []*models.Expense{{ExpenseId: "e1", Version: 2}},
+		CategoryDeltas: map[string]int64{"food": -100},
+	})
+	if !errors.Is(err, models.ErrVersionConflict) {
+		t.Fatalf("got error %v; want %v", err, models.ErrVersionConflict)
+	}
+
+	if _, err := repos.Expenses.Get("e1"); err != nil {
+		t.Errorf("expense of the refused batch: %v", err)
+	}
+	total, err := repos.ExpenseCategories.GetCategoryTotalSum(userId, "food")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 0 {
+		t.Errorf("total of the refused batch: got %d; want 0", total)
+	}
+}
@@ -0,0 +1,82 @@
+package memory
+
+import (
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
+
+type idempotencyRepository struct {
+	s    *Store
+	inTx bool
+}
+
+func (r *idempotencyRepository) Reserve(userId, key, requestHash string) error {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	id := idempotencyKey{userId: userId, key: key}
+	now := r.s.now()
+	if rec, ok := d.idempotencyKeys[id]; ok {
+		// Forget an expired use of the key so that it can be claimed again
+		if !rec.value.CreatedAt.Before(now.Add(-models.IdempotencyKeyTTL)) {
+			return models.ErrDuplicateIdempotencyKey
+		}
+	}
+
+	d.idempotencyKeys[id] = &row[models.IdempotencyRecord]{
+		value: models.IdempotencyRecord{
+			UserId:         userId,
+			IdempotencyKey: key,
+			RequestHash:    requestHash,
+			CreatedAt:      now,
+		},
+		seq: d.next(),
+	}
+	return nil
+}
+
+func (r *idempotencyRepository) Get(userId, key string) (*models.IdempotencyRecord, error) {
+	defer r.s.lock(r.inTx)()
+
+	rec, ok := r.s.data.idempotencyKeys[idempotencyKey{userId: userId, key: key}]
+	if !ok {
+		return nil, models.ErrNoRecord
+	}
+	copied := rec.value
+	copied.ResponseBody = append([]byte(nil), rec.value.ResponseBody...)
+	return &copied, nil
+}
+
+func (r *idempotencyRepository) Complete(userId, key string, status int, contentType, etag string, body []byte) error {
+	defer r.s.lock(r.inTx)()
+
+	rec, ok := r.s.data.idempotencyKeys[idempotencyKey{userId: userId, key: key}]
+	if !ok {
+		return nil
+	}
+	rec.value.ResponseStatus = status
+	rec.value.ContentType = contentType
+	rec.value.ETag = etag
+	rec.value.ResponseBody = append([]byte(nil), body...)
+	return nil
+}
+
+func (r *idempotencyRepository) Release(userId, key string) error {
+	defer r.s.lock(r.inTx)()
+
+	delete(r.s.data.idempotencyKeys, idempotencyKey{userId: userId, key: key})
+	return nil
+}
+
+func (r *idempotencyRepository) DeleteExpired() (int64, error) {
+	defer r.s.lock(r.inTx)()
+
+	cutoff := r.s.now().Add(-models.IdempotencyKeyTTL)
+	var n int64
+	for id, rec := range r.s.data.idempotencyKeys {
+		if rec.value.CreatedAt.Before(cutoff) {
+			delete(r.s.data.idempotencyKeys, id)
+			n++
+		}
+	}
+	return n, nil
+}
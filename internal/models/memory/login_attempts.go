@@ -0,0 +1,100 @@
+package memory
+
+import (
+	"time"
+
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
+
+type loginAttemptRepository struct {
+	s    *Store
+	inTx bool
+}
+
+func (r *loginAttemptRepository) Get(key string) (*models.LoginAttempt, error) {
+	defer r.s.lock(r.inTx)()
+
+	a, ok := r.s.data.loginAttempts[key]
+	if !ok {
+		return nil, models.ErrNoRecord
+	}
+	return copyLoginAttempt(a.value), nil
+}
+
+func (r *loginAttemptRepository) RecordFailure(key string, window time.Duration) (*models.LoginAttempt, error) {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	now := r.s.now()
+	a := models.LoginAttempt{Key: key, Failures: 1, LastFailureAt: now}
+	seq := d.next()
+	if existing, ok := d.loginAttempts[key]; ok {
+		a.LockedUntil = existing.value.LockedUntil
+		if !existing.value.LastFailureAt.Before(now.Add(-window)) {
+			a.Failures = existing.value.Failures + 1
+		}
+		seq = existing.seq
+	}
+	d.loginAttempts[key] = &row[models.LoginAttempt]{value: a, seq: seq}
+	return copyLoginAttempt(a), nil
+}
+
+func (r *loginAttemptRepository) ForgetFailure(key string) error {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	existing, ok := d.loginAttempts[key]
+	if !ok || existing.value.Failures == 0 {
+		return nil
+	}
+	a := existing.value
+	a.Failures--
+	d.loginAttempts[key] = &row[models.LoginAttempt]{value: a, seq: existing.seq}
+	return nil
+}
+
+func (r *loginAttemptRepository) Lock(key string, until time.Time) error {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	existing, ok := d.loginAttempts[key]
+	if !ok {
+		return nil
+	}
+	a := existing.value
+	lockedUntil := until.UTC().Truncate(time.Second)
+	a.LockedUntil = &lockedUntil
+	d.loginAttempts[key] = &row[models.LoginAttempt]{value: a, seq: existing.seq}
+	return nil
+}
+
+func (r *loginAttemptRepository) Reset(key string) error {
+	defer r.s.lock(r.inTx)()
+
+	delete(r.s.data.loginAttempts, key)
+	return nil
+}
+
+func (r *loginAttemptRepository) DeleteStale(before time.Time) (int64, error) {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	var n int64
+	now := r.s.Now()
+	for key, a := range d.loginAttempts {
+		if a.value.LastFailureAt.Before(before) && (a.value.LockedUntil == nil || a.value.LockedUntil.Before(now)) {
+			delete(d.loginAttempts, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// copyLoginAttempt copies the attempt, lock time included
+func copyLoginAttempt(a models.LoginAttempt) *models.LoginAttempt {
+	if a.LockedUntil != nil {
+		lockedUntil := *a.LockedUntil
+		a.LockedUntil = &lockedUntil
+	}
+	return &a
+}
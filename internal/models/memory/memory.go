@@ -0,0 +1,239 @@
+// Package memory is a thread-safe, in-memory implementation of the
+// repositories of the models package. It behaves like the MySQL models,
+// returning the same errors, so that the handlers can run without a
+// database, in tests or in demos.
+//
+// A transaction holds the lock of the store until it ends, and is rolled
+// back by restoring a copy of the data taken when it began. Calling the
+// repositories of Repositories() from inside InTx blocks forever; use the
+// repositories passed to fn instead.
+package memory
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
+
+// bcryptCost is the cost of the password hashes of the store, the lowest one
+// since the store is not meant to keep real passwords
+const bcryptCost = 4
+
+// row is a stored record with the sequence number of its insertion, used to
+// order records created within the same second
+type row[T any] struct {
+	value T
+	seq   int64
+}
+
+type idempotencyKey struct {
+	userId string
+	key    string
+}
+
+type passwordReset struct {
+	userId    string
+	expiresAt time.Time
+}
+
+type recoveryCodeKey struct {
+	userId   string
+	codeHash string
+}
+
+type recoveryCode struct {
+	used bool
+}
+
+// apiToken is a token with the hash it is looked up by
+type apiToken struct {
+	models.APIToken
+	tokenHash string
+}
+
+type identityKey struct {
+	provider string
+	subject  string
+}
+
+type emailVerification struct {
+	userId    string
+	expiresAt time.Time
+	createdAt time.Time
+}
+
+// data holds every table of the store. Records are copied on the way in and
+// out, so the values in the maps are never shared with callers.
+type data struct {
+	seq             int64
+	users           map[string]*row[models.User]
+	budgets         map[string]*row[models.Budget]
+	expenses        map[string]*row[models.Expense]
+	categories      map[string]*row[models.ExpenseCategory]
+	idempotencyKeys map[idempotencyKey]*row[models.IdempotencyRecord]
+	webhooks        map[string]*row[models.Webhook]
+	deliveries      map[string]*row[models.WebhookDelivery]
+	auditLog        []models.AuditEntry
+	auditSeq        int64
+	passwordResets  map[string]*row[passwordReset]
+	verifications   map[string]*row[emailVerification]
+	twoFactor       map[string]*row[models.TwoFactor]
+	recoveryCodes   map[recoveryCodeKey]*row[recoveryCode]
+	loginAttempts   map[string]*row[models.LoginAttempt]
+	apiTokens       map[string]*row[apiToken]
+	identities      map[identityKey]*row[models.UserIdentity]
+	userSessions    map[string]*row[models.UserSession]
+}
+
+func newData() *data {
+	return &data{
+		users:           map[string]*row[models.User]{},
+		budgets:         map[string]*row[models.Budget]{},
+		expenses:        map[string]*row[models.Expense]{},
+		categories:      map[string]*row[models.ExpenseCategory]{},
+		idempotencyKeys: map[idempotencyKey]*row[models.IdempotencyRecord]{},
+		webhooks:        map[string]*row[models.Webhook]{},
+		deliveries:      map[string]*row[models.WebhookDelivery]{},
+		passwordResets:  map[string]*row[passwordReset]{},
+		verifications:   map[string]*row[emailVerification]{},
+		twoFactor:       map[string]*row[models.TwoFactor]{},
+		recoveryCodes:   map[recoveryCodeKey]*row[recoveryCode]{},
+		loginAttempts:   map[string]*row[models.LoginAttempt]{},
+		apiTokens:       map[string]*row[apiToken]{},
+		identities:      map[identityKey]*row[models.UserIdentity]{},
+		userSessions:    map[string]*row[models.UserSession]{},
+	}
+}
+
+// next returns the sequence number of a new record
+func (d *data) next() int64 {
+	d.seq++
+	return d.seq
+}
+
+// clone copies the tables. The records themselves are only ever replaced,
+// never changed in place, so copying the rows is enough.
+func (d *data) clone() *data {
+	c := &data{
+		seq:             d.seq,
+		users:           cloneRows(d.users),
+		budgets:         cloneRows(d.budgets),
+		expenses:        cloneRows(d.expenses),
+		categories:      cloneRows(d.categories),
+		idempotencyKeys: cloneRows(d.idempotencyKeys),
+		webhooks:        cloneRows(d.webhooks),
+		deliveries:      cloneRows(d.deliveries),
+		auditLog:        append([]models.AuditEntry(nil), d.auditLog...),
+		auditSeq:        d.auditSeq,
+		passwordResets:  cloneRows(d.passwordResets),
+		verifications:   cloneRows(d.verifications),
+		twoFactor:       cloneRows(d.twoFactor),
+		recoveryCodes:   cloneRows(d.recoveryCodes),
+		loginAttempts:   cloneRows(d.loginAttempts),
+		apiTokens:       cloneRows(d.apiTokens),
+		identities:      cloneRows(d.identities),
+		userSessions:    cloneRows(d.userSessions),
+	}
+	return c
+}
+
+func cloneRows[K comparable, T any](rows map[K]*row[T]) map[K]*row[T] {
+	c := make(map[K]*row[T], len(rows))
+	for k, r := range rows {
+		copied := *r
+		c[k] = &copied
+	}
+	return c
+}
+
+// sortedRows returns the rows that match, oldest first
+func sortedRows[K comparable, T any](rows map[K]*row[T], match func(*T) bool) []*row[T] {
+	matched := []*row[T]{}
+	for _, r := range rows {
+		if match(&r.value) {
+			matched = append(matched, r)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].seq < matched[j].seq })
+	return matched
+}
+
+// define Store type, the in-memory models.Store
+type Store struct {
+	mu   sync.Mutex
+	data *data
+	// Now returns the current time, it can be replaced to control the
+	// timestamps of the records
+	Now func() time.Time
+}
+
+func NewStore() *Store {
+	return &Store{data: newData(), Now: time.Now}
+}
+
+// Repositories returns repositories which lock the store for every call
+func (s *Store) Repositories() *models.Repositories {
+	return s.repositories(false)
+}
+
+// InTx locks the store while fn runs, and restores the data as it was before
+// fn if fn returns an error
+func (s *Store) InTx(fn func(repos *models.Repositories) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.atomically(func() error {
+		return fn(s.repositories(true))
+	})
+}
+
+// atomically runs fn and rolls back its changes if it returns an error. The
+// store must be locked.
+func (s *Store) atomically(fn func() error) error {
+	snapshot := s.data.clone()
+	err := fn()
+	if err != nil {
+		s.data = snapshot
+	}
+	return err
+}
+
+// lock locks the store, unless the caller runs inside a transaction which
+// already holds the lock. Use it as defer s.lock(inTx)().
+func (s *Store) lock(inTx bool) func() {
+	if inTx {
+		return func() {}
+	}
+	s.mu.Lock()
+	return s.mu.Unlock
+}
+
+// now returns the current time the way the database stores it, in UTC and
+// to the second
+func (s *Store) now() time.Time {
+	return s.Now().UTC().Truncate(time.Second)
+}
+
+func (s *Store) repositories(inTx bool) *models.Repositories {
+	return &models.Repositories{
+		Users:              &userRepository{s: s, inTx: inTx},
+		Budgets:            &budgetRepository{s: s, inTx: inTx},
+		Expenses:           &expenseRepository{s: s, inTx: inTx},
+		ExpenseCategories:  &expenseCategoryRepository{s: s, inTx: inTx},
+		IdempotencyKeys:    &idempotencyRepository{s: s, inTx: inTx},
+		Webhooks:           &webhookRepository{s: s, inTx: inTx},
+		AuditLog:           &auditRepository{s: s, inTx: inTx},
+		PasswordResets:     &passwordResetRepository{s: s, inTx: inTx},
+		EmailVerifications: &emailVerificationRepository{s: s, inTx: inTx},
+		TwoFactor:          &twoFactorRepository{s: s, inTx: inTx},
+		LoginAttempts:      &loginAttemptRepository{s: s, inTx: inTx},
+		APITokens:          &apiTokenRepository{s: s, inTx: inTx},
+		UserIdentities:     &userIdentityRepository{s: s, inTx: inTx},
+		UserSessions:       &userSessionRepository{s: s, inTx: inTx},
+		Stats:              &statsRepository{s: s, inTx: inTx},
+	}
+}
+
+var _ models.Store = (*Store)(nil)
@@ -0,0 +1,153 @@
+package memory_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"kweeuhree.personal-budgeting-backend/internal/models"
+	"kweeuhree.personal-budgeting-backend/internal/models/memory"
+)
+
+func TestInTxRollsBack(t *testing.T) {
+	store := memory.NewStore()
+	repos := store.Repositories()
+
+	const userId = "user-1"
+	err := repos.Users.Insert(userId, "tx@example.com", "Test User", "pa$$word123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errAbort := errors.New("abort")
+	err = store.InTx(func(tx *models.Repositories) error {
+		_, err := tx.Budgets.Insert("budget-1", userId, 1000, 0, 1000)
+		if err != nil {
+			return err
+		}
+		// The transaction sees its own writes
+		if _, err := tx.Budgets.GetBudgetByUserIdForUpdate(userId); err != nil {
+			t.Errorf("budget inside the transaction: %v", err)
+		}
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("got error %v; want %v", err, errAbort)
+	}
+
+	_, err = repos.Budgets.GetBudgetByUserId(userId)
+	if !errors.Is(err, models.ErrNoRecord) {
+		t.Errorf("budget of the rolled back transaction: got error %v; want %v", err, models.ErrNoRecord)
+	}
+
+	err = store.InTx(func(tx *models.Repositories) error {
+		_, err := tx.Budgets.Insert("budget-1", userId, 1000, 0, 1000)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = repos.Budgets.GetBudgetByUserId(userId); err != nil {
+		t.Errorf("budget of the committed transaction: %v", err)
+	}
+}
+
+func TestBudgetPutIfVersion(t *testing.T) {
+	repos := newUserWithCategories(t, "user-1")
+
+	_, err := repos.Budgets.Insert("budget-1", "user-1", 1000, 500, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		userId  string
+		version int
+		wantErr error
+	}{
+		{"current version", "user-1", 1, nil},
+		// the first update moved the budget to version 2
+		{"stale version", "user-1", 1, models.ErrVersionConflict},
+		{"another user", "user-2", 2, models.ErrVersionConflict},
+		{"new current version", "user-1", 2, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := repos.Budgets.PutIfVersion("budget-1", tt.userId, tt.version, 900, 500, 1400, 1400, 100)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v; want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	budget, err := repos.Budgets.Get("budget-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if budget.Version != 3 || budget.CheckingBalance != 900 {
+		t.Errorf("got version %d and checking %d; want 3 and 900", budget.Version, budget.CheckingBalance)
+	}
+}
+
+func TestUsers(t *testing.T) {
+	repos := memory.NewStore().Repositories()
+
+	err := repos.Users.Insert("user-1", "someone@example.com", "Test User", "pa$$word123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repos.Users.Insert("user-2", "someone@example.com", "Someone Else", "pa$$word123")
+	if !errors.Is(err, models.ErrDuplicateEmail) {
+		t.Errorf("duplicate email: got error %v; want %v", err, models.ErrDuplicateEmail)
+	}
+
+	tests := []struct {
+		email    string
+		password string
+		wantId   string
+		wantErr  error
+	}{
+		{"someone@example.com", "pa$$word123", "user-1", nil},
+		{"someone@example.com", "wrong-password", "", models.ErrInvalidCredentials},
+		{"nobody@example.com", "pa$$word123", "", models.ErrInvalidCredentials},
+	}
+	for _, tt := range tests {
+		id, err := repos.Users.Authenticate(tt.email, tt.password)
+		if !errors.Is(err, tt.wantErr) || (err == nil && id != tt.wantId) {
+			t.Errorf("Authenticate(%q, %q) = %q, %v; want %q, %v", tt.email, tt.password, id, err, tt.wantId, tt.wantErr)
+		}
+	}
+}
+
+// Deleting a user forgets their sessions
+func TestUserDeleteForgetsSessions(t *testing.T) {
+	store := memory.NewStore()
+	repos := store.Repositories()
+
+	err := repos.Users.Insert("user-1", "sessions@example.com", "Test User", "pa$$word123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repos.UserSessions.Touch(&models.UserSession{
+		Token:     "token-1",
+		SessionId: "session-1",
+		UserId:    "user-1",
+		ExpiresAt: store.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, err := repos.UserSessions.All("user-1")
+	if err != nil || len(sessions) != 1 {
+		t.Fatalf("All() = %d sessions, %v; want 1, nil", len(sessions), err)
+	}
+
+	if err = repos.Users.Delete("user-1"); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := repos.UserSessions.DeleteExpired(store.Now().Add(2 * time.Hour)); n != 0 {
+		t.Errorf("%d sessions of the deleted user were left", n)
+	}
+}
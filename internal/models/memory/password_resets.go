@@ -0,0 +1,62 @@
+package memory
+
+import (
+	"time"
+
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
+
+type passwordResetRepository struct {
+	s    *Store
+	inTx bool
+}
+
+func (r *passwordResetRepository) Insert(tokenHash, userId string, expiresAt time.Time) error {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	if _, ok := d.users[userId]; !ok {
+		return ErrForeignKey
+	}
+	if _, ok := d.passwordResets[tokenHash]; ok {
+		return ErrDuplicateKey
+	}
+	d.passwordResets[tokenHash] = &row[passwordReset]{
+		value: passwordReset{userId: userId, expiresAt: expiresAt.UTC().Truncate(time.Second)},
+		seq:   d.next(),
+	}
+	return nil
+}
+
+func (r *passwordResetRepository) Consume(tokenHash string) (string, error) {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	reset, ok := d.passwordResets[tokenHash]
+	if !ok || !reset.value.expiresAt.After(r.s.Now()) {
+		return "", models.ErrInvalidResetToken
+	}
+
+	userId := reset.value.userId
+	for hash, other := range d.passwordResets {
+		if other.value.userId == userId {
+			delete(d.passwordResets, hash)
+		}
+	}
+	return userId, nil
+}
+
+func (r *passwordResetRepository) DeleteExpired() (int64, error) {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	var n int64
+	now := r.s.Now()
+	for hash, reset := range d.passwordResets {
+		if !reset.value.expiresAt.After(now) {
+			delete(d.passwordResets, hash)
+			n++
+		}
+	}
+	return n, nil
+}
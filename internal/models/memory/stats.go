@@ -0,0 +1,44 @@
+package memory
+
+import (
+	"time"
+
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
+
+type statsRepository struct {
+	s    *Store
+	inTx bool
+}
+
+func (r *statsRepository) Get(since time.Time) (*models.SystemStats, error) {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	s := &models.SystemStats{}
+	for _, u := range d.users {
+		s.Users++
+		if u.value.Role == models.RoleAdmin {
+			s.AdminUsers++
+		}
+		if u.value.Disabled() {
+			s.DisabledUsers++
+		}
+		if u.value.EmailVerifiedAt == nil {
+			s.UnverifiedUsers++
+		}
+		if !u.value.CreatedAt.Before(since) {
+			s.NewUsers++
+		}
+	}
+	s.Budgets = int64(len(d.budgets))
+	for _, e := range d.expenses {
+		s.Expenses++
+		s.ExpenseAmount += e.value.AmountInCents
+		if !e.value.CreatedAt.Before(since) {
+			s.NewExpenses++
+			s.NewExpenseAmount += e.value.AmountInCents
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,113 @@
+package memory
+
+import (
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
+
+// twoFactorRepository keeps the TOTP settings apart from the users, a user
+// without settings has two-factor authentication off
+type twoFactorRepository struct {
+	s    *Store
+	inTx bool
+}
+
+func (r *twoFactorRepository) Get(userId string) (*models.TwoFactor, error) {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	if _, ok := d.users[userId]; !ok {
+		return nil, models.ErrNoRecord
+	}
+	tf, ok := d.twoFactor[userId]
+	if !ok {
+		return &models.TwoFactor{}, nil
+	}
+	copied := tf.value
+	return &copied, nil
+}
+
+func (r *twoFactorRepository) Enroll(userId, secret string) error {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	if _, ok := d.users[userId]; !ok {
+		return models.ErrTwoFactorEnabled
+	}
+	if tf, ok := d.twoFactor[userId]; ok && tf.value.Enabled() {
+		return models.ErrTwoFactorEnabled
+	}
+	d.twoFactor[userId] = &row[models.TwoFactor]{
+		value: models.TwoFactor{Secret: secret},
+		seq:   d.next(),
+	}
+	return nil
+}
+
+func (r *twoFactorRepository) Enable(userId string, recoveryCodeHashes []string) error {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	tf, ok := d.twoFactor[userId]
+	if !ok || tf.value.Secret == "" || tf.value.Enabled() {
+		return models.ErrNoRecord
+	}
+	now := r.s.now()
+	tf.value.EnabledAt = &now
+
+	for key := range d.recoveryCodes {
+		if key.userId == userId {
+			delete(d.recoveryCodes, key)
+		}
+	}
+	for _, codeHash := range recoveryCodeHashes {
+		d.recoveryCodes[recoveryCodeKey{userId: userId, codeHash: codeHash}] = &row[recoveryCode]{seq: d.next()}
+	}
+	return nil
+}
+
+func (r *twoFactorRepository) Disable(userId string) error {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	delete(d.twoFactor, userId)
+	for key := range d.recoveryCodes {
+		if key.userId == userId {
+			delete(d.recoveryCodes, key)
+		}
+	}
+	return nil
+}
+
+func (r *twoFactorRepository) UseStep(userId string, step int64) error {
+	defer r.s.lock(r.inTx)()
+
+	tf, ok := r.s.data.twoFactor[userId]
+	if !ok || tf.value.LastStep >= step {
+		return models.ErrInvalidTwoFactorCode
+	}
+	tf.value.LastStep = step
+	return nil
+}
+
+func (r *twoFactorRepository) UseRecoveryCode(userId, codeHash string) error {
+	defer r.s.lock(r.inTx)()
+
+	code, ok := r.s.data.recoveryCodes[recoveryCodeKey{userId: userId, codeHash: codeHash}]
+	if !ok || code.value.used {
+		return models.ErrInvalidTwoFactorCode
+	}
+	code.value.used = true
+	return nil
+}
+
+func (r *twoFactorRepository) RemainingRecoveryCodes(userId string) (int, error) {
+	defer r.s.lock(r.inTx)()
+
+	n := 0
+	for key, code := range r.s.data.recoveryCodes {
+		if key.userId == userId && !code.value.used {
+			n++
+		}
+	}
+	return n, nil
+}
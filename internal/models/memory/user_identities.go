@@ -0,0 +1,43 @@
+package memory
+
+import (
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
+
+type userIdentityRepository struct {
+	s    *Store
+	inTx bool
+}
+
+func (r *userIdentityRepository) Insert(provider, subject, userId, email string) error {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	if _, ok := d.users[userId]; !ok {
+		return ErrForeignKey
+	}
+	key := identityKey{provider: provider, subject: subject}
+	if _, ok := d.identities[key]; ok {
+		return models.ErrDuplicateIdentity
+	}
+
+	d.identities[key] = &row[models.UserIdentity]{value: models.UserIdentity{
+		Provider:  provider,
+		Subject:   subject,
+		UserId:    userId,
+		Email:     email,
+		CreatedAt: r.s.now(),
+	}, seq: d.next()}
+	return nil
+}
+
+func (r *userIdentityRepository) Get(provider, subject string) (*models.UserIdentity, error) {
+	defer r.s.lock(r.inTx)()
+
+	i, ok := r.s.data.identities[identityKey{provider: provider, subject: subject}]
+	if !ok {
+		return nil, models.ErrNoRecord
+	}
+	identity := i.value
+	return &identity, nil
+}
@@ -0,0 +1,118 @@
+package memory
+
+import (
+	"sort"
+	"time"
+
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
+
+type userSessionRepository struct {
+	s    *Store
+	inTx bool
+}
+
+func (r *userSessionRepository) Insert(s *models.UserSession) error {
+	defer r.s.lock(r.inTx)()
+	return r.insert(s)
+}
+
+func (r *userSessionRepository) insert(s *models.UserSession) error {
+	d := r.s.data
+
+	if _, ok := d.users[s.UserId]; !ok {
+		return ErrForeignKey
+	}
+	if _, ok := d.userSessions[s.Token]; ok {
+		return ErrDuplicateKey
+	}
+	for _, existing := range d.userSessions {
+		if existing.value.SessionId == s.SessionId {
+			return ErrDuplicateKey
+		}
+	}
+
+	stored := *s
+	if s.CreatedAt != nil {
+		createdAt := s.CreatedAt.UTC().Truncate(time.Second)
+		stored.CreatedAt = &createdAt
+	}
+	stored.LastSeenAt = r.s.now()
+	stored.ExpiresAt = s.ExpiresAt.UTC().Truncate(time.Second)
+	d.userSessions[s.Token] = &row[models.UserSession]{value: stored, seq: d.next()}
+	return nil
+}
+
+// Touch records the use of the session, or records the session if it was
+// not recorded yet
+func (r *userSessionRepository) Touch(s *models.UserSession) error {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	existing, ok := d.userSessions[s.Token]
+	if !ok {
+		return r.insert(s)
+	}
+	touched := existing.value
+	touched.IP = s.IP
+	touched.UserAgent = s.UserAgent
+	touched.LastSeenAt = r.s.now()
+	touched.ExpiresAt = s.ExpiresAt.UTC().Truncate(time.Second)
+	d.userSessions[s.Token] = &row[models.UserSession]{value: touched, seq: existing.seq}
+	return nil
+}
+
+// All returns the sessions of the user which have not expired, the most
+// recently used first
+func (r *userSessionRepository) All(userId string) ([]*models.UserSession, error) {
+	defer r.s.lock(r.inTx)()
+
+	now := r.s.Now()
+	rows := sortedRows(r.s.data.userSessions, func(s *models.UserSession) bool {
+		return s.UserId == userId && s.ExpiresAt.After(now)
+	})
+	// The most recently recorded first among the sessions last seen in
+	// the same second
+	sort.SliceStable(rows, func(i, j int) bool {
+		if !rows[i].value.LastSeenAt.Equal(rows[j].value.LastSeenAt) {
+			return rows[i].value.LastSeenAt.After(rows[j].value.LastSeenAt)
+		}
+		return rows[i].seq > rows[j].seq
+	})
+
+	sessions := []*models.UserSession{}
+	for _, s := range rows {
+		sessions = append(sessions, copyUserSession(s.value))
+	}
+	return sessions, nil
+}
+
+func (r *userSessionRepository) Delete(token string) error {
+	defer r.s.lock(r.inTx)()
+
+	delete(r.s.data.userSessions, token)
+	return nil
+}
+
+func (r *userSessionRepository) DeleteExpired(before time.Time) (int64, error) {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	var n int64
+	for token, s := range d.userSessions {
+		if s.value.ExpiresAt.Before(before) {
+			delete(d.userSessions, token)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// copyUserSession copies the session, its creation time included
+func copyUserSession(s models.UserSession) *models.UserSession {
+	if s.CreatedAt != nil {
+		createdAt := *s.CreatedAt
+		s.CreatedAt = &createdAt
+	}
+	return &s
+}
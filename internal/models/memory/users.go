@@ -0,0 +1,332 @@
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
+
+// Errors of the constraints the database would enforce
+var (
+	ErrDuplicateKey = errors.New("memory: duplicate primary key")
+	ErrForeignKey   = errors.New("memory: referenced record does not exist")
+)
+
+// dummyPasswordHash is compared with the password of an unknown email, like
+// the SQL model does
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, err := bcrypt.GenerateFromPassword([]byte("not the password of any user"), bcryptCost)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+})
+
+type userRepository struct {
+	s    *Store
+	inTx bool
+}
+
+func (r *userRepository) Insert(userId, email, displayName, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	if err != nil {
+		return err
+	}
+
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	if _, ok := d.users[userId]; ok {
+		return ErrDuplicateKey
+	}
+	for _, u := range d.users {
+		if u.value.Email == email {
+			return models.ErrDuplicateEmail
+		}
+	}
+
+	d.users[userId] = &row[models.User]{
+		value: models.User{
+			UserId:         userId,
+			Email:          email,
+			DisplayName:    displayName,
+			HashedPassword: hashedPassword,
+			CreatedAt:      r.s.now(),
+			Role:           models.RoleUser,
+		},
+		seq: d.next(),
+	}
+	return nil
+}
+
+func (r *userRepository) Authenticate(email, password string) (string, error) {
+	unlock := r.s.lock(r.inTx)
+	var user *models.User
+	for _, u := range r.s.data.users {
+		if u.value.Email == email {
+			copied := u.value
+			user = &copied
+			break
+		}
+	}
+	unlock()
+
+	// Compare outside of the lock, hashing is slow
+	if user == nil {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+		return "Invalid credentials", models.ErrInvalidCredentials
+	}
+	err := bcrypt.CompareHashAndPassword(user.HashedPassword, []byte(password))
+	if err != nil {
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return "Invalid credentials", models.ErrInvalidCredentials
+		}
+		return "", err
+	}
+	if user.Disabled() {
+		return "", models.ErrAccountDisabled
+	}
+	return user.UserId, nil
+}
+
+func (r *userRepository) Exists(userId string) (bool, error) {
+	defer r.s.lock(r.inTx)()
+
+	_, ok := r.s.data.users[userId]
+	return ok, nil
+}
+
+func (r *userRepository) IsActive(userId string) (bool, error) {
+	defer r.s.lock(r.inTx)()
+
+	u, ok := r.s.data.users[userId]
+	return ok && !u.value.Disabled(), nil
+}
+
+func (r *userRepository) GetUserNameByUserId(userId string) (string, error) {
+	defer r.s.lock(r.inTx)()
+
+	u, ok := r.s.data.users[userId]
+	if !ok {
+		return "", fmt.Errorf("no user found with userId: %s", userId)
+	}
+	return u.value.DisplayName, nil
+}
+
+func (r *userRepository) Get(userId string) (*models.User, error) {
+	defer r.s.lock(r.inTx)()
+
+	u, ok := r.s.data.users[userId]
+	if !ok {
+		return nil, models.ErrNoRecord
+	}
+	copied := u.value
+	return &copied, nil
+}
+
+// The store is locked for the whole of a transaction, so reading the user is
+// enough to keep others from changing them
+func (r *userRepository) GetForUpdate(userId string) (*models.User, error) {
+	return r.Get(userId)
+}
+
+func (r *userRepository) GetByEmail(email string) (*models.User, error) {
+	defer r.s.lock(r.inTx)()
+
+	for _, u := range r.s.data.users {
+		if u.value.Email == email {
+			copied := u.value
+			return &copied, nil
+		}
+	}
+	return nil, models.ErrNoRecord
+}
+
+func (r *userRepository) UpdatePassword(userId, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	if err != nil {
+		return err
+	}
+
+	defer r.s.lock(r.inTx)()
+
+	u, ok := r.s.data.users[userId]
+	if !ok {
+		return models.ErrNoRecord
+	}
+	u.value.HashedPassword = hashedPassword
+	return nil
+}
+
+func (r *userRepository) UpdateDisplayName(userId, displayName string) error {
+	defer r.s.lock(r.inTx)()
+
+	u, ok := r.s.data.users[userId]
+	if !ok {
+		return models.ErrNoRecord
+	}
+	u.value.DisplayName = displayName
+	return nil
+}
+
+func (r *userRepository) UpdateEmail(userId, email string) error {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	u, ok := d.users[userId]
+	if !ok {
+		return models.ErrNoRecord
+	}
+	for id, other := range d.users {
+		if id != userId && other.value.Email == email {
+			return models.ErrDuplicateEmail
+		}
+	}
+	u.value.Email = email
+	u.value.EmailVerifiedAt = nil
+	return nil
+}
+
+func (r *userRepository) IsEmailVerified(userId string) (bool, error) {
+	defer r.s.lock(r.inTx)()
+
+	u, ok := r.s.data.users[userId]
+	if !ok {
+		return false, models.ErrNoRecord
+	}
+	return u.value.EmailVerifiedAt != nil, nil
+}
+
+func (r *userRepository) MarkEmailVerified(userId string) error {
+	defer r.s.lock(r.inTx)()
+
+	u, ok := r.s.data.users[userId]
+	if !ok {
+		return models.ErrNoRecord
+	}
+	if u.value.EmailVerifiedAt == nil {
+		now := r.s.now()
+		u.value.EmailVerifiedAt = &now
+	}
+	return nil
+}
+
+func (r *userRepository) Search(filter models.UserFilter) ([]*models.User, error) {
+	defer r.s.lock(r.inTx)()
+
+	query := strings.ToLower(filter.Query)
+	matched := sortedRows(r.s.data.users, func(u *models.User) bool {
+		switch {
+		case query != "" && !strings.Contains(strings.ToLower(u.Email), query) &&
+			!strings.Contains(strings.ToLower(u.DisplayName), query),
+			filter.Role != "" && u.Role != filter.Role,
+			filter.Status == models.UserStatusActive && u.Disabled(),
+			filter.Status == models.UserStatusDisabled && !u.Disabled():
+			return false
+		}
+		return true
+	})
+	// Newest first, like the SQL model
+	slices.Reverse(matched)
+
+	users := []*models.User{}
+	for i := filter.Offset; i < len(matched) && len(users) < filter.Limit; i++ {
+		copied := matched[i].value
+		users = append(users, &copied)
+	}
+	return users, nil
+}
+
+func (r *userRepository) SetRole(userId, role string) error {
+	defer r.s.lock(r.inTx)()
+
+	u, ok := r.s.data.users[userId]
+	if !ok {
+		return models.ErrNoRecord
+	}
+	u.value.Role = role
+	return nil
+}
+
+func (r *userRepository) SetDisabled(userId string, disabled bool) error {
+	defer r.s.lock(r.inTx)()
+
+	u, ok := r.s.data.users[userId]
+	if !ok {
+		return models.ErrNoRecord
+	}
+	switch {
+	case !disabled:
+		u.value.DisabledAt = nil
+	case u.value.DisabledAt == nil:
+		now := r.s.now()
+		u.value.DisabledAt = &now
+	}
+	return nil
+}
+
+// Delete removes the user and every record of their data
+func (r *userRepository) Delete(userId string) error {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	if _, ok := d.users[userId]; !ok {
+		return models.ErrNoRecord
+	}
+	deleteWhere(d.expenses, func(e models.Expense) bool { return e.UserId == userId })
+	deleteWhere(d.categories, func(c models.ExpenseCategory) bool { return c.UserId == userId })
+	deleteWhere(d.budgets, func(b models.Budget) bool { return b.UserId == userId })
+	deleteWhere(d.deliveries, func(wd models.WebhookDelivery) bool { return wd.UserId == userId })
+	deleteWhere(d.webhooks, func(wh models.Webhook) bool { return wh.UserId == userId })
+	deleteWhere(d.passwordResets, func(pr passwordReset) bool { return pr.userId == userId })
+	deleteWhere(d.verifications, func(v emailVerification) bool { return v.userId == userId })
+	deleteWhere(d.apiTokens, func(t apiToken) bool { return t.UserId == userId })
+	deleteWhere(d.identities, func(i models.UserIdentity) bool { return i.UserId == userId })
+	deleteWhere(d.userSessions, func(s models.UserSession) bool { return s.UserId == userId })
+	delete(d.twoFactor, userId)
+	for key := range d.recoveryCodes {
+		if key.userId == userId {
+			delete(d.recoveryCodes, key)
+		}
+	}
+	for key := range d.idempotencyKeys {
+		if key.userId == userId {
+			delete(d.idempotencyKeys, key)
+		}
+	}
+
+	kept := d.auditLog[:0:0]
+	for _, e := range d.auditLog {
+		if e.UserId != userId {
+			kept = append(kept, e)
+		}
+	}
+	d.auditLog = kept
+
+	delete(d.users, userId)
+	return nil
+}
+
+// deleteWhere removes the rows whose value matches
+func deleteWhere[K comparable, T any](rows map[K]*row[T], match func(T) bool) {
+	for k, r := range rows {
+		if match(r.value) {
+			delete(rows, k)
+		}
+	}
+}
+
+func (r *userRepository) AllIds() ([]string, error) {
+	defer r.s.lock(r.inTx)()
+
+	userIds := []string{}
+	for _, u := range sortedRows(r.s.data.users, func(*models.User) bool { return true }) {
+		userIds = append(userIds, u.value.UserId)
+	}
+	return userIds, nil
+}
@@ -0,0 +1,205 @@
+package memory
+
+import (
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
+
+type webhookRepository struct {
+	s    *Store
+	inTx bool
+}
+
+func (r *webhookRepository) Insert(webhookId, userId, url, secret string, events []string) error {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	if _, ok := d.webhooks[webhookId]; ok {
+		return ErrDuplicateKey
+	}
+
+	wh := models.Webhook{
+		WebhookId: webhookId,
+		UserId:    userId,
+		URL:       url,
+		Secret:    secret,
+		CreatedAt: r.s.now(),
+	}
+	// An empty list is stored as no list, like the events column
+	if len(events) > 0 {
+		wh.Events = slices.Clone(events)
+	}
+	d.webhooks[webhookId] = &row[models.Webhook]{value: wh, seq: d.next()}
+	return nil
+}
+
+func (r *webhookRepository) Get(webhookId, userId string) (*models.Webhook, error) {
+	defer r.s.lock(r.inTx)()
+
+	wh, ok := r.s.data.webhooks[webhookId]
+	if !ok || wh.value.UserId != userId {
+		return nil, models.ErrNoRecord
+	}
+	return copyWebhook(wh.value), nil
+}
+
+// All returns the webhooks of the user in the order they were created
+func (r *webhookRepository) All(userId string) ([]*models.Webhook, error) {
+	defer r.s.lock(r.inTx)()
+
+	return r.all(userId), nil
+}
+
+func (r *webhookRepository) all(userId string) []*models.Webhook {
+	webhooks := []*models.Webhook{}
+	for _, wh := range sortedRows(r.s.data.webhooks, func(wh *models.Webhook) bool { return wh.UserId == userId }) {
+		webhooks = append(webhooks, copyWebhook(wh.value))
+	}
+	return webhooks
+}
+
+// Delete removes the webhook of the user together with its deliveries
+func (r *webhookRepository) Delete(webhookId, userId string) error {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	wh, ok := d.webhooks[webhookId]
+	if !ok || wh.value.UserId != userId {
+		return models.ErrNoRecord
+	}
+	delete(d.webhooks, webhookId)
+	for deliveryId, delivery := range d.deliveries {
+		if delivery.value.WebhookId == webhookId {
+			delete(d.deliveries, deliveryId)
+		}
+	}
+	return nil
+}
+
+// Enqueue adds a pending delivery of the event to every webhook of the user
+// that subscribed to it
+func (r *webhookRepository) Enqueue(userId, eventId, eventType string, payload []byte) error {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	now := r.s.now()
+	for _, wh := range r.all(userId) {
+		if !wh.Wants(eventType) {
+			continue
+		}
+		deliveryId := uuid.New().String()
+		d.deliveries[deliveryId] = &row[models.WebhookDelivery]{
+			value: models.WebhookDelivery{
+				DeliveryId:    deliveryId,
+				WebhookId:     wh.WebhookId,
+				UserId:        userId,
+				EventId:       eventId,
+				EventType:     eventType,
+				Payload:       slices.Clone(payload),
+				Status:        models.DeliveryPending,
+				NextAttemptAt: now,
+				CreatedAt:     now,
+			},
+			seq: d.next(),
+		}
+	}
+	return nil
+}
+
+// DueDeliveries returns up to limit pending deliveries whose next attempt is
+// due, oldest first, with the URL and secret of their webhook
+func (r *webhookRepository) DueDeliveries(limit int) ([]*models.WebhookDelivery, error) {
+	defer r.s.lock(r.inTx)()
+	d := r.s.data
+
+	now := r.s.now()
+	rows := sortedRows(d.deliveries, func(delivery *models.WebhookDelivery) bool {
+		return delivery.Status == models.DeliveryPending && !delivery.NextAttemptAt.After(now)
+	})
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].value.NextAttemptAt.Before(rows[j].value.NextAttemptAt)
+	})
+
+	deliveries := []*models.WebhookDelivery{}
+	for _, delivery := range rows {
+		wh, ok := d.webhooks[delivery.value.WebhookId]
+		if !ok {
+			continue
+		}
+		if len(deliveries) == limit {
+			break
+		}
+		copied := copyDelivery(delivery.value)
+		copied.URL = wh.value.URL
+		copied.Secret = wh.value.Secret
+		deliveries = append(deliveries, copied)
+	}
+	return deliveries, nil
+}
+
+// Deliveries returns the latest deliveries of a webhook of the user, newest first
+func (r *webhookRepository) Deliveries(webhookId, userId string, limit int) ([]*models.WebhookDelivery, error) {
+	defer r.s.lock(r.inTx)()
+
+	rows := sortedRows(r.s.data.deliveries, func(delivery *models.WebhookDelivery) bool {
+		return delivery.WebhookId == webhookId && delivery.UserId == userId
+	})
+
+	deliveries := []*models.WebhookDelivery{}
+	for i := len(rows) - 1; i >= 0 && len(deliveries) < limit; i-- {
+		deliveries = append(deliveries, copyDelivery(rows[i].value))
+	}
+	return deliveries, nil
+}
+
+func (r *webhookRepository) MarkDelivered(deliveryId string, statusCode int) error {
+	defer r.s.lock(r.inTx)()
+
+	delivery, ok := r.s.data.deliveries[deliveryId]
+	if !ok {
+		return nil
+	}
+	deliveredAt := r.s.now()
+	delivery.value.Status = models.DeliveryDelivered
+	delivery.value.Attempts++
+	delivery.value.LastStatusCode = statusCode
+	delivery.value.LastError = ""
+	delivery.value.DeliveredAt = &deliveredAt
+	return nil
+}
+
+func (r *webhookRepository) MarkAttemptFailed(deliveryId string, statusCode int, lastError string, nextAttemptAt time.Time, giveUp bool) error {
+	defer r.s.lock(r.inTx)()
+
+	delivery, ok := r.s.data.deliveries[deliveryId]
+	if !ok {
+		return nil
+	}
+	delivery.value.Status = models.DeliveryPending
+	if giveUp {
+		delivery.value.Status = models.DeliveryFailed
+	}
+	delivery.value.Attempts++
+	delivery.value.LastStatusCode = statusCode
+	delivery.value.LastError = lastError
+	delivery.value.NextAttemptAt = nextAttemptAt.UTC().Truncate(time.Second)
+	return nil
+}
+
+func copyWebhook(wh models.Webhook) *models.Webhook {
+	wh.Events = slices.Clone(wh.Events)
+	return &wh
+}
+
+func copyDelivery(delivery models.WebhookDelivery) *models.WebhookDelivery {
+	delivery.Payload = slices.Clone(delivery.Payload)
+	if delivery.DeliveredAt != nil {
+		deliveredAt := *delivery.DeliveredAt
+		delivery.DeliveredAt = &deliveredAt
+	}
+	return &delivery
+}
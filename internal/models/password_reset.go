@@ -0,0 +1,70 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// PasswordResetTTL is how long a password reset token can be used
+const PasswordResetTTL = time.Hour
+
+// define PasswordResetModel type which wraps a sql.DB connection pool, or a
+// transaction. Only the SHA-256 hash of a token is stored, so that the
+// tokens cannot be read back from the database.
+type PasswordResetModel struct {
+	DB      DBTX
+	Dialect Dialect
+}
+
+// Insert stores the hash of a new reset token of the user
+func (m *PasswordResetModel) Insert(tokenHash, userId string, expiresAt time.Time) error {
+	stmt := `INSERT INTO password_resets (tokenHash, userId, expiresAt, createdAt)
+			VALUES (?, ?, ?, ` + m.Dialect.Now() + `)`
+	_, err := m.DB.Exec(stmt, tokenHash, userId, expiresAt.UTC())
+	return err
+}
+
+// Consume uses up the token and returns the user it was issued to. Every
+// other token of the user is deleted with it. Returns ErrInvalidResetToken
+// if the token is unknown, expired or already used.
+func (m *PasswordResetModel) Consume(tokenHash string) (string, error) {
+	var userId string
+	stmt := `SELECT userId FROM password_resets WHERE tokenHash = ? AND expiresAt > ?`
+	err := m.DB.QueryRow(stmt, tokenHash, time.Now().UTC()).Scan(&userId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrInvalidResetToken
+		}
+		return "", err
+	}
+
+	// Only one of two concurrent uses of the token deletes it
+	result, err := m.DB.Exec(`DELETE FROM password_resets WHERE tokenHash = ?`, tokenHash)
+	if err != nil {
+		return "", err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+	if rowsAffected == 0 {
+		return "", ErrInvalidResetToken
+	}
+
+	_, err = m.DB.Exec(`DELETE FROM password_resets WHERE userId = ?`, userId)
+	if err != nil {
+		return "", err
+	}
+	return userId, nil
+}
+
+// DeleteExpired removes the tokens that can no longer be used and returns
+// how many it removed
+func (m *PasswordResetModel) DeleteExpired() (int64, error) {
+	result, err := m.DB.Exec(`DELETE FROM password_resets WHERE expiresAt <= ?`, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,260 @@
+package models
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// The repository interfaces describe what the application needs from each
+// model, so that the SQL models can be swapped for another store, such as
+// the in-memory one of the memory package.
+
+type UserRepository interface {
+	Insert(userId, email, displayName, password string) error
+	Authenticate(email, password string) (string, error)
+	Exists(userId string) (bool, error)
+	GetUserNameByUserId(userId string) (string, error)
+	Get(userId string) (*User, error)
+	GetForUpdate(userId string) (*User, error)
+	GetByEmail(email string) (*User, error)
+	UpdatePassword(userId, password string) error
+	UpdateDisplayName(userId, displayName string) error
+	UpdateEmail(userId, email string) error
+	IsEmailVerified(userId string) (bool, error)
+	MarkEmailVerified(userId string) error
+	Delete(userId string) error
+	AllIds() ([]string, error)
+	IsActive(userId string) (bool, error)
+	Search(filter UserFilter) ([]*User, error)
+	SetRole(userId, role string) error
+	SetDisabled(userId string, disabled bool) error
+}
+
+type BudgetRepository interface {
+	Insert(budgetId, userId string, checkingBalance, savingsBalance, budgetTotal int64) (string, error)
+	Get(budgetId string) (*Budget, error)
+	Put(budgetId, userId string, checkingBalance, savingsBalance, budgetTotal, budgetRemaining, totalSpent int64) error
+	PutIfVersion(budgetId, userId string, version int, checkingBalance, savingsBalance, budgetTotal, budgetRemaining, totalSpent int64) error
+	Delete(budgetId, userId string) error
+	GetBudgetByUserId(userId string) (*Budget, error)
+	GetBudgetByUserIdForUpdate(userId string) (*Budget, error)
+}
+
+type ExpenseRepository interface {
+	Insert(expenseId, userId, categoryId, description, expenseType string, amountInCents int64) (string, error)
+	Get(expenseId string) (*Expense, error)
+	All(userId string) ([]*Expense, error)
+	Put(expenseId, userId, categoryId, description, expenseType string, amountInCents int64) error
+	PutIfVersion(expenseId, userId string, version int, categoryId, description, expenseType string, amountInCents int64) error
+	Delete(expenseId, userId string) error
+	DeleteAll(userId string) error
+	DeleteAllByCategory(userId, expenseCategoryId string) error
+	ApplyBatch(batch *ExpenseBatch) error
+}
+
+type ExpenseCategoryRepository interface {
+	Insert(expenseCategoryId, userId, name, description string, totalSum int64) (string, error)
+	Get(expenseCategoryId string) (*ExpenseCategory, error)
+	All(userId string) ([]*ExpenseCategory, error)
+	AllExpensesPerCategory(categoryId string) ([]*Expense, error)
+	Put(userId, expenseCategoryId, name, description string) error
+	PutIfVersion(userId, expenseCategoryId string, version int, name, description string) error
+	Delete(expenseCategoryId, userId string) error
+	PutTotalSum(userId, categoryId string, amount int64) error
+	GetCategoryTotalSum(userId, expenseCategoryId string) (int64, error)
+	VoidAllTotalSums(userId string) error
+}
+
+type IdempotencyRepository interface {
+	Reserve(userId, idempotencyKey, requestHash string) error
+	Get(userId, idempotencyKey string) (*IdempotencyRecord, error)
+	Complete(userId, idempotencyKey string, status int, contentType, etag string, body []byte) error
+	Release(userId, idempotencyKey string) error
+	DeleteExpired() (int64, error)
+}
+
+type WebhookRepository interface {
+	Insert(webhookId, userId, url, secret string, events []string) error
+	Get(webhookId, userId string) (*Webhook, error)
+	All(userId string) ([]*Webhook, error)
+	Delete(webhookId, userId string) error
+	Enqueue(userId, eventId, eventType string, payload []byte) error
+	DueDeliveries(limit int) ([]*WebhookDelivery, error)
+	Deliveries(webhookId, userId string, limit int) ([]*WebhookDelivery, error)
+	MarkDelivered(deliveryId string, statusCode int) error
+	MarkAttemptFailed(deliveryId string, statusCode int, lastError string, nextAttemptAt time.Time, giveUp bool) error
+}
+
+type PasswordResetRepository interface {
+	Insert(tokenHash, userId string, expiresAt time.Time) error
+	Consume(tokenHash string) (string, error)
+	DeleteExpired() (int64, error)
+}
+
+type EmailVerificationRepository interface {
+	Insert(tokenHash, userId string, expiresAt time.Time) error
+	Consume(tokenHash string) (string, error)
+	CountSince(userId string, since time.Time) (int, error)
+	DeleteAll(userId string) error
+	DeleteExpired() (int64, error)
+}
+
+type TwoFactorRepository interface {
+	Get(userId string) (*TwoFactor, error)
+	Enroll(userId, secret string) error
+	Enable(userId string, recoveryCodeHashes []string) error
+	Disable(userId string) error
+	UseStep(userId string, step int64) error
+	UseRecoveryCode(userId, codeHash string) error
+	RemainingRecoveryCodes(userId string) (int, error)
+}
+
+type LoginAttemptRepository interface {
+	Get(key string) (*LoginAttempt, error)
+	RecordFailure(key string, window time.Duration) (*LoginAttempt, error)
+	ForgetFailure(key string) error
+	Lock(key string, until time.Time) error
+	Reset(key string) error
+	DeleteStale(before time.Time) (int64, error)
+}
+
+type APITokenRepository interface {
+	Insert(tokenId, userId, name, prefix, tokenHash string, scopes []string, expiresAt time.Time) error
+	All(userId string) ([]*APIToken, error)
+	GetByHash(tokenHash string) (*APIToken, error)
+	Touch(tokenId string) error
+	Delete(tokenId, userId string) error
+	DeleteExpired(before time.Time) (int64, error)
+}
+
+type UserIdentityRepository interface {
+	Insert(provider, subject, userId, email string) error
+	Get(provider, subject string) (*UserIdentity, error)
+}
+
+type UserSessionRepository interface {
+	Insert(s *UserSession) error
+	Touch(s *UserSession) error
+	All(userId string) ([]*UserSession, error)
+	Delete(token string) error
+	DeleteExpired(before time.Time) (int64, error)
+}
+
+type StatsRepository interface {
+	Get(since time.Time) (*SystemStats, error)
+}
+
+type AuditRepository interface {
+	Insert(entry *AuditEntry) error
+	List(userId string, filter AuditFilter) ([]*AuditEntry, error)
+	DeleteOlderThan(cutoff time.Time) (int64, error)
+}
+
+// The SQL models implement the repositories
+var (
+	_ UserRepository              = (*UserModel)(nil)
+	_ BudgetRepository            = (*BudgetModel)(nil)
+	_ ExpenseRepository           = (*ExpenseModel)(nil)
+	_ ExpenseCategoryRepository   = (*ExpenseCategoryModel)(nil)
+	_ IdempotencyRepository       = (*IdempotencyModel)(nil)
+	_ WebhookRepository           = (*WebhookModel)(nil)
+	_ AuditRepository             = (*AuditModel)(nil)
+	_ PasswordResetRepository     = (*PasswordResetModel)(nil)
+	_ EmailVerificationRepository = (*EmailVerificationModel)(nil)
+	_ TwoFactorRepository         = (*TwoFactorModel)(nil)
+	_ LoginAttemptRepository      = (*LoginAttemptModel)(nil)
+	_ APITokenRepository          = (*APITokenModel)(nil)
+	_ UserIdentityRepository      = (*UserIdentityModel)(nil)
+	_ UserSessionRepository       = (*UserSessionModel)(nil)
+	_ StatsRepository             = (*StatsModel)(nil)
+)
+
+// define Repositories type, one of each repository. The repositories of a
+// transaction all share it.
+type Repositories struct {
+	Users              UserRepository
+	Budgets            BudgetRepository
+	Expenses           ExpenseRepository
+	ExpenseCategories  ExpenseCategoryRepository
+	IdempotencyKeys    IdempotencyRepository
+	Webhooks           WebhookRepository
+	AuditLog           AuditRepository
+	PasswordResets     PasswordResetRepository
+	EmailVerifications EmailVerificationRepository
+	TwoFactor          TwoFactorRepository
+	LoginAttempts      LoginAttemptRepository
+	APITokens          APITokenRepository
+	UserIdentities     UserIdentityRepository
+	UserSessions       UserSessionRepository
+	Stats              StatsRepository
+}
+
+// Store hands out the repositories, and runs a function against
+// repositories bound to one transaction. The transaction is committed if fn
+// returns nil and rolled back otherwise.
+type Store interface {
+	Repositories() *Repositories
+	InTx(fn func(repos *Repositories) error) error
+}
+
+// define SQLStore type, the Store of the SQL models on the database of the
+// dialect. The models are handed the connection pool or transaction bound to
+// the dialect.
+type SQLStore struct {
+	DB       *sql.DB
+	Dialect  Dialect
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+func NewSQLStore(db *sql.DB, dialect Dialect, infoLog *log.Logger, errorLog *log.Logger) *SQLStore {
+	return &SQLStore{
+		DB:       db,
+		Dialect:  dialect,
+		InfoLog:  infoLog,
+		ErrorLog: errorLog,
+	}
+}
+
+// Repositories returns models which run their statements on the connection pool
+func (s *SQLStore) Repositories() *Repositories {
+	return s.repositories(s.DB)
+}
+
+// InTx runs fn against models which share one database transaction
+func (s *SQLStore) InTx(fn func(repos *Repositories) error) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = fn(s.repositories(tx))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLStore) repositories(db DBTX) *Repositories {
+	db = Bind(db, s.Dialect)
+	return &Repositories{
+		Users:              &UserModel{DB: db, Dialect: s.Dialect},
+		Budgets:            NewBudgetModel(db, s.Dialect, s.InfoLog, s.ErrorLog),
+		Expenses:           &ExpenseModel{DB: db, Dialect: s.Dialect},
+		ExpenseCategories:  &ExpenseCategoryModel{DB: db},
+		IdempotencyKeys:    &IdempotencyModel{DB: db, Dialect: s.Dialect},
+		Webhooks:           &WebhookModel{DB: db, Dialect: s.Dialect},
+		AuditLog:           &AuditModel{DB: db, Dialect: s.Dialect},
+		PasswordResets:     &PasswordResetModel{DB: db, Dialect: s.Dialect},
+		EmailVerifications: &EmailVerificationModel{DB: db, Dialect: s.Dialect},
+		TwoFactor:          &TwoFactorModel{DB: db, Dialect: s.Dialect},
+		LoginAttempts:      &LoginAttemptModel{DB: db, Dialect: s.Dialect},
+		APITokens:          &APITokenModel{DB: db, Dialect: s.Dialect},
+		UserIdentities:     &UserIdentityModel{DB: db, Dialect: s.Dialect},
+		UserSessions:       &UserSessionModel{DB: db, Dialect: s.Dialect},
+		Stats:              &StatsModel{DB: db, Dialect: s.Dialect},
+	}
+}
@@ -0,0 +1,63 @@
+package models
+
+import (
+	"time"
+)
+
+// define SystemStats type, the figures of the whole system shown to the
+// admins. The New ones only count what was created since the start of the
+// period they were asked for.
+type SystemStats struct {
+	Users           int64
+	AdminUsers      int64
+	DisabledUsers   int64
+	UnverifiedUsers int64
+	NewUsers        int64
+	Budgets         int64
+	Expenses        int64
+	// ExpenseAmount is the sum of the amounts of the expenses, in cents
+	ExpenseAmount    int64
+	NewExpenses      int64
+	NewExpenseAmount int64
+}
+
+// define StatsModel type which wraps a sql.DB connection pool, or a
+// transaction
+type StatsModel struct {
+	DB      DBTX
+	Dialect Dialect
+}
+
+// Get counts the users, budgets and expenses, and what of them was created
+// since the given time
+func (m *StatsModel) Get(since time.Time) (*SystemStats, error) {
+	s := &SystemStats{}
+	since = since.UTC()
+
+	stmt := `SELECT COUNT(*),
+				COUNT(CASE WHEN role = ? THEN 1 END),
+				COUNT(CASE WHEN disabledAt IS NOT NULL THEN 1 END),
+				COUNT(CASE WHEN emailVerifiedAt IS NULL THEN 1 END),
+				COUNT(CASE WHEN createdAt >= ? THEN 1 END)
+			FROM users`
+	err := m.DB.QueryRow(stmt, RoleAdmin, since).Scan(&s.Users, &s.AdminUsers, &s.DisabledUsers, &s.UnverifiedUsers, &s.NewUsers)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.DB.QueryRow(`SELECT COUNT(*) FROM budget`).Scan(&s.Budgets)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt = `SELECT COUNT(*),
+				COALESCE(SUM(amountInCents), 0),
+				COUNT(CASE WHEN createdAt >= ? THEN 1 END),
+				COALESCE(SUM(CASE WHEN createdAt >= ? THEN amountInCents END), 0)
+			FROM expenses`
+	err = m.DB.QueryRow(stmt, since, since).Scan(&s.Expenses, &s.ExpenseAmount, &s.NewExpenses, &s.NewExpenseAmount)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
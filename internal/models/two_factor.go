@@ -0,0 +1,160 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// define TwoFactor type, the TOTP settings of a user. Secret is set at
+// enrollment, and two-factor authentication is on once EnabledAt is.
+type TwoFactor struct {
+	Secret    string
+	EnabledAt *time.Time
+	// LastStep is the time step of the last code accepted
+	LastStep int64
+}
+
+// Enabled reports whether logging in takes a second factor
+func (tf *TwoFactor) Enabled() bool {
+	return tf.EnabledAt != nil
+}
+
+// define TwoFactorModel type which wraps a sql.DB connection pool, or a
+// transaction. The TOTP settings are columns of users, and the recovery
+// codes are stored as their SHA-256 hash.
+type TwoFactorModel struct {
+	DB      DBTX
+	Dialect Dialect
+}
+
+// Get returns the TOTP settings of the user, or ErrNoRecord if the user
+// does not exist
+func (m *TwoFactorModel) Get(userId string) (*TwoFactor, error) {
+	var secret sql.NullString
+	tf := &TwoFactor{}
+	stmt := `SELECT totpSecret, totpEnabledAt, totpLastStep FROM users WHERE userId = ?`
+	err := m.DB.QueryRow(stmt, userId).Scan(&secret, &tf.EnabledAt, &tf.LastStep)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+	tf.Secret = secret.String
+	return tf, nil
+}
+
+// Enroll stores a new secret of the user, which takes effect once it is
+// confirmed with Enable. Returns ErrTwoFactorEnabled if two-factor
+// authentication is already on.
+func (m *TwoFactorModel) Enroll(userId, secret string) error {
+	stmt := `UPDATE users SET totpSecret = ?, totpLastStep = 0
+			WHERE userId = ? AND totpEnabledAt IS NULL`
+	result, err := m.DB.Exec(stmt, secret, userId)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrTwoFactorEnabled
+	}
+	return nil
+}
+
+// Enable turns two-factor authentication on, and replaces the recovery
+// codes of the user with the hashed codes. Returns ErrNoRecord if no
+// secret is waiting to be confirmed.
+func (m *TwoFactorModel) Enable(userId string, recoveryCodeHashes []string) error {
+	stmt := `UPDATE users SET totpEnabledAt = ` + m.Dialect.Now() + `
+			WHERE userId = ? AND totpSecret IS NOT NULL AND totpEnabledAt IS NULL`
+	result, err := m.DB.Exec(stmt, userId)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrNoRecord
+	}
+
+	_, err = m.DB.Exec(`DELETE FROM recovery_codes WHERE userId = ?`, userId)
+	if err != nil {
+		return err
+	}
+	stmt = `INSERT INTO recovery_codes (userId, codeHash, createdAt)
+			VALUES (?, ?, ` + m.Dialect.Now() + `)`
+	for _, codeHash := range recoveryCodeHashes {
+		_, err = m.DB.Exec(stmt, userId, codeHash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Disable turns two-factor authentication off, and forgets the secret and
+// the recovery codes of the user
+func (m *TwoFactorModel) Disable(userId string) error {
+	_, err := m.DB.Exec(`DELETE FROM recovery_codes WHERE userId = ?`, userId)
+	if err != nil {
+		return err
+	}
+
+	stmt := `UPDATE users SET totpSecret = NULL, totpEnabledAt = NULL, totpLastStep = 0
+			WHERE userId = ?`
+	_, err = m.DB.Exec(stmt, userId)
+	return err
+}
+
+// UseStep records that a code of the time step was accepted. Returns
+// ErrInvalidTwoFactorCode if a code of the same or a later step was already
+// accepted, so that a code cannot be replayed.
+func (m *TwoFactorModel) UseStep(userId string, step int64) error {
+	stmt := `UPDATE users SET totpLastStep = ? WHERE userId = ? AND totpLastStep < ?`
+	result, err := m.DB.Exec(stmt, step, userId, step)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrInvalidTwoFactorCode
+	}
+	return nil
+}
+
+// UseRecoveryCode uses up the recovery code with the hash. Returns
+// ErrInvalidTwoFactorCode if the user has no such unused code.
+func (m *TwoFactorModel) UseRecoveryCode(userId, codeHash string) error {
+	stmt := `UPDATE recovery_codes SET usedAt = ` + m.Dialect.Now() + `
+			WHERE userId = ? AND codeHash = ? AND usedAt IS NULL`
+	result, err := m.DB.Exec(stmt, userId, codeHash)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrInvalidTwoFactorCode
+	}
+	return nil
+}
+
+// RemainingRecoveryCodes returns how many recovery codes of the user are
+// unused
+func (m *TwoFactorModel) RemainingRecoveryCodes(userId string) (int, error) {
+	var n int
+	stmt := `SELECT COUNT(*) FROM recovery_codes WHERE userId = ? AND usedAt IS NULL`
+	err := m.DB.QueryRow(stmt, userId).Scan(&n)
+	return n, err
+}
@@ -5,9 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/go-sql-driver/mysql"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -18,11 +18,57 @@ type User struct {
 	DisplayName    string
 	HashedPassword []byte
 	CreatedAt      time.Time
+	// EmailVerifiedAt is nil until the user verifies their email address
+	EmailVerifiedAt *time.Time
+	// Role is one of the Role values
+	Role string
+	// DisabledAt is set while an admin keeps the user from logging in
+	DisabledAt *time.Time
 }
 
+// The roles a user can have. Admins can manage the other users.
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Disabled reports whether the user is kept from logging in
+func (u *User) Disabled() bool {
+	return u.DisabledAt != nil
+}
+
+// define UserFilter type, the search of the admins through the users. Zero
+// fields do not filter. Query matches part of the email or display name.
+// Status is "active" or "disabled".
+type UserFilter struct {
+	Query  string
+	Role   string
+	Status string
+	Limit  int
+	Offset int
+}
+
+// The statuses a UserFilter can match
+const (
+	UserStatusActive   = "active"
+	UserStatusDisabled = "disabled"
+)
+
+// dummyPasswordHash is compared with the password when no user has the
+// email, so that an unknown email takes as long to reject as a wrong
+// password and does not give away which emails have an account
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, err := bcrypt.GenerateFromPassword([]byte("not the password of any user"), 12)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+})
+
 // define UserModel type which wraps a database connection pool
 type UserModel struct {
-	DB *sql.DB
+	DB      DBTX
+	Dialect Dialect
 }
 
 // add a new record to the users table
@@ -35,23 +81,17 @@ func (m *UserModel) Insert(userId, email, displayName, password string) error {
 		return err
 	}
 	stmt := `INSERT INTO users (userId, email, displayName, hashedPassword, createdAt)
-VALUES(?, ?, ?, ?, UTC_TIMESTAMP())`
+VALUES(?, ?, ?, ?, ` + m.Dialect.Now() + `)`
 
 	// insert with Exec()
 	_, err = m.DB.Exec(stmt, userId, email, displayName, string(hashedPassword))
 	if err != nil {
-		// If this returns an error, we use the errors.As() function to check
-		// whether the error has the type *mysql.MySQLError. If it does, the
-		// error will be assigned to the mySQLError variable. We can then check
-		// whether or not the error relates to our users_uc_email key by
-		// checking if the error code equals 1062 and the contents of the error
-		// message string. If it does, we return an ErrDuplicateEmail error.
-		var mySQLError *mysql.MySQLError
-		if errors.As(err, &mySQLError) {
-			if mySQLError.Number == 1062 &&
-				strings.Contains(mySQLError.Message, "users_uc_email") {
-				return ErrDuplicateEmail
-			}
+		// If this returns an error, we ask the dialect whether it was caused
+		// by a unique key on the email column. Both MySQL and SQLite name the
+		// key or the column in the message. If it was, we return an
+		// ErrDuplicateEmail error.
+		if m.Dialect.IsDuplicateKey(err, "email") {
+			return ErrDuplicateEmail
 		}
 		return err
 	}
@@ -64,13 +104,16 @@ VALUES(?, ?, ?, ?, UTC_TIMESTAMP())`
 func (m *UserModel) Authenticate(email, password string) (string, error) {
 	// Retrieve the id and hashed password associated with the given email.
 
-	// If  no matching email exists we return the ErrInvalidCredentials error.
+	// If  no matching email exists we return the ErrInvalidCredentials error,
+	// after hashing the password all the same.
 	var userId string
 	var hashedPassword []byte
-	stmt := "SELECT userId, hashedPassword FROM users WHERE email = ?"
-	err := m.DB.QueryRow(stmt, email).Scan(&userId, &hashedPassword)
+	var disabledAt sql.NullTime
+	stmt := "SELECT userId, hashedPassword, disabledAt FROM users WHERE email = ?"
+	err := m.DB.QueryRow(stmt, email).Scan(&userId, &hashedPassword, &disabledAt)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
+			bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
 			return "Invalid credentials", ErrInvalidCredentials
 		} else {
 			return "", err
@@ -86,11 +129,306 @@ func (m *UserModel) Authenticate(email, password string) (string, error) {
 			return "", err
 		}
 	}
+	// The password is correct, but a disabled user may not log in. This is
+	// only told to whoever knows the password.
+	if disabledAt.Valid {
+		return "", ErrAccountDisabled
+	}
 	// Otherwise, the password is correct. Return the user ID.
 	return userId, nil
 
 }
 
+// Get returns the user with the id, or ErrNoRecord
+func (m *UserModel) Get(userId string) (*User, error) {
+	return m.getBy("userId", userId, "")
+}
+
+// GetForUpdate returns the user with the id, or ErrNoRecord, and locks their
+// row until the end of the transaction, so that checks made on behalf of the
+// user, such as rate limits, are not raced by a concurrent request
+func (m *UserModel) GetForUpdate(userId string) (*User, error) {
+	return m.getBy("userId", userId, m.Dialect.ForUpdate())
+}
+
+// GetByEmail returns the user with the email, or ErrNoRecord
+func (m *UserModel) GetByEmail(email string) (*User, error) {
+	return m.getBy("email", email, "")
+}
+
+// getBy returns the user whose unique column has the value
+func (m *UserModel) getBy(column, value, lock string) (*User, error) {
+	stmt := `SELECT ` + userColumns + ` FROM users WHERE ` + column + ` = ?` + lock
+
+	u, err := scanUser(m.DB.QueryRow(stmt, value))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+	return u, nil
+}
+
+// userColumns are the columns scanUser reads, in its order
+const userColumns = `userId, email, displayName, hashedPassword, createdAt, emailVerifiedAt, role, disabledAt`
+
+// scanUser reads the userColumns of a row into a User
+func scanUser(row interface{ Scan(dest ...any) error }) (*User, error) {
+	u := &User{}
+	var displayName sql.NullString
+	err := row.Scan(&u.UserId, &u.Email, &displayName, &u.HashedPassword, &u.CreatedAt, &u.EmailVerifiedAt, &u.Role, &u.DisabledAt)
+	if err != nil {
+		return nil, err
+	}
+	u.DisplayName = displayName.String
+	return u, nil
+}
+
+// Search returns the users matching the filter, the newest first
+func (m *UserModel) Search(filter UserFilter) ([]*User, error) {
+	conditions := []string{"1 = 1"}
+	args := []any{}
+
+	if filter.Query != "" {
+		// Match case-insensitively in every dialect, with the wildcards of
+		// LIKE escaped so that they are matched as they are
+		pattern := "%" + likeEscaper.Replace(strings.ToLower(filter.Query)) + "%"
+		conditions = append(conditions, "(LOWER(email) LIKE ? ESCAPE '!' OR LOWER(displayName) LIKE ? ESCAPE '!')")
+		args = append(args, pattern, pattern)
+	}
+	if filter.Role != "" {
+		conditions = append(conditions, "role = ?")
+		args = append(args, filter.Role)
+	}
+	switch filter.Status {
+	case UserStatusActive:
+		conditions = append(conditions, "disabledAt IS NULL")
+	case UserStatusDisabled:
+		conditions = append(conditions, "disabledAt IS NOT NULL")
+	}
+
+	stmt := `SELECT ` + userColumns + `
+			FROM users
+			WHERE ` + strings.Join(conditions, " and ") + `
+			ORDER BY createdAt DESC, userId
+			LIMIT ? OFFSET ?`
+	args = append(args, filter.Limit, filter.Offset)
+
+	rows, err := m.DB.Query(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// likeEscaper escapes the wildcards of a LIKE pattern, with ! as the escape
+// character since a backslash means something else to each dialect
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// SetRole gives the user the role. Returns ErrNoRecord if the user does not
+// exist.
+func (m *UserModel) SetRole(userId, role string) error {
+	result, err := m.DB.Exec(`UPDATE users SET role = ? WHERE userId = ?`, role, userId)
+	if err != nil {
+		return err
+	}
+	return m.checkUpdated(result, userId)
+}
+
+// SetDisabled disables the user from now on, or enables them again. A
+// disabled user keeps the time they were disabled at. Returns ErrNoRecord if
+// the user does not exist.
+func (m *UserModel) SetDisabled(userId string, disabled bool) error {
+	stmt := `UPDATE users SET disabledAt = NULL WHERE userId = ?`
+	if disabled {
+		stmt = `UPDATE users SET disabledAt = COALESCE(disabledAt, ` + m.Dialect.Now() + `) WHERE userId = ?`
+	}
+	result, err := m.DB.Exec(stmt, userId)
+	if err != nil {
+		return err
+	}
+	return m.checkUpdated(result, userId)
+}
+
+// checkUpdated returns ErrNoRecord if an update of the user found no row.
+// MySQL only counts the rows it changed, so a user left as they were is
+// looked up.
+func (m *UserModel) checkUpdated(result sql.Result, userId string) error {
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		exists, err := m.Exists(userId)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrNoRecord
+		}
+	}
+	return nil
+}
+
+// UpdatePassword replaces the password of the user with a bcrypt hash of
+// password. Returns ErrNoRecord if the user does not exist.
+func (m *UserModel) UpdatePassword(userId, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	if err != nil {
+		return err
+	}
+
+	stmt := `UPDATE users SET hashedPassword = ? WHERE userId = ?`
+	result, err := m.DB.Exec(stmt, string(hashedPassword), userId)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrNoRecord
+	}
+	return nil
+}
+
+// UpdateDisplayName replaces the display name of the user. Returns
+// ErrNoRecord if the user does not exist.
+func (m *UserModel) UpdateDisplayName(userId, displayName string) error {
+	result, err := m.DB.Exec(`UPDATE users SET displayName = ? WHERE userId = ?`, displayName, userId)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	// MySQL only counts the rows it changed, and the name may be the same
+	if rowsAffected == 0 {
+		exists, err := m.Exists(userId)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrNoRecord
+		}
+	}
+	return nil
+}
+
+// UpdateEmail replaces the email of the user, which has to be verified
+// again. Returns ErrDuplicateEmail if another user has the email, and
+// ErrNoRecord if the user does not exist.
+func (m *UserModel) UpdateEmail(userId, email string) error {
+	stmt := `UPDATE users SET email = ?, emailVerifiedAt = NULL WHERE userId = ?`
+	result, err := m.DB.Exec(stmt, email, userId)
+	if err != nil {
+		if m.Dialect.IsDuplicateKey(err, "email") {
+			return ErrDuplicateEmail
+		}
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrNoRecord
+	}
+	return nil
+}
+
+// userTables are the tables that hold the data of a user, in the order
+// their rows are deleted in, the rows that reference others first
+var userTables = []string{
+	"expenses",
+	"expensecategory",
+	"budget",
+	"webhook_deliveries",
+	"webhooks",
+	"idempotency_keys",
+	"password_resets",
+	"email_verifications",
+	"recovery_codes",
+	"api_tokens",
+	"user_identities",
+	"user_sessions",
+	"audit_log",
+}
+
+// Delete removes the user and every row of their data. Run it in a
+// transaction, so that the account is deleted whole or not at all. Returns
+// ErrNoRecord if the user does not exist.
+func (m *UserModel) Delete(userId string) error {
+	for _, table := range userTables {
+		_, err := m.DB.Exec(`DELETE FROM `+table+` WHERE userId = ?`, userId)
+		if err != nil {
+			return fmt.Errorf("deleting %s: %w", table, err)
+		}
+	}
+
+	result, err := m.DB.Exec(`DELETE FROM users WHERE userId = ?`, userId)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrNoRecord
+	}
+	return nil
+}
+
+// IsEmailVerified reports whether the user verified their email address.
+// Returns ErrNoRecord if the user does not exist.
+func (m *UserModel) IsEmailVerified(userId string) (bool, error) {
+	var verifiedAt sql.NullTime
+	err := m.DB.QueryRow(`SELECT emailVerifiedAt FROM users WHERE userId = ?`, userId).Scan(&verifiedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, ErrNoRecord
+		}
+		return false, err
+	}
+	return verifiedAt.Valid, nil
+}
+
+// MarkEmailVerified records that the user verified their email address now,
+// unless they already had. Returns ErrNoRecord if the user does not exist.
+func (m *UserModel) MarkEmailVerified(userId string) error {
+	stmt := `UPDATE users SET emailVerifiedAt = COALESCE(emailVerifiedAt, ` + m.Dialect.Now() + `)
+			WHERE userId = ?`
+	result, err := m.DB.Exec(stmt, userId)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrNoRecord
+	}
+	return nil
+}
+
 // Exists method checks if a user exists with a specific ID.
 func (m *UserModel) Exists(userId string) (bool, error) {
 	var exists bool
@@ -101,6 +439,16 @@ func (m *UserModel) Exists(userId string) (bool, error) {
 	return exists, err
 }
 
+// IsActive reports whether a user exists with the id and is not disabled
+func (m *UserModel) IsActive(userId string) (bool, error) {
+	var active bool
+	stmt := "SELECT EXISTS(SELECT true FROM users WHERE userId = ? AND disabledAt IS NULL)"
+
+	err := m.DB.QueryRow(stmt, userId).Scan(&active)
+
+	return active, err
+}
+
 // Find username based on UserId
 func (m *UserModel) GetUserNameByUserId(userId string) (string, error) {
 	stmt := `SELECT displayName 
@@ -114,3 +462,26 @@ func (m *UserModel) GetUserNameByUserId(userId string) (string, error) {
 	}
 	return userName, nil
 }
+
+// return the ids of all users, oldest first
+func (m *UserModel) AllIds() ([]string, error) {
+	rows, err := m.DB.Query(`SELECT userId FROM users ORDER BY createdAt`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	userIds := []string{}
+	for rows.Next() {
+		var userId string
+		err = rows.Scan(&userId)
+		if err != nil {
+			return nil, err
+		}
+		userIds = append(userIds, userId)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return userIds, nil
+}
@@ -0,0 +1,57 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// define UserIdentity type, an account of an OpenID Connect provider linked
+// to a user. Subject is the id the provider gives the account, it does not
+// change when the email of the account does.
+type UserIdentity struct {
+	Provider  string
+	Subject   string
+	UserId    string
+	Email     string
+	CreatedAt time.Time
+}
+
+// define UserIdentityModel type which wraps a sql.DB connection pool, or a
+// transaction
+type UserIdentityModel struct {
+	DB      DBTX
+	Dialect Dialect
+}
+
+// Insert links the account of the provider to the user. Returns
+// ErrDuplicateIdentity if the account is already linked.
+func (m *UserIdentityModel) Insert(provider, subject, userId, email string) error {
+	stmt := `INSERT INTO user_identities (provider, subject, userId, email, createdAt)
+			VALUES (?, ?, ?, ?, ` + m.Dialect.Now() + `)`
+	_, err := m.DB.Exec(stmt, provider, subject, userId, email)
+	if err != nil {
+		if m.Dialect.IsDuplicateKey(err, "") {
+			return ErrDuplicateIdentity
+		}
+		return err
+	}
+	return nil
+}
+
+// Get returns the identity of the account of the provider. Returns
+// ErrNoRecord if the account is not linked to a user.
+func (m *UserIdentityModel) Get(provider, subject string) (*UserIdentity, error) {
+	stmt := `SELECT provider, subject, userId, email, createdAt
+			FROM user_identities WHERE provider = ? AND subject = ?`
+
+	i := &UserIdentity{}
+	err := m.DB.QueryRow(stmt, provider, subject).Scan(&i.Provider, &i.Subject, &i.UserId, &i.Email, &i.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+	return i, nil
+}
@@ -0,0 +1,108 @@
+package models
+
+import "time"
+
+// define UserSession type, a session a user is logged in with. Token is the
+// token of the session in the session store, it is never shown; SessionId
+// tells the sessions apart instead.
+type UserSession struct {
+	Token     string
+	SessionId string
+	UserId    string
+	IP        string
+	UserAgent string
+	// CreatedAt is nil for the sessions logged in before they were recorded
+	CreatedAt  *time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+}
+
+// define UserSessionModel type which wraps a sql.DB connection pool, or a
+// transaction
+type UserSessionModel struct {
+	DB      DBTX
+	Dialect Dialect
+}
+
+// Insert records a session of the user, last seen now
+func (m *UserSessionModel) Insert(s *UserSession) error {
+	var createdAt *time.Time
+	if s.CreatedAt != nil {
+		t := s.CreatedAt.UTC()
+		createdAt = &t
+	}
+	stmt := `INSERT INTO user_sessions (token, sessionId, userId, ip, userAgent, createdAt, lastSeenAt, expiresAt)
+			VALUES (?, ?, ?, ?, ?, ?, ` + m.Dialect.Now() + `, ?)`
+	_, err := m.DB.Exec(stmt, s.Token, s.SessionId, s.UserId, s.IP, s.UserAgent, createdAt, s.ExpiresAt.UTC())
+	return err
+}
+
+// Touch records that the session was used now, from the address and user
+// agent of s, and records the session as s if it was not recorded yet
+func (m *UserSessionModel) Touch(s *UserSession) error {
+	stmt := `UPDATE user_sessions SET ip = ?, userAgent = ?, lastSeenAt = ` + m.Dialect.Now() + `, expiresAt = ?
+			WHERE token = ?`
+	result, err := m.DB.Exec(stmt, s.IP, s.UserAgent, s.ExpiresAt.UTC(), s.Token)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected > 0 {
+		return nil
+	}
+
+	err = m.Insert(s)
+	// MySQL does not count a row the update left as it was, the session
+	// was recorded already
+	if err != nil && !m.Dialect.IsDuplicateKey(err, "") {
+		return err
+	}
+	return nil
+}
+
+// All returns the sessions of the user which have not expired, the most
+// recently used first
+func (m *UserSessionModel) All(userId string) ([]*UserSession, error) {
+	stmt := `SELECT token, sessionId, userId, ip, userAgent, createdAt, lastSeenAt, expiresAt
+			FROM user_sessions WHERE userId = ? AND expiresAt > ?
+			ORDER BY lastSeenAt DESC`
+
+	rows, err := m.DB.Query(stmt, userId, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*UserSession{}
+	for rows.Next() {
+		s := &UserSession{}
+		err = rows.Scan(&s.Token, &s.SessionId, &s.UserId, &s.IP, &s.UserAgent, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// Delete forgets the session, if it was recorded
+func (m *UserSessionModel) Delete(token string) error {
+	_, err := m.DB.Exec(`DELETE FROM user_sessions WHERE token = ?`, token)
+	return err
+}
+
+// DeleteExpired deletes the sessions that expired before the time, and
+// returns how many it deleted
+func (m *UserSessionModel) DeleteExpired(before time.Time) (int64, error) {
+	result, err := m.DB.Exec(`DELETE FROM user_sessions WHERE expiresAt < ?`, before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
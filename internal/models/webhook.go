@@ -0,0 +1,267 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Status of a webhook delivery
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// define Webhook type, an endpoint of the user which receives the events
+// listed in Events, or every event if Events is empty
+type Webhook struct {
+	WebhookId string
+	UserId    string
+	URL       string
+	Secret    string
+	Events    []string
+	CreatedAt time.Time
+}
+
+// Wants returns true if the webhook subscribed to the event type
+func (wh *Webhook) Wants(eventType string) bool {
+	return len(wh.Events) == 0 || slices.Contains(wh.Events, eventType)
+}
+
+// define WebhookDelivery type, a row of the outbox. URL and Secret are those
+// of the webhook, they are only filled in for deliveries that are due.
+type WebhookDelivery struct {
+	DeliveryId     string
+	WebhookId      string
+	UserId         string
+	EventId        string
+	EventType      string
+	Payload        []byte
+	Status         string
+	Attempts       int
+	NextAttemptAt  time.Time
+	LastStatusCode int
+	LastError      string
+	CreatedAt      time.Time
+	DeliveredAt    *time.Time
+	URL            string
+	Secret         string
+}
+
+// define WebhookModel type which wraps a sql.DB connection pool, or a
+// transaction
+type WebhookModel struct {
+	DB      DBTX
+	Dialect Dialect
+}
+
+// insert a new webhook into the database
+func (m *WebhookModel) Insert(webhookId, userId, url, secret string, events []string) error {
+	stmt := `INSERT INTO webhooks (webhookId, userId, url, secret, events, createdAt)
+			VALUES(?, ?, ?, ?, ?, ` + m.Dialect.Now() + `)`
+
+	_, err := m.DB.Exec(stmt, webhookId, userId, url, secret, strings.Join(events, ","))
+	return err
+}
+
+// return a specific webhook of the user
+func (m *WebhookModel) Get(webhookId, userId string) (*Webhook, error) {
+	stmt := `SELECT webhookId, userId, url, secret, events, createdAt
+			FROM webhooks WHERE webhookId = ? and userId = ?`
+
+	wh, err := scanWebhook(m.DB.QueryRow(stmt, webhookId, userId))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+	return wh, nil
+}
+
+// return all webhooks of the user
+func (m *WebhookModel) All(userId string) ([]*Webhook, error) {
+	stmt := `SELECT webhookId, userId, url, secret, events, createdAt
+			FROM webhooks WHERE userId = ?
+			ORDER BY createdAt`
+
+	rows, err := m.DB.Query(stmt, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []*Webhook{}
+	for rows.Next() {
+		wh, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, wh)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+// delete a webhook of the user together with its deliveries
+func (m *WebhookModel) Delete(webhookId, userId string) error {
+	return inTx(m.DB, func(tx DBTX) error {
+		_, err := tx.Exec(`DELETE FROM webhook_deliveries WHERE webhookId = ? and userId = ?`, webhookId, userId)
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.Exec(`DELETE FROM webhooks WHERE webhookId = ? and userId = ?`, webhookId, userId)
+		if err != nil {
+			return err
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rowsAffected == 0 {
+			return ErrNoRecord
+		}
+		return nil
+	})
+}
+
+// Enqueue adds a pending delivery of the event to every webhook of the user
+// that subscribed to it. Run it in the transaction of the change the event
+// describes, so that the event is stored if and only if the change is.
+func (m *WebhookModel) Enqueue(userId, eventId, eventType string, payload []byte) error {
+	webhooks, err := m.All(userId)
+	if err != nil {
+		return err
+	}
+
+	stmt := `INSERT INTO webhook_deliveries (deliveryId, webhookId, userId, eventId, eventType, payload, status, attempts, nextAttemptAt, createdAt)
+			VALUES(?, ?, ?, ?, ?, ?, ?, 0, ` + m.Dialect.Now() + `, ` + m.Dialect.Now() + `)`
+	for _, wh := range webhooks {
+		if !wh.Wants(eventType) {
+			continue
+		}
+		_, err = m.DB.Exec(stmt, uuid.New().String(), wh.WebhookId, userId, eventId, eventType, payload, DeliveryPending)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DueDeliveries returns up to limit pending deliveries whose next attempt is
+// due, oldest first
+func (m *WebhookModel) DueDeliveries(limit int) ([]*WebhookDelivery, error) {
+	stmt := `SELECT d.deliveryId, d.webhookId, d.userId, d.eventId, d.eventType, d.payload, d.status, d.attempts,
+			d.nextAttemptAt, d.lastStatusCode, d.lastError, d.createdAt, d.deliveredAt, w.url, w.secret
+			FROM webhook_deliveries d
+			JOIN webhooks w ON w.webhookId = d.webhookId
+			WHERE d.status = ? and d.nextAttemptAt <= ` + m.Dialect.Now() + `
+			ORDER BY d.nextAttemptAt
+			LIMIT ?`
+
+	return m.queryDeliveries(stmt, DeliveryPending, limit)
+}
+
+// Deliveries returns the latest deliveries of a webhook of the user, newest first
+func (m *WebhookModel) Deliveries(webhookId, userId string, limit int) ([]*WebhookDelivery, error) {
+	stmt := `SELECT d.deliveryId, d.webhookId, d.userId, d.eventId, d.eventType, d.payload, d.status, d.attempts,
+			d.nextAttemptAt, d.lastStatusCode, d.lastError, d.createdAt, d.deliveredAt, '', ''
+			FROM webhook_deliveries d
+			WHERE d.webhookId = ? and d.userId = ?
+			ORDER BY d.createdAt DESC
+			LIMIT ?`
+
+	return m.queryDeliveries(stmt, webhookId, userId, limit)
+}
+
+// MarkDelivered records a successful attempt
+func (m *WebhookModel) MarkDelivered(deliveryId string, statusCode int) error {
+	stmt := `UPDATE webhook_deliveries
+			SET status = ?,
+			attempts = attempts + 1,
+			lastStatusCode = ?,
+			lastError = NULL,
+			deliveredAt = ` + m.Dialect.Now() + `
+			WHERE deliveryId = ?`
+
+	_, err := m.DB.Exec(stmt, DeliveryDelivered, statusCode, deliveryId)
+	return err
+}
+
+// MarkAttemptFailed records a failed attempt. The delivery is retried at
+// nextAttemptAt, or marked as failed for good if giveUp is set.
+func (m *WebhookModel) MarkAttemptFailed(deliveryId string, statusCode int, lastError string, nextAttemptAt time.Time, giveUp bool) error {
+	status := DeliveryPending
+	if giveUp {
+		status = DeliveryFailed
+	}
+
+	stmt := `UPDATE webhook_deliveries
+			SET status = ?,
+			attempts = attempts + 1,
+			lastStatusCode = ?,
+			lastError = ?,
+			nextAttemptAt = ?
+			WHERE deliveryId = ?`
+
+	_, err := m.DB.Exec(stmt, status, statusCode, lastError, nextAttemptAt.UTC(), deliveryId)
+	return err
+}
+
+func (m *WebhookModel) queryDeliveries(stmt string, args ...any) ([]*WebhookDelivery, error) {
+	rows, err := m.DB.Query(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []*WebhookDelivery{}
+	for rows.Next() {
+		d := &WebhookDelivery{}
+		var lastStatusCode sql.NullInt64
+		var lastError sql.NullString
+		var deliveredAt sql.NullTime
+		err = rows.Scan(&d.DeliveryId, &d.WebhookId, &d.UserId, &d.EventId, &d.EventType, &d.Payload, &d.Status, &d.Attempts,
+			&d.NextAttemptAt, &lastStatusCode, &lastError, &d.CreatedAt, &deliveredAt, &d.URL, &d.Secret)
+		if err != nil {
+			return nil, err
+		}
+		d.LastStatusCode = int(lastStatusCode.Int64)
+		d.LastError = lastError.String
+		if deliveredAt.Valid {
+			d.DeliveredAt = &deliveredAt.Time
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanWebhook(row rowScanner) (*Webhook, error) {
+	wh := &Webhook{}
+	var events string
+	err := row.Scan(&wh.WebhookId, &wh.UserId, &wh.URL, &wh.Secret, &events, &wh.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if events != "" {
+		wh.Events = strings.Split(events, ",")
+	}
+	return wh, nil
+}
@@ -0,0 +1,117 @@
+// Package pgstore is a Postgres session store for scs, the counterpart of
+// scs/mysqlstore for the Postgres storage backend. It uses the sessions
+// table created by the migrations.
+package pgstore
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+// defaultCleanupInterval is how often expired sessions are deleted
+const defaultCleanupInterval = 5 * time.Minute
+
+// define PostgresStore type which wraps a sql.DB connection pool
+type PostgresStore struct {
+	db          *sql.DB
+	stopCleanup chan bool
+}
+
+// New returns a store which deletes expired sessions every five minutes
+func New(db *sql.DB) *PostgresStore {
+	return NewWithCleanupInterval(db, defaultCleanupInterval)
+}
+
+// NewWithCleanupInterval returns a store which deletes expired sessions at
+// the given interval, or never if it is zero
+func NewWithCleanupInterval(db *sql.DB, cleanupInterval time.Duration) *PostgresStore {
+	p := &PostgresStore{db: db}
+	if cleanupInterval > 0 {
+		p.stopCleanup = make(chan bool)
+		go p.startCleanup(cleanupInterval)
+	}
+	return p
+}
+
+// Find returns the data of a session which has not expired
+func (p *PostgresStore) Find(token string) ([]byte, bool, error) {
+	var b []byte
+	stmt := `SELECT data FROM sessions WHERE token = $1 AND current_timestamp < expiry`
+	err := p.db.QueryRow(stmt, token).Scan(&b)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return b, true, nil
+}
+
+// Commit adds the session, or replaces its data and expiry
+func (p *PostgresStore) Commit(token string, b []byte, expiry time.Time) error {
+	stmt := `INSERT INTO sessions (token, data, expiry) VALUES ($1, $2, $3)
+			ON CONFLICT (token) DO UPDATE SET data = EXCLUDED.data, expiry = EXCLUDED.expiry`
+	_, err := p.db.Exec(stmt, token, b, expiry)
+	return err
+}
+
+// Delete removes the session
+func (p *PostgresStore) Delete(token string) error {
+	_, err := p.db.Exec(`DELETE FROM sessions WHERE token = $1`, token)
+	return err
+}
+
+// All returns the data of every session which has not expired
+func (p *PostgresStore) All() (map[string][]byte, error) {
+	rows, err := p.db.Query(`SELECT token, data FROM sessions WHERE current_timestamp < expiry`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := map[string][]byte{}
+	for rows.Next() {
+		var token string
+		var data []byte
+		err = rows.Scan(&token, &data)
+		if err != nil {
+			return nil, err
+		}
+		sessions[token] = data
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (p *PostgresStore) startCleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := p.deleteExpired()
+			if err != nil {
+				log.Println(err)
+			}
+		case <-p.stopCleanup:
+			return
+		}
+	}
+}
+
+// StopCleanup stops the goroutine which deletes expired sessions
+func (p *PostgresStore) StopCleanup() {
+	if p.stopCleanup != nil {
+		p.stopCleanup <- true
+	}
+}
+
+func (p *PostgresStore) deleteExpired() error {
+	_, err := p.db.Exec(`DELETE FROM sessions WHERE expiry < current_timestamp`)
+	return err
+}
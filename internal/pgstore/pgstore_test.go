@@ -0,0 +1,98 @@
+package pgstore_test
+
+import (
+	"database/sql"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"kweeuhree.personal-budgeting-backend/internal/migrations"
+	"kweeuhree.personal-budgeting-backend/internal/models"
+	"kweeuhree.personal-budgeting-backend/internal/pgstore"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// openTestDB opens the Postgres database of TEST_POSTGRES_DSN and applies
+// the migrations, or skips the test if it is not set
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("TEST_POSTGRES_DSN is not set")
+	}
+
+	db, err := sql.Open(models.Postgres.Driver(), dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	migrator, err := migrations.New(db, models.Postgres, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestPostgresStore(t *testing.T) {
+	db := openTestDB(t)
+	store := pgstore.NewWithCleanupInterval(db, 0)
+
+	token := uuid.New().String()
+	expired := uuid.New().String()
+	t.Cleanup(func() {
+		store.Delete(token)
+		store.Delete(expired)
+	})
+
+	_, found, err := store.Find(token)
+	if err != nil || found {
+		t.Fatalf("Find() of an unknown token = %t, %v; want false, nil", found, err)
+	}
+
+	// The second commit replaces the data of the first
+	for _, data := range []string{"first", "second"} {
+		err = store.Commit(token, []byte(data), time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, found, err := store.Find(token)
+	if err != nil || !found || string(data) != "second" {
+		t.Fatalf("Find() = %q, %t, %v; want \"second\", true, nil", data, found, err)
+	}
+
+	err = store.Commit(expired, []byte("expired"), time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ = store.Find(expired); found {
+		t.Error("found an expired session")
+	}
+
+	all, err := store.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(all[token]) != "second" {
+		t.Errorf("All() has %q for the session; want \"second\"", all[token])
+	}
+	if _, ok := all[expired]; ok {
+		t.Error("All() has the expired session")
+	}
+
+	if err = store.Delete(token); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ = store.Find(token); found {
+		t.Error("found the deleted session")
+	}
+}
@@ -0,0 +1,118 @@
+// Package sqlitestore is an SQLite session store for scs, the counterpart of
+// scs/mysqlstore for the SQLite storage backend. It uses the sessions table
+// created by the migrations, whose expiry is a Unix time in milliseconds.
+package sqlitestore
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
+
+// defaultCleanupInterval is how often expired sessions are deleted
+const defaultCleanupInterval = 5 * time.Minute
+
+// define SQLiteStore type which wraps a sql.DB connection pool
+type SQLiteStore struct {
+	db          *sql.DB
+	stopCleanup chan bool
+}
+
+// New returns a store which deletes expired sessions every five minutes
+func New(db *sql.DB) *SQLiteStore {
+	return NewWithCleanupInterval(db, defaultCleanupInterval)
+}
+
+// NewWithCleanupInterval returns a store which deletes expired sessions at
+// the given interval, or never if it is zero
+func NewWithCleanupInterval(db *sql.DB, cleanupInterval time.Duration) *SQLiteStore {
+	s := &SQLiteStore{db: db}
+	if cleanupInterval > 0 {
+		s.stopCleanup = make(chan bool)
+		go s.startCleanup(cleanupInterval)
+	}
+	return s
+}
+
+// Find returns the data of a session which has not expired
+func (s *SQLiteStore) Find(token string) ([]byte, bool, error) {
+	var b []byte
+	stmt := `SELECT data FROM sessions WHERE token = ? AND expiry > ?`
+	err := s.db.QueryRow(stmt, token, time.Now().UnixMilli()).Scan(&b)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return b, true, nil
+}
+
+// Commit adds the session, or replaces its data and expiry
+func (s *SQLiteStore) Commit(token string, b []byte, expiry time.Time) error {
+	stmt := models.SQLite.Upsert("sessions", []string{"token"}, []string{"token", "data", "expiry"})
+	_, err := s.db.Exec(stmt, token, b, expiry.UnixMilli())
+	return err
+}
+
+// Delete removes the session
+func (s *SQLiteStore) Delete(token string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE token = ?`, token)
+	return err
+}
+
+// All returns the data of every session which has not expired
+func (s *SQLiteStore) All() (map[string][]byte, error) {
+	rows, err := s.db.Query(`SELECT token, data FROM sessions WHERE expiry > ?`, time.Now().UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := map[string][]byte{}
+	for rows.Next() {
+		var token string
+		var data []byte
+		err = rows.Scan(&token, &data)
+		if err != nil {
+			return nil, err
+		}
+		sessions[token] = data
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (s *SQLiteStore) startCleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := s.deleteExpired()
+			if err != nil {
+				log.Println(err)
+			}
+		case <-s.stopCleanup:
+			return
+		}
+	}
+}
+
+// StopCleanup stops the goroutine which deletes expired sessions
+func (s *SQLiteStore) StopCleanup() {
+	if s.stopCleanup != nil {
+		s.stopCleanup <- true
+	}
+}
+
+func (s *SQLiteStore) deleteExpired() error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE expiry <= ?`, time.Now().UnixMilli())
+	return err
+}
@@ -0,0 +1,139 @@
+package sqlitestore_test
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"kweeuhree.personal-budgeting-backend/internal/migrations"
+	"kweeuhree.personal-budgeting-backend/internal/models"
+	"kweeuhree.personal-budgeting-backend/internal/sqlitestore"
+)
+
+// openTestDB opens an SQLite database in a temporary file and applies the
+// migrations
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := fmt.Sprintf("file:%s?_foreign_keys=on&_busy_timeout=5000&_txlock=immediate&_journal_mode=WAL",
+		filepath.Join(t.TempDir(), "budgeting.db"))
+	db, err := sql.Open(models.SQLite.Driver(), dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	migrator, err := migrations.New(db, models.SQLite, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestSQLiteStore(t *testing.T) {
+	db := openTestDB(t)
+	store := sqlitestore.NewWithCleanupInterval(db, 0)
+
+	_, found, err := store.Find("session")
+	if err != nil || found {
+		t.Fatalf("Find() of an unknown token = %t, %v; want false, nil", found, err)
+	}
+
+	// The second commit replaces the data of the first
+	expiry := time.Now().Add(time.Hour)
+	for _, data := range []string{"first", "second"} {
+		err = store.Commit("session", []byte(data), expiry)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, found, err := store.Find("session")
+	if err != nil || !found || string(data) != "second" {
+		t.Fatalf("Find() = %q, %t, %v; want \"second\", true, nil", data, found, err)
+	}
+
+	// The expiry is stored in Unix milliseconds
+	var stored int64
+	err = db.QueryRow(`SELECT expiry FROM sessions WHERE token = ?`, "session").Scan(&stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != expiry.UnixMilli() {
+		t.Errorf("got expiry %d; want %d", stored, expiry.UnixMilli())
+	}
+
+	err = store.Commit("expired", []byte("expired"), time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ = store.Find("expired"); found {
+		t.Error("found an expired session")
+	}
+
+	all, err := store.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || string(all["session"]) != "second" {
+		t.Errorf("All() = %q; want only the session with \"second\"", all)
+	}
+
+	if err = store.Delete("session"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ = store.Find("session"); found {
+		t.Error("found the deleted session")
+	}
+	// Deleting a session that does not exist is not an error
+	if err = store.Delete("session"); err != nil {
+		t.Error(err)
+	}
+}
+
+// The cleanup deletes the rows of expired sessions and keeps the others
+func TestSQLiteStoreCleanup(t *testing.T) {
+	db := openTestDB(t)
+	store := sqlitestore.NewWithCleanupInterval(db, 10*time.Millisecond)
+	defer store.StopCleanup()
+
+	err := store.Commit("expired", []byte("expired"), time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Commit("session", []byte("session"), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var tokens []string
+		rows, err := db.Query(`SELECT token FROM sessions`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			var token string
+			if err := rows.Scan(&token); err != nil {
+				t.Fatal(err)
+			}
+			tokens = append(tokens, token)
+		}
+		rows.Close()
+
+		if len(tokens) == 1 && tokens[0] == "session" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got sessions %v; want only the unexpired one", tokens)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
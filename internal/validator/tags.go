@@ -0,0 +1,165 @@
+package validator
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ValidateStruct() checks every field of the struct pointed to by s against
+// the constraints declared in its `validate` struct tag, and records a field
+// error for the first constraint each field fails. Errors are keyed by the
+// field's json name, so they line up with the request body the user sent.
+//
+// Constraints are comma separated:
+//
+//	required          string must not be blank, number must not be zero
+//	positive          number must be greater than zero
+//	min=N, max=N      number must be at least / no more than N
+//	minchars=N        string must contain at least N characters
+//	maxchars=N        string must contain no more than N characters
+//	oneof=a|b         string must be one of the listed values
+//	email             string must be a valid email address
+//	uuid              string must be a canonically formatted UUID
+//	url               string must be an absolute http or https URL
+//	date=LAYOUT       string must parse as a date in the time layout
+//
+// Format constraints (oneof, email, uuid, url, date) are skipped for empty
+// strings, pair them with required when the field is mandatory. Fields without
+// a `validate` tag, including the embedded Validator, are ignored.
+//
+// Pointer fields are checked against the value they point to. A nil pointer
+// means the field was left out of a partial update and is skipped entirely,
+// so required on a pointer field only rejects values that are present but blank.
+//
+// ValidateStruct() panics if a tag is malformed, as that is a programming error.
+func (v *Validator) ValidateStruct(s any) {
+	rv := reflect.ValueOf(s)
+	if rv.Kind() == reflect.Pointer {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("validator: ValidateStruct expects a struct, got %s", rv.Kind()))
+	}
+
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		tag, ok := field.Tag.Lookup("validate")
+		if !ok || tag == "" || tag == "-" {
+			continue
+		}
+
+		value := rv.Field(i)
+		if value.Kind() == reflect.Pointer {
+			if value.IsNil() {
+				continue
+			}
+			value = value.Elem()
+		}
+
+		key := fieldKey(field)
+		for _, rule := range strings.Split(tag, ",") {
+			name, param, _ := strings.Cut(strings.TrimSpace(rule), "=")
+			ok, message := checkRule(value, name, param)
+			if !ok {
+				v.AddFieldError(key, message)
+				break
+			}
+		}
+	}
+}
+
+// fieldKey() returns the json name of a struct field, falling back to the Go name.
+func fieldKey(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" || name == "-" {
+		return field.Name
+	}
+	return name
+}
+
+// checkRule() applies a single constraint to a field value and returns
+// whether it passed together with the message to report if it did not.
+func checkRule(value reflect.Value, name, param string) (bool, string) {
+	switch value.Kind() {
+	case reflect.String:
+		return checkStringRule(value.String(), name, param)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return checkIntRule(value.Int(), name, param)
+	default:
+		panic(fmt.Sprintf("validator: unsupported field kind %s", value.Kind()))
+	}
+}
+
+// skippedWhenEmpty lists the string rules which only apply when a value was
+// provided
+var skippedWhenEmpty = map[string]bool{
+	"maxchars": true,
+	"oneof":    true,
+	"email":    true,
+	"uuid":     true,
+	"url":      true,
+	"date":     true,
+}
+
+func checkStringRule(value, name, param string) (bool, string) {
+	// Format checks only apply when a value was provided
+	if value == "" && skippedWhenEmpty[name] {
+		return true, ""
+	}
+
+	switch name {
+	case "required":
+		return NotBlank(value), "This field cannot be blank"
+	case "minchars":
+		n := intParam(name, param)
+		return MinChars(value, n), fmt.Sprintf("This field must be at least %d characters long", n)
+	case "maxchars":
+		n := intParam(name, param)
+		return MaxChars(value, n), fmt.Sprintf("This field cannot be more than %d characters long", n)
+	case "oneof":
+		permitted := strings.Split(param, "|")
+		return PermittedValue(value, permitted...), fmt.Sprintf("This field must be one of: %s", strings.Join(permitted, ", "))
+	case "email":
+		return Matches(value, EmailRX), "This field must be a valid email address"
+	case "uuid":
+		return IsUUID(value), "This field must be a valid id"
+	case "url":
+		return IsURL(value), "This field must be a valid http or https URL"
+	case "date":
+		return ValidDate(value, param), fmt.Sprintf("This field must be a valid date (%s)", param)
+	default:
+		panic(fmt.Sprintf("validator: unknown string rule %q", name))
+	}
+}
+
+func checkIntRule(value int64, name, param string) (bool, string) {
+	switch name {
+	case "required":
+		return value != 0, "This field cannot be blank"
+	case "positive":
+		return Positive(value), "This field must be greater than zero"
+	case "min":
+		n := int64Param(name, param)
+		return value >= n, fmt.Sprintf("This field must be at least %d", n)
+	case "max":
+		n := int64Param(name, param)
+		return value <= n, fmt.Sprintf("This field cannot be more than %d", n)
+	default:
+		panic(fmt.Sprintf("validator: unknown number rule %q", name))
+	}
+}
+
+func intParam(name, param string) int {
+	return int(int64Param(name, param))
+}
+
+func int64Param(name, param string) int64 {
+	n, err := strconv.ParseInt(param, 10, 64)
+	if err != nil {
+		panic(fmt.Sprintf("validator: rule %q needs a numeric parameter, got %q", name, param))
+	}
+	return n
+}
@@ -0,0 +1,187 @@
+package validator_test
+
+import (
+	"reflect"
+	"testing"
+
+	"kweeuhree.personal-budgeting-backend/internal/validator"
+)
+
+type moneyInput struct {
+	AmountInCents       int64  `json:"amountInCents" validate:"positive,max=100000000000000"`
+	Balance             int64  `json:"balance" validate:"min=0,max=100"`
+	ExpenseType         string `json:"expenseType" validate:"required,oneof=checkingBalance|savingsBalance"`
+	Untagged            int64
+	validator.Validator `json:"-"`
+}
+
+type textInput struct {
+	Name                string `json:"name" validate:"required,minchars=2,maxchars=5"`
+	Email               string `json:"email" validate:"email"`
+	Id                  string `json:"id" validate:"uuid"`
+	URL                 string `json:"url" validate:"url"`
+	Day                 string `json:"day" validate:"date=2006-01-02"`
+	NoJSONName          string `validate:"maxchars=1"`
+	validator.Validator `json:"-"`
+}
+
+type patchInput struct {
+	Name                *string `json:"name" validate:"required,maxchars=5"`
+	AmountInCents       *int64  `json:"amountInCents" validate:"positive"`
+	validator.Validator `json:"-"`
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestValidateStruct(t *testing.T) {
+	tests := []struct {
+		name  string
+		input any
+		want  map[string]string
+	}{
+		{
+			name:  "valid money",
+			input: &moneyInput{AmountInCents: 1, Balance: 100, ExpenseType: "savingsBalance"},
+			want:  nil,
+		},
+		{
+			name:  "money out of range",
+			input: &moneyInput{AmountInCents: 100000000000001, Balance: -1, ExpenseType: "cash"},
+			want: map[string]string{
+				"amountInCents": "This field cannot be more than 100000000000000",
+				"balance":       "This field must be at least 0",
+				"expenseType":   "This field must be one of: checkingBalance, savingsBalance",
+			},
+		},
+		{
+			// Only the first failed constraint of a field is reported
+			name:  "first failure wins",
+			input: &moneyInput{AmountInCents: 0, Balance: 101},
+			want: map[string]string{
+				"amountInCents": "This field must be greater than zero",
+				"balance":       "This field cannot be more than 100",
+				"expenseType":   "This field cannot be blank",
+			},
+		},
+		{
+			name:  "valid text",
+			input: &textInput{Name: "abc", Email: "a@example.com", Id: "0b6f9a8e-3c1d-4f5a-9b7e-2d4c6e8f0a1b", URL: "https://example.com/x", Day: "2024-02-29"},
+			want:  nil,
+		},
+		{
+			// Format checks skip empty strings, required does not
+			name:  "empty text",
+			input: &textInput{},
+			want: map[string]string{
+				"name": "This field cannot be blank",
+			},
+		},
+		{
+			name:  "invalid text",
+			input: &textInput{Name: "abcdef", Email: "nope", Id: "123", URL: "ftp://example.com", Day: "2023-02-29", NoJSONName: "ab"},
+			want: map[string]string{
+				"name":       "This field cannot be more than 5 characters long",
+				"email":      "This field must be a valid email address",
+				"id":         "This field must be a valid id",
+				"url":        "This field must be a valid http or https URL",
+				"day":        "This field must be a valid date (2006-01-02)",
+				"NoJSONName": "This field cannot be more than 1 characters long",
+			},
+		},
+		{
+			name:  "minchars counts characters, not bytes",
+			input: &textInput{Name: "é"},
+			want: map[string]string{
+				"name": "This field must be at least 2 characters long",
+			},
+		},
+		{
+			// A nil pointer was left out of a partial update
+			name:  "omitted pointers",
+			input: &patchInput{},
+			want:  nil,
+		},
+		{
+			name:  "present pointers",
+			input: &patchInput{Name: ptr(" "), AmountInCents: ptr(int64(-5))},
+			want: map[string]string{
+				"name":          "This field cannot be blank",
+				"amountInCents": "This field must be greater than zero",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &validator.Validator{}
+			v.ValidateStruct(tt.input)
+
+			if len(tt.want) == 0 {
+				if !v.Valid() {
+					t.Fatalf("got errors %v; want none", v.FieldErrors)
+				}
+				return
+			}
+			if !reflect.DeepEqual(v.FieldErrors, tt.want) {
+				t.Errorf("got errors %v; want %v", v.FieldErrors, tt.want)
+			}
+		})
+	}
+}
+
+// Malformed tags are programming errors and panic
+func TestValidateStructPanics(t *testing.T) {
+	tests := []struct {
+		name  string
+		input any
+	}{
+		{"not a struct", ptr(5)},
+		{"unknown string rule", &struct {
+			Name string `validate:"shiny"`
+		}{}},
+		{"unknown number rule", &struct {
+			Count int64 `validate:"email"`
+		}{}},
+		{"missing parameter", &struct {
+			Name string `validate:"maxchars="`
+		}{Name: "x"}},
+		{"non-numeric parameter", &struct {
+			Count int64 `validate:"max=ten"`
+		}{}},
+		{"unsupported kind", &struct {
+			Ok bool `validate:"required"`
+		}{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("got no panic; want one")
+				}
+			}()
+			v := &validator.Validator{}
+			v.ValidateStruct(tt.input)
+		})
+	}
+}
+
+func TestInRange(t *testing.T) {
+	tests := []struct {
+		value, min, max int64
+		want            bool
+	}{
+		{0, 0, 10, true},
+		{10, 0, 10, true},
+		{-1, 0, 10, false},
+		{11, 0, 10, false},
+	}
+
+	for _, tt := range tests {
+		if got := validator.InRange(tt.value, tt.min, tt.max); got != tt.want {
+			t.Errorf("InRange(%d, %d, %d) = %t; want %t", tt.value, tt.min, tt.max, got, tt.want)
+		}
+	}
+}
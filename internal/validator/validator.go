@@ -1,8 +1,10 @@
 package validator
 
 import (
+	"net/url"
 	"regexp"
 	"strings"
+	"time"
 	"unicode/utf8"
 )
 
@@ -75,3 +77,47 @@ func PermittedInt(value int, permittedValues ...int) bool {
 	}
 	return false
 }
+
+// PermittedValue() returns true if a value is in a list of permitted values,
+// e.g. the permitted expenseType or updateType strings.
+func PermittedValue[T comparable](value T, permittedValues ...T) bool {
+	for i := range permittedValues {
+		if value == permittedValues[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// Positive() returns true if a money value in cents is greater than zero.
+func Positive(value int64) bool {
+	return value > 0
+}
+
+// InRange() returns true if a money value in cents is between min and max inclusive.
+func InRange(value, min, max int64) bool {
+	return value >= min && value <= max
+}
+
+// Canonical textual representation of a UUID as generated by uuid.New().String()
+var UUIDRX = regexp.MustCompile("^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$")
+
+// IsUUID() returns true if a value is a canonically formatted UUID.
+func IsUUID(value string) bool {
+	return UUIDRX.MatchString(value)
+}
+
+// IsURL() returns true if a value is an absolute http or https URL with a host.
+func IsURL(value string) bool {
+	u, err := url.Parse(value)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// ValidDate() returns true if a value can be parsed as a date in the given layout.
+func ValidDate(value, layout string) bool {
+	_, err := time.Parse(layout, value)
+	return err == nil
+}
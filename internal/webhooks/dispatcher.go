@@ -0,0 +1,171 @@
+// Package webhooks delivers the events stored in the webhook outbox to the
+// endpoints registered by users, signing every request so that receivers can
+// check it came from us.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"kweeuhree.personal-budgeting-backend/internal/models"
+)
+
+// Headers sent with every delivery
+const (
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderDelivery  = "X-Webhook-Delivery"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+// Store is the part of models.WebhookModel the dispatcher needs
+type Store interface {
+	DueDeliveries(limit int) ([]*models.WebhookDelivery, error)
+	MarkDelivered(deliveryId string, statusCode int) error
+	MarkAttemptFailed(deliveryId string, statusCode int, lastError string, nextAttemptAt time.Time, giveUp bool) error
+}
+
+// define Dispatcher type which sends due deliveries and schedules retries
+// with exponential backoff: BaseDelay after the first failed attempt,
+// doubling up to MaxDelay, until MaxAttempts attempts have failed.
+type Dispatcher struct {
+	Store       Store
+	Client      *http.Client
+	ErrorLog    *log.Logger
+	BatchSize   int
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// Now returns the current time, it can be replaced to control retries
+	Now func() time.Time
+}
+
+// NewDispatcher returns a dispatcher with the default retry policy: 10
+// attempts spread over roughly a day. Deliveries to addresses that are not
+// public fail unless allowPrivate is set, see NewClient.
+func NewDispatcher(store Store, errorLog *log.Logger, allowPrivate bool) *Dispatcher {
+	return &Dispatcher{
+		Store:       store,
+		Client:      NewClient(allowPrivate),
+		ErrorLog:    errorLog,
+		BatchSize:   50,
+		MaxAttempts: 10,
+		BaseDelay:   30 * time.Second,
+		MaxDelay:    6 * time.Hour,
+		Now:         time.Now,
+	}
+}
+
+// Run sends due deliveries every interval until ctx is cancelled
+func (d *Dispatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, err := d.DeliverDue(ctx)
+			if err != nil {
+				d.ErrorLog.Printf("webhooks: %v", err)
+			}
+		}
+	}
+}
+
+// DeliverDue attempts every delivery that is due once and returns how many
+// were delivered
+func (d *Dispatcher) DeliverDue(ctx context.Context) (int, error) {
+	due, err := d.Store.DueDeliveries(d.BatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("unable to read due deliveries: %w", err)
+	}
+
+	delivered := 0
+	for _, delivery := range due {
+		if ctx.Err() != nil {
+			break
+		}
+
+		statusCode, err := d.Deliver(ctx, delivery)
+		if err == nil {
+			delivered++
+			err = d.Store.MarkDelivered(delivery.DeliveryId, statusCode)
+		} else {
+			attempts := delivery.Attempts + 1
+			giveUp := attempts >= d.MaxAttempts
+			err = d.Store.MarkAttemptFailed(delivery.DeliveryId, statusCode, err.Error(), d.Now().Add(d.Backoff(attempts)), giveUp)
+		}
+		if err != nil {
+			return delivered, fmt.Errorf("unable to record delivery %s: %w", delivery.DeliveryId, err)
+		}
+	}
+
+	return delivered, nil
+}
+
+// Deliver sends a single delivery and returns the status code of the
+// receiver. Any response outside of 2xx is an error.
+func (d *Dispatcher) Deliver(ctx context.Context, delivery *models.WebhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(d.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "personal-budgeting-webhooks/1")
+	req.Header.Set(HeaderEvent, delivery.EventType)
+	req.Header.Set(HeaderDelivery, delivery.DeliveryId)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, Sign(delivery.Secret, timestamp, delivery.Payload))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Drain a little of the body so that the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver responded with %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// Backoff returns how long to wait after the given number of failed attempts
+func (d *Dispatcher) Backoff(attempts int) time.Duration {
+	delay := d.BaseDelay
+	for i := 1; i < attempts && delay < d.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, d.MaxDelay)
+}
+
+// Sign returns the signature of a delivery: "sha256=" followed by the hex
+// encoded HMAC-SHA256 of "<timestamp>.<body>" keyed with the webhook secret.
+// Receivers should compute it themselves, compare in constant time, and
+// reject old timestamps to prevent replays.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a signature made by Sign, receivers written in Go can use it
+func Verify(secret, timestamp string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
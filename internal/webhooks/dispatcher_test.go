@@ -0,0 +1,314 @@
+package webhooks_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"kweeuhree.personal-budgeting-backend/internal/models"
+	"kweeuhree.personal-budgeting-backend/internal/webhooks"
+)
+
+// fakeStore keeps the deliveries in memory, and makes the due ones those
+// whose next attempt is not after now
+type fakeStore struct {
+	mu         sync.Mutex
+	now        func() time.Time
+	deliveries []*models.WebhookDelivery
+}
+
+func (s *fakeStore) DueDeliveries(limit int) ([]*models.WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	due := []*models.WebhookDelivery{}
+	for _, d := range s.deliveries {
+		if d.Status == "pending" && !d.NextAttemptAt.After(s.now()) && len(due) < limit {
+			copied := *d
+			due = append(due, &copied)
+		}
+	}
+	return due, nil
+}
+
+func (s *fakeStore) MarkDelivered(deliveryId string, statusCode int) error {
+	d := s.get(deliveryId)
+	d.Status = "delivered"
+	d.Attempts++
+	d.LastStatusCode = statusCode
+	return nil
+}
+
+func (s *fakeStore) MarkAttemptFailed(deliveryId string, statusCode int, lastError string, nextAttemptAt time.Time, giveUp bool) error {
+	d := s.get(deliveryId)
+	d.Attempts++
+	d.LastStatusCode = statusCode
+	d.LastError = lastError
+	d.NextAttemptAt = nextAttemptAt
+	if giveUp {
+		d.Status = "failed"
+	}
+	return nil
+}
+
+func (s *fakeStore) get(deliveryId string) *models.WebhookDelivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, d := range s.deliveries {
+		if d.DeliveryId == deliveryId {
+			return d
+		}
+	}
+	panic("unknown delivery " + deliveryId)
+}
+
+// receiver is an httptest server that checks the signature of every
+// request, and answers with the next of its status codes
+type receiver struct {
+	*httptest.Server
+	t      *testing.T
+	secret string
+
+	mu       sync.Mutex
+	statuses []int
+	requests int
+}
+
+func newReceiver(t *testing.T, secret string, statuses ...int) *receiver {
+	rec := &receiver{t: t, secret: secret, statuses: statuses}
+	rec.Server = httptest.NewServer(http.HandlerFunc(rec.serveHTTP))
+	t.Cleanup(rec.Close)
+	return rec
+}
+
+func (rec *receiver) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		rec.t.Error(err)
+	}
+
+	timestamp := r.Header.Get(webhooks.HeaderTimestamp)
+	if !webhooks.Verify(rec.secret, timestamp, body, r.Header.Get(webhooks.HeaderSignature)) {
+		rec.t.Errorf("invalid signature %q for timestamp %q", r.Header.Get(webhooks.HeaderSignature), timestamp)
+	}
+	if got := r.Header.Get(webhooks.HeaderEvent); got != "expense.created" {
+		rec.t.Errorf("got event %q; want expense.created", got)
+	}
+
+	rec.mu.Lock()
+	status := http.StatusOK
+	if rec.requests < len(rec.statuses) {
+		status = rec.statuses[rec.requests]
+	}
+	rec.requests++
+	rec.mu.Unlock()
+
+	w.WriteHeader(status)
+}
+
+func (rec *receiver) count() int {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.requests
+}
+
+func newDelivery(url, secret string) *models.WebhookDelivery {
+	return &models.WebhookDelivery{
+		DeliveryId: "delivery-1",
+		EventType:  "expense.created",
+		Payload:    []byte(`{"id":"event-1","type":"expense.created","data":{}}`),
+		Status:     "pending",
+		URL:        url,
+		Secret:     secret,
+	}
+}
+
+func TestDeliverDueRetries(t *testing.T) {
+	const secret = "whsec_test"
+	rec := newReceiver(t, secret, http.StatusInternalServerError, http.StatusServiceUnavailable, http.StatusNoContent)
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	store := &fakeStore{now: clock, deliveries: []*models.WebhookDelivery{newDelivery(rec.URL, secret)}}
+	d := webhooks.NewDispatcher(store, log.New(io.Discard, "", 0), true)
+	d.Now = clock
+
+	// Each attempt fails until the receiver answers 204, and the next one is
+	// scheduled with a doubling delay
+	wantDelays := []time.Duration{d.BaseDelay, 2 * d.BaseDelay}
+	for i, delay := range wantDelays {
+		delivered, err := d.DeliverDue(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if delivered != 0 {
+			t.Fatalf("attempt %d: got %d delivered; want 0", i+1, delivered)
+		}
+
+		got := store.get("delivery-1")
+		if got.Attempts != i+1 {
+			t.Errorf("got %d attempts; want %d", got.Attempts, i+1)
+		}
+		if want := now.Add(delay); !got.NextAttemptAt.Equal(want) {
+			t.Errorf("attempt %d: next attempt at %s; want %s", i+1, got.NextAttemptAt, want)
+		}
+
+		// Nothing is due until the delay has passed
+		delivered, err = d.DeliverDue(context.Background())
+		if err != nil || delivered != 0 || rec.count() != i+1 {
+			t.Fatalf("attempt %d: the delivery was retried before its delay", i+1)
+		}
+		now = now.Add(delay)
+	}
+
+	delivered, err := d.DeliverDue(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivered != 1 {
+		t.Fatalf("got %d delivered; want 1", delivered)
+	}
+	if got := store.get("delivery-1"); got.Status != "delivered" || got.LastStatusCode != http.StatusNoContent {
+		t.Errorf("got status %s and code %d; want delivered and 204", got.Status, got.LastStatusCode)
+	}
+	if rec.count() != 3 {
+		t.Errorf("receiver got %d requests; want 3", rec.count())
+	}
+}
+
+func TestDeliverDueGivesUp(t *testing.T) {
+	const secret = "whsec_test"
+	rec := newReceiver(t, secret, http.StatusInternalServerError, http.StatusInternalServerError)
+
+	store := &fakeStore{now: time.Now, deliveries: []*models.WebhookDelivery{newDelivery(rec.URL, secret)}}
+	d := webhooks.NewDispatcher(store, log.New(io.Discard, "", 0), true)
+	d.MaxAttempts = 2
+	d.BaseDelay = 0
+
+	for range 3 {
+		if _, err := d.DeliverDue(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := store.get("delivery-1"); got.Status != "failed" || got.Attempts != 2 {
+		t.Errorf("got status %s after %d attempts; want failed after 2", got.Status, got.Attempts)
+	}
+	if rec.count() != 2 {
+		t.Errorf("receiver got %d requests; want 2", rec.count())
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	d := webhooks.NewDispatcher(nil, nil, false)
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{10, 512 * 30 * time.Second},
+		{11, 6 * time.Hour},
+		{50, 6 * time.Hour},
+	}
+	for _, tt := range tests {
+		if got := d.Backoff(tt.attempts); got != tt.want {
+			t.Errorf("Backoff(%d) = %s; want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+// The default client refuses to connect to the loopback address of the
+// receiver, whatever the URL says
+func TestDeliverRefusesPrivateAddresses(t *testing.T) {
+	const secret = "whsec_test"
+	rec := newReceiver(t, secret)
+
+	d := webhooks.NewDispatcher(nil, log.New(io.Discard, "", 0), false)
+	_, err := d.Deliver(context.Background(), newDelivery(rec.URL, secret))
+	if !errors.Is(err, webhooks.ErrPrivateAddress) {
+		t.Errorf("got error %v; want %v", err, webhooks.ErrPrivateAddress)
+	}
+	if rec.count() != 0 {
+		t.Errorf("receiver got %d requests; want 0", rec.count())
+	}
+}
+
+// A redirect is a failed attempt, it is not followed to its target
+func TestDeliverDoesNotFollowRedirects(t *testing.T) {
+	const secret = "whsec_test"
+	target := newReceiver(t, secret)
+	redirect := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusTemporaryRedirect))
+	t.Cleanup(redirect.Close)
+
+	d := webhooks.NewDispatcher(nil, log.New(io.Discard, "", 0), true)
+	status, err := d.Deliver(context.Background(), newDelivery(redirect.URL, secret))
+	if err == nil || status != http.StatusTemporaryRedirect {
+		t.Errorf("got status %d and error %v; want 307 and an error", status, err)
+	}
+	if target.count() != 0 {
+		t.Errorf("redirect target got %d requests; want 0", target.count())
+	}
+}
+
+func TestPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"100.64.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+	}
+	for _, tt := range tests {
+		if got := webhooks.PublicAddr(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("PublicAddr(%s) = %t; want %t", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	tests := []struct {
+		url          string
+		allowPrivate bool
+		wantErr      bool
+	}{
+		{"https://93.184.216.34/hooks", false, false},
+		{"http://127.0.0.1:8080/hooks", false, true},
+		{"http://localhost:8080/hooks", false, true},
+		{"http://169.254.169.254/latest/meta-data/", false, true},
+		{"http://[::1]/hooks", false, true},
+		{"http://10.0.0.5/hooks", false, true},
+		{"http://localhost:8080/hooks", true, false},
+	}
+	for _, tt := range tests {
+		err := webhooks.CheckURL(context.Background(), tt.url, tt.allowPrivate)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("CheckURL(%q, %t) = %v; want error %t", tt.url, tt.allowPrivate, err, tt.wantErr)
+		}
+	}
+}